@@ -0,0 +1,1301 @@
+// Command chat-tui is a terminal UI client for the chat server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/gorilla/websocket"
+
+	"cli-chat-app/pkg/chatserver"
+)
+
+// statusPane collects server notices and errors.
+const statusPane = "*status*"
+
+const sidebarWidth = 20
+
+var (
+	sidebarStyle = lipgloss.NewStyle().
+			Width(sidebarWidth).
+			BorderStyle(lipgloss.NormalBorder()).
+			BorderRight(true).
+			PaddingRight(1)
+	activeStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("12"))
+	unreadStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("11"))
+	errorStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+	infoStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	senderStyle = lipgloss.NewStyle().Bold(true)
+
+	markdown = markdownStyle{
+		bold:   render(lipgloss.NewStyle().Bold(true)),
+		italic: render(lipgloss.NewStyle().Italic(true)),
+		code:   render(lipgloss.NewStyle().Foreground(lipgloss.Color("6"))),
+	}
+)
+
+func render(st lipgloss.Style) func(string) string {
+	return func(s string) string { return st.Render(s) }
+}
+
+type incomingMsg chatserver.Message
+
+type disconnectedMsg struct{ err error }
+
+type typingState struct {
+	user string
+	at   time.Time
+}
+
+// typingTimeout is how long a typing notice stays visible.
+const typingTimeout = 4 * time.Second
+
+type conn struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *conn) send(msg chatserver.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws.WriteJSON(msg)
+}
+
+type model struct {
+	conn     *conn
+	username string
+	// url is the server's WebSocket URL and token the session token from
+	// signing in, which together let the client upload attachments.
+	url   string
+	token string
+	// keys encrypts direct messages for the signed-in user.
+	keys *keyring
+
+	panes  map[string][]string
+	unread map[string]bool
+	active string
+	// latest is the ID of the newest message seen in each room, and
+	// polls that of the newest poll.
+	latest map[string]string
+	polls  map[string]string
+	files  *transfers
+	// shortcodes are the emoji shortcodes the server knows but leaves for
+	// clients to expand.
+	shortcodes map[string]string
+
+	// typing maps room to the user last seen typing there and when.
+	typing     map[string]typingState
+	lastTyping time.Time
+
+	viewport viewport.Model
+	input    textinput.Model
+	width    int
+	height   int
+	ready    bool
+}
+
+func newModel(c *conn, url string) model {
+	input := textinput.New()
+	input.Placeholder = "/help for commands"
+	input.Focus()
+
+	return model{
+		conn:   c,
+		url:    url,
+		panes:  map[string][]string{statusPane: nil},
+		unread: make(map[string]bool),
+		latest: make(map[string]string),
+		polls:  make(map[string]string),
+		files:  newTransfers(),
+		typing: make(map[string]typingState),
+		active: statusPane,
+		input:  input,
+	}
+}
+
+func (m model) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmds []tea.Cmd
+
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		paneWidth := msg.Width - sidebarWidth - 2
+		paneHeight := msg.Height - 2
+		if !m.ready {
+			m.viewport = viewport.New(paneWidth, paneHeight)
+			m.ready = true
+		} else {
+			m.viewport.Width, m.viewport.Height = paneWidth, paneHeight
+		}
+		m.input.Width = msg.Width - 4
+		m.refresh()
+
+	case tea.KeyMsg:
+		switch msg.Type {
+		case tea.KeyCtrlC, tea.KeyEsc:
+			return m, tea.Quit
+		case tea.KeyTab:
+			m.cyclePane(1)
+			return m, nil
+		case tea.KeyShiftTab:
+			m.cyclePane(-1)
+			return m, nil
+		case tea.KeyPgUp, tea.KeyPgDown:
+			var cmd tea.Cmd
+			m.viewport, cmd = m.viewport.Update(msg)
+			return m, cmd
+		case tea.KeyEnter:
+			line := strings.TrimSpace(m.input.Value())
+			m.input.Reset()
+			if line != "" {
+				if quit := m.submit(line); quit {
+					return m, tea.Quit
+				}
+			}
+			return m, nil
+		case tea.KeyRunes:
+			m.notifyTyping()
+		}
+
+	case incomingMsg:
+		m.receive(chatserver.Message(msg))
+
+	case disconnectedMsg:
+		m.appendLine(statusPane, errorStyle.Render(fmt.Sprintf("disconnected: %v", msg.err)))
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	cmds = append(cmds, cmd)
+	return m, tea.Batch(cmds...)
+}
+
+func (m model) View() string {
+	if !m.ready {
+		return "connecting..."
+	}
+
+	sidebar := sidebarStyle.Height(m.viewport.Height).Render(m.sidebar())
+	body := lipgloss.JoinHorizontal(lipgloss.Top, sidebar, " ", m.viewport.View())
+	status := fmt.Sprintf("%s  [%s]", m.active, m.username)
+	if t, ok := m.typing[m.active]; ok && time.Since(t.at) < typingTimeout {
+		status += "  " + t.user + " is typing…"
+	}
+	header := infoStyle.Render(status)
+	return lipgloss.JoinVertical(lipgloss.Left, header, body, m.input.View())
+}
+
+func (m *model) sidebar() string {
+	var b strings.Builder
+	for _, name := range m.paneNames() {
+		var line string
+		switch {
+		case name == m.active:
+			line = activeStyle.Render("> " + name)
+		case m.unread[name]:
+			line = unreadStyle.Render("* " + name)
+		default:
+			line = "  " + name
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+func (m *model) paneNames() []string {
+	names := make([]string, 0, len(m.panes))
+	for name := range m.panes {
+		if name != statusPane {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{statusPane}, names...)
+}
+
+func (m *model) cyclePane(delta int) {
+	names := m.paneNames()
+	for i, name := range names {
+		if name == m.active {
+			m.setActive(names[(i+delta+len(names))%len(names)])
+			return
+		}
+	}
+}
+
+func (m *model) setActive(name string) {
+	if _, ok := m.panes[name]; !ok {
+		m.panes[name] = nil
+	}
+	m.active = name
+	delete(m.unread, name)
+	m.refresh()
+}
+
+func (m *model) appendLine(pane, line string) {
+	m.panes[pane] = append(m.panes[pane], line)
+	if pane == m.active {
+		m.refresh()
+	} else {
+		m.unread[pane] = true
+	}
+}
+
+func (m *model) refresh() {
+	if !m.ready {
+		return
+	}
+	atBottom := m.viewport.AtBottom()
+	m.viewport.SetContent(strings.Join(m.panes[m.active], "\n"))
+	if atBottom {
+		m.viewport.GotoBottom()
+	}
+}
+
+func (m *model) receive(msg chatserver.Message) {
+	stamp := messageTime(msg).Format("15:04")
+	if msg.Seq > 0 {
+		m.latest[msg.Room] = msg.MessageID
+		if msg.Poll != nil {
+			m.polls[msg.Room] = msg.MessageID
+		}
+	}
+	if msg.ID == fileRequestID {
+		next, note := m.files.advance(msg)
+		if next != nil {
+			m.send(*next)
+		}
+		if note != "" {
+			m.appendLine(m.paneFor(msg.Room), infoStyle.Render("-- "+note))
+		}
+		if msg.Type != "error" {
+			return
+		}
+	} else {
+		m.files.receive(msg)
+	}
+	m.e2e(&msg)
+
+	switch msg.Type {
+	case "error":
+		m.appendLine(m.paneFor(msg.Room), errorStyle.Render("error: "+msg.Content))
+		if msg.Code == chatserver.CodePasswordRequired {
+			m.usage("/join " + msg.Room + " <password>")
+		}
+	case "info":
+		pane := m.paneFor(msg.Room)
+		if _, ok := m.panes[pane]; !ok && msg.Room != "" {
+			m.panes[pane] = nil
+		}
+		m.appendLine(pane, infoStyle.Render("-- "+msg.Content))
+		var topic chatserver.RoomTopic
+		if msg.DecodeData(&topic) == nil && topic.Topic != "" {
+			m.appendLine(pane, infoStyle.Render("-- topic: "+topic.Topic))
+		}
+		if msg.Content == "Left room successfully" {
+			delete(m.panes, msg.Room)
+			if m.active == msg.Room {
+				m.setActive(statusPane)
+			}
+		}
+	case "hello":
+		var hello chatserver.HelloReply
+		if msg.DecodeData(&hello) == nil && !hello.Capabilities.ExpandsEmoji {
+			m.shortcodes = hello.Capabilities.EmojiShortcodes
+		}
+	case "session":
+		m.token = msg.Content
+		m.appendLine(statusPane, infoStyle.Render("-- session established"))
+	case "server_shutdown":
+		var notice chatserver.ShutdownNotice
+		msg.DecodeData(&notice)
+		m.appendLine(m.active, errorStyle.Render(fmt.Sprintf("-- %s; disconnecting in %ds", msg.Content, notice.GraceSeconds)))
+	case "typing":
+		m.typing[msg.Room] = typingState{user: msg.Sender, at: time.Now()}
+	case "edit":
+		m.appendLine(m.paneFor(msg.Room), fmt.Sprintf("%s %s %s %s", stamp, senderStyle.Render(msg.Sender+":"), formatContent(msg, markdown, m.shortcodes), infoStyle.Render("(edited)")))
+	case "files":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s turned file sharing %s", stamp, msg.Sender, msg.Content)))
+	case "file_offer":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s is sharing %s (%d bytes)", stamp, msg.Sender, msg.File.Name, msg.File.Size)))
+	case "file_complete":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s shared %s; /save %s to keep it", stamp, msg.Sender, msg.File.Name, msg.File.ID)))
+	case "file_cancelled":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s stopped sharing a file", stamp, msg.Sender)))
+	case "file_chunk":
+		// Collected by m.files.
+	case "deleted":
+		if msg.Content == "expired" {
+			m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- a message self-destructed", stamp)))
+			break
+		}
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- a message was deleted by %s", stamp, msg.Sender)))
+	case "slow_mode":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s", stamp, slowModeText(msg))))
+	case "topic":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s set the topic: %s", stamp, msg.Sender, msg.Content)))
+	case "tags":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s set the tags: %s", stamp, msg.Sender, msg.Content)))
+	case "description":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s changed the description: %s", stamp, msg.Sender, msg.Content)))
+	case "filter":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s turned the word filter %s", stamp, msg.Sender, msg.Content)))
+	case "fun":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s turned fun commands %s", stamp, msg.Sender, msg.Content)))
+	case "remote_joined":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s joined from another server", stamp, msg.Sender)))
+	case "remote_left":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s left", stamp, msg.Sender)))
+	case "assistant":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s turned the assistant %s", stamp, msg.Sender, msg.Content)))
+	case "invite":
+		var invite chatserver.Invite
+		msg.DecodeData(&invite)
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render("-- invite "+inviteText(invite)))
+	case "invites":
+		var invites []chatserver.Invite
+		msg.DecodeData(&invites)
+		pane := m.paneFor(msg.Room)
+		m.appendLine(pane, infoStyle.Render(fmt.Sprintf("-- %d invites", len(invites))))
+		for _, invite := range invites {
+			m.appendLine(pane, infoStyle.Render("   "+inviteText(invite)))
+		}
+	case "pinned", "unpinned":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s %s message %s", stamp, msg.Sender, msg.Type, msg.MessageID)))
+	case "pins":
+		var pins []chatserver.PinnedMessage
+		msg.DecodeData(&pins)
+		pane := m.paneFor(msg.Room)
+		m.appendLine(pane, infoStyle.Render(fmt.Sprintf("-- %d pinned messages", len(pins))))
+		for _, p := range pins {
+			m.appendLine(pane, m.historyLine(p.Message)+infoStyle.Render(" (pinned by "+p.PinnedBy+")"))
+		}
+	case "starred":
+		var starred []chatserver.StarredMessage
+		msg.DecodeData(&starred)
+		m.appendLine(statusPane, infoStyle.Render(fmt.Sprintf("-- %d starred messages", len(starred))))
+		for _, s := range starred {
+			m.appendLine(statusPane, infoStyle.Render("["+s.Room+"] ")+m.historyLine(s.Message))
+		}
+	case "scheduled":
+		var scheduled []chatserver.ScheduledMessage
+		msg.DecodeData(&scheduled)
+		m.appendLine(statusPane, infoStyle.Render(fmt.Sprintf("-- %d scheduled messages", len(scheduled))))
+		for _, s := range scheduled {
+			m.appendLine(statusPane, infoStyle.Render(s.ID+" ")+scheduledText(s))
+		}
+	case "reminder":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s ⏰ reminder: %s", stamp, msg.Content)))
+	case "invite_only":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s turned invite-only %s", stamp, msg.Sender, msg.Content)))
+	case "room_archived", "room_deleted":
+		m.appendLine(statusPane, infoStyle.Render(fmt.Sprintf("%s -- %s", stamp, msg.Content)))
+	case "presence":
+		m.appendLine(statusPane, infoStyle.Render(fmt.Sprintf("%s -- %s is %s", stamp, msg.Sender, msg.Content)))
+	case "presence_list":
+		var online []string
+		msg.DecodeData(&online)
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render("-- online: "+strings.Join(online, ", ")))
+	case "rooms":
+		var page chatserver.RoomPage
+		msg.DecodeData(&page)
+		m.appendLine(statusPane, infoStyle.Render(fmt.Sprintf("-- %d public rooms", len(page.Rooms))))
+		for _, r := range page.Rooms {
+			m.appendLine(statusPane, infoStyle.Render("   "+roomText(r)))
+		}
+		if page.Next != "" {
+			m.appendLine(statusPane, infoStyle.Render(fmt.Sprintf("-- more rooms: /rooms %s -cursor %s", msg.Content, page.Next)))
+		}
+	case "room_members":
+		var members []chatserver.RoomMember
+		msg.DecodeData(&members)
+		pane := m.paneFor(msg.Room)
+		m.appendLine(pane, infoStyle.Render(fmt.Sprintf("-- %d members", len(members))))
+		for _, member := range members {
+			m.appendLine(pane, infoStyle.Render("   "+memberText(member)))
+		}
+	case "status":
+		m.appendLine(statusPane, infoStyle.Render(fmt.Sprintf("%s -- %s", stamp, statusText(msg))))
+	case "whois":
+		var info chatserver.WhoisInfo
+		msg.DecodeData(&info)
+		m.appendLine(m.active, infoStyle.Render("-- "+whoisText(info)))
+	case "poll":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s", stamp, pollText(msg.Poll))))
+	case "commands":
+		var cmds []chatserver.Command
+		msg.DecodeData(&cmds)
+		pane := m.paneFor(msg.Room)
+		m.appendLine(pane, infoStyle.Render("-- server commands"))
+		for _, cmd := range cmds {
+			m.appendLine(pane, infoStyle.Render("   "+commandText(cmd)))
+		}
+	case "read", "read_marker", "delivered", "reactions", "ack":
+		// Receipts are not rendered yet.
+	case "sync_complete":
+		if msg.More {
+			// A long backlog is synced a page at a time.
+			m.send(chatserver.Message{Type: "sync", Room: msg.Room, SinceSeq: msg.Seq})
+		}
+	case "history":
+		var page []chatserver.Message
+		if err := msg.DecodeData(&page); err != nil {
+			m.appendLine(statusPane, errorStyle.Render("error: "+err.Error()))
+			return
+		}
+		for _, h := range page {
+			m.appendLine(m.paneFor(msg.Room), m.historyLine(h))
+		}
+	case "search_results":
+		var results []chatserver.Message
+		if err := msg.DecodeData(&results); err != nil {
+			m.appendLine(statusPane, errorStyle.Render("error: "+err.Error()))
+			return
+		}
+		pane := m.paneFor(msg.Room)
+		m.appendLine(pane, infoStyle.Render(fmt.Sprintf("-- %d results for %q", len(results), msg.Content)))
+		for _, r := range results {
+			m.appendLine(pane, m.historyLine(r))
+		}
+	case "sync":
+		var state chatserver.SyncState
+		msg.DecodeData(&state)
+		for _, u := range state.Unread {
+			if u.Unread > 0 {
+				// Writing to the room's pane marks it unread in the sidebar.
+				m.appendLine(m.paneFor(u.Room), infoStyle.Render("-- "+unreadText(u)))
+			}
+		}
+	case "mention":
+		m.appendLine(statusPane, senderStyle.Render(fmt.Sprintf("%s -- %s mentioned you in %s: %s", stamp, msg.Sender, msg.Room, msg.Content)))
+	case "dm":
+		peer := msg.Sender
+		if peer == m.username {
+			peer = msg.Target
+		}
+		m.appendLine("@"+peer, fmt.Sprintf("%s %s %s", stamp, senderStyle.Render(msg.Sender+":"), formatContent(msg, markdown, m.shortcodes)))
+	case "encrypted_dm":
+		peer := msg.Sender
+		if peer == m.username {
+			peer = msg.Target
+		}
+		m.appendLine("@"+peer, fmt.Sprintf("%s %s %s %s", stamp, senderStyle.Render(msg.Sender+":"), msg.Content, infoStyle.Render("(encrypted)")))
+	case "key":
+		// Used by /sdm.
+	case "preview":
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s %s", stamp, msg.Preview.URL, linkPreviewText(msg.Preview))))
+	case "translation":
+		var t chatserver.Translation
+		msg.DecodeData(&t)
+		m.appendLine(m.paneFor(msg.Room), infoStyle.Render(fmt.Sprintf("%s -- %s (%s): %s", stamp, msg.Sender, t.Lang, msg.Content)))
+	default:
+		if t, ok := m.typing[msg.Room]; ok && t.user == msg.Sender {
+			delete(m.typing, msg.Room)
+		}
+		line := fmt.Sprintf("%s %s %s", stamp, senderStyle.Render(msg.Sender+":"), formatContent(msg, markdown, m.shortcodes))
+		if msg.Action {
+			line = fmt.Sprintf("%s %s %s", stamp, senderStyle.Render("* "+msg.Sender), formatContent(msg, markdown, m.shortcodes))
+		}
+		if msg.Poll != nil {
+			line += " " + infoStyle.Render("(/vote <n> "+msg.MessageID+")")
+		}
+		if msg.Forwarded != nil {
+			line += " " + infoStyle.Render(forwardText(msg.Forwarded))
+		}
+		if msg.ExpiresAt != "" {
+			line += " " + infoStyle.Render(expiryText(msg.ExpiresAt))
+		}
+		for _, a := range msg.Attachments {
+			line += " " + infoStyle.Render(attachmentText(a))
+		}
+		if msg.Preview != nil {
+			line += " " + infoStyle.Render(linkPreviewText(msg.Preview))
+		}
+		m.appendLine(m.paneFor(msg.Room), line)
+	}
+}
+
+// e2e handles the messages of the encrypted direct message protocol,
+// decrypting an encrypted_dm into its Content.
+func (m *model) e2e(msg *chatserver.Message) {
+	if m.keys == nil {
+		if msg.Type == "encrypted_dm" {
+			msg.Content = "(sign in to read it)"
+		}
+		return
+	}
+	switch msg.Type {
+	case "session":
+		m.send(chatserver.Message{Type: "publish_key", Content: m.keys.publicKey()})
+	case "error":
+		if msg.Code != chatserver.CodeNotFound && msg.Code != chatserver.CodeUserNotFound {
+			return
+		}
+		if n := len(m.keys.pending[msg.Target]); n > 0 {
+			delete(m.keys.pending, msg.Target)
+			m.appendLine("@"+msg.Target, errorStyle.Render(fmt.Sprintf("%d encrypted messages not sent", n)))
+		}
+	case "key":
+		pending, changed, err := m.keys.learn(*msg)
+		if err != nil {
+			m.appendLine("@"+msg.Target, errorStyle.Render("bad key for "+msg.Target))
+			return
+		}
+		if changed {
+			m.appendLine("@"+msg.Target, errorStyle.Render(msg.Target+"'s key has changed; check /fingerprint "+msg.Target+" with them"))
+		}
+		for _, text := range pending {
+			sealed, _, err := m.keys.seal(msg.Target, text)
+			if err != nil {
+				m.appendLine("@"+msg.Target, errorStyle.Render(err.Error()))
+				continue
+			}
+			m.send(*sealed)
+		}
+	case "encrypted_dm":
+		text, changed, err := m.keys.open(*msg)
+		if err != nil {
+			text = "(could not decrypt: " + err.Error() + ")"
+		}
+		if changed {
+			text += " (their key has changed; check /fingerprint " + msg.Sender + ")"
+		}
+		msg.Content = text
+	}
+}
+
+// historyLine renders a message replayed from history.
+func (m *model) historyLine(msg chatserver.Message) string {
+	stamp := messageTime(msg).Format("15:04")
+	if msg.Deleted {
+		return infoStyle.Render(stamp + " -- deleted message")
+	}
+	line := fmt.Sprintf("%s %s %s", stamp, senderStyle.Render(msg.Sender+":"), formatContent(msg, markdown, m.shortcodes))
+	if msg.Action {
+		line = fmt.Sprintf("%s %s %s", stamp, senderStyle.Render("* "+msg.Sender), formatContent(msg, markdown, m.shortcodes))
+	}
+	if msg.Edited {
+		line += " " + infoStyle.Render("(edited)")
+	}
+	if msg.Forwarded != nil {
+		line += " " + infoStyle.Render(forwardText(msg.Forwarded))
+	}
+	if msg.ExpiresAt != "" {
+		line += " " + infoStyle.Render(expiryText(msg.ExpiresAt))
+	}
+	for _, a := range msg.Attachments {
+		line += " " + infoStyle.Render(attachmentText(a))
+	}
+	if msg.Preview != nil {
+		line += " " + infoStyle.Render(linkPreviewText(msg.Preview))
+	}
+	return line
+}
+
+// pollText sums up a poll's votes.
+func pollText(p *chatserver.Poll) string {
+	if p == nil {
+		return "poll"
+	}
+	counts := make([]string, len(p.Options))
+	for i, o := range p.Options {
+		counts[i] = fmt.Sprintf("%s %d", o.Text, len(o.Voters))
+	}
+	state := "votes"
+	if p.Closed {
+		state = "final votes"
+	}
+	return fmt.Sprintf("%s %s: %s", p.Question, state, strings.Join(counts, ", "))
+}
+
+// scheduledText describes a scheduled message for the list /scheduled
+// shows.
+func scheduledText(s chatserver.ScheduledMessage) string {
+	when := s.At.Local().Format("Jan 2 15:04")
+	if s.Reminder {
+		return fmt.Sprintf("%s reminder: %s", when, s.Content)
+	}
+	return fmt.Sprintf("%s [%s] %s", when, s.Room, s.Content)
+}
+
+// commandText describes a server command for the list /commands shows.
+func commandText(cmd chatserver.Command) string {
+	usage := "/" + cmd.Name
+	if cmd.Usage != "" {
+		usage += " " + cmd.Usage
+	}
+	return fmt.Sprintf("%-21s %s", usage, cmd.Help)
+}
+
+// expiryText says when a self-destructing message goes.
+func expiryText(expiresAt string) string {
+	at, err := time.Parse(time.RFC3339Nano, expiresAt)
+	if err != nil {
+		return "(self-destructs)"
+	}
+	return "(self-destructs at " + at.Local().Format("15:04:05") + ")"
+}
+
+// linkPreviewText summarises a preview of a link in a message.
+func linkPreviewText(p *chatserver.LinkPreview) string {
+	text := p.Title
+	if p.Description != "" {
+		if text != "" {
+			text += " - "
+		}
+		text += p.Description
+	}
+	if p.SiteName != "" {
+		text = p.SiteName + ": " + text
+	}
+	return "(" + text + ")"
+}
+
+// forwardText credits the original of a forwarded message.
+func forwardText(f *chatserver.Forward) string {
+	return fmt.Sprintf("(forwarded from %s in %s)", f.Sender, f.Room)
+}
+
+// notifyTyping tells the active room we are typing, at most every couple of
+// seconds.
+func (m *model) notifyTyping() {
+	if m.active == statusPane || strings.HasPrefix(m.active, "@") || strings.HasPrefix(m.input.Value(), "/") {
+		return
+	}
+	if time.Since(m.lastTyping) < 2*time.Second {
+		return
+	}
+	m.lastTyping = time.Now()
+	m.send(chatserver.Message{Type: "typing", Room: m.active})
+}
+
+func (m *model) paneFor(room string) string {
+	if room == "" {
+		return statusPane
+	}
+	return room
+}
+
+// submit handles one line of input and reports whether the client should quit.
+func (m *model) submit(line string) bool {
+	if !strings.HasPrefix(line, "/") {
+		m.sendChat(line, "")
+		return false
+	}
+
+	cmd, rest, _ := strings.Cut(line[1:], " ")
+	args := strings.Fields(rest)
+
+	switch cmd {
+	case "signup", "signin":
+		if len(args) != 2 {
+			m.usage("/" + cmd + " <user> <password>")
+			return false
+		}
+		if cmd == "signin" {
+			m.username = args[0]
+			keys, err := loadKeyring(args[0])
+			if err != nil {
+				m.appendLine(statusPane, errorStyle.Render("encrypted messages unavailable: "+err.Error()))
+			}
+			m.keys = keys
+		}
+		m.send(chatserver.Message{Type: cmd, Sender: args[0], Content: args[1]})
+	case "signout":
+		m.send(chatserver.Message{Type: "signout"})
+	case "passwd":
+		if len(args) != 2 {
+			m.usage("/passwd <current> <new>")
+			return false
+		}
+		m.send(chatserver.Message{Type: "change_password", Password: args[0], Content: args[1]})
+	case "resetpw":
+		if len(args) != 2 {
+			m.usage("/resetpw <token> <new>")
+			return false
+		}
+		m.send(chatserver.Message{Type: "reset_password", Password: args[0], Content: args[1]})
+	case "create":
+		msg, ok := parseCreate(args)
+		if !ok {
+			m.usage("/create <room> [-private] [password]")
+			return false
+		}
+		m.send(msg)
+	case "join":
+		msg, ok := parseJoin(args)
+		if !ok {
+			m.usage("/join <room> [-invite code] [password]")
+			return false
+		}
+		m.send(msg)
+		m.setActive(msg.Content)
+	case "leave":
+		room := m.active
+		if len(args) == 1 {
+			room = args[0]
+		}
+		m.send(chatserver.Message{Type: "leave_room", Content: room})
+	case "search":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || len(args) == 0 {
+			m.usage("/search <words> (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "search", Room: m.active, Content: strings.Join(args, " ")})
+	case "rooms":
+		query, cursor, _ := strings.Cut(rest, "-cursor ")
+		m.send(chatserver.Message{Type: "list_rooms", Content: strings.TrimSpace(query), Cursor: strings.TrimSpace(cursor)})
+		m.setActive(statusPane)
+	case "tags":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") {
+			m.usage("/tags [tag,...] (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "set_tags", Room: m.active, Content: strings.TrimSpace(rest)})
+	case "topic", "describe":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") {
+			m.usage("/" + cmd + " [text] (in a room)")
+			return false
+		}
+		msgType := "set_topic"
+		if cmd == "describe" {
+			msgType = "set_description"
+		}
+		m.send(chatserver.Message{Type: msgType, Room: m.active, Content: strings.TrimSpace(rest)})
+	case "inviteonly":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || len(args) != 1 {
+			m.usage("/inviteonly on|off (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "set_invite_only", Room: m.active, Content: args[0]})
+	case "invite":
+		uses, err := strconv.Atoi(optArg(args, 1))
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || len(args) > 2 || (len(args) == 2 && err != nil) {
+			m.usage("/invite [lifetime] [uses] (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "create_invite", Room: m.active, Content: optArg(args, 0), Limit: uses})
+	case "invites":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") {
+			m.usage("/invites (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "list_invites", Room: m.active})
+	case "revoke":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || len(args) != 1 {
+			m.usage("/revoke <code> (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "revoke_invite", Room: m.active, Content: args[0]})
+	case "pin", "unpin", "star", "unstar":
+		id := m.latest[m.active]
+		if len(args) == 1 {
+			id = args[0]
+		}
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || id == "" || len(args) > 1 {
+			m.usage("/" + cmd + " [message-id] (in a room; default the latest message)")
+			return false
+		}
+		m.send(chatserver.Message{Type: cmd, Room: m.active, MessageID: id})
+	case "vote", "closepoll":
+		id := m.polls[m.active]
+		want := 0
+		if cmd == "vote" {
+			want = 1
+		}
+		if len(args) == want+1 {
+			id = args[want]
+		}
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || id == "" || len(args) < want || len(args) > want+1 {
+			if cmd == "vote" {
+				m.usage("/vote <option> [poll-id] (in a room; default the latest poll)")
+			} else {
+				m.usage("/closepoll [poll-id] (in a room; default the latest poll)")
+			}
+			return false
+		}
+		if cmd == "vote" {
+			m.send(chatserver.Message{Type: "vote", Room: m.active, MessageID: id, Content: args[0]})
+		} else {
+			m.send(chatserver.Message{Type: "close_poll", Room: m.active, MessageID: id})
+		}
+	case "pins":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") {
+			m.usage("/pins (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "get_pins", Room: m.active})
+	case "md":
+		if rest == "" {
+			m.usage("/md <text>")
+			return false
+		}
+		m.sendChat(rest, chatserver.FormatMarkdown)
+	case "burn":
+		secs, text, _ := strings.Cut(rest, " ")
+		n, err := strconv.Atoi(secs)
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || err != nil || n <= 0 || text == "" {
+			m.usage("/burn <seconds> <text> (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "broadcast", Sender: m.username, Room: m.active, Content: text, ExpiresIn: n})
+	case "files":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || len(args) != 1 {
+			m.usage("/files on|off (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "set_files", Room: m.active, Content: args[0]})
+	case "fun":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || len(args) != 1 {
+			m.usage("/fun on|off (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "set_fun", Room: m.active, Content: args[0]})
+	case "assistant":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || len(args) != 1 {
+			m.usage("/assistant on|off (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "set_assistant", Room: m.active, Content: args[0]})
+	case "sendfile":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || rest == "" {
+			m.usage("/sendfile <path> (in a room)")
+			return false
+		}
+		offer, err := m.files.offer(m.active, rest)
+		if err != nil {
+			m.appendLine(m.active, errorStyle.Render(err.Error()))
+			return false
+		}
+		m.send(offer)
+	case "save":
+		if len(args) < 1 || len(args) > 2 {
+			m.usage("/save <file-id> [path]")
+			return false
+		}
+		path, err := m.files.save(args[0], optArg(args, 1))
+		if err != nil {
+			m.appendLine(m.active, errorStyle.Render(err.Error()))
+			return false
+		}
+		m.appendLine(m.active, infoStyle.Render("-- saved "+path))
+	case "attach":
+		path, text, _ := strings.Cut(rest, " ")
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || path == "" {
+			m.usage("/attach <path> [text] (in a room)")
+			return false
+		}
+		a, err := uploadAttachment(m.url, m.token, m.active, path)
+		if err != nil {
+			m.appendLine(m.active, errorStyle.Render(err.Error()))
+			return false
+		}
+		if text = strings.TrimSpace(text); text == "" {
+			text = a.Name
+		}
+		m.send(chatserver.Message{Type: "broadcast", Sender: m.username, Room: m.active, Content: text, Attachments: []chatserver.Attachment{{ID: a.ID}}})
+	case "forward":
+		id := m.latest[m.active]
+		if len(args) == 2 {
+			id = args[1]
+		}
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || id == "" || len(args) < 1 || len(args) > 2 {
+			m.usage("/forward <room> [message-id] (from a room; default the latest message)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "forward", Room: m.active, MessageID: id, Target: args[0]})
+	case "starred":
+		m.send(chatserver.Message{Type: "list_starred"})
+	case "scheduled":
+		m.send(chatserver.Message{Type: "list_scheduled"})
+	case "members":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") {
+			m.usage("/members (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "room_members", Room: m.active})
+	case "who":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") {
+			m.usage("/who (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "presence_query", Room: m.active})
+	case "status":
+		state, text, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		if state == "" {
+			m.usage("/status available|away|dnd [text]")
+			return false
+		}
+		m.send(chatserver.Message{Type: "set_status", Status: state, Content: strings.TrimSpace(text)})
+	case "whois":
+		if len(args) != 1 {
+			m.usage("/whois <user>")
+			return false
+		}
+		m.send(chatserver.Message{Type: "whois", Target: args[0]})
+	case "lastseen":
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			m.usage("/lastseen on|off")
+			return false
+		}
+		m.send(chatserver.Message{Type: "set_last_seen", Content: args[0]})
+	case "autotranslate":
+		if len(args) != 1 {
+			m.usage("/autotranslate <language>|off")
+			return false
+		}
+		m.send(chatserver.Message{Type: "set_translate", Content: args[0]})
+	case "translate":
+		// With only a language, the latest message is translated.
+		id := m.latest[m.active]
+		if len(args) > 1 {
+			id = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), args[0]))
+		}
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") || len(args) == 0 || id == "" {
+			m.usage("/translate <language> [message-id or text] (in a room; default the latest message)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "broadcast", Sender: m.username, Room: m.active, Content: "/translate " + args[0] + " " + id})
+	case "dm":
+		target, text, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		if target == "" || text == "" {
+			m.usage("/dm <user> <text>")
+			return false
+		}
+		m.send(chatserver.Message{Type: "dm", Sender: m.username, Target: target, Content: text})
+		m.setActive("@" + target)
+	case "sdm":
+		target, text, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		if target == "" || text == "" {
+			m.usage("/sdm <user> <text>")
+			return false
+		}
+		if m.keys == nil {
+			m.appendLine(m.active, errorStyle.Render("sign in first"))
+			return false
+		}
+		sealed, ready, err := m.keys.seal(target, text)
+		switch {
+		case err != nil:
+			m.appendLine(m.active, errorStyle.Render(err.Error()))
+			return false
+		case !ready:
+			// Sent once their key arrives.
+			m.send(chatserver.Message{Type: "get_key", Target: target})
+		default:
+			m.send(*sealed)
+		}
+		m.setActive("@" + target)
+	case "fingerprint":
+		switch {
+		case m.keys == nil:
+			m.appendLine(m.active, errorStyle.Render("sign in first"))
+		case len(args) == 0:
+			m.appendLine(m.active, infoStyle.Render("-- your key: "+fingerprint(m.keys.private.PublicKey())))
+		case m.keys.peers[args[0]] != nil:
+			m.appendLine(m.active, infoStyle.Render("-- "+args[0]+"'s key: "+fingerprint(m.keys.peers[args[0]])))
+		default:
+			m.appendLine(m.active, errorStyle.Render("no key for "+args[0]+" yet; /sdm them first"))
+		}
+	case "quit":
+		return true
+	case "help":
+		for _, h := range []string{
+			"/signup <user> <pw>   create an account",
+			"/signin <user> <pw>   sign in",
+			"/passwd <current> <new> change your password, signing out your other sessions",
+			"/resetpw <token> <new> set a new password with a reset token from an admin",
+			"/create <room> [-private] [pw]",
+			"/rooms [search]       list public rooms; search by words, tag:, active: and sort:active",
+			"/tags [tag,...]       set or clear the current room's tags",
+			"/join <room> [-invite code] [pw]",
+			"/leave [room]         leave a room",
+			"/dm <user> <text>     send a direct message",
+			"/sdm <user> <text>    send an end-to-end encrypted direct message",
+			"/fingerprint [user]   show your key's fingerprint, or a user's",
+			"/search <words>       search the current room",
+			"/who                  list who is online in the current room",
+			"/members              list everyone in the current room",
+			"/pin [id]             pin a message, by default the latest one",
+			"/unpin [id]           unpin a message",
+			"/pins                 list the current room's pinned messages",
+			"/burn <secs> <text>   send a message that self-destructs after secs",
+			"/md <text>            send a markdown message: **bold**, *italic*, `code`",
+			"/files on|off         allow or forbid file sharing in the current room",
+			"/sendfile <path>      share a small file with the current room",
+			"/save <id> [path]     save a file shared with you",
+			"/attach <path> [text] upload a file and post it to the current room",
+			"/forward <room> [id]  forward a message to another room",
+			"/star [id]            star a message, by default the latest one",
+			"/unstar [id]          unstar a message",
+			"/starred              list your starred messages from every room",
+			"/remind me in <d> <text> remind yourself later, e.g. /remind me in 10m tea",
+			"/schedule in <d> <text> post a message to the current room later",
+			"/scheduled            list your scheduled messages; /remind cancel <id> cancels one",
+			"/inviteonly on|off    require an invite to join the current room",
+			"/invite [ttl] [uses]  create an invite code, e.g. /invite 24h 1",
+			"/invites              list the current room's invite codes",
+			"/revoke <code>        revoke an invite code",
+			"/topic [text]         set or clear the current room's topic",
+			"/describe [text]      set or clear the current room's description",
+			"/status <state> [text] set your status: available, away or dnd",
+			"/whois <user>         show whether a user is online and when last seen",
+			"/lastseen on|off      show or hide when you were last seen",
+			"/translate <lang> [id] translate a message, by default the latest one, or some text",
+			"/autotranslate <lang> have room messages translated as they arrive; off stops",
+			"/vote <n> [id]        vote in a poll, by default the latest one; /poll opens one",
+			"/closepoll [id]       close a poll you opened",
+			"/commands             list the commands the server answers, such as /me",
+			"/fun on|off           allow or forbid /roll, /flip and /8ball in the current room",
+			"/assistant on|off     let the server's assistant answer @mentions in the current room",
+			"/quit                 exit",
+			"other commands go to the server; // starts a message with a slash",
+			"tab/shift+tab switch panes, pgup/pgdn scroll",
+		} {
+			m.appendLine(m.active, infoStyle.Render(h))
+		}
+	case "commands":
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") {
+			m.usage("/commands (in a room)")
+			return false
+		}
+		m.send(chatserver.Message{Type: "broadcast", Sender: m.username, Room: m.active, Content: "/help " + strings.TrimSpace(rest)})
+	default:
+		// The server has commands of its own, and takes off the first
+		// slash of a message starting with two.
+		if m.active == statusPane || strings.HasPrefix(m.active, "@") {
+			m.appendLine(m.active, errorStyle.Render("unknown command: /"+cmd))
+			return false
+		}
+		m.send(chatserver.Message{Type: "broadcast", Sender: m.username, Room: m.active, Content: line})
+	}
+	return false
+}
+
+// sendChat sends text, written in the given format, to the active room or
+// DM.
+func (m *model) sendChat(text, format string) {
+	switch {
+	case m.active == statusPane:
+		m.appendLine(statusPane, errorStyle.Render("join a room or open a DM first"))
+	case strings.HasPrefix(m.active, "@"):
+		m.send(chatserver.Message{Type: "dm", Sender: m.username, Target: m.active[1:], Content: text, Format: format})
+	default:
+		m.send(chatserver.Message{Type: "broadcast", Sender: m.username, Room: m.active, Content: text, Format: format})
+	}
+}
+
+func (m *model) send(msg chatserver.Message) {
+	if err := m.conn.send(msg); err != nil {
+		m.appendLine(statusPane, errorStyle.Render("send failed: "+err.Error()))
+	}
+}
+
+func (m *model) usage(text string) {
+	m.appendLine(m.active, errorStyle.Render("usage: "+text))
+}
+
+// features are the optional features this client shows. Read receipts and
+// reaction events are left out, as it does not show them.
+var features = []string{
+	chatserver.FeatureTyping, chatserver.FeaturePresence, chatserver.FeatureEdits,
+	chatserver.FeaturePins, chatserver.FeatureMentions, chatserver.FeatureThreads,
+	chatserver.FeatureMarkdown, chatserver.FeatureE2E, chatserver.FeatureFiles,
+	chatserver.FeatureAttachments, chatserver.FeatureLinkPreviews,
+}
+
+func main() {
+	url := flag.String("url", "ws://localhost:8000/ws", "chat server WebSocket URL")
+	flag.Parse()
+
+	// Compression is used if the server offers it.
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	ws, _, err := dialer.Dial(*url, nil)
+	if err != nil {
+		log.Fatal("dial: ", err)
+	}
+	defer ws.Close()
+
+	c := &conn{ws: ws}
+	if err := c.send(chatserver.Message{Type: "hello", Data: chatserver.Hello{Protocol: chatserver.ProtocolVersion, Features: features}}); err != nil {
+		log.Fatal("send: ", err)
+	}
+	p := tea.NewProgram(newModel(c, *url), tea.WithAltScreen())
+
+	go func() {
+		for {
+			var msg chatserver.Message
+			if err := ws.ReadJSON(&msg); err != nil {
+				p.Send(disconnectedMsg{err: err})
+				return
+			}
+			p.Send(incomingMsg(msg))
+		}
+	}()
+
+	if _, err := p.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// parseCreate builds a create_room request from "/create <room> [-private] [password]".
+func parseCreate(args []string) (chatserver.Message, bool) {
+	msg := chatserver.Message{Type: "create_room"}
+	for _, arg := range args {
+		switch {
+		case arg == "-private":
+			msg.Private = true
+		case msg.Content == "":
+			msg.Content = arg
+		case msg.Password == "":
+			msg.Password = arg
+		default:
+			return msg, false
+		}
+	}
+	return msg, msg.Content != ""
+}
+
+func parseJoin(args []string) (chatserver.Message, bool) {
+	msg := chatserver.Message{Type: "join_room"}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-invite" && i+1 < len(args):
+			i++
+			msg.Invite = args[i]
+		case msg.Content == "":
+			msg.Content = args[i]
+		case msg.Password == "":
+			msg.Password = args[i]
+		default:
+			return msg, false
+		}
+	}
+	return msg, msg.Content != ""
+}
+
+func optArg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// messageTime is when the server stamped msg, falling back to now.
+func messageTime(msg chatserver.Message) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, msg.Timestamp); err == nil {
+		return t.Local()
+	}
+	return time.Now()
+}
+
+// roomText describes a room in a listing.
+func roomText(r chatserver.RoomInfo) string {
+	text := fmt.Sprintf("%s - %d members, %d online, active %s", r.Name, r.Members, r.Online, r.LastActivity.Local().Format("2006-01-02 15:04"))
+	if r.Protected {
+		text += ", password"
+	}
+	if r.InviteOnly {
+		text += ", invite only"
+	}
+	if len(r.Tags) > 0 {
+		text += ", tags " + strings.Join(r.Tags, ",")
+	}
+	if r.Topic != "" {
+		text += " - " + r.Topic
+	}
+	return text
+}
+
+// unreadText describes what is waiting in a room.
+func unreadText(u chatserver.RoomUnread) string {
+	text := fmt.Sprintf("%d unread", u.Unread)
+	if u.Mentions > 0 {
+		text += fmt.Sprintf(", %d mentioning you", u.Mentions)
+	}
+	return text
+}
+
+// inviteText describes an invite code and what is left of it.
+func inviteText(i chatserver.Invite) string {
+	text := i.Code
+	if i.MaxUses > 0 {
+		text += fmt.Sprintf(" - used %d of %d", i.Uses, i.MaxUses)
+	} else {
+		text += fmt.Sprintf(" - used %d", i.Uses)
+	}
+	if i.ExpiresAt != nil {
+		text += ", expires " + i.ExpiresAt.Local().Format("2006-01-02 15:04")
+	}
+	return text
+}
+
+// memberText describes a room member.
+func memberText(m chatserver.RoomMember) string {
+	text := m.Username
+	if m.Role != "member" {
+		text += " (" + m.Role + ")"
+	}
+	if m.Server != "" {
+		// Whether members on other servers are online is not known here.
+		return text + " - on " + m.Server
+	}
+	if !m.Online {
+		return text + " - offline"
+	}
+	if m.Status != "" && m.Status != chatserver.StatusAvailable {
+		return text + " - " + m.Status
+	}
+	return text + " - online"
+}
+
+// statusText describes a status event.
+func statusText(msg chatserver.Message) string {
+	text := msg.Sender + " is " + msg.Status
+	if msg.Status == chatserver.StatusDoNotDisturb {
+		text = msg.Sender + " does not want to be disturbed"
+	}
+	if msg.Content != "" {
+		text += ": " + msg.Content
+	}
+	return text
+}
+
+// whoisText describes a whois reply.
+func whoisText(info chatserver.WhoisInfo) string {
+	switch {
+	case info.Online && info.LastSeen != nil:
+		return fmt.Sprintf("%s is online, last active %s", info.Username, info.LastSeen.Local().Format("2006-01-02 15:04"))
+	case info.Online:
+		return info.Username + " is online"
+	case info.LastSeen != nil:
+		return fmt.Sprintf("%s is offline, last seen %s", info.Username, info.LastSeen.Local().Format("2006-01-02 15:04"))
+	default:
+		return info.Username + " is offline"
+	}
+}
+
+// slowModeText describes a slow_mode event.
+func slowModeText(msg chatserver.Message) string {
+	if d, err := time.ParseDuration(msg.Content); err == nil && d > 0 {
+		return fmt.Sprintf("%s set slow mode to one message every %s", msg.Sender, d)
+	}
+	return msg.Sender + " turned slow mode off"
+}
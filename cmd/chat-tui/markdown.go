@@ -0,0 +1,95 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"cli-chat-app/pkg/chatserver"
+)
+
+// markdownStyle says how each kind of markdown text is shown.
+type markdownStyle struct {
+	bold, italic, code func(string) string
+}
+
+// shortcodePattern finds :name: emoji shortcodes.
+var shortcodePattern = regexp.MustCompile(`:[a-z0-9_+-]+:`)
+
+// formatContent renders a message's content for display according to its
+// format, replacing the emoji shortcodes in the given table.
+func formatContent(msg chatserver.Message, st markdownStyle, shortcodes map[string]string) string {
+	content := msg.Content
+	if len(shortcodes) > 0 {
+		content = shortcodePattern.ReplaceAllStringFunc(content, func(code string) string {
+			if emoji, ok := shortcodes[strings.Trim(code, ":")]; ok {
+				return emoji
+			}
+			return code
+		})
+	}
+	if msg.Format != chatserver.FormatMarkdown {
+		return content
+	}
+	return renderMarkdown(content, st)
+}
+
+// renderMarkdown renders the subset of markdown the clients understand:
+// fenced code blocks, `code`, **bold** or __bold__, and *italic* or
+// _italic_. Anything else is shown as written.
+func renderMarkdown(src string, st markdownStyle) string {
+	lines := strings.Split(src, "\n")
+	out := make([]string, 0, len(lines))
+	inCode := false
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			out = append(out, "  "+st.code(line))
+			continue
+		}
+		out = append(out, renderInline(line, st))
+	}
+	return strings.Join(out, "\n")
+}
+
+// renderInline renders the code spans and emphasis in one line of text.
+func renderInline(s string, st markdownStyle) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end >= 0 {
+				b.WriteString(st.code(s[i+1 : i+1+end]))
+				i += end + 2
+				continue
+			}
+		case strings.HasPrefix(s[i:], "**") || strings.HasPrefix(s[i:], "__"):
+			marker := s[i : i+2]
+			if end := strings.Index(s[i+2:], marker); end > 0 {
+				b.WriteString(st.bold(renderInline(s[i+2:i+2+end], st)))
+				i += end + 4
+				continue
+			}
+		case (s[i] == '*' || s[i] == '_') && canOpen(s, i):
+			if end := strings.IndexByte(s[i+1:], s[i]); end > 0 {
+				b.WriteString(st.italic(renderInline(s[i+1:i+1+end], st)))
+				i += end + 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+		i++
+	}
+	return b.String()
+}
+
+// canOpen reports whether the emphasis marker at s[i] can open emphasis: it
+// must start a word, so snake_case and 2*3 are left alone.
+func canOpen(s string, i int) bool {
+	if i+1 >= len(s) || s[i+1] == ' ' {
+		return false
+	}
+	return i == 0 || strings.ContainsRune(" \t([{\"'", rune(s[i-1]))
+}
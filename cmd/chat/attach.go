@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cli-chat-app/pkg/chatserver"
+)
+
+var uploadClient = &http.Client{Timeout: time.Minute}
+
+// serverURL turns the WebSocket URL the client connected to into the HTTP
+// URL of path on the same server.
+func serverURL(wsURL, path string) (string, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path, u.RawQuery = path, ""
+	return u.String(), nil
+}
+
+// uploadAttachment sends the file at path to the server's /upload endpoint
+// for room, signed in with token, and returns the stored attachment.
+func uploadAttachment(wsURL, token, room, path string) (chatserver.Attachment, error) {
+	var a chatserver.Attachment
+	if token == "" {
+		return a, errors.New("sign in first")
+	}
+	target, err := serverURL(wsURL, "/upload")
+	if err != nil {
+		return a, err
+	}
+	target += "?" + url.Values{"room": {room}}.Encode()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return a, err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return a, err
+	}
+	part.Write(data)
+	form.Close()
+
+	req, err := http.NewRequest(http.MethodPost, target, &body)
+	if err != nil {
+		return a, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return a, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return a, fmt.Errorf("upload failed: %s", strings.TrimSpace(string(reason)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&a)
+	return a, err
+}
+
+// attachmentText describes an attachment and where to fetch it.
+func attachmentText(a chatserver.Attachment) string {
+	return fmt.Sprintf("[attached %s, %d bytes: %s]", a.Name, a.Size, a.URL)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cli-chat-app/pkg/chatserver"
+)
+
+// keyLabel separates the keys derived here from any other use of the same
+// shared secret.
+const keyLabel = "cli-chat-app e2e v1"
+
+// keyring holds the user's key pair for encrypted direct messages and the
+// public keys of the people they message.
+type keyring struct {
+	username string
+	private  *ecdh.PrivateKey
+	peers    map[string]*ecdh.PublicKey
+	// pending holds messages waiting for their recipient's key.
+	pending map[string][]string
+}
+
+// keyPath is where username's private key is kept.
+func keyPath(username string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cli-chat-app", "keys", username+".key"), nil
+}
+
+// loadKeyring reads username's private key, creating one the first time.
+func loadKeyring(username string) (*keyring, error) {
+	path, err := keyPath(username)
+	if err != nil {
+		return nil, err
+	}
+	var private *ecdh.PrivateKey
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, errors.New("bad key file " + path)
+		}
+		if private, err = ecdh.X25519().NewPrivateKey(raw); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if private, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(private.Bytes())
+		if err := os.WriteFile(path, []byte(encoded+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return &keyring{
+		username: username,
+		private:  private,
+		peers:    make(map[string]*ecdh.PublicKey),
+		pending:  make(map[string][]string),
+	}, nil
+}
+
+// publicKey is the user's public key as published.
+func (k *keyring) publicKey() string {
+	return base64.StdEncoding.EncodeToString(k.private.PublicKey().Bytes())
+}
+
+// fingerprint is a short digest of a public key for people to compare.
+func fingerprint(key *ecdh.PublicKey) string {
+	sum := sha256.Sum256(key.Bytes())
+	return hex.EncodeToString(sum[:8])
+}
+
+func parsePublicKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// learn records the public key in a key reply. It returns the messages
+// that were waiting for it, and whether it replaces a different key.
+func (k *keyring) learn(msg chatserver.Message) (pending []string, changed bool, err error) {
+	var published chatserver.PublicKey
+	if err := msg.DecodeData(&published); err != nil {
+		return nil, false, err
+	}
+	key, err := parsePublicKey(published.Key)
+	if err != nil {
+		return nil, false, err
+	}
+	old, known := k.peers[published.Username]
+	changed = known && !old.Equal(key)
+	k.peers[published.Username] = key
+	pending = k.pending[published.Username]
+	delete(k.pending, published.Username)
+	return pending, changed, nil
+}
+
+// cipherFor derives the AEAD shared with the holder of peer.
+func (k *keyring) cipherFor(peer *ecdh.PublicKey) (cipher.AEAD, error) {
+	secret, err := k.private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(append([]byte(keyLabel), secret...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// conversation binds a ciphertext to its sender and recipient.
+func conversation(sender, target string) []byte {
+	return []byte(sender + "\x00" + target)
+}
+
+// seal encrypts text for target, whose key must already be known; if it is
+// not, text is kept until it is and seal reports false.
+func (k *keyring) seal(target, text string) (*chatserver.Message, bool, error) {
+	peer, ok := k.peers[target]
+	if !ok {
+		k.pending[target] = append(k.pending[target], text)
+		return nil, false, nil
+	}
+	aead, err := k.cipherFor(peer)
+	if err != nil {
+		return nil, false, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, false, err
+	}
+	data := aead.Seal(nil, nonce, []byte(text), conversation(k.username, target))
+	return &chatserver.Message{
+		Type:   "encrypted_dm",
+		Sender: k.username,
+		Target: target,
+		Encrypted: &chatserver.Ciphertext{
+			Algorithm: chatserver.KeyAlgorithm,
+			SenderKey: k.publicKey(),
+			Nonce:     base64.StdEncoding.EncodeToString(nonce),
+			Data:      base64.StdEncoding.EncodeToString(data),
+		},
+	}, true, nil
+}
+
+// open decrypts an encrypted_dm, sent to or by the user. It warns, through
+// changed, when the sender's key differs from the one looked up for them.
+func (k *keyring) open(msg chatserver.Message) (text string, changed bool, err error) {
+	e := msg.Encrypted
+	if e == nil {
+		return "", false, errors.New("no encrypted payload")
+	}
+	var peer *ecdh.PublicKey
+	if msg.Sender == k.username {
+		// The copy of a message the user sent.
+		if peer = k.peers[msg.Target]; peer == nil {
+			return "", false, errors.New("no key for " + msg.Target)
+		}
+	} else {
+		if peer, err = parsePublicKey(e.SenderKey); err != nil {
+			return "", false, err
+		}
+		known, ok := k.peers[msg.Sender]
+		changed = ok && !known.Equal(peer)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(e.Nonce)
+	if err != nil {
+		return "", changed, err
+	}
+	data, err := base64.StdEncoding.DecodeString(e.Data)
+	if err != nil {
+		return "", changed, err
+	}
+	aead, err := k.cipherFor(peer)
+	if err != nil {
+		return "", changed, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return "", changed, errors.New("bad nonce")
+	}
+	plain, err := aead.Open(nil, nonce, data, conversation(msg.Sender, msg.Target))
+	return string(plain), changed, err
+}
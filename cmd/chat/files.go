@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"cli-chat-app/pkg/chatserver"
+)
+
+// fileRequestID tags the requests of an upload, so its acks and errors can
+// be told apart from the rest.
+const fileRequestID = "file"
+
+// upload is a file being sent to a room, one acknowledged chunk at a time.
+type upload struct {
+	room   string
+	name   string
+	data   []byte
+	id     string
+	chunk  int
+	offset int
+}
+
+// download is a file being received, or received and ready to save.
+type download struct {
+	info chatserver.FileInfo
+	data []byte
+	done bool
+}
+
+type transfers struct {
+	upload    *upload
+	downloads map[string]*download
+}
+
+func newTransfers() *transfers {
+	return &transfers{downloads: make(map[string]*download)}
+}
+
+// offer starts sending the file at path to room, returning the file_offer
+// to send.
+func (t *transfers) offer(room, path string) (chatserver.Message, error) {
+	if t.upload != nil {
+		return chatserver.Message{}, errors.New("already sending " + t.upload.name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return chatserver.Message{}, err
+	}
+	t.upload = &upload{room: room, name: filepath.Base(path), data: data}
+	return chatserver.Message{
+		Type: "file_offer",
+		ID:   fileRequestID,
+		Room: room,
+		File: &chatserver.FileInfo{Name: t.upload.name, Size: int64(len(data))},
+	}, nil
+}
+
+// advance moves the upload on in answer to msg, a reply to one of its
+// requests. It returns the next request to send, if any, and a note for
+// the user, if any.
+func (t *transfers) advance(msg chatserver.Message) (*chatserver.Message, string) {
+	u := t.upload
+	if u == nil {
+		return nil, ""
+	}
+	switch {
+	case msg.Type == "error":
+		t.upload = nil
+		return nil, "sending " + u.name + " failed"
+	case msg.Type == "file_offer" && msg.File != nil:
+		u.id, u.chunk = msg.File.ID, msg.File.ChunkSize
+		if u.chunk <= 0 {
+			t.upload = nil
+			return nil, "sending " + u.name + " failed: the server gave no chunk size"
+		}
+		return u.nextChunk(), fmt.Sprintf("sending %s (%d bytes)", u.name, len(u.data))
+	case msg.Type == "ack" && msg.Content == "file_chunk":
+		if u.offset < len(u.data) {
+			return u.nextChunk(), ""
+		}
+		return &chatserver.Message{Type: "file_complete", ID: fileRequestID, Room: u.room, File: &chatserver.FileInfo{ID: u.id}}, ""
+	case msg.Type == "file_complete":
+		t.upload = nil
+		return nil, "sent " + u.name
+	}
+	return nil, ""
+}
+
+func (u *upload) nextChunk() *chatserver.Message {
+	end := min(u.offset+u.chunk, len(u.data))
+	msg := &chatserver.Message{
+		Type:    "file_chunk",
+		ID:      fileRequestID,
+		Room:    u.room,
+		Content: base64.StdEncoding.EncodeToString(u.data[u.offset:end]),
+		File:    &chatserver.FileInfo{ID: u.id, Offset: int64(u.offset)},
+	}
+	u.offset = end
+	return msg
+}
+
+// receive collects a file someone else is sending from msg, one of
+// file_offer, file_chunk, file_complete or file_cancelled.
+func (t *transfers) receive(msg chatserver.Message) {
+	if msg.File == nil {
+		return
+	}
+	switch msg.Type {
+	case "file_offer":
+		if msg.File.Size > 0 {
+			t.downloads[msg.File.ID] = &download{info: *msg.File, data: make([]byte, 0, msg.File.Size)}
+		}
+	case "file_chunk":
+		d, ok := t.downloads[msg.File.ID]
+		data, err := base64.StdEncoding.DecodeString(msg.Content)
+		if !ok || d.done || err != nil || msg.File.Offset != int64(len(d.data)) || int64(len(d.data)+len(data)) > d.info.Size {
+			return
+		}
+		d.data = append(d.data, data...)
+	case "file_complete":
+		if d, ok := t.downloads[msg.File.ID]; ok {
+			d.done = int64(len(d.data)) == d.info.Size
+			if !d.done {
+				delete(t.downloads, msg.File.ID)
+			}
+		}
+	case "file_cancelled":
+		delete(t.downloads, msg.File.ID)
+	}
+}
+
+// save writes the received file id to path, or to its own name in the
+// current directory, without overwriting anything. It returns where the
+// file was written.
+func (t *transfers) save(id, path string) (string, error) {
+	d, ok := t.downloads[id]
+	if !ok || !d.done {
+		return "", errors.New("no received file " + id)
+	}
+	if path == "" {
+		path = filepath.Base(d.info.Name)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(d.data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	delete(t.downloads, id)
+	return path, nil
+}
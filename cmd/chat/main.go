@@ -0,0 +1,1139 @@
+// Command chat is a minimal line-based client for the chat server. It reads
+// commands from stdin, so it can be scripted, and doubles as a reference for
+// the JSON WebSocket protocol.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"cli-chat-app/pkg/chatserver"
+)
+
+type client struct {
+	ws       *websocket.Conn
+	mu       sync.Mutex
+	closing  bool
+	username string
+	room     string
+	// older is the history cursor for each room's next older page.
+	older map[string]uint64
+	// latest is the ID of the newest message seen in each room, and
+	// polls that of the newest poll.
+	latest map[string]string
+	polls  map[string]string
+	files  *transfers
+	// url is the server's WebSocket URL and token the session token from
+	// signing in, which together let the client upload attachments.
+	url   string
+	token string
+	// keys encrypts direct messages for the signed-in user.
+	keys *keyring
+}
+
+func (c *client) send(msg chatserver.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, frameType, err := chatserver.EncodeMessage(c.ws.Subprotocol(), msg)
+	if err == nil {
+		err = c.ws.WriteMessage(frameType, data)
+	}
+	if err != nil {
+		log.Printf("send: %v", err)
+	}
+}
+
+// readMessage reads the next message, in the encoding agreed with the
+// server.
+func readMessage(ws *websocket.Conn, msg *chatserver.Message) error {
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return chatserver.DecodeMessage(ws.Subprotocol(), data, msg)
+}
+
+func main() {
+	url := flag.String("url", "ws://localhost:8000/ws", "chat server WebSocket URL")
+	linger := flag.Duration("linger", time.Second, "how long to keep printing messages after stdin closes")
+	encoding := flag.String("encoding", chatserver.EncodingJSON, "message encoding to ask the server for: json or msgpack")
+	flag.Parse()
+
+	// Compression is used if the server offers it.
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	dialer.Subprotocols = []string{*encoding}
+	ws, _, err := dialer.Dial(*url, nil)
+	if err != nil {
+		log.Fatal("dial: ", err)
+	}
+	defer ws.Close()
+
+	c := &client{ws: ws, url: *url, older: make(map[string]uint64), latest: make(map[string]string), polls: make(map[string]string), files: newTransfers()}
+	c.send(chatserver.Message{Type: "hello", Data: chatserver.Hello{Protocol: chatserver.ProtocolVersion, Features: features}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var msg chatserver.Message
+			if err := readMessage(ws, &msg); err != nil {
+				c.mu.Lock()
+				closing := c.closing
+				c.mu.Unlock()
+				switch {
+				case closing:
+				case websocket.IsCloseError(err, websocket.CloseGoingAway):
+					fmt.Println("* disconnected: server went away")
+				default:
+					log.Printf("read: %v", err)
+				}
+				return
+			}
+			c.mu.Lock()
+			if msg.Type == "history" {
+				c.older[msg.Room] = msg.Before
+			}
+			if msg.Seq > 0 {
+				c.latest[msg.Room] = msg.MessageID
+				if msg.Poll != nil {
+					c.polls[msg.Room] = msg.MessageID
+				}
+			}
+			if msg.Type == "session" {
+				c.token = msg.Content
+			}
+			var next *chatserver.Message
+			var note string
+			if msg.ID == fileRequestID {
+				next, note = c.files.advance(msg)
+			} else {
+				c.files.receive(msg)
+			}
+			replies := c.e2e(&msg)
+			c.mu.Unlock()
+			if next != nil {
+				c.send(*next)
+			}
+			for _, reply := range replies {
+				c.send(reply)
+			}
+			if msg.Type == "sync_complete" && msg.More {
+				// A long backlog is synced a page at a time.
+				c.send(chatserver.Message{Type: "sync", Room: msg.Room, SinceSeq: msg.Seq})
+			}
+			if note != "" {
+				fmt.Println("* " + note)
+			}
+			if msg.ID == fileRequestID && msg.Type != "error" {
+				continue
+			}
+			printMessage(msg)
+		}
+	}()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if quit := c.handleLine(line); quit {
+			break
+		}
+	}
+
+	select {
+	case <-done:
+		return
+	case <-time.After(*linger):
+	}
+
+	c.mu.Lock()
+	c.closing = true
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
+
+// handleLine runs one line of input and reports whether the client should quit.
+func (c *client) handleLine(line string) bool {
+	if !strings.HasPrefix(line, "/") {
+		if c.room == "" {
+			fmt.Println("! join a room first (/join <room>)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "broadcast", Sender: c.username, Room: c.room, Content: line})
+		return false
+	}
+
+	cmd, rest, _ := strings.Cut(line[1:], " ")
+	rest = strings.TrimSpace(rest)
+	args := strings.Fields(rest)
+
+	switch cmd {
+	case "signup", "signin":
+		if len(args) != 2 {
+			fmt.Printf("! usage: /%s <user> <password>\n", cmd)
+			return false
+		}
+		if cmd == "signin" {
+			c.username = args[0]
+			keys, err := loadKeyring(args[0])
+			if err != nil {
+				fmt.Println("! encrypted messages unavailable: " + err.Error())
+			}
+			c.mu.Lock()
+			c.keys = keys
+			c.mu.Unlock()
+		}
+		c.send(chatserver.Message{Type: cmd, Sender: args[0], Content: args[1]})
+	case "signout":
+		c.send(chatserver.Message{Type: "signout"})
+	case "passwd":
+		if len(args) != 2 {
+			fmt.Println("! usage: /passwd <current> <new>")
+			return false
+		}
+		c.send(chatserver.Message{Type: "change_password", Password: args[0], Content: args[1]})
+	case "resetpw":
+		if len(args) != 2 {
+			fmt.Println("! usage: /resetpw <token> <new>")
+			return false
+		}
+		c.send(chatserver.Message{Type: "reset_password", Password: args[0], Content: args[1]})
+	case "create":
+		msg, ok := parseCreate(args)
+		if !ok {
+			fmt.Println("! usage: /create <room> [-private] [password]")
+			return false
+		}
+		c.send(msg)
+	case "join":
+		msg, ok := parseJoin(args)
+		if !ok {
+			fmt.Println("! usage: /join <room> [-invite code] [password]")
+			return false
+		}
+		c.room = msg.Content
+		c.send(msg)
+	case "room":
+		if len(args) != 1 {
+			fmt.Println("! usage: /room <room>")
+			return false
+		}
+		c.room = args[0]
+	case "leave":
+		room := c.room
+		if len(args) == 1 {
+			room = args[0]
+		}
+		if room == c.room {
+			c.room = ""
+		}
+		c.send(chatserver.Message{Type: "leave_room", Content: room})
+	case "more":
+		c.mu.Lock()
+		before := c.older[c.room]
+		c.mu.Unlock()
+		if c.room == "" || before == 0 {
+			fmt.Println("! no older messages")
+			return false
+		}
+		c.send(chatserver.Message{Type: "history", Room: c.room, Before: before})
+	case "search":
+		if c.room == "" || rest == "" {
+			fmt.Println("! usage: /search <words> (in the current room)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "search", Room: c.room, Content: rest})
+	case "rooms":
+		query, cursor, _ := strings.Cut(rest, "-cursor ")
+		c.send(chatserver.Message{Type: "list_rooms", Content: strings.TrimSpace(query), Cursor: strings.TrimSpace(cursor)})
+	case "tags":
+		if c.room == "" {
+			fmt.Println("! join a room first (/join <room>)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "set_tags", Room: c.room, Content: rest})
+	case "topic", "describe":
+		if c.room == "" {
+			fmt.Println("! join a room first (/join <room>)")
+			return false
+		}
+		msgType := "set_topic"
+		if cmd == "describe" {
+			msgType = "set_description"
+		}
+		c.send(chatserver.Message{Type: msgType, Room: c.room, Content: rest})
+	case "inviteonly":
+		if c.room == "" || len(args) != 1 {
+			fmt.Println("! usage: /inviteonly on|off (in the current room)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "set_invite_only", Room: c.room, Content: args[0]})
+	case "invite":
+		uses, err := strconv.Atoi(optArg(args, 1))
+		if c.room == "" || len(args) > 2 || (len(args) == 2 && err != nil) {
+			fmt.Println("! usage: /invite [lifetime] [uses] (in the current room)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "create_invite", Room: c.room, Content: optArg(args, 0), Limit: uses})
+	case "invites":
+		if c.room == "" {
+			fmt.Println("! join a room first (/join <room>)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "list_invites", Room: c.room})
+	case "revoke":
+		if c.room == "" || len(args) != 1 {
+			fmt.Println("! usage: /revoke <code> (in the current room)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "revoke_invite", Room: c.room, Content: args[0]})
+	case "pin", "unpin", "star", "unstar":
+		c.mu.Lock()
+		id := c.latest[c.room]
+		c.mu.Unlock()
+		if len(args) == 1 {
+			id = args[0]
+		}
+		if c.room == "" || id == "" || len(args) > 1 {
+			fmt.Printf("! usage: /%s [message-id] (in the current room; default the latest message)\n", cmd)
+			return false
+		}
+		c.send(chatserver.Message{Type: cmd, Room: c.room, MessageID: id})
+	case "vote", "closepoll":
+		c.mu.Lock()
+		id := c.polls[c.room]
+		c.mu.Unlock()
+		want := 0
+		if cmd == "vote" {
+			want = 1
+		}
+		if len(args) == want+1 {
+			id = args[want]
+		}
+		if c.room == "" || id == "" || len(args) < want || len(args) > want+1 {
+			if cmd == "vote" {
+				fmt.Println("! usage: /vote <option> [poll-id] (in the current room; default the latest poll)")
+			} else {
+				fmt.Println("! usage: /closepoll [poll-id] (in the current room; default the latest poll)")
+			}
+			return false
+		}
+		if cmd == "vote" {
+			c.send(chatserver.Message{Type: "vote", Room: c.room, MessageID: id, Content: args[0]})
+		} else {
+			c.send(chatserver.Message{Type: "close_poll", Room: c.room, MessageID: id})
+		}
+	case "pins":
+		if c.room == "" {
+			fmt.Println("! join a room first (/join <room>)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "get_pins", Room: c.room})
+	case "files":
+		if c.room == "" || len(args) != 1 {
+			fmt.Println("! usage: /files on|off (in the current room)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "set_files", Room: c.room, Content: args[0]})
+	case "fun":
+		if c.room == "" || len(args) != 1 {
+			fmt.Println("! usage: /fun on|off (in the current room)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "set_fun", Room: c.room, Content: args[0]})
+	case "assistant":
+		if c.room == "" || len(args) != 1 {
+			fmt.Println("! usage: /assistant on|off (in the current room)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "set_assistant", Room: c.room, Content: args[0]})
+	case "sendfile":
+		if c.room == "" || rest == "" {
+			fmt.Println("! usage: /sendfile <path> (in the current room)")
+			return false
+		}
+		c.mu.Lock()
+		offer, err := c.files.offer(c.room, rest)
+		c.mu.Unlock()
+		if err != nil {
+			fmt.Println("! " + err.Error())
+			return false
+		}
+		c.send(offer)
+	case "save":
+		if len(args) < 1 || len(args) > 2 {
+			fmt.Println("! usage: /save <file-id> [path]")
+			return false
+		}
+		c.mu.Lock()
+		path, err := c.files.save(args[0], optArg(args, 1))
+		c.mu.Unlock()
+		if err != nil {
+			fmt.Println("! " + err.Error())
+			return false
+		}
+		fmt.Println("* saved " + path)
+	case "attach":
+		path, text, _ := strings.Cut(rest, " ")
+		if c.room == "" || path == "" {
+			fmt.Println("! usage: /attach <path> [text] (in the current room)")
+			return false
+		}
+		c.mu.Lock()
+		token := c.token
+		c.mu.Unlock()
+		a, err := uploadAttachment(c.url, token, c.room, path)
+		if err != nil {
+			fmt.Println("! " + err.Error())
+			return false
+		}
+		if text = strings.TrimSpace(text); text == "" {
+			text = a.Name
+		}
+		c.send(chatserver.Message{Type: "broadcast", Sender: c.username, Room: c.room, Content: text, Attachments: []chatserver.Attachment{{ID: a.ID}}})
+	case "forward":
+		c.mu.Lock()
+		id := c.latest[c.room]
+		c.mu.Unlock()
+		if len(args) == 2 {
+			id = args[1]
+		}
+		if c.room == "" || id == "" || len(args) < 1 || len(args) > 2 {
+			fmt.Println("! usage: /forward <room> [message-id] (from the current room; default the latest message)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "forward", Room: c.room, MessageID: id, Target: args[0]})
+	case "starred":
+		c.send(chatserver.Message{Type: "list_starred"})
+	case "scheduled":
+		c.send(chatserver.Message{Type: "list_scheduled"})
+	case "members":
+		if c.room == "" {
+			fmt.Println("! join a room first (/join <room>)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "room_members", Room: c.room})
+	case "who":
+		if c.room == "" {
+			fmt.Println("! join a room first (/join <room>)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "presence_query", Room: c.room})
+	case "status":
+		state, text, _ := strings.Cut(rest, " ")
+		if state == "" {
+			fmt.Println("! usage: /status available|away|dnd [text]")
+			return false
+		}
+		c.send(chatserver.Message{Type: "set_status", Status: state, Content: strings.TrimSpace(text)})
+	case "whois":
+		if len(args) != 1 {
+			fmt.Println("! usage: /whois <user>")
+			return false
+		}
+		c.send(chatserver.Message{Type: "whois", Target: args[0]})
+	case "lastseen":
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			fmt.Println("! usage: /lastseen on|off")
+			return false
+		}
+		c.send(chatserver.Message{Type: "set_last_seen", Content: args[0]})
+	case "autotranslate":
+		if len(args) != 1 {
+			fmt.Println("! usage: /autotranslate <language>|off")
+			return false
+		}
+		c.send(chatserver.Message{Type: "set_translate", Content: args[0]})
+	case "translate":
+		// With only a language, the latest message is translated.
+		c.mu.Lock()
+		id := c.latest[c.room]
+		c.mu.Unlock()
+		if len(args) > 1 {
+			id = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), args[0]))
+		}
+		if c.room == "" || len(args) == 0 || id == "" {
+			fmt.Println("! usage: /translate <language> [message-id or text] (in the current room; default the latest message)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "broadcast", Sender: c.username, Room: c.room, Content: "/translate " + args[0] + " " + id})
+	case "dm":
+		target, text, _ := strings.Cut(rest, " ")
+		if target == "" || text == "" {
+			fmt.Println("! usage: /dm <user> <text>")
+			return false
+		}
+		c.send(chatserver.Message{Type: "dm", Sender: c.username, Target: target, Content: text})
+	case "sdm":
+		target, text, _ := strings.Cut(rest, " ")
+		if target == "" || text == "" {
+			fmt.Println("! usage: /sdm <user> <text>")
+			return false
+		}
+		c.mu.Lock()
+		keys := c.keys
+		var sealed *chatserver.Message
+		var ready bool
+		var err error
+		if keys != nil {
+			sealed, ready, err = keys.seal(target, text)
+		}
+		c.mu.Unlock()
+		switch {
+		case keys == nil:
+			fmt.Println("! sign in first")
+		case err != nil:
+			fmt.Println("! " + err.Error())
+		case !ready:
+			// Sent once their key arrives.
+			c.send(chatserver.Message{Type: "get_key", Target: target})
+		default:
+			c.send(*sealed)
+		}
+	case "fingerprint":
+		c.mu.Lock()
+		var text string
+		switch {
+		case c.keys == nil:
+			text = "! sign in first"
+		case len(args) == 0:
+			text = "* your key: " + fingerprint(c.keys.private.PublicKey())
+		case c.keys.peers[args[0]] != nil:
+			text = "* " + args[0] + "'s key: " + fingerprint(c.keys.peers[args[0]])
+		default:
+			text = "! no key for " + args[0] + " yet; /sdm them first"
+		}
+		c.mu.Unlock()
+		fmt.Println(text)
+	case "md":
+		if c.room == "" || rest == "" {
+			fmt.Println("! usage: /md <text> (in the current room)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "broadcast", Sender: c.username, Room: c.room, Content: rest, Format: chatserver.FormatMarkdown})
+	case "burn":
+		secs, text, _ := strings.Cut(rest, " ")
+		n, err := strconv.Atoi(secs)
+		if c.room == "" || err != nil || n <= 0 || text == "" {
+			fmt.Println("! usage: /burn <seconds> <text> (in the current room)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "broadcast", Sender: c.username, Room: c.room, Content: text, ExpiresIn: n})
+	case "quit":
+		return true
+	case "help":
+		fmt.Println(`commands:
+  /signup <user> <pw>   create an account
+  /signin <user> <pw>   sign in
+  /passwd <current> <new>
+                        change your password, signing out your other sessions
+  /resetpw <token> <new>
+                        set a new password with a reset token from an admin
+  /create <room> [-private] [pw]
+                        create a room
+  /rooms [search]       list public rooms, optionally matching words,
+                        tag:<tag>, active:<duration> and sort:active
+  /tags [tag,...]       set or clear the current room's tags
+  /join <room> [-invite code] [pw]
+                        join a room and make it current
+  /room <room>          switch the current room
+  /leave [room]         leave a room
+  /more                 show older messages in the current room
+  /search <words>       search the current room
+  /who                  list who is online in the current room
+  /members              list everyone in the current room
+  /pin [id]             pin a message, by default the latest one
+  /unpin [id]           unpin a message
+  /pins                 list the current room's pinned messages
+  /burn <secs> <text>   send a message that self-destructs after secs
+  /md <text>            send a message formatted with markdown: **bold**,
+                        *italic* and code in backticks
+  /files on|off         allow or forbid file sharing in the current room
+  /sendfile <path>      share a small file with the current room
+  /save <id> [path]     save a file shared with you
+  /attach <path> [text] upload a file and post it to the current room
+  /forward <room> [id]  forward a message to another room
+  /star [id]            star a message, by default the latest one
+  /unstar [id]          unstar a message
+  /starred              list your starred messages from every room
+  /remind me in <d> <text> remind yourself later, e.g. /remind me in 10m tea
+  /schedule in <d> <text> post a message to the current room later
+  /scheduled            list your scheduled messages and reminders; cancel
+                        one with /remind cancel <id>
+  /inviteonly on|off    require an invite to join the current room
+  /invite [ttl] [uses]  create an invite code, e.g. /invite 24h 1
+  /invites              list the current room's invite codes
+  /revoke <code>        revoke an invite code
+  /topic [text]         set or clear the current room's topic
+  /describe [text]      set or clear the current room's description
+  /status <state> [text] set your status: available, away or dnd
+  /whois <user>         show whether a user is online and when last seen
+  /lastseen on|off      show or hide when you were last seen
+  /translate <lang> [id] translate a message, by default the latest one, or
+                        some text, for yourself alone
+  /autotranslate <lang> have room messages translated as they arrive, e.g.
+                        /autotranslate de; /autotranslate off stops
+  /dm <user> <text>     send a direct message
+  /sdm <user> <text>    send an end-to-end encrypted direct message
+  /fingerprint [user]   show your key's fingerprint, or a user's
+  /vote <n> [id]        vote in a poll, by default the latest one; /poll opens one
+  /closepoll [id]       close a poll you opened
+  /commands             list the commands the server answers, such as /me
+                        and /roll 2d6
+  /fun on|off           allow or forbid /roll, /flip and /8ball in the
+                        current room
+  /assistant on|off     let the server's assistant answer @mentions in the
+                        current room
+  /quit                 exit
+other commands are sent to the server; start a message with // to send
+one beginning with a slash, and anything else is sent to the current room`)
+	case "commands":
+		if c.room == "" {
+			fmt.Println("! join a room first (/join <room>)")
+			return false
+		}
+		c.send(chatserver.Message{Type: "broadcast", Sender: c.username, Room: c.room, Content: "/help " + rest})
+	default:
+		// The server has commands of its own, and takes off the first
+		// slash of a message starting with two.
+		if c.room == "" {
+			fmt.Printf("! unknown command /%s; join a room to use the server's\n", cmd)
+			return false
+		}
+		c.send(chatserver.Message{Type: "broadcast", Sender: c.username, Room: c.room, Content: line})
+	}
+	return false
+}
+
+func printMessage(msg chatserver.Message) {
+	stamp := messageTime(msg).Format("15:04:05")
+
+	switch msg.Type {
+	case "error":
+		fmt.Printf("%s ! %s\n", stamp, withRoom(msg.Room, msg.Content))
+		if msg.Code == chatserver.CodePasswordRequired {
+			fmt.Printf("%s ! try /join %s <password>\n", stamp, msg.Room)
+		}
+	case "info":
+		fmt.Printf("%s * %s\n", stamp, withRoom(msg.Room, msg.Content))
+		var topic chatserver.RoomTopic
+		if msg.DecodeData(&topic) == nil && topic.Topic != "" {
+			fmt.Printf("%s * [%s] topic: %s\n", stamp, msg.Room, topic.Topic)
+		}
+	case "session":
+		fmt.Printf("%s * session token: %s\n", stamp, msg.Content)
+	case "hello":
+		var hello chatserver.HelloReply
+		if msg.DecodeData(&hello) == nil && !hello.Capabilities.ExpandsEmoji {
+			shortcodes = hello.Capabilities.EmojiShortcodes
+		}
+	case "server_shutdown":
+		var notice chatserver.ShutdownNotice
+		msg.DecodeData(&notice)
+		fmt.Printf("%s * %s; disconnecting in %ds\n", stamp, msg.Content, notice.GraceSeconds)
+	case "history":
+		var page []chatserver.Message
+		if err := msg.DecodeData(&page); err != nil {
+			log.Printf("history: %v", err)
+			return
+		}
+		for _, m := range page {
+			printMessage(m)
+		}
+		if msg.Before > 0 {
+			fmt.Printf("%s ~ [%s] older messages: /more\n", stamp, msg.Room)
+		}
+	case "search_results":
+		var results []chatserver.Message
+		if err := msg.DecodeData(&results); err != nil {
+			log.Printf("search: %v", err)
+			return
+		}
+		fmt.Printf("%s ~ [%s] %d results for %q\n", stamp, msg.Room, len(results), msg.Content)
+		for _, m := range results {
+			printMessage(m)
+		}
+	case "edit":
+		fmt.Printf("%s [%s] %s edited %s: %s\n", stamp, msg.Room, msg.Sender, msg.MessageID, formatContent(msg, termStyle, shortcodes))
+	case "files":
+		fmt.Printf("%s * [%s] %s turned file sharing %s\n", stamp, msg.Room, msg.Sender, msg.Content)
+	case "file_offer":
+		fmt.Printf("%s [%s] %s is sharing %s (%d bytes)\n", stamp, msg.Room, msg.Sender, msg.File.Name, msg.File.Size)
+	case "file_complete":
+		fmt.Printf("%s [%s] %s shared %s; /save %s to keep it\n", stamp, msg.Room, msg.Sender, msg.File.Name, msg.File.ID)
+	case "file_cancelled":
+		fmt.Printf("%s [%s] %s stopped sharing a file\n", stamp, msg.Room, msg.Sender)
+	case "file_chunk":
+		// Collected by the reader.
+	case "deleted":
+		if msg.Content == "expired" {
+			fmt.Printf("%s [%s] message %s self-destructed\n", stamp, msg.Room, msg.MessageID)
+			break
+		}
+		fmt.Printf("%s [%s] %s deleted %s\n", stamp, msg.Room, msg.Sender, msg.MessageID)
+	case "slow_mode":
+		fmt.Printf("%s * [%s] %s\n", stamp, msg.Room, slowModeText(msg))
+	case "topic":
+		fmt.Printf("%s * [%s] %s set the topic: %s\n", stamp, msg.Room, msg.Sender, msg.Content)
+	case "poll":
+		fmt.Printf("%s * [%s] %s\n", stamp, msg.Room, pollText(msg.Poll))
+	case "commands":
+		var cmds []chatserver.Command
+		msg.DecodeData(&cmds)
+		fmt.Printf("%s * server commands:\n", stamp)
+		for _, cmd := range cmds {
+			fmt.Printf("    %s\n", commandText(cmd))
+		}
+	case "tags":
+		fmt.Printf("%s * [%s] %s set the tags: %s\n", stamp, msg.Room, msg.Sender, msg.Content)
+	case "description":
+		fmt.Printf("%s * [%s] %s changed the description: %s\n", stamp, msg.Room, msg.Sender, msg.Content)
+	case "filter":
+		fmt.Printf("%s * [%s] %s turned the word filter %s\n", stamp, msg.Room, msg.Sender, msg.Content)
+	case "fun":
+		fmt.Printf("%s * [%s] %s turned fun commands %s\n", stamp, msg.Room, msg.Sender, msg.Content)
+	case "remote_joined":
+		fmt.Printf("%s * [%s] %s joined from another server\n", stamp, msg.Room, msg.Sender)
+	case "remote_left":
+		fmt.Printf("%s * [%s] %s left\n", stamp, msg.Room, msg.Sender)
+	case "assistant":
+		fmt.Printf("%s * [%s] %s turned the assistant %s\n", stamp, msg.Room, msg.Sender, msg.Content)
+	case "invite":
+		var invite chatserver.Invite
+		msg.DecodeData(&invite)
+		fmt.Printf("%s * [%s] invite %s\n", stamp, msg.Room, inviteText(invite))
+	case "invites":
+		var invites []chatserver.Invite
+		msg.DecodeData(&invites)
+		fmt.Printf("%s * [%s] %d invites\n", stamp, msg.Room, len(invites))
+		for _, invite := range invites {
+			fmt.Printf("    %s\n", inviteText(invite))
+		}
+	case "pinned", "unpinned":
+		fmt.Printf("%s * [%s] %s %s message %s\n", stamp, msg.Room, msg.Sender, msg.Type, msg.MessageID)
+	case "pins":
+		var pins []chatserver.PinnedMessage
+		msg.DecodeData(&pins)
+		fmt.Printf("%s * [%s] %d pinned messages\n", stamp, msg.Room, len(pins))
+		for _, p := range pins {
+			fmt.Printf("    %s %s: %s (pinned by %s)\n", p.MessageID, p.Message.Sender, p.Message.Content, p.PinnedBy)
+		}
+	case "starred":
+		var starred []chatserver.StarredMessage
+		msg.DecodeData(&starred)
+		fmt.Printf("%s * %d starred messages\n", stamp, len(starred))
+		for _, s := range starred {
+			fmt.Printf("    [%s] %s %s: %s\n", s.Room, s.MessageID, s.Message.Sender, s.Message.Content)
+		}
+	case "scheduled":
+		var scheduled []chatserver.ScheduledMessage
+		msg.DecodeData(&scheduled)
+		fmt.Printf("%s * %d scheduled messages\n", stamp, len(scheduled))
+		for _, s := range scheduled {
+			fmt.Printf("    %s %s\n", s.ID, scheduledText(s))
+		}
+	case "reminder":
+		fmt.Printf("%s ⏰ reminder: %s\n", stamp, msg.Content)
+	case "invite_only":
+		fmt.Printf("%s * [%s] %s turned invite-only %s\n", stamp, msg.Room, msg.Sender, msg.Content)
+	case "room_archived", "room_deleted":
+		fmt.Printf("%s * %s\n", stamp, msg.Content)
+	case "presence":
+		fmt.Printf("%s * %s is %s\n", stamp, msg.Sender, msg.Content)
+	case "presence_list":
+		var online []string
+		msg.DecodeData(&online)
+		fmt.Printf("%s * [%s] online: %s\n", stamp, msg.Room, strings.Join(online, ", "))
+	case "rooms":
+		var page chatserver.RoomPage
+		msg.DecodeData(&page)
+		fmt.Printf("%s * %d public rooms\n", stamp, len(page.Rooms))
+		for _, r := range page.Rooms {
+			fmt.Printf("    %s\n", roomText(r))
+		}
+		if page.Next != "" {
+			fmt.Printf("%s ~ more rooms: /rooms %s -cursor %s\n", stamp, msg.Content, page.Next)
+		}
+	case "room_members":
+		var members []chatserver.RoomMember
+		msg.DecodeData(&members)
+		fmt.Printf("%s * [%s] %d members\n", stamp, msg.Room, len(members))
+		for _, m := range members {
+			fmt.Printf("    %s\n", memberText(m))
+		}
+	case "status":
+		fmt.Printf("%s * %s\n", stamp, statusText(msg))
+	case "whois":
+		var info chatserver.WhoisInfo
+		msg.DecodeData(&info)
+		fmt.Printf("%s * %s\n", stamp, whoisText(info))
+	case "typing", "read", "read_marker", "delivered", "reactions", "sync_complete", "ack":
+		// Too chatty for a line-based client.
+	case "sync":
+		var state chatserver.SyncState
+		msg.DecodeData(&state)
+		for _, u := range state.Unread {
+			if u.Unread > 0 {
+				fmt.Printf("%s * [%s] %s\n", stamp, u.Room, unreadText(u))
+			}
+		}
+	case "mention":
+		fmt.Printf("%s @ [%s] %s mentioned you: %s\n", stamp, msg.Room, msg.Sender, msg.Content)
+	case "dm":
+		fmt.Printf("%s [dm] %s -> %s: %s\n", stamp, msg.Sender, msg.Target, formatContent(msg, termStyle, shortcodes))
+	case "encrypted_dm":
+		fmt.Printf("%s [dm] %s -> %s: %s (encrypted)\n", stamp, msg.Sender, msg.Target, msg.Content)
+	case "key":
+		// Used by /sdm.
+	case "preview":
+		fmt.Printf("%s [%s] %s %s\n", stamp, msg.Room, msg.Preview.URL, linkPreviewText(msg.Preview))
+	case "translation":
+		var t chatserver.Translation
+		msg.DecodeData(&t)
+		fmt.Printf("%s [%s] %s (%s): %s\n", stamp, msg.Room, msg.Sender, t.Lang, msg.Content)
+	default:
+		content := formatContent(msg, termStyle, shortcodes)
+		switch {
+		case msg.Deleted:
+			content = "(deleted)"
+		case msg.Edited:
+			content += " (edited)"
+		}
+		if msg.Forwarded != nil {
+			content += " " + forwardText(msg.Forwarded)
+		}
+		if msg.Poll != nil && !msg.Deleted {
+			content += " (/vote <n> " + msg.MessageID + ")"
+		}
+		if msg.Action && !msg.Deleted {
+			fmt.Printf("%s [%s] * %s %s\n", stamp, msg.Room, msg.Sender, content)
+			return
+		}
+		if msg.ExpiresAt != "" && !msg.Deleted {
+			content += " " + expiryText(msg.ExpiresAt)
+		}
+		if !msg.Deleted {
+			for _, a := range msg.Attachments {
+				content += " " + attachmentText(a)
+			}
+			if msg.Preview != nil {
+				content += " " + linkPreviewText(msg.Preview)
+			}
+		}
+		fmt.Printf("%s [%s] %s: %s\n", stamp, msg.Room, msg.Sender, content)
+	}
+}
+
+// pollText sums up a poll's votes.
+func pollText(p *chatserver.Poll) string {
+	if p == nil {
+		return "poll"
+	}
+	counts := make([]string, len(p.Options))
+	for i, o := range p.Options {
+		counts[i] = fmt.Sprintf("%s %d", o.Text, len(o.Voters))
+	}
+	state := "votes"
+	if p.Closed {
+		state = "final votes"
+	}
+	return fmt.Sprintf("%s %s: %s", p.Question, state, strings.Join(counts, ", "))
+}
+
+// scheduledText describes a scheduled message for the list /scheduled
+// shows.
+func scheduledText(s chatserver.ScheduledMessage) string {
+	when := s.At.Local().Format("Jan 2 15:04")
+	if s.Reminder {
+		return fmt.Sprintf("%s reminder: %s", when, s.Content)
+	}
+	return fmt.Sprintf("%s [%s] %s", when, s.Room, s.Content)
+}
+
+// commandText describes a server command for the list /commands shows.
+func commandText(cmd chatserver.Command) string {
+	usage := "/" + cmd.Name
+	if cmd.Usage != "" {
+		usage += " " + cmd.Usage
+	}
+	return fmt.Sprintf("%-21s %s", usage, cmd.Help)
+}
+
+// expiryText says when a self-destructing message goes.
+func expiryText(expiresAt string) string {
+	at, err := time.Parse(time.RFC3339Nano, expiresAt)
+	if err != nil {
+		return "(self-destructs)"
+	}
+	return "(self-destructs at " + at.Local().Format("15:04:05") + ")"
+}
+
+// features are the optional features this client shows. Typing, read
+// receipts and reaction events are left out, as it does not show them.
+var features = []string{
+	chatserver.FeaturePresence, chatserver.FeatureEdits, chatserver.FeaturePins,
+	chatserver.FeatureMentions, chatserver.FeatureThreads, chatserver.FeatureMarkdown,
+	chatserver.FeatureE2E, chatserver.FeatureFiles, chatserver.FeatureAttachments,
+	chatserver.FeatureLinkPreviews,
+}
+
+// shortcodes are the emoji shortcodes the server knows but leaves for
+// clients to expand. Only the goroutine reading from the server uses them.
+var shortcodes map[string]string
+
+// e2e handles the messages of the encrypted direct message protocol,
+// decrypting an encrypted_dm into its Content, and returns any requests to
+// send in answer. The caller holds c.mu.
+func (c *client) e2e(msg *chatserver.Message) []chatserver.Message {
+	if c.keys == nil {
+		if msg.Type == "encrypted_dm" {
+			msg.Content = "(sign in to read it)"
+		}
+		return nil
+	}
+	switch msg.Type {
+	case "session":
+		return []chatserver.Message{{Type: "publish_key", Content: c.keys.publicKey()}}
+	case "error":
+		if msg.Code != chatserver.CodeNotFound && msg.Code != chatserver.CodeUserNotFound {
+			return nil
+		}
+		if n := len(c.keys.pending[msg.Target]); n > 0 {
+			delete(c.keys.pending, msg.Target)
+			fmt.Printf("! %d encrypted messages to %s not sent\n", n, msg.Target)
+		}
+	case "key":
+		pending, changed, err := c.keys.learn(*msg)
+		if err != nil {
+			fmt.Println("! bad key for " + msg.Target)
+			return nil
+		}
+		if changed {
+			fmt.Printf("! %s's key has changed; check /fingerprint %s with them\n", msg.Target, msg.Target)
+		}
+		var replies []chatserver.Message
+		for _, text := range pending {
+			sealed, _, err := c.keys.seal(msg.Target, text)
+			if err != nil {
+				fmt.Println("! " + err.Error())
+				continue
+			}
+			replies = append(replies, *sealed)
+		}
+		return replies
+	case "encrypted_dm":
+		text, changed, err := c.keys.open(*msg)
+		if err != nil {
+			text = "(could not decrypt: " + err.Error() + ")"
+		}
+		if changed {
+			text += " (their key has changed; check /fingerprint " + msg.Sender + ")"
+		}
+		msg.Content = text
+	}
+	return nil
+}
+
+// termStyle shows markdown with ANSI attributes when printing to a
+// terminal, and as bare text otherwise so scripted output stays clean.
+var termStyle = newTermStyle()
+
+func newTermStyle() markdownStyle {
+	if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		bare := func(s string) string { return s }
+		return markdownStyle{bold: bare, italic: bare, code: bare}
+	}
+	sgr := func(code string) func(string) string {
+		return func(s string) string { return "\x1b[" + code + "m" + s + "\x1b[0m" }
+	}
+	return markdownStyle{bold: sgr("1"), italic: sgr("3"), code: sgr("36")}
+}
+
+// linkPreviewText summarises a preview of a link in a message.
+func linkPreviewText(p *chatserver.LinkPreview) string {
+	text := p.Title
+	if p.Description != "" {
+		if text != "" {
+			text += " - "
+		}
+		text += p.Description
+	}
+	if p.SiteName != "" {
+		text = p.SiteName + ": " + text
+	}
+	return "(" + text + ")"
+}
+
+// forwardText credits the original of a forwarded message.
+func forwardText(f *chatserver.Forward) string {
+	return fmt.Sprintf("(forwarded from %s in %s)", f.Sender, f.Room)
+}
+
+func withRoom(room, text string) string {
+	if room == "" {
+		return text
+	}
+	return "[" + room + "] " + text
+}
+
+// parseCreate builds a create_room request from "/create <room> [-private] [password]".
+func parseCreate(args []string) (chatserver.Message, bool) {
+	msg := chatserver.Message{Type: "create_room"}
+	for _, arg := range args {
+		switch {
+		case arg == "-private":
+			msg.Private = true
+		case msg.Content == "":
+			msg.Content = arg
+		case msg.Password == "":
+			msg.Password = arg
+		default:
+			return msg, false
+		}
+	}
+	return msg, msg.Content != ""
+}
+
+func parseJoin(args []string) (chatserver.Message, bool) {
+	msg := chatserver.Message{Type: "join_room"}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-invite" && i+1 < len(args):
+			i++
+			msg.Invite = args[i]
+		case msg.Content == "":
+			msg.Content = args[i]
+		case msg.Password == "":
+			msg.Password = args[i]
+		default:
+			return msg, false
+		}
+	}
+	return msg, msg.Content != ""
+}
+
+func optArg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// messageTime is when the server stamped msg, falling back to now.
+func messageTime(msg chatserver.Message) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, msg.Timestamp); err == nil {
+		return t.Local()
+	}
+	return time.Now()
+}
+
+// roomText describes a room in a listing.
+func roomText(r chatserver.RoomInfo) string {
+	text := fmt.Sprintf("%s - %d members, %d online, active %s", r.Name, r.Members, r.Online, r.LastActivity.Local().Format("2006-01-02 15:04"))
+	if r.Protected {
+		text += ", password"
+	}
+	if r.InviteOnly {
+		text += ", invite only"
+	}
+	if len(r.Tags) > 0 {
+		text += ", tags " + strings.Join(r.Tags, ",")
+	}
+	if r.Topic != "" {
+		text += " - " + r.Topic
+	}
+	return text
+}
+
+// unreadText describes what is waiting in a room.
+func unreadText(u chatserver.RoomUnread) string {
+	text := fmt.Sprintf("%d unread", u.Unread)
+	if u.Mentions > 0 {
+		text += fmt.Sprintf(", %d mentioning you", u.Mentions)
+	}
+	return text
+}
+
+// inviteText describes an invite code and what is left of it.
+func inviteText(i chatserver.Invite) string {
+	text := i.Code
+	if i.MaxUses > 0 {
+		text += fmt.Sprintf(" - used %d of %d", i.Uses, i.MaxUses)
+	} else {
+		text += fmt.Sprintf(" - used %d", i.Uses)
+	}
+	if i.ExpiresAt != nil {
+		text += ", expires " + i.ExpiresAt.Local().Format("2006-01-02 15:04")
+	}
+	return text
+}
+
+// memberText describes a room member.
+func memberText(m chatserver.RoomMember) string {
+	text := m.Username
+	if m.Role != "member" {
+		text += " (" + m.Role + ")"
+	}
+	if m.Server != "" {
+		// Whether members on other servers are online is not known here.
+		return text + " - on " + m.Server
+	}
+	if !m.Online {
+		return text + " - offline"
+	}
+	if m.Status != "" && m.Status != chatserver.StatusAvailable {
+		return text + " - " + m.Status
+	}
+	return text + " - online"
+}
+
+// statusText describes a status event.
+func statusText(msg chatserver.Message) string {
+	text := msg.Sender + " is " + msg.Status
+	if msg.Status == chatserver.StatusDoNotDisturb {
+		text = msg.Sender + " does not want to be disturbed"
+	}
+	if msg.Content != "" {
+		text += ": " + msg.Content
+	}
+	return text
+}
+
+// whoisText describes a whois reply.
+func whoisText(info chatserver.WhoisInfo) string {
+	switch {
+	case info.Online && info.LastSeen != nil:
+		return fmt.Sprintf("%s is online, last active %s", info.Username, info.LastSeen.Local().Format("2006-01-02 15:04"))
+	case info.Online:
+		return info.Username + " is online"
+	case info.LastSeen != nil:
+		return fmt.Sprintf("%s is offline, last seen %s", info.Username, info.LastSeen.Local().Format("2006-01-02 15:04"))
+	default:
+		return info.Username + " is offline"
+	}
+}
+
+// slowModeText describes a slow_mode event.
+func slowModeText(msg chatserver.Message) string {
+	if d, err := time.ParseDuration(msg.Content); err == nil && d > 0 {
+		return fmt.Sprintf("%s set slow mode to one message every %s", msg.Sender, d)
+	}
+	return msg.Sender + " turned slow mode off"
+}
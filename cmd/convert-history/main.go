@@ -0,0 +1,179 @@
+// Command convert-history rewrites room history kept in the old
+// chat_history_<room>.txt format as the JSON Lines files the server now
+// reads. Entries already in a room's .jsonl file are kept after the
+// converted ones; the .txt files are left in place.
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+
+	"cli-chat-app/pkg/chatserver"
+)
+
+var (
+	// stampedLine matches lines written since messages carried a timestamp
+	// and ID; plainLine matches the earlier "[room] rest" lines.
+	stampedLine = regexp.MustCompile(`^\[([^\]]*)\] (\S+) ([0-9A-HJKMNP-TV-Z]{26}) (.*)$`)
+	plainLine   = regexp.MustCompile(`^\[([^\]]*)\] (.*)$`)
+)
+
+func main() {
+	dir := flag.String("dir", ".", "directory holding the history files")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: convert-history [-dir path] [chat_history_<room>.txt ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		matches, err := filepath.Glob(filepath.Join(*dir, "chat_history_*.txt"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = matches
+	}
+	if len(files) == 0 {
+		log.Println("no history files to convert")
+		return
+	}
+
+	for _, path := range files {
+		n, err := convert(path)
+		if err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+		log.Printf("%s: converted %d entries", path, n)
+	}
+}
+
+// convert writes the entries of the text history file at path to the room's
+// JSONL history file, ahead of anything already there.
+func convert(path string) (int, error) {
+	base := filepath.Base(path)
+	room := strings.TrimSuffix(strings.TrimPrefix(base, "chat_history_"), ".txt")
+	if room == base || room == "" {
+		return 0, fmt.Errorf("not a chat_history_<room>.txt file")
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	dest := filepath.Join(filepath.Dir(path), chatserver.HistoryFile(room))
+	tmp, err := os.CreateTemp(filepath.Dir(dest), base+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Lines from before messages were stamped are dated to when the file was
+	// last written; replay follows file order, not timestamps.
+	p := &parser{room: room, fallback: info.ModTime().UTC(), entropy: ulid.Monotonic(rand.Reader, 0)}
+	out := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+
+	n := 0
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		entry, ok := p.parse(scanner.Text())
+		if !ok {
+			log.Printf("%s:%d: skipping unrecognised line", path, line)
+			continue
+		}
+		if err := enc.Encode(entry); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if existing, err := os.ReadFile(dest); err == nil {
+		out.Write(existing)
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err := out.Flush(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), dest)
+}
+
+type parser struct {
+	room     string
+	fallback time.Time
+	entropy  *ulid.MonotonicEntropy
+}
+
+// parse turns one line of a text history file into a history entry.
+func (p *parser) parse(line string) (chatserver.Message, bool) {
+	var timestamp, id, body string
+	if m := stampedLine.FindStringSubmatch(line); m != nil {
+		timestamp, id, body = m[2], m[3], m[4]
+	} else if m := plainLine.FindStringSubmatch(line); m != nil {
+		body = m[2]
+	} else {
+		return chatserver.Message{}, false
+	}
+
+	if rest, ok := strings.CutPrefix(body, "message from "); ok {
+		_, by, ok := strings.Cut(rest, " deleted by ")
+		if !ok {
+			return chatserver.Message{}, false
+		}
+		if id == "" {
+			// Without an ID there is no telling which message was deleted.
+			return chatserver.Message{}, false
+		}
+		return chatserver.Message{Type: "deleted", Sender: by, Room: p.room, MessageID: id, Timestamp: timestamp}, true
+	}
+
+	sender, content, ok := strings.Cut(body, ": ")
+	if !ok {
+		return chatserver.Message{}, false
+	}
+	sender, edited := strings.CutSuffix(sender, " (edited)")
+	if edited && id != "" {
+		return chatserver.Message{Type: "edit", Sender: sender, Room: p.room, MessageID: id, Content: content, Timestamp: timestamp}, true
+	}
+
+	if id == "" {
+		id = ulid.MustNew(ulid.Timestamp(p.fallback), p.entropy).String()
+		timestamp = p.fallback.Format(time.RFC3339Nano)
+	}
+	return chatserver.Message{
+		Type:      "broadcast",
+		Sender:    sender,
+		Room:      p.room,
+		MessageID: id,
+		Timestamp: timestamp,
+		Content:   content,
+		Edited:    edited,
+	}, true
+}
@@ -0,0 +1,329 @@
+// Command loadtest puts a chat server under load. It connects synthetic
+// users, signing them up the first time, spreads them over rooms and has
+// them post at a target rate, reporting how long messages take to reach the
+// members of their rooms and the errors the server answers with.
+//
+// Each message carries the time it was sent and is timed again by every
+// member that receives it, its sender included, so the latencies reported
+// are those of the whole fan-out path. The server's limits apply to the
+// load too: raise max_conns_per_ip and rate_limit in its configuration to
+// go beyond them, or the excess shows up as errors.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"cli-chat-app/pkg/chatserver"
+)
+
+// marker starts the content of the messages loadtest posts, followed by the
+// time each was sent in Unix nanoseconds.
+const marker = "loadtest "
+
+// setupTimeout bounds each step of connecting a user.
+const setupTimeout = 10 * time.Second
+
+// stats gathers what the users observe, guarded by mu.
+type stats struct {
+	mu        sync.Mutex
+	connected int
+	failed    int
+	dropped   int
+	sent      int
+	delivered int
+	errors    map[string]int
+	// latencies are those measured since the last report.
+	latencies []time.Duration
+	all       []time.Duration
+}
+
+func (st *stats) errorSeen(code string) {
+	if code == "" {
+		code = "unknown"
+	}
+	st.mu.Lock()
+	st.errors[code]++
+	st.mu.Unlock()
+}
+
+// user is one synthetic user's connection.
+type user struct {
+	name string
+	room string
+	ws   *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (u *user) send(msg chatserver.Message) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ws.SetWriteDeadline(time.Now().Add(setupTimeout))
+	return u.ws.WriteJSON(msg)
+}
+
+// request sends msg and waits for the server's answer, an info or an error
+// carrying msg's ID, returning the error's code. Other messages arriving
+// meanwhile are skipped.
+func (u *user) request(msg chatserver.Message) (string, error) {
+	msg.ID = msg.Type
+	if err := u.send(msg); err != nil {
+		return "", err
+	}
+	u.ws.SetReadDeadline(time.Now().Add(setupTimeout))
+	defer u.ws.SetReadDeadline(time.Time{})
+	for {
+		var reply chatserver.Message
+		if err := u.ws.ReadJSON(&reply); err != nil {
+			return "", err
+		}
+		if reply.ID != msg.ID {
+			continue
+		}
+		switch reply.Type {
+		case "info":
+			// Signing in also tells of the rooms rejoined.
+			if msg.Type == "signin" && reply.Content != "Signin successful" {
+				continue
+			}
+			return "", nil
+		case "error":
+			return reply.Code, nil
+		}
+	}
+}
+
+func main() {
+	url := flag.String("url", "ws://localhost:8000/ws", "chat server WebSocket URL")
+	users := flag.Int("users", 50, "number of users to connect")
+	rooms := flag.Int("rooms", 5, "number of rooms to spread them over")
+	rate := flag.Float64("rate", 20, "messages to post per second, in all")
+	duration := flag.Duration("duration", 30*time.Second, "how long to post for")
+	connectRate := flag.Float64("connect-rate", 50, "users to connect per second")
+	size := flag.Int("size", 64, "length of each message in bytes")
+	prefix := flag.String("prefix", "loadtest", "prefix of the users' and rooms' names")
+	password := flag.String("password", "loadtest-password", "password of the users")
+	interval := flag.Duration("interval", 5*time.Second, "how often to report progress")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: loadtest [flags]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *users < 1 || *rooms < 1 || *rate <= 0 || *connectRate <= 0 || *interval <= 0 {
+		log.Fatal("users, rooms, rate, connect-rate and interval must be positive")
+	}
+	if *size < len(marker)+20 {
+		*size = len(marker) + 20
+	}
+
+	st := &stats{errors: make(map[string]int)}
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	log.Printf("connecting %d users to %d rooms", *users, *rooms)
+	start := time.Now()
+	connected := make([]*user, *users)
+	var wg sync.WaitGroup
+	pace := time.NewTicker(time.Duration(float64(time.Second) / *connectRate))
+	for i := range *users {
+		<-pace.C
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u := &user{name: fmt.Sprintf("%s-%d", *prefix, i), room: fmt.Sprintf("%s-room-%d", *prefix, i%*rooms)}
+			if err := u.connect(*url, *password); err != nil {
+				log.Printf("%s: %v", u.name, err)
+				st.mu.Lock()
+				st.failed++
+				st.mu.Unlock()
+				return
+			}
+			st.mu.Lock()
+			st.connected++
+			st.mu.Unlock()
+			connected[i] = u
+			go u.receive(st, stop)
+		}()
+	}
+	pace.Stop()
+	wg.Wait()
+	connected = slices.DeleteFunc(connected, func(u *user) bool { return u == nil })
+	log.Printf("connected %d users in %s, %d failed", st.connected, time.Since(start).Round(time.Millisecond), st.failed)
+	if len(connected) == 0 {
+		os.Exit(1)
+	}
+
+	log.Printf("posting %g messages a second for %s", *rate, *duration)
+	padding := strings.Repeat("x", *size-len(marker)-20)
+	send := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	report := time.NewTicker(*interval)
+	end := time.After(*duration)
+	start = time.Now()
+posting:
+	for next := 0; ; {
+		select {
+		case <-send.C:
+			u := connected[next%len(connected)]
+			next++
+			content := marker + strconv.FormatInt(time.Now().UnixNano(), 10) + " " + padding
+			if err := u.send(chatserver.Message{Type: "broadcast", Room: u.room, Content: content}); err != nil {
+				st.errorSeen("send_failed")
+				continue
+			}
+			st.mu.Lock()
+			st.sent++
+			st.mu.Unlock()
+		case <-report.C:
+			st.report(time.Since(start))
+		case <-end:
+			break posting
+		case <-interrupt:
+			log.Print("interrupted")
+			break posting
+		}
+	}
+	send.Stop()
+	report.Stop()
+	elapsed := time.Since(start)
+
+	// Messages still on their way are given a moment to arrive.
+	time.Sleep(2 * time.Second)
+	close(stop)
+	for _, u := range connected {
+		u.ws.Close()
+	}
+	st.summary(elapsed)
+}
+
+// connect dials the server, signs the user up unless they exist already,
+// signs them in and joins their room, creating it if it is missing.
+func (u *user) connect(url, password string) error {
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	u.ws = ws
+	steps := []struct {
+		msg chatserver.Message
+		// ok is the error code, besides none, that lets setup go on.
+		ok string
+	}{
+		{chatserver.Message{Type: "signup", Sender: u.name, Content: password}, chatserver.CodeAlreadyExists},
+		{chatserver.Message{Type: "signin", Sender: u.name, Content: password}, ""},
+		{chatserver.Message{Type: "create_room", Content: u.room}, chatserver.CodeAlreadyExists},
+		{chatserver.Message{Type: "join_room", Content: u.room}, chatserver.CodeAlreadyExists},
+	}
+	for _, step := range steps {
+		code, err := u.request(step.msg)
+		if err == nil && code != "" && code != step.ok {
+			err = fmt.Errorf("server answered %s", code)
+		}
+		if err != nil {
+			ws.Close()
+			return fmt.Errorf("%s: %w", step.msg.Type, err)
+		}
+	}
+	return nil
+}
+
+// receive times the messages posted by loadtest that reach u and counts the
+// errors the server sends it until stop is closed.
+func (u *user) receive(st *stats, stop <-chan struct{}) {
+	for {
+		var msg chatserver.Message
+		if err := u.ws.ReadJSON(&msg); err != nil {
+			select {
+			case <-stop:
+			default:
+				log.Printf("%s: %v", u.name, err)
+				st.mu.Lock()
+				st.dropped++
+				st.mu.Unlock()
+			}
+			return
+		}
+		switch msg.Type {
+		case "broadcast":
+			rest, ok := strings.CutPrefix(msg.Content, marker)
+			if !ok {
+				continue
+			}
+			stamp, _, _ := strings.Cut(rest, " ")
+			nanos, err := strconv.ParseInt(stamp, 10, 64)
+			if err != nil {
+				continue
+			}
+			latency := time.Since(time.Unix(0, nanos))
+			st.mu.Lock()
+			st.delivered++
+			st.latencies = append(st.latencies, latency)
+			st.mu.Unlock()
+		case "error":
+			st.errorSeen(msg.Code)
+		}
+	}
+}
+
+// report logs progress, with the latencies measured since the last report.
+func (st *stats) report(elapsed time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	window := st.latencies
+	st.all = append(st.all, window...)
+	st.latencies = nil
+	log.Printf("%s: sent %d, delivered %d, errors %d, latency %s",
+		elapsed.Round(time.Second), st.sent, st.delivered, st.errorCount(), percentiles(window))
+}
+
+// summary prints the totals once posting is over, after elapsed.
+func (st *stats) summary(elapsed time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	all := append(st.all, st.latencies...)
+	fmt.Printf("users:     %d connected, %d failed, %d dropped\n", st.connected, st.failed, st.dropped)
+	fmt.Printf("messages:  %d sent (%.1f/s), %d delivered (%.1f/s)\n",
+		st.sent, float64(st.sent)/elapsed.Seconds(), st.delivered, float64(st.delivered)/elapsed.Seconds())
+	fmt.Printf("latency:   %s\n", percentiles(all))
+	fmt.Printf("errors:    %d\n", st.errorCount())
+	codes := make([]string, 0, len(st.errors))
+	for code := range st.errors {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		fmt.Printf("  %-20s %d\n", code, st.errors[code])
+	}
+}
+
+// errorCount is the number of errors seen. The caller must hold mu.
+func (st *stats) errorCount() int {
+	n := 0
+	for _, count := range st.errors {
+		n += count
+	}
+	return n
+}
+
+// percentiles describes the spread of latencies.
+func percentiles(latencies []time.Duration) string {
+	if len(latencies) == 0 {
+		return "n/a"
+	}
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	at := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s, max %s", at(0.5), at(0.9), at(0.99), sorted[len(sorted)-1].Round(time.Microsecond))
+}
@@ -0,0 +1,893 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cli-chat-app/pkg/chatserver"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything the server can be configured with. Values come
+// from, in increasing order of precedence: the defaults, the YAML file named
+// by -config, CHAT_* environment variables, and command-line flags.
+type Config struct {
+	Addr string `yaml:"addr"`
+	// GRPCAddr serves the gRPC API when set, using the TLS certificate
+	// when there is one.
+	GRPCAddr string `yaml:"grpc_addr"`
+	// LineAddr accepts netcat and telnet users when set. It is plain TCP,
+	// so their passwords are sent unencrypted.
+	LineAddr string `yaml:"line_addr"`
+	// Database is the SQLite file accounts are kept in. It is unused when
+	// Postgres is set.
+	Database string `yaml:"database"`
+	Postgres string `yaml:"postgres"`
+	// HistoryDir is where per-room history files are written. They are not
+	// written at all if HistoryFiles is false or Postgres is set.
+	HistoryDir    string        `yaml:"history_dir"`
+	HistoryFiles  bool          `yaml:"history_files"`
+	Broker        string        `yaml:"broker"`
+	Admins        []string      `yaml:"admins"`
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"`
+	// Cluster shards rooms between the instances sharing Broker.
+	Cluster struct {
+		Enabled bool `yaml:"enabled"`
+		// Node names this instance in logs and /cluster; it defaults to
+		// the host name.
+		Node      string        `yaml:"node"`
+		Heartbeat time.Duration `yaml:"heartbeat"`
+	} `yaml:"cluster"`
+	// Metrics serves Prometheus metrics at /metrics.
+	Metrics bool `yaml:"metrics"`
+	// Debug serves pprof and /debug/stats to admins.
+	Debug bool `yaml:"debug"`
+
+	TLS struct {
+		Cert         string `yaml:"cert"`
+		Key          string `yaml:"key"`
+		HTTPRedirect string `yaml:"http_redirect"`
+		// Bots is a listener that signs bots and services in by client
+		// certificate.
+		Bots struct {
+			Addr     string `yaml:"addr"`
+			ClientCA string `yaml:"client_ca"`
+			// Accounts maps certificate names, subject alternative names
+			// or the common name, to the account they sign in as.
+			Accounts map[string]string `yaml:"accounts"`
+		} `yaml:"bots"`
+	} `yaml:"tls"`
+
+	Session struct {
+		TTL time.Duration `yaml:"ttl"`
+		// Key signs session tokens. It is best left to CHAT_SESSION_KEY
+		// rather than written in the file.
+		Key string `yaml:"key"`
+	} `yaml:"session"`
+
+	Retention struct {
+		MaxAge      time.Duration `yaml:"max_age"`
+		MaxMessages int           `yaml:"max_messages"`
+	} `yaml:"retention"`
+
+	// EmptyRooms archives or deletes rooms that have had no members and no
+	// messages for IdleFor; zero keeps them.
+	EmptyRooms struct {
+		IdleFor time.Duration `yaml:"idle_for"`
+		Action  string        `yaml:"action"`
+	} `yaml:"empty_rooms"`
+
+	// MaxConnsPerIP caps the WebSocket connections open from one address;
+	// zero is unlimited. TrustedProxies lists the addresses or CIDRs of
+	// proxies whose X-Forwarded-For header is believed.
+	MaxConnsPerIP  int      `yaml:"max_conns_per_ip"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// AllowedOrigins lists the other sites, as host patterns such as
+	// chat.example.com or *.example.com, whose web pages may connect.
+	// AllowAnyOrigin lets every site's do, for development.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	AllowAnyOrigin bool     `yaml:"allow_any_origin"`
+
+	// PreviewHosts lists the hosts, with their subdomains, whose pages are
+	// fetched to preview links in messages. Previews are off when it is
+	// empty.
+	PreviewHosts []string `yaml:"preview_hosts"`
+
+	// Keepalive pings clients every PingInterval and closes connections
+	// silent for PongTimeout, or sending no messages for IdleTimeout when
+	// that is set. Writes taking longer than WriteTimeout fail.
+	Keepalive struct {
+		PingInterval time.Duration `yaml:"ping_interval"`
+		PongTimeout  time.Duration `yaml:"pong_timeout"`
+		WriteTimeout time.Duration `yaml:"write_timeout"`
+		IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	} `yaml:"keepalive"`
+
+	// Compression negotiates per-message deflate with clients that support
+	// it, compressing messages of at least Threshold bytes.
+	Compression struct {
+		Enabled   bool `yaml:"enabled"`
+		Threshold int  `yaml:"threshold"`
+	} `yaml:"compression"`
+
+	// MaxContentLength is the longest message, in characters, accepted
+	// from clients.
+	MaxContentLength int `yaml:"max_content_length"`
+
+	// MaxFileSize is the largest file, in bytes, that can be shared in
+	// rooms that allow it. Zero turns file sharing off.
+	MaxFileSize int `yaml:"max_file_size"`
+	// ExpandEmoji replaces :shortcode: emoji in messages with the emoji.
+	ExpandEmoji bool `yaml:"expand_emoji"`
+
+	// Attachments keeps files uploaded to /upload in Dir or, if Bucket is
+	// set, in that S3 bucket. Uploads are off when neither is set.
+	Attachments struct {
+		Dir     string `yaml:"dir"`
+		MaxSize int    `yaml:"max_size"`
+		S3      struct {
+			Endpoint string `yaml:"endpoint"`
+			Bucket   string `yaml:"bucket"`
+			Region   string `yaml:"region"`
+			// The keys are best left to CHAT_S3_ACCESS_KEY and
+			// CHAT_S3_SECRET_KEY, or the standard AWS variables.
+			AccessKey string `yaml:"access_key"`
+			SecretKey string `yaml:"secret_key"`
+			Insecure  bool   `yaml:"insecure"`
+		} `yaml:"s3"`
+	} `yaml:"attachments"`
+
+	// RateLimit is how many messages a second each user may send to a
+	// room, after an initial burst, unless the room's owner overrides it.
+	// It also applies to direct messages. A zero rate is unlimited.
+	RateLimit struct {
+		Rate  float64 `yaml:"rate"`
+		Burst int     `yaml:"burst"`
+	} `yaml:"rate_limit"`
+
+	// BotRateLimit replaces RateLimit and rooms' own limits for bot
+	// accounts. A zero rate is unlimited.
+	BotRateLimit struct {
+		Rate  float64 `yaml:"rate"`
+		Burst int     `yaml:"burst"`
+	} `yaml:"bot_rate_limit"`
+
+	// Filter masks or rejects room messages containing any of Words or
+	// the words listed one per line in WordsFile. Moderators can turn it
+	// off for their rooms.
+	Filter struct {
+		Words     []string `yaml:"words"`
+		WordsFile string   `yaml:"words_file"`
+		// Mode is mask or reject.
+		Mode string `yaml:"mode"`
+	} `yaml:"filter"`
+
+	// Spam mutes users for MuteFor when they repeat a message
+	// RepeatLimit times within RepeatWindow, mention more than MaxMentions
+	// users in one message, or post more than MaxLinks links within
+	// LinkWindow. A zero limit turns its check off.
+	Spam struct {
+		RepeatLimit  int           `yaml:"repeat_limit"`
+		RepeatWindow time.Duration `yaml:"repeat_window"`
+		MaxMentions  int           `yaml:"max_mentions"`
+		MaxLinks     int           `yaml:"max_links"`
+		LinkWindow   time.Duration `yaml:"link_window"`
+		MuteFor      time.Duration `yaml:"mute_for"`
+	} `yaml:"spam"`
+
+	// Matrix mirrors Rooms, which maps local room names to Matrix room
+	// IDs, to the Matrix homeserver at Homeserver as an application
+	// service. The bridge is off unless Homeserver is set.
+	Matrix struct {
+		Homeserver string `yaml:"homeserver"`
+		// Domain is the homeserver's server name, as in @user:domain.
+		Domain string `yaml:"domain"`
+		// The tokens are those of the bridge's registration file, and are
+		// best left to CHAT_MATRIX_AS_TOKEN and CHAT_MATRIX_HS_TOKEN.
+		ASToken string `yaml:"as_token"`
+		HSToken string `yaml:"hs_token"`
+		// UserPrefix begins the names of the Matrix users that stand in
+		// for local users.
+		UserPrefix string            `yaml:"user_prefix"`
+		Rooms      map[string]string `yaml:"rooms"`
+	} `yaml:"matrix"`
+
+	// WebhookBridges join rooms to Slack or Discord channels. Room
+	// messages are posted to URL, the channel's incoming webhook, and the
+	// channel's outgoing webhook posts to /bridges/<token>. Either may be
+	// left out for a one-way bridge.
+	WebhookBridges []struct {
+		Room string `yaml:"room"`
+		// Format is slack or discord.
+		Format string `yaml:"format"`
+		URL    string `yaml:"url"`
+		Token  string `yaml:"token"`
+	} `yaml:"webhook_bridges"`
+
+	// Telegram relays rooms to Telegram groups through a bot, which must
+	// be in each group with privacy mode off.
+	Telegram struct {
+		// Token is the bot's, for bridges that do not name their own. It is
+		// best left to CHAT_TELEGRAM_TOKEN.
+		Token string `yaml:"token"`
+		// APIURL is a Bot API server to use instead of Telegram's.
+		APIURL  string `yaml:"api_url"`
+		Bridges []struct {
+			Room   string `yaml:"room"`
+			ChatID int64  `yaml:"chat_id"`
+			Token  string `yaml:"token"`
+		} `yaml:"bridges"`
+	} `yaml:"telegram"`
+
+	// Federation shares rooms with other servers over signed WebSocket
+	// links. It is off when Name is empty.
+	Federation struct {
+		// Name is this server's name, as its peers know it.
+		Name  string `yaml:"name"`
+		Peers []struct {
+			Name string `yaml:"name"`
+			// URL is the peer's federation endpoint; when it is empty the
+			// peer is left to dial this server.
+			URL    string   `yaml:"url"`
+			Secret string   `yaml:"secret"`
+			Rooms  []string `yaml:"rooms"`
+		} `yaml:"peers"`
+	} `yaml:"federation"`
+
+	// Plugins are plugin binaries to start, asked in this order about
+	// room messages, joins and commands.
+	Plugins []string `yaml:"plugins"`
+
+	// Scripts are Lua scripts run on room messages, joins and leaves.
+	Scripts struct {
+		// Dir holds the scripts, every .lua file of which is loaded in
+		// name order. Scripts are off when it is empty.
+		Dir string `yaml:"dir"`
+		// Timeout bounds each call to a script.
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"scripts"`
+
+	// Assistant is a bot backed by an OpenAI-compatible chat completions
+	// API that answers messages mentioning it in rooms whose moderators
+	// turned it on. It is off when APIURL is empty.
+	Assistant struct {
+		Name string `yaml:"name"`
+		// APIURL is the API's base URL, such as https://api.openai.com/v1.
+		APIURL string `yaml:"api_url"`
+		// APIKey is best left to CHAT_ASSISTANT_API_KEY.
+		APIKey       string `yaml:"api_key"`
+		Model        string `yaml:"model"`
+		SystemPrompt string `yaml:"system_prompt"`
+		// Context is how many of a room's latest messages it is shown.
+		Context   int `yaml:"context"`
+		MaxTokens int `yaml:"max_tokens"`
+		// RateLimit is how many questions a second each user may ask it,
+		// after an initial burst.
+		RateLimit struct {
+			Rate  float64 `yaml:"rate"`
+			Burst int     `yaml:"burst"`
+		} `yaml:"rate_limit"`
+		// DailyTokens and RoomDailyTokens cap the tokens it uses each day,
+		// in all and in each room. Zero does not cap them.
+		DailyTokens     int           `yaml:"daily_tokens"`
+		RoomDailyTokens int           `yaml:"room_daily_tokens"`
+		Timeout         time.Duration `yaml:"timeout"`
+	} `yaml:"assistant"`
+
+	// Translation translates messages for /translate and for users who
+	// turn on automatic translation. It is off when Provider is empty.
+	Translation struct {
+		// Provider is deepl or libretranslate.
+		Provider string `yaml:"provider"`
+		// APIURL is the provider's base URL. It may be left empty for
+		// DeepL, and is required for LibreTranslate.
+		APIURL string `yaml:"api_url"`
+		// APIKey is best left to CHAT_TRANSLATION_API_KEY.
+		APIKey string `yaml:"api_key"`
+	} `yaml:"translation"`
+
+	Log struct {
+		// Level is debug, info, warn or error.
+		Level string `yaml:"level"`
+		// Format is text or json.
+		Format string `yaml:"format"`
+		// Output is stderr, stdout or a file to append to.
+		Output string `yaml:"output"`
+	} `yaml:"log"`
+}
+
+func defaultConfig() *Config {
+	cfg := &Config{
+		Addr:          ":8000",
+		Database:      "chat.db",
+		HistoryDir:    ".",
+		HistoryFiles:  true,
+		ShutdownGrace: 5 * time.Second,
+		Metrics:       true,
+	}
+	cfg.Session.TTL = 24 * time.Hour
+	cfg.Cluster.Heartbeat = chatserver.DefaultClusterHeartbeat
+	cfg.Keepalive.PingInterval = chatserver.DefaultKeepalive.PingInterval
+	cfg.Keepalive.PongTimeout = chatserver.DefaultKeepalive.PongTimeout
+	cfg.Keepalive.WriteTimeout = chatserver.DefaultKeepalive.WriteTimeout
+	cfg.Compression.Threshold = 512
+	cfg.EmptyRooms.Action = chatserver.ExpireArchive
+	cfg.MaxConnsPerIP = 20
+	cfg.MaxContentLength = 4000
+	cfg.MaxFileSize = 1 << 20
+	cfg.Attachments.MaxSize = 10 << 20
+	cfg.Attachments.S3.Endpoint = "s3.amazonaws.com"
+	cfg.RateLimit.Rate = 2
+	cfg.RateLimit.Burst = 10
+	cfg.BotRateLimit.Rate = 5
+	cfg.BotRateLimit.Burst = 20
+	cfg.Filter.Mode = "mask"
+	cfg.Spam.RepeatLimit = 3
+	cfg.Spam.RepeatWindow = time.Minute
+	cfg.Spam.MaxMentions = 5
+	cfg.Spam.MaxLinks = 3
+	cfg.Spam.LinkWindow = time.Minute
+	cfg.Spam.MuteFor = 5 * time.Minute
+	cfg.Matrix.UserPrefix = "chat_"
+	cfg.Scripts.Timeout = chatserver.DefaultScriptTimeout
+	cfg.Assistant.Name = chatserver.DefaultAssistantName
+	cfg.Assistant.Context = chatserver.DefaultAssistantContext
+	cfg.Assistant.RateLimit.Rate = 0.1
+	cfg.Assistant.RateLimit.Burst = 3
+	cfg.Assistant.Timeout = chatserver.DefaultAssistantTimeout
+	cfg.Log.Level = "info"
+	cfg.Log.Format = "text"
+	cfg.Log.Output = "stderr"
+	return cfg
+}
+
+// load reads the YAML file at path over cfg. Unknown keys are rejected so
+// typos do not go unnoticed.
+func (cfg *Config) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides cfg with any CHAT_* environment variables that are set.
+func (cfg *Config) applyEnv() error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	dur := func(name string, dst *time.Duration) {
+		if v, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = d
+		}
+	}
+	num := func(name string, dst *int) {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	float := func(name string, dst *float64) {
+		if v, ok := os.LookupEnv(name); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = f
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = b
+		}
+	}
+
+	str("CHAT_ADDR", &cfg.Addr)
+	str("CHAT_DATABASE", &cfg.Database)
+	str("CHAT_GRPC_ADDR", &cfg.GRPCAddr)
+	str("CHAT_LINE_ADDR", &cfg.LineAddr)
+	str("CHAT_POSTGRES", &cfg.Postgres)
+	str("CHAT_HISTORY_DIR", &cfg.HistoryDir)
+	boolean("CHAT_HISTORY_FILES", &cfg.HistoryFiles)
+	str("CHAT_BROKER", &cfg.Broker)
+	boolean("CHAT_CLUSTER", &cfg.Cluster.Enabled)
+	str("CHAT_CLUSTER_NODE", &cfg.Cluster.Node)
+	dur("CHAT_CLUSTER_HEARTBEAT", &cfg.Cluster.Heartbeat)
+	if v, ok := os.LookupEnv("CHAT_ADMINS"); ok {
+		cfg.Admins = splitList(v)
+	}
+	dur("CHAT_SHUTDOWN_GRACE", &cfg.ShutdownGrace)
+	boolean("CHAT_METRICS", &cfg.Metrics)
+	boolean("CHAT_DEBUG", &cfg.Debug)
+	str("CHAT_TLS_CERT", &cfg.TLS.Cert)
+	str("CHAT_TLS_KEY", &cfg.TLS.Key)
+	str("CHAT_HTTP_REDIRECT", &cfg.TLS.HTTPRedirect)
+	str("CHAT_BOT_ADDR", &cfg.TLS.Bots.Addr)
+	str("CHAT_BOT_CLIENT_CA", &cfg.TLS.Bots.ClientCA)
+	if v, ok := os.LookupEnv("CHAT_BOT_ACCOUNTS"); ok {
+		if accounts, err := splitMap(v); err != nil {
+			errs = append(errs, fmt.Errorf("CHAT_BOT_ACCOUNTS: %w", err))
+		} else {
+			cfg.TLS.Bots.Accounts = accounts
+		}
+	}
+	dur("CHAT_SESSION_TTL", &cfg.Session.TTL)
+	str("CHAT_SESSION_KEY", &cfg.Session.Key)
+	dur("CHAT_RETAIN_AGE", &cfg.Retention.MaxAge)
+	num("CHAT_RETAIN_MESSAGES", &cfg.Retention.MaxMessages)
+	dur("CHAT_EMPTY_ROOM_IDLE", &cfg.EmptyRooms.IdleFor)
+	str("CHAT_EMPTY_ROOM_ACTION", &cfg.EmptyRooms.Action)
+	num("CHAT_MAX_CONNS_PER_IP", &cfg.MaxConnsPerIP)
+	if v, ok := os.LookupEnv("CHAT_TRUSTED_PROXIES"); ok {
+		cfg.TrustedProxies = splitList(v)
+	}
+	if v, ok := os.LookupEnv("CHAT_ALLOWED_ORIGINS"); ok {
+		cfg.AllowedOrigins = splitList(v)
+	}
+	boolean("CHAT_ALLOW_ANY_ORIGIN", &cfg.AllowAnyOrigin)
+	if v, ok := os.LookupEnv("CHAT_PREVIEW_HOSTS"); ok {
+		cfg.PreviewHosts = splitList(v)
+	}
+	dur("CHAT_PING_INTERVAL", &cfg.Keepalive.PingInterval)
+	dur("CHAT_PONG_TIMEOUT", &cfg.Keepalive.PongTimeout)
+	dur("CHAT_WRITE_TIMEOUT", &cfg.Keepalive.WriteTimeout)
+	dur("CHAT_IDLE_TIMEOUT", &cfg.Keepalive.IdleTimeout)
+	boolean("CHAT_COMPRESSION", &cfg.Compression.Enabled)
+	num("CHAT_COMPRESSION_THRESHOLD", &cfg.Compression.Threshold)
+	num("CHAT_MAX_CONTENT_LENGTH", &cfg.MaxContentLength)
+	num("CHAT_MAX_FILE_SIZE", &cfg.MaxFileSize)
+	boolean("CHAT_EXPAND_EMOJI", &cfg.ExpandEmoji)
+	str("CHAT_ATTACHMENT_DIR", &cfg.Attachments.Dir)
+	num("CHAT_ATTACHMENT_MAX_SIZE", &cfg.Attachments.MaxSize)
+	str("CHAT_S3_ENDPOINT", &cfg.Attachments.S3.Endpoint)
+	str("CHAT_S3_BUCKET", &cfg.Attachments.S3.Bucket)
+	str("CHAT_S3_REGION", &cfg.Attachments.S3.Region)
+	str("CHAT_S3_ACCESS_KEY", &cfg.Attachments.S3.AccessKey)
+	str("CHAT_S3_SECRET_KEY", &cfg.Attachments.S3.SecretKey)
+	boolean("CHAT_S3_INSECURE", &cfg.Attachments.S3.Insecure)
+	float("CHAT_RATE_LIMIT", &cfg.RateLimit.Rate)
+	num("CHAT_RATE_BURST", &cfg.RateLimit.Burst)
+	float("CHAT_BOT_RATE_LIMIT", &cfg.BotRateLimit.Rate)
+	num("CHAT_BOT_RATE_BURST", &cfg.BotRateLimit.Burst)
+	str("CHAT_FILTER_WORDS_FILE", &cfg.Filter.WordsFile)
+	str("CHAT_FILTER_MODE", &cfg.Filter.Mode)
+	num("CHAT_SPAM_REPEAT_LIMIT", &cfg.Spam.RepeatLimit)
+	dur("CHAT_SPAM_REPEAT_WINDOW", &cfg.Spam.RepeatWindow)
+	num("CHAT_SPAM_MAX_MENTIONS", &cfg.Spam.MaxMentions)
+	num("CHAT_SPAM_MAX_LINKS", &cfg.Spam.MaxLinks)
+	dur("CHAT_SPAM_LINK_WINDOW", &cfg.Spam.LinkWindow)
+	dur("CHAT_SPAM_MUTE_FOR", &cfg.Spam.MuteFor)
+	str("CHAT_MATRIX_HOMESERVER", &cfg.Matrix.Homeserver)
+	str("CHAT_MATRIX_DOMAIN", &cfg.Matrix.Domain)
+	str("CHAT_MATRIX_AS_TOKEN", &cfg.Matrix.ASToken)
+	str("CHAT_MATRIX_HS_TOKEN", &cfg.Matrix.HSToken)
+	str("CHAT_MATRIX_USER_PREFIX", &cfg.Matrix.UserPrefix)
+	if v, ok := os.LookupEnv("CHAT_MATRIX_ROOMS"); ok {
+		if rooms, err := splitMap(v); err != nil {
+			errs = append(errs, fmt.Errorf("CHAT_MATRIX_ROOMS: %w", err))
+		} else {
+			cfg.Matrix.Rooms = rooms
+		}
+	}
+	str("CHAT_TELEGRAM_TOKEN", &cfg.Telegram.Token)
+	str("CHAT_TELEGRAM_API_URL", &cfg.Telegram.APIURL)
+	str("CHAT_FEDERATION_NAME", &cfg.Federation.Name)
+	if v, ok := os.LookupEnv("CHAT_PLUGINS"); ok {
+		cfg.Plugins = splitList(v)
+	}
+	str("CHAT_SCRIPTS_DIR", &cfg.Scripts.Dir)
+	dur("CHAT_SCRIPT_TIMEOUT", &cfg.Scripts.Timeout)
+	str("CHAT_ASSISTANT_NAME", &cfg.Assistant.Name)
+	str("CHAT_ASSISTANT_API_URL", &cfg.Assistant.APIURL)
+	str("CHAT_ASSISTANT_API_KEY", &cfg.Assistant.APIKey)
+	str("CHAT_ASSISTANT_MODEL", &cfg.Assistant.Model)
+	num("CHAT_ASSISTANT_DAILY_TOKENS", &cfg.Assistant.DailyTokens)
+	num("CHAT_ASSISTANT_ROOM_DAILY_TOKENS", &cfg.Assistant.RoomDailyTokens)
+	str("CHAT_TRANSLATION_PROVIDER", &cfg.Translation.Provider)
+	str("CHAT_TRANSLATION_API_URL", &cfg.Translation.APIURL)
+	str("CHAT_TRANSLATION_API_KEY", &cfg.Translation.APIKey)
+	str("CHAT_LOG_LEVEL", &cfg.Log.Level)
+	str("CHAT_LOG_FORMAT", &cfg.Log.Format)
+	str("CHAT_LOG_OUTPUT", &cfg.Log.Output)
+	return errors.Join(errs...)
+}
+
+// validate reports every problem with cfg at once.
+func (cfg *Config) validate() error {
+	var errs []error
+	if cfg.Addr == "" {
+		errs = append(errs, errors.New("addr must not be empty"))
+	}
+	if cfg.Postgres == "" && cfg.Database == "" {
+		errs = append(errs, errors.New("one of database or postgres is required"))
+	}
+	if cfg.HistoryFiles && cfg.Postgres == "" && cfg.HistoryDir == "" {
+		errs = append(errs, errors.New("history_dir must not be empty"))
+	}
+	if cfg.Broker != "" {
+		scheme, _, _ := strings.Cut(cfg.Broker, "://")
+		switch scheme {
+		case "redis", "rediss", "nats", "tls":
+		default:
+			errs = append(errs, fmt.Errorf("broker: unsupported scheme %q", scheme))
+		}
+	}
+	if cfg.Cluster.Enabled && cfg.Broker == "" {
+		errs = append(errs, errors.New("cluster needs a broker"))
+	}
+	if cfg.Cluster.Heartbeat <= 0 {
+		errs = append(errs, errors.New("cluster.heartbeat must be positive"))
+	}
+	if cfg.ShutdownGrace < 0 {
+		errs = append(errs, errors.New("shutdown_grace must not be negative"))
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		errs = append(errs, errors.New("tls.cert and tls.key must be set together"))
+	}
+	if cfg.TLS.HTTPRedirect != "" && cfg.TLS.Cert == "" {
+		errs = append(errs, errors.New("tls.http_redirect requires tls.cert and tls.key"))
+	}
+	if bots := cfg.TLS.Bots; bots.Addr != "" {
+		if cfg.TLS.Cert == "" {
+			errs = append(errs, errors.New("tls.bots.addr requires tls.cert and tls.key"))
+		}
+		if bots.ClientCA == "" {
+			errs = append(errs, errors.New("tls.bots.addr requires tls.bots.client_ca"))
+		}
+		if len(bots.Accounts) == 0 {
+			errs = append(errs, errors.New("tls.bots.accounts must map at least one certificate name"))
+		}
+	}
+	if cfg.Session.TTL <= 0 {
+		errs = append(errs, errors.New("session.ttl must be positive"))
+	}
+	if cfg.Retention.MaxAge < 0 {
+		errs = append(errs, errors.New("retention.max_age must not be negative"))
+	}
+	if cfg.Retention.MaxMessages < 0 {
+		errs = append(errs, errors.New("retention.max_messages must not be negative"))
+	}
+	if cfg.EmptyRooms.IdleFor < 0 {
+		errs = append(errs, errors.New("empty_rooms.idle_for must not be negative"))
+	}
+	if cfg.EmptyRooms.Action != chatserver.ExpireArchive && cfg.EmptyRooms.Action != chatserver.ExpireDelete {
+		errs = append(errs, fmt.Errorf("empty_rooms.action must be %s or %s", chatserver.ExpireArchive, chatserver.ExpireDelete))
+	}
+	if cfg.MaxConnsPerIP < 0 {
+		errs = append(errs, errors.New("max_conns_per_ip must not be negative"))
+	}
+	if _, err := cfg.trustedProxies(); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	for _, pattern := range cfg.AllowedOrigins {
+		if !chatserver.ValidOriginPattern(pattern) {
+			errs = append(errs, fmt.Errorf("allowed_origins: bad pattern %q", pattern))
+		}
+	}
+	if cfg.Keepalive.PingInterval <= 0 || cfg.Keepalive.WriteTimeout <= 0 {
+		errs = append(errs, errors.New("keepalive.ping_interval and keepalive.write_timeout must be positive"))
+	}
+	if cfg.Keepalive.PongTimeout <= cfg.Keepalive.PingInterval {
+		errs = append(errs, errors.New("keepalive.pong_timeout must be longer than keepalive.ping_interval"))
+	}
+	if cfg.Keepalive.IdleTimeout < 0 {
+		errs = append(errs, errors.New("keepalive.idle_timeout must not be negative"))
+	}
+	if cfg.Compression.Threshold < 0 {
+		errs = append(errs, errors.New("compression.threshold must not be negative"))
+	}
+	if cfg.MaxContentLength <= 0 {
+		errs = append(errs, errors.New("max_content_length must be positive"))
+	}
+	if cfg.MaxFileSize < 0 {
+		errs = append(errs, errors.New("max_file_size must not be negative"))
+	}
+	for _, host := range cfg.PreviewHosts {
+		if host == "" || strings.ContainsAny(host, "/:@ ") {
+			errs = append(errs, fmt.Errorf("preview_hosts entry %q must be a host name", host))
+		}
+	}
+	if cfg.Attachments.Dir != "" && cfg.Attachments.S3.Bucket != "" {
+		errs = append(errs, errors.New("attachments.dir and attachments.s3.bucket cannot both be set"))
+	}
+	if cfg.Attachments.S3.Bucket != "" && cfg.Attachments.S3.Endpoint == "" {
+		errs = append(errs, errors.New("attachments.s3.endpoint must not be empty"))
+	}
+	if cfg.Attachments.MaxSize <= 0 {
+		errs = append(errs, errors.New("attachments.max_size must be positive"))
+	}
+	if cfg.RateLimit.Rate < 0 {
+		errs = append(errs, errors.New("rate_limit.rate must not be negative"))
+	}
+	if cfg.RateLimit.Burst < 0 {
+		errs = append(errs, errors.New("rate_limit.burst must not be negative"))
+	}
+	if cfg.BotRateLimit.Rate < 0 {
+		errs = append(errs, errors.New("bot_rate_limit.rate must not be negative"))
+	}
+	if cfg.BotRateLimit.Burst < 0 {
+		errs = append(errs, errors.New("bot_rate_limit.burst must not be negative"))
+	}
+	if cfg.Filter.Mode != "mask" && cfg.Filter.Mode != "reject" {
+		errs = append(errs, fmt.Errorf("filter.mode must be mask or reject, not %q", cfg.Filter.Mode))
+	}
+	if cfg.Spam.RepeatLimit < 0 || cfg.Spam.MaxMentions < 0 || cfg.Spam.MaxLinks < 0 {
+		errs = append(errs, errors.New("spam limits must not be negative"))
+	}
+	if cfg.Spam.RepeatWindow < 0 || cfg.Spam.LinkWindow < 0 || cfg.Spam.MuteFor < 0 {
+		errs = append(errs, errors.New("spam durations must not be negative"))
+	}
+	if m := cfg.Matrix; m.Homeserver != "" {
+		if u, err := url.Parse(m.Homeserver); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("matrix.homeserver %q must be an http or https URL", m.Homeserver))
+		}
+		if m.Domain == "" {
+			errs = append(errs, errors.New("matrix.homeserver requires matrix.domain"))
+		}
+		if m.ASToken == "" || m.HSToken == "" {
+			errs = append(errs, errors.New("matrix.homeserver requires matrix.as_token and matrix.hs_token"))
+		}
+		if len(m.Rooms) == 0 {
+			errs = append(errs, errors.New("matrix.rooms must map at least one room"))
+		}
+	}
+	tokens := make(map[string]bool)
+	for i, b := range cfg.WebhookBridges {
+		if b.Room == "" {
+			errs = append(errs, fmt.Errorf("webhook_bridges[%d].room must not be empty", i))
+		}
+		if b.Format != chatserver.BridgeSlack && b.Format != chatserver.BridgeDiscord {
+			errs = append(errs, fmt.Errorf("webhook_bridges[%d].format must be slack or discord, not %q", i, b.Format))
+		}
+		if b.URL == "" && b.Token == "" {
+			errs = append(errs, fmt.Errorf("webhook_bridges[%d] needs a url, a token or both", i))
+		}
+		if u, err := url.Parse(b.URL); b.URL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			errs = append(errs, fmt.Errorf("webhook_bridges[%d].url must be an http or https URL", i))
+		}
+		if b.Token != "" && len(b.Token) < 16 {
+			errs = append(errs, fmt.Errorf("webhook_bridges[%d].token must be at least 16 characters", i))
+		}
+		if tokens[b.Token] {
+			errs = append(errs, fmt.Errorf("webhook_bridges[%d].token is used by another bridge", i))
+		}
+		if b.Token != "" {
+			tokens[b.Token] = true
+		}
+	}
+	for i, b := range cfg.Telegram.Bridges {
+		if b.Room == "" || b.ChatID == 0 {
+			errs = append(errs, fmt.Errorf("telegram.bridges[%d] needs a room and a chat_id", i))
+		}
+		if b.Token == "" && cfg.Telegram.Token == "" {
+			errs = append(errs, fmt.Errorf("telegram.bridges[%d] needs a token, or telegram.token must be set", i))
+		}
+	}
+	if u, err := url.Parse(cfg.Telegram.APIURL); cfg.Telegram.APIURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		errs = append(errs, errors.New("telegram.api_url must be an http or https URL"))
+	}
+	for _, path := range cfg.Plugins {
+		if info, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("plugins: %w", err))
+		} else if info.IsDir() || info.Mode()&0111 == 0 {
+			errs = append(errs, fmt.Errorf("plugins: %s is not an executable file", path))
+		}
+	}
+	if cfg.Scripts.Dir != "" {
+		if info, err := os.Stat(cfg.Scripts.Dir); err != nil {
+			errs = append(errs, fmt.Errorf("scripts.dir: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("scripts.dir: %s is not a directory", cfg.Scripts.Dir))
+		}
+	}
+	if cfg.Scripts.Timeout <= 0 {
+		errs = append(errs, errors.New("scripts.timeout must be positive"))
+	}
+	if fed := cfg.Federation; fed.Name != "" || len(fed.Peers) > 0 {
+		if fed.Name == "" || strings.ContainsAny(fed.Name, " \t@/") {
+			errs = append(errs, errors.New("federation.name must be set, without spaces, @ or /"))
+		}
+		seen := make(map[string]bool)
+		for i, p := range fed.Peers {
+			if p.Name == "" || strings.ContainsAny(p.Name, " \t@/") || p.Name == fed.Name || seen[p.Name] {
+				errs = append(errs, fmt.Errorf("federation.peers[%d] needs a name of its own, without spaces, @ or /", i))
+			}
+			seen[p.Name] = true
+			if len(p.Secret) < 16 {
+				errs = append(errs, fmt.Errorf("federation.peers[%d].secret must be at least 16 characters", i))
+			}
+			if u, err := url.Parse(p.URL); p.URL != "" && (err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "") {
+				errs = append(errs, fmt.Errorf("federation.peers[%d].url must be a ws or wss URL", i))
+			}
+			if len(p.Rooms) == 0 {
+				errs = append(errs, fmt.Errorf("federation.peers[%d] shares no rooms", i))
+			}
+		}
+	}
+	if a := cfg.Assistant; a.APIURL != "" {
+		if u, err := url.Parse(a.APIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("assistant.api_url must be an http or https URL"))
+		}
+		if a.Model == "" {
+			errs = append(errs, errors.New("assistant.model is required when assistant.api_url is set"))
+		}
+		if a.Name == "" || strings.ContainsAny(a.Name, " \t@") {
+			errs = append(errs, errors.New("assistant.name must be a single word"))
+		}
+		if a.Context <= 0 || a.MaxTokens < 0 || a.DailyTokens < 0 || a.RoomDailyTokens < 0 {
+			errs = append(errs, errors.New("assistant.context must be positive, and max_tokens and the daily token budgets not negative"))
+		}
+		if a.RateLimit.Rate < 0 || a.RateLimit.Burst < 0 {
+			errs = append(errs, errors.New("assistant.rate_limit must not be negative"))
+		}
+		if a.Timeout <= 0 {
+			errs = append(errs, errors.New("assistant.timeout must be positive"))
+		}
+	}
+	switch t := cfg.Translation; t.Provider {
+	case "":
+	case "deepl", "libretranslate":
+		if t.APIURL != "" {
+			if u, err := url.Parse(t.APIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, errors.New("translation.api_url must be an http or https URL"))
+			}
+		} else if t.Provider == "libretranslate" {
+			errs = append(errs, errors.New("translation.api_url is required for libretranslate"))
+		}
+		if t.Provider == "deepl" && t.APIKey == "" {
+			errs = append(errs, errors.New("translation.api_key is required for deepl"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("translation.provider must be deepl or libretranslate, not %q", t.Provider))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format must be text or json, not %q", cfg.Log.Format))
+	}
+	if cfg.Log.Output == "" {
+		errs = append(errs, errors.New("log.output must not be empty"))
+	}
+	return errors.Join(errs...)
+}
+
+// logger builds the logger described by cfg.Log. The returned function
+// closes its output.
+func (cfg *Config) logger() (*slog.Logger, func() error, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		return nil, nil, err
+	}
+
+	var out io.Writer
+	closeOut := func() error { return nil }
+	switch cfg.Log.Output {
+	case "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(cfg.Log.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		out, closeOut = f, f.Close
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Log.Format == "json" {
+		return slog.New(slog.NewJSONHandler(out, opts)), closeOut, nil
+	}
+	return slog.New(slog.NewTextHandler(out, opts)), closeOut, nil
+}
+
+// trustedProxies parses TrustedProxies.
+func (cfg *Config) trustedProxies() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cfg.TrustedProxies))
+	for _, s := range cfg.TrustedProxies {
+		prefix, err := chatserver.ParseIPPrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// filterWords returns the configured filter words, including those read
+// from Filter.WordsFile. Blank lines and lines starting with # are skipped.
+func (cfg *Config) filterWords() ([]string, error) {
+	words := slices.Clone(cfg.Filter.Words)
+	if cfg.Filter.WordsFile == "" {
+		return words, nil
+	}
+	data, err := os.ReadFile(cfg.Filter.WordsFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, nil
+}
+
+// attachmentStore opens the store uploads are kept in: the S3 bucket if
+// one is set, otherwise the directory.
+func (cfg *Config) attachmentStore() (chatserver.AttachmentStore, error) {
+	if s3 := cfg.Attachments.S3; s3.Bucket != "" {
+		return chatserver.OpenS3AttachmentStore(chatserver.S3Config{
+			Endpoint:  s3.Endpoint,
+			Bucket:    s3.Bucket,
+			Region:    s3.Region,
+			AccessKey: s3.AccessKey,
+			SecretKey: s3.SecretKey,
+			Insecure:  s3.Insecure,
+		})
+	}
+	return chatserver.NewDirAttachmentStore(cfg.Attachments.Dir)
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// splitMap splits a comma-separated list of name=value pairs.
+func splitMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, item := range splitList(s) {
+		name, value, ok := strings.Cut(item, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("%q is not name=value", item)
+		}
+		m[name] = value
+	}
+	return m, nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cli-chat-app/pkg/chatserver"
+)
+
+// consoleCommand is one operator command available on the server's stdin.
+type consoleCommand struct {
+	usage string
+	help  string
+	// minArgs is the number of arguments the command needs.
+	minArgs int
+	run     func(c *console, args []string, rest string)
+}
+
+type console struct {
+	srv      *chatserver.Server
+	out      io.Writer
+	commands map[string]consoleCommand
+}
+
+func newConsole(srv *chatserver.Server, out io.Writer) *console {
+	c := &console{srv: srv, out: out}
+	c.commands = map[string]consoleCommand{
+		"help": {
+			usage: "/help",
+			help:  "list commands",
+			run:   (*console).help,
+		},
+		"rooms": {
+			usage: "/rooms",
+			help:  "list rooms with member and online counts",
+			run:   (*console).rooms,
+		},
+		"users": {
+			usage: "/users",
+			help:  "list signed-in users",
+			run:   (*console).users,
+		},
+		"kick": {
+			usage:   "/kick <user> [reason]",
+			help:    "sign a user out and close their connection",
+			minArgs: 1,
+			run:     (*console).kick,
+		},
+		"resettoken": {
+			usage:   "/resettoken <user>",
+			help:    "make a one-time token that lets a user set a new password",
+			minArgs: 1,
+			run:     (*console).resetToken,
+		},
+		"broadcast": {
+			usage:   "/broadcast <room> <text>",
+			help:    "send a server message to a room",
+			minArgs: 2,
+			run:     (*console).broadcast,
+		},
+		"export": {
+			usage:   "/export <room> <json|csv> <file>",
+			help:    "write a room's history to a file",
+			minArgs: 3,
+			run:     (*console).export,
+		},
+		"banip": {
+			usage:   "/banip <ip|cidr> [reason]",
+			help:    "refuse connections from an address or range",
+			minArgs: 1,
+			run:     (*console).banIP,
+		},
+		"unbanip": {
+			usage:   "/unbanip <ip|cidr>",
+			help:    "lift an address ban",
+			minArgs: 1,
+			run:     (*console).unbanIP,
+		},
+		"listbans": {
+			usage: "/listbans",
+			help:  "list banned addresses",
+			run:   (*console).listBans,
+		},
+		"permanent": {
+			usage:   "/permanent <room> <on|off>",
+			help:    "exempt a room from removal when it stands empty",
+			minArgs: 2,
+			run:     (*console).permanent,
+		},
+		"audit": {
+			usage: "/audit [n]",
+			help:  "show the last n moderation and admin actions (default 20)",
+			run:   (*console).audit,
+		},
+		"cluster": {
+			usage: "/cluster",
+			help:  "list the cluster's instances and the rooms each owns",
+			run:   (*console).cluster,
+		},
+		"stats": {
+			usage: "/stats",
+			help:  "show connection and room counts",
+			run:   (*console).stats,
+		},
+	}
+	return c
+}
+
+// run reads commands from in until it is exhausted.
+func (c *console) run(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		c.exec(scanner.Text())
+	}
+}
+
+func (c *console) exec(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if !strings.HasPrefix(line, "/") {
+		c.printf("commands start with /, try /help\n")
+		return
+	}
+
+	name, rest, _ := strings.Cut(line[1:], " ")
+	rest = strings.TrimSpace(rest)
+	args := strings.Fields(rest)
+
+	cmd, ok := c.commands[name]
+	if !ok {
+		c.printf("unknown command /%s, try /help\n", name)
+		return
+	}
+	if len(args) < cmd.minArgs {
+		c.printf("usage: %s\n", cmd.usage)
+		return
+	}
+	cmd.run(c, args, rest)
+}
+
+func (c *console) printf(format string, args ...any) {
+	fmt.Fprintf(c.out, format, args...)
+}
+
+func (c *console) help(args []string, rest string) {
+	names := make([]string, 0, len(c.commands))
+	for name := range c.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cmd := c.commands[name]
+		c.printf("  %-26s %s\n", cmd.usage, cmd.help)
+	}
+}
+
+func (c *console) rooms(args []string, rest string) {
+	rooms := c.srv.Rooms()
+	if len(rooms) == 0 {
+		c.printf("no rooms\n")
+		return
+	}
+	for _, r := range rooms {
+		var flags []string
+		if r.Private {
+			flags = append(flags, "private")
+		}
+		if r.Protected {
+			flags = append(flags, "password")
+		}
+		if r.Permanent {
+			flags = append(flags, "permanent")
+		}
+		if r.Archived {
+			flags = append(flags, "archived")
+		}
+		c.printf("  %-20s %3d members %3d online  owner=%s %s\n", r.Name, r.Members, r.Online, r.Owner, strings.Join(flags, ","))
+	}
+}
+
+func (c *console) cluster(args []string, rest string) {
+	nodes := c.srv.ClusterNodes()
+	if nodes == nil {
+		c.printf("cluster mode is off\n")
+		return
+	}
+	for _, n := range nodes {
+		self := ""
+		if n.Self {
+			self = "  (this instance)"
+		}
+		c.printf("  %-20s %3d rooms  id=%s%s\n", n.Name, n.Rooms, n.ID, self)
+	}
+}
+
+func (c *console) users(args []string, rest string) {
+	users := c.srv.OnlineUsers()
+	if len(users) == 0 {
+		c.printf("no users signed in\n")
+		return
+	}
+	for _, name := range users {
+		c.printf("  %s\n", name)
+	}
+}
+
+func (c *console) kick(args []string, rest string) {
+	reason := strings.TrimSpace(strings.TrimPrefix(rest, args[0]))
+	if reason == "" {
+		reason = "Disconnected by the server operator"
+	}
+	if !c.srv.Kick(args[0], reason) {
+		c.printf("%s is not signed in\n", args[0])
+		return
+	}
+	c.printf("kicked %s\n", args[0])
+}
+
+func (c *console) resetToken(args []string, rest string) {
+	token, expires, err := c.srv.CreateResetToken(args[0], "console")
+	if err != nil {
+		c.printf("reset token: %v\n", err)
+		return
+	}
+	c.printf("reset token for %s, good until %s:\n  %s\n", args[0], expires.Local().Format(time.DateTime), token)
+}
+
+func (c *console) broadcast(args []string, rest string) {
+	text := strings.TrimSpace(strings.TrimPrefix(rest, args[0]))
+	if err := c.srv.Announce(args[0], text); err != nil {
+		c.printf("error: %v\n", err)
+	}
+}
+
+func (c *console) export(args []string, rest string) {
+	room, format, path := args[0], args[1], args[2]
+	f, err := os.Create(path)
+	if err != nil {
+		c.printf("error: %v\n", err)
+		return
+	}
+	err = c.srv.ExportHistory(f, room, format)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		c.printf("error: %v\n", err)
+		return
+	}
+	c.printf("exported %s to %s\n", room, path)
+}
+
+func (c *console) stats(args []string, rest string) {
+	st := c.srv.Stats()
+	c.printf("  connections: %d\n  signed in:   %d\n  rooms:       %d\n  uptime:      %s\n",
+		st.Connections, st.SignedIn, st.Rooms, st.Uptime.Round(time.Second))
+}
+
+func (c *console) banIP(args []string, rest string) {
+	prefix, err := chatserver.ParseIPPrefix(args[0])
+	if err != nil {
+		c.printf("error: %v\n", err)
+		return
+	}
+	reason := strings.TrimSpace(strings.TrimPrefix(rest, args[0]))
+	if err := c.srv.BanIP(prefix, reason, "console"); err != nil {
+		c.printf("error: %v\n", err)
+		return
+	}
+	c.printf("banned %s\n", prefix)
+}
+
+func (c *console) unbanIP(args []string, rest string) {
+	prefix, err := chatserver.ParseIPPrefix(args[0])
+	if err != nil {
+		c.printf("error: %v\n", err)
+		return
+	}
+	if err := c.srv.UnbanIP(prefix, "console"); err != nil {
+		c.printf("error: %v\n", err)
+		return
+	}
+	c.printf("unbanned %s\n", prefix)
+}
+
+func (c *console) listBans(args []string, rest string) {
+	bans := c.srv.IPBans()
+	if len(bans) == 0 {
+		c.printf("no banned addresses\n")
+		return
+	}
+	for _, ban := range bans {
+		c.printf("  %-20s %s by %s  %s\n", ban.Prefix, ban.CreatedAt.Local().Format("2006-01-02 15:04"), ban.CreatedBy, ban.Reason)
+	}
+}
+
+func (c *console) permanent(args []string, rest string) {
+	if args[1] != "on" && args[1] != "off" {
+		c.printf("usage: /permanent <room> <on|off>\n")
+		return
+	}
+	if err := c.srv.SetRoomPermanent(args[0], args[1] == "on", "console"); err != nil {
+		c.printf("error: %v\n", err)
+		return
+	}
+	c.printf("%s permanent %s\n", args[0], args[1])
+}
+
+func (c *console) audit(args []string, rest string) {
+	n := 20
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v <= 0 {
+			c.printf("error: %q is not a positive number\n", args[0])
+			return
+		}
+		n = v
+	}
+	entries := c.srv.AuditLog()
+	if len(entries) == 0 {
+		c.printf("no audit entries\n")
+		return
+	}
+	for _, e := range entries[max(0, len(entries)-n):] {
+		c.printf("  %s  %-10s %-14s %-16s %-12s %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Actor, e.Action, e.Target, e.Room, e.Detail)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"cli-chat-app/pkg/chatplugin"
+	"cli-chat-app/pkg/chatserver"
+)
+
+func main() {
+	cfg := defaultConfig()
+	configPath := flag.String("config", "", "YAML configuration file; environment variables and flags override it")
+	flag.StringVar(&cfg.Addr, "addr", cfg.Addr, "listen address")
+	flag.StringVar(&cfg.GRPCAddr, "grpc-addr", cfg.GRPCAddr, "address to serve the gRPC API on; off if empty")
+	flag.StringVar(&cfg.LineAddr, "line-addr", cfg.LineAddr, "plain TCP address for netcat and telnet users; off if empty, and unencrypted")
+	flag.StringVar(&cfg.Database, "database", cfg.Database, "SQLite file accounts are stored in")
+	flag.StringVar(&cfg.HistoryDir, "history-dir", cfg.HistoryDir, "directory room history files are written to")
+	flag.BoolVar(&cfg.HistoryFiles, "history-files", cfg.HistoryFiles, "write room history to files and replay it at startup")
+	flag.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "TLS certificate file; enables wss://")
+	flag.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "TLS private key file")
+	flag.StringVar(&cfg.TLS.HTTPRedirect, "http-redirect", cfg.TLS.HTTPRedirect, "plain HTTP address that redirects to the TLS listener")
+	flag.StringVar(&cfg.TLS.Bots.Addr, "bot-addr", cfg.TLS.Bots.Addr, "TLS address where bots sign in with a client certificate")
+	flag.StringVar(&cfg.TLS.Bots.ClientCA, "bot-client-ca", cfg.TLS.Bots.ClientCA, "CA certificate file bot client certificates must be signed by")
+	flag.Func("bot-accounts", "comma-separated certificate-name=account pairs for the bot listener", func(v string) error {
+		accounts, err := splitMap(v)
+		if err != nil {
+			return err
+		}
+		cfg.TLS.Bots.Accounts = accounts
+		return nil
+	})
+	flag.DurationVar(&cfg.Session.TTL, "session-ttl", cfg.Session.TTL, "how long session tokens stay valid")
+	flag.Func("admins", "comma-separated usernames with admin privileges", func(v string) error {
+		cfg.Admins = splitList(v)
+		return nil
+	})
+	flag.DurationVar(&cfg.Retention.MaxAge, "retain-age", cfg.Retention.MaxAge, "delete room messages older than this; 0 keeps them forever")
+	flag.IntVar(&cfg.Retention.MaxMessages, "retain-messages", cfg.Retention.MaxMessages, "keep at most this many messages per room; 0 for no limit")
+	flag.DurationVar(&cfg.EmptyRooms.IdleFor, "empty-room-idle", cfg.EmptyRooms.IdleFor, "archive or delete rooms with no members or messages for this long; 0 keeps them")
+	flag.StringVar(&cfg.EmptyRooms.Action, "empty-room-action", cfg.EmptyRooms.Action, "what to do with long-empty rooms: archive or delete")
+	flag.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", cfg.MaxConnsPerIP, "WebSocket connections allowed from one address; 0 for no limit")
+	flag.Func("trusted-proxies", "comma-separated addresses or CIDRs of proxies whose X-Forwarded-For is trusted", func(v string) error {
+		cfg.TrustedProxies = splitList(v)
+		return nil
+	})
+	flag.Func("allowed-origins", "comma-separated host patterns, such as *.example.com, of other sites whose pages may connect", func(v string) error {
+		cfg.AllowedOrigins = splitList(v)
+		return nil
+	})
+	flag.BoolVar(&cfg.AllowAnyOrigin, "allow-any-origin", cfg.AllowAnyOrigin, "let web pages from any site connect; for development")
+	flag.Func("preview-hosts", "comma-separated hosts whose pages are fetched to preview links in messages", func(v string) error {
+		cfg.PreviewHosts = splitList(v)
+		return nil
+	})
+	flag.DurationVar(&cfg.Keepalive.PingInterval, "ping-interval", cfg.Keepalive.PingInterval, "how often clients are pinged")
+	flag.DurationVar(&cfg.Keepalive.PongTimeout, "pong-timeout", cfg.Keepalive.PongTimeout, "close connections silent for this long")
+	flag.DurationVar(&cfg.Keepalive.WriteTimeout, "write-timeout", cfg.Keepalive.WriteTimeout, "how long a write to a client may take")
+	flag.DurationVar(&cfg.Keepalive.IdleTimeout, "idle-timeout", cfg.Keepalive.IdleTimeout, "close connections that send no messages for this long; 0 keeps them open")
+	flag.BoolVar(&cfg.Compression.Enabled, "compression", cfg.Compression.Enabled, "negotiate per-message deflate compression with clients")
+	flag.IntVar(&cfg.Compression.Threshold, "compression-threshold", cfg.Compression.Threshold, "compress messages of at least this many bytes")
+	flag.IntVar(&cfg.MaxContentLength, "max-content-length", cfg.MaxContentLength, "longest message, in characters, accepted from clients")
+	flag.BoolVar(&cfg.ExpandEmoji, "expand-emoji", cfg.ExpandEmoji, "replace :shortcode: emoji in messages with the emoji")
+	flag.IntVar(&cfg.MaxFileSize, "max-file-size", cfg.MaxFileSize, "largest file, in bytes, that can be shared in rooms allowing it; 0 turns file sharing off")
+	flag.StringVar(&cfg.Attachments.Dir, "attachment-dir", cfg.Attachments.Dir, "directory files uploaded to /upload are kept in; enables uploads")
+	flag.StringVar(&cfg.Attachments.S3.Bucket, "s3-bucket", cfg.Attachments.S3.Bucket, "S3 bucket files uploaded to /upload are kept in, instead of a directory")
+	flag.StringVar(&cfg.Attachments.S3.Endpoint, "s3-endpoint", cfg.Attachments.S3.Endpoint, "host of the S3 or S3-compatible service holding the bucket")
+	flag.IntVar(&cfg.Attachments.MaxSize, "attachment-max-size", cfg.Attachments.MaxSize, "largest file, in bytes, that can be uploaded")
+	flag.Float64Var(&cfg.RateLimit.Rate, "rate-limit", cfg.RateLimit.Rate, "messages per second each user may send to a room; 0 for no limit")
+	flag.IntVar(&cfg.RateLimit.Burst, "rate-burst", cfg.RateLimit.Burst, "messages each user may send at once before the rate limit applies")
+	flag.Float64Var(&cfg.BotRateLimit.Rate, "bot-rate-limit", cfg.BotRateLimit.Rate, "messages per second each bot may send; 0 for no limit")
+	flag.IntVar(&cfg.BotRateLimit.Burst, "bot-rate-burst", cfg.BotRateLimit.Burst, "messages each bot may send at once before the bot rate limit applies")
+	flag.StringVar(&cfg.Filter.WordsFile, "filter-words", cfg.Filter.WordsFile, "file of words, one per line, to filter from room messages")
+	flag.StringVar(&cfg.Filter.Mode, "filter-mode", cfg.Filter.Mode, "what to do with filtered words: mask or reject")
+	flag.IntVar(&cfg.Spam.RepeatLimit, "spam-repeat-limit", cfg.Spam.RepeatLimit, "identical messages in a row that count as spam; 0 to allow any")
+	flag.DurationVar(&cfg.Spam.RepeatWindow, "spam-repeat-window", cfg.Spam.RepeatWindow, "longest gap between repeated messages that still counts towards the limit")
+	flag.IntVar(&cfg.Spam.MaxMentions, "spam-max-mentions", cfg.Spam.MaxMentions, "most @mentions allowed in one message; 0 for no limit")
+	flag.IntVar(&cfg.Spam.MaxLinks, "spam-max-links", cfg.Spam.MaxLinks, "most links a user may post within the link window; 0 for no limit")
+	flag.DurationVar(&cfg.Spam.LinkWindow, "spam-link-window", cfg.Spam.LinkWindow, "period the link limit applies over")
+	flag.DurationVar(&cfg.Spam.MuteFor, "spam-mute", cfg.Spam.MuteFor, "how long spammers are muted for; 0 disables spam detection")
+	flag.StringVar(&cfg.Postgres, "postgres", cfg.Postgres, "PostgreSQL connection string; stores accounts and messages there instead of the database and history files")
+	flag.DurationVar(&cfg.ShutdownGrace, "shutdown-grace", cfg.ShutdownGrace, "how long clients are given to disconnect when the server shuts down")
+	flag.BoolVar(&cfg.Metrics, "metrics", cfg.Metrics, "serve Prometheus metrics at /metrics")
+	flag.BoolVar(&cfg.Debug, "debug", cfg.Debug, "serve pprof and /debug/stats to admins")
+	flag.StringVar(&cfg.Broker, "broker", cfg.Broker, "redis:// or nats:// URL of a broker for sharing rooms with other instances")
+	flag.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "minimum level logged: debug, info, warn or error")
+	flag.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "log format: text or json")
+	flag.StringVar(&cfg.Log.Output, "log-output", cfg.Log.Output, "where logs go: stderr, stdout or a file path")
+	flag.Parse()
+
+	// The file and environment are applied over the defaults, then the
+	// flags are parsed again so those given explicitly win.
+	if *configPath != "" {
+		if err := cfg.load(*configPath); err != nil {
+			fatal("load config", err)
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		fatal("load config", err)
+	}
+	flag.CommandLine.Parse(os.Args[1:])
+	if err := cfg.validate(); err != nil {
+		fatal("invalid config", err)
+	}
+
+	logger, closeLog, err := cfg.logger()
+	if err != nil {
+		fatal("open log", err)
+	}
+	defer closeLog()
+	slog.SetDefault(logger)
+
+	proxies, _ := cfg.trustedProxies()
+	opts := []chatserver.Option{
+		chatserver.WithAddr(cfg.Addr),
+		chatserver.WithLogger(logger),
+		chatserver.WithMetrics(cfg.Metrics),
+		chatserver.WithDebugEndpoints(cfg.Debug),
+		chatserver.WithSessionTTL(cfg.Session.TTL),
+		chatserver.WithShutdownGrace(cfg.ShutdownGrace),
+		chatserver.WithKeepalive(chatserver.Keepalive{
+			PingInterval: cfg.Keepalive.PingInterval,
+			PongTimeout:  cfg.Keepalive.PongTimeout,
+			WriteTimeout: cfg.Keepalive.WriteTimeout,
+			IdleTimeout:  cfg.Keepalive.IdleTimeout,
+		}),
+		chatserver.WithMaxConnsPerIP(cfg.MaxConnsPerIP),
+		chatserver.WithTrustedProxies(proxies...),
+		chatserver.WithAllowedOrigins(cfg.AllowedOrigins...),
+		chatserver.WithAnyOrigin(cfg.AllowAnyOrigin),
+		chatserver.WithLinkPreviews(cfg.PreviewHosts),
+		chatserver.WithMaxContentLength(cfg.MaxContentLength),
+		chatserver.WithMaxFileSize(int64(cfg.MaxFileSize)),
+		chatserver.WithEmojiShortcodes(cfg.ExpandEmoji),
+		chatserver.WithMaxAttachmentSize(int64(cfg.Attachments.MaxSize)),
+		chatserver.WithRateLimit(chatserver.RateLimit{Rate: cfg.RateLimit.Rate, Burst: cfg.RateLimit.Burst}),
+		chatserver.WithBotRateLimit(chatserver.RateLimit{Rate: cfg.BotRateLimit.Rate, Burst: cfg.BotRateLimit.Burst}),
+		chatserver.WithSpamPolicy(chatserver.SpamPolicy{
+			RepeatLimit:  cfg.Spam.RepeatLimit,
+			RepeatWindow: cfg.Spam.RepeatWindow,
+			MaxMentions:  cfg.Spam.MaxMentions,
+			MaxLinks:     cfg.Spam.MaxLinks,
+			LinkWindow:   cfg.Spam.LinkWindow,
+			MuteFor:      cfg.Spam.MuteFor,
+		}),
+		chatserver.WithRetention(chatserver.RetentionPolicy{MaxAge: cfg.Retention.MaxAge, MaxMessages: cfg.Retention.MaxMessages}),
+		chatserver.WithEmptyRoomPolicy(chatserver.EmptyRoomPolicy{IdleFor: cfg.EmptyRooms.IdleFor, Action: cfg.EmptyRooms.Action}),
+	}
+	if cfg.Compression.Enabled {
+		opts = append(opts, chatserver.WithCompression(cfg.Compression.Threshold))
+	}
+	if cfg.Postgres != "" {
+		store, err := chatserver.OpenPostgresStore(cfg.Postgres)
+		if err != nil {
+			fatal("open postgres", err)
+		}
+		defer store.Close()
+		opts = append(opts,
+			chatserver.WithUserRepository(store),
+			chatserver.WithReadMarkerStore(store),
+			chatserver.WithStarStore(store),
+			chatserver.WithKeyStore(store),
+			chatserver.WithIPBanStore(store),
+			chatserver.WithWebhookStore(store),
+			chatserver.WithHookStore(store),
+			chatserver.WithBotStore(store),
+			chatserver.WithRoomStore(store),
+			chatserver.WithScheduleStore(store),
+			chatserver.WithMessageStore(store.MessageStore()),
+			chatserver.WithSearchIndex(store.MessageStore()),
+			chatserver.WithHistoryFiles(false),
+		)
+	} else {
+		store, err := chatserver.OpenSQLiteStore(cfg.Database)
+		if err != nil {
+			fatal("open user database", err)
+		}
+		defer store.Close()
+		opts = append(opts,
+			chatserver.WithUserRepository(store),
+			chatserver.WithReadMarkerStore(store),
+			chatserver.WithStarStore(store),
+			chatserver.WithKeyStore(store),
+			chatserver.WithIPBanStore(store),
+			chatserver.WithWebhookStore(store),
+			chatserver.WithHookStore(store),
+			chatserver.WithBotStore(store),
+			chatserver.WithRoomStore(store),
+			chatserver.WithScheduleStore(store),
+			chatserver.WithSearchIndex(store),
+			chatserver.WithHistoryFiles(cfg.HistoryFiles),
+		)
+		if cfg.HistoryFiles {
+			if err := os.MkdirAll(cfg.HistoryDir, 0755); err != nil {
+				fatal("create history directory", err)
+			}
+			opts = append(opts, chatserver.WithHistoryDir(cfg.HistoryDir))
+		}
+	}
+	words, err := cfg.filterWords()
+	if err != nil {
+		fatal("load filter words", err)
+	}
+	if len(words) > 0 {
+		opts = append(opts, chatserver.WithContentFilter(chatserver.NewWordFilter(words, cfg.Filter.Mode == "reject")))
+	}
+	if len(cfg.Admins) > 0 {
+		opts = append(opts, chatserver.WithAdmins(cfg.Admins...))
+	}
+	if cfg.GRPCAddr != "" {
+		opts = append(opts, chatserver.WithGRPC(cfg.GRPCAddr))
+	}
+	if cfg.LineAddr != "" {
+		opts = append(opts, chatserver.WithLineProtocol(cfg.LineAddr))
+	}
+	if m := cfg.Matrix; m.Homeserver != "" {
+		opts = append(opts, chatserver.WithMatrixBridge(chatserver.MatrixConfig{
+			Homeserver: m.Homeserver,
+			Domain:     m.Domain,
+			ASToken:    m.ASToken,
+			HSToken:    m.HSToken,
+			UserPrefix: m.UserPrefix,
+			Rooms:      m.Rooms,
+		}))
+	}
+	if len(cfg.WebhookBridges) > 0 {
+		bridges := make([]chatserver.WebhookBridge, len(cfg.WebhookBridges))
+		for i, b := range cfg.WebhookBridges {
+			bridges[i] = chatserver.WebhookBridge{Room: b.Room, Format: b.Format, URL: b.URL, Token: b.Token}
+		}
+		opts = append(opts, chatserver.WithWebhookBridges(bridges...))
+	}
+	if len(cfg.Telegram.Bridges) > 0 {
+		bridges := make([]chatserver.TelegramBridge, len(cfg.Telegram.Bridges))
+		for i, b := range cfg.Telegram.Bridges {
+			bridges[i] = chatserver.TelegramBridge{Room: b.Room, ChatID: b.ChatID, Token: b.Token, APIURL: cfg.Telegram.APIURL}
+			if b.Token == "" {
+				bridges[i].Token = cfg.Telegram.Token
+			}
+		}
+		opts = append(opts, chatserver.WithTelegramBridges(bridges...))
+	}
+	for _, path := range cfg.Plugins {
+		p, err := chatplugin.Load(path)
+		if err != nil {
+			fatal("load plugin", err)
+		}
+		defer p.Close()
+		opts = append(opts, chatserver.WithPlugin(p.Name, p))
+	}
+	if cfg.Scripts.Dir != "" {
+		scripts, err := chatserver.LoadScripts(cfg.Scripts.Dir, cfg.Scripts.Timeout)
+		if err != nil {
+			fatal("load scripts", err)
+		}
+		for _, script := range scripts {
+			defer script.Close()
+		}
+		opts = append(opts, chatserver.WithScripts(scripts...))
+	}
+	if fed := cfg.Federation; fed.Name != "" {
+		peers := make([]chatserver.FederationPeer, len(fed.Peers))
+		for i, p := range fed.Peers {
+			peers[i] = chatserver.FederationPeer{Name: p.Name, URL: p.URL, Secret: p.Secret, Rooms: p.Rooms}
+		}
+		opts = append(opts, chatserver.WithFederation(chatserver.Federation{Name: fed.Name, Peers: peers}))
+	}
+	if a := cfg.Assistant; a.APIURL != "" {
+		opts = append(opts, chatserver.WithAssistant(chatserver.Assistant{
+			Name:            a.Name,
+			APIURL:          a.APIURL,
+			APIKey:          a.APIKey,
+			Model:           a.Model,
+			SystemPrompt:    a.SystemPrompt,
+			Context:         a.Context,
+			MaxTokens:       a.MaxTokens,
+			RateLimit:       chatserver.RateLimit{Rate: a.RateLimit.Rate, Burst: a.RateLimit.Burst},
+			DailyTokens:     a.DailyTokens,
+			RoomDailyTokens: a.RoomDailyTokens,
+			Timeout:         a.Timeout,
+		}))
+	}
+	switch t := cfg.Translation; t.Provider {
+	case "deepl":
+		opts = append(opts, chatserver.WithTranslator(chatserver.DeepLTranslator{APIURL: t.APIURL, APIKey: t.APIKey}))
+	case "libretranslate":
+		opts = append(opts, chatserver.WithTranslator(chatserver.LibreTranslator{APIURL: t.APIURL, APIKey: t.APIKey}))
+	}
+	if cfg.Session.Key != "" {
+		opts = append(opts, chatserver.WithSessionKey([]byte(cfg.Session.Key)))
+	}
+	if cfg.TLS.Cert != "" {
+		opts = append(opts, chatserver.WithTLS(cfg.TLS.Cert, cfg.TLS.Key), chatserver.WithHTTPRedirect(cfg.TLS.HTTPRedirect))
+		if bots := cfg.TLS.Bots; bots.Addr != "" {
+			opts = append(opts, chatserver.WithBotListener(bots.Addr, bots.ClientCA, bots.Accounts))
+		}
+	}
+	if cfg.Attachments.Dir != "" || cfg.Attachments.S3.Bucket != "" {
+		store, err := cfg.attachmentStore()
+		if err != nil {
+			fatal("open attachment store", err)
+		}
+		opts = append(opts, chatserver.WithAttachmentStore(store))
+	}
+	if cfg.Broker != "" {
+		broker, err := openBroker(cfg.Broker)
+		if err != nil {
+			fatal("connect to broker", err)
+		}
+		defer broker.Close()
+		opts = append(opts, chatserver.WithBroker(broker))
+		if cfg.Cluster.Enabled {
+			opts = append(opts, chatserver.WithCluster(chatserver.Cluster{Node: cfg.Cluster.Node, Heartbeat: cfg.Cluster.Heartbeat}))
+		}
+	}
+	srv := chatserver.New(opts...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go newConsole(srv, os.Stdout).run(os.Stdin)
+
+	if err := srv.Run(ctx); err != nil {
+		fatal("serve", err)
+	}
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// openBroker connects to the broker at rawURL, choosing the implementation
+// by its scheme.
+func openBroker(rawURL string) (chatserver.Broker, error) {
+	scheme, _, _ := strings.Cut(rawURL, "://")
+	switch scheme {
+	case "redis", "rediss":
+		return chatserver.NewRedisBroker(context.Background(), rawURL, "chat:events")
+	case "nats", "tls":
+		return chatserver.NewNATSBroker(rawURL, "chat.events")
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", scheme)
+	}
+}
@@ -0,0 +1,412 @@
+// Command simbot runs simulated users against a chat server, for demos and
+// soak tests. Each bot signs up the first time, joins its rooms, creating
+// them if they are missing, and chats on an interval, announcing it is
+// typing first. Now and then it goes offline, signing out or dropping its
+// connection without a word, and comes back later, resuming its session
+// when it still can, so that reconnection, presence and the cleanup after
+// lost connections are exercised all the time.
+//
+// The bots are described in a YAML file given with -config:
+//
+//	bots:
+//	  - name: ada
+//	    password: ada-password
+//	    rooms: [lobby, random]
+//	    lines: ["Morning all", "Has anyone seen the build?"]
+//	    interval: 20s  # between messages, on average
+//	    online: 5m     # before going offline, on average
+//	    offline: 30s   # before coming back, on average
+//	    drop: 0.5      # chance of dropping the connection instead of signing out
+//	    leave: 0.2     # chance of leaving a room before going offline
+//
+// Without one, -bots demo bots chat in the lobby room.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v3"
+
+	"cli-chat-app/pkg/chatserver"
+)
+
+// requestTimeout bounds the wait for the server's answer to a request.
+const requestTimeout = 10 * time.Second
+
+// demoLines are what the demo bots say.
+var demoLines = []string{
+	"Morning all",
+	"Has anyone looked at the build today?",
+	"I'll be in meetings this afternoon",
+	"That's a good point",
+	"Coffee?",
+	"Back in five",
+	"Did the deploy go out?",
+	"Sounds good to me",
+	"Can someone review my change?",
+	"Lunch plans?",
+}
+
+// botConfig describes one bot. Durations are averages; each wait is picked
+// at random between half and one and a half times as long.
+type botConfig struct {
+	Name     string        `yaml:"name"`
+	Password string        `yaml:"password"`
+	Rooms    []string      `yaml:"rooms"`
+	Lines    []string      `yaml:"lines"`
+	Interval time.Duration `yaml:"interval"`
+	Online   time.Duration `yaml:"online"`
+	Offline  time.Duration `yaml:"offline"`
+	// Drop is the chance of dropping the connection when going offline
+	// instead of signing out.
+	Drop float64 `yaml:"drop"`
+	// Leave is the chance of leaving one of the rooms before going offline;
+	// the bot joins it again when it comes back.
+	Leave float64 `yaml:"leave"`
+}
+
+type config struct {
+	Bots []botConfig `yaml:"bots"`
+}
+
+// load reads the YAML file at path. Unknown keys are rejected so typos do
+// not go unnoticed.
+func (cfg *config) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// demo returns n bots chatting in the lobby.
+func demo(n int) config {
+	var cfg config
+	for i := range n {
+		name := fmt.Sprintf("simbot-%d", i+1)
+		cfg.Bots = append(cfg.Bots, botConfig{Name: name, Password: name + "-password", Rooms: []string{"lobby"}})
+	}
+	return cfg
+}
+
+// withDefaults fills in what b leaves out.
+func (b botConfig) withDefaults() botConfig {
+	if b.Password == "" {
+		b.Password = b.Name + "-password"
+	}
+	if len(b.Lines) == 0 {
+		b.Lines = demoLines
+	}
+	if b.Interval <= 0 {
+		b.Interval = 20 * time.Second
+	}
+	if b.Online <= 0 {
+		b.Online = 5 * time.Minute
+	}
+	if b.Offline <= 0 {
+		b.Offline = 30 * time.Second
+	}
+	return b
+}
+
+// jitter picks a duration between half and one and a half times d.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d)
+}
+
+// sleep waits for d, reporting false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func main() {
+	url := flag.String("url", "ws://localhost:8000/ws", "chat server WebSocket URL")
+	configPath := flag.String("config", "", "YAML file describing the bots")
+	bots := flag.Int("bots", 3, "number of demo bots to run without -config")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: simbot [-url ws://host/ws] [-config bots.yaml | -bots n]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg := demo(*bots)
+	if *configPath != "" {
+		cfg = config{}
+		if err := cfg.load(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(cfg.Bots) == 0 {
+		log.Fatal("no bots to run")
+	}
+	for i, b := range cfg.Bots {
+		if b.Name == "" || len(b.Rooms) == 0 {
+			log.Fatalf("bots[%d] needs a name and rooms", i)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("running %d bots against %s", len(cfg.Bots), *url)
+	var wg sync.WaitGroup
+	for _, b := range cfg.Bots {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			(&bot{cfg: b.withDefaults(), url: *url}).run(ctx)
+		}()
+		// Bots arrive one after another rather than all at once.
+		if !sleep(ctx, time.Duration(rand.N(1000))*time.Millisecond) {
+			break
+		}
+	}
+	wg.Wait()
+}
+
+// bot is a simulated user.
+type bot struct {
+	cfg botConfig
+	url string
+	// token is the session token from the last time it signed in.
+	token string
+
+	ws *websocket.Conn
+	mu sync.Mutex
+	// replies passes the server's answers to requests from the reader.
+	replies chan chatserver.Message
+}
+
+func (b *bot) logf(format string, args ...any) {
+	log.Printf("%s: "+format, append([]any{b.cfg.Name}, args...)...)
+}
+
+// run connects the bot, chats until it is time to go offline, and waits to
+// come back, over and over until ctx is done.
+func (b *bot) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		lost, err := b.connect()
+		if err != nil {
+			b.logf("connect: %v", err)
+		} else {
+			b.chat(ctx, lost)
+		}
+		if !sleep(ctx, jitter(b.cfg.Offline)) {
+			return
+		}
+	}
+}
+
+// connect dials the server and signs the bot in, resuming its session if it
+// has one, then joins its rooms. The returned channel is closed when the
+// connection is lost.
+func (b *bot) connect() (<-chan struct{}, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(b.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	b.ws = ws
+	b.replies = make(chan chatserver.Message, 16)
+	lost := make(chan struct{})
+	go b.read(ws, b.replies, lost)
+
+	b.mu.Lock()
+	token := b.token
+	b.mu.Unlock()
+	resumed := false
+	if token != "" {
+		code, err := b.request(chatserver.Message{Type: "resume", Content: token})
+		if err != nil {
+			ws.Close()
+			return nil, err
+		}
+		resumed = code == ""
+	}
+	if !resumed {
+		steps := []struct {
+			msg chatserver.Message
+			ok  string
+		}{
+			{chatserver.Message{Type: "signup", Sender: b.cfg.Name, Content: b.cfg.Password}, chatserver.CodeAlreadyExists},
+			{chatserver.Message{Type: "signin", Sender: b.cfg.Name, Content: b.cfg.Password}, ""},
+		}
+		for _, step := range steps {
+			if err := b.expect(step.msg, step.ok); err != nil {
+				ws.Close()
+				return nil, err
+			}
+		}
+	}
+	for _, room := range b.cfg.Rooms {
+		err := b.expect(chatserver.Message{Type: "create_room", Content: room}, chatserver.CodeAlreadyExists)
+		if err == nil {
+			err = b.expect(chatserver.Message{Type: "join_room", Content: room}, chatserver.CodeAlreadyExists)
+		}
+		if err != nil {
+			ws.Close()
+			return nil, err
+		}
+	}
+	if resumed {
+		b.logf("resumed session")
+	} else {
+		b.logf("signed in")
+	}
+	return lost, nil
+}
+
+// read passes the answers to requests on to replies, keeps the session
+// token, and closes lost when the connection is.
+func (b *bot) read(ws *websocket.Conn, replies chan<- chatserver.Message, lost chan<- struct{}) {
+	defer close(lost)
+	for {
+		var msg chatserver.Message
+		if err := ws.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch {
+		case msg.Type == "session":
+			b.mu.Lock()
+			b.token = msg.Content
+			b.mu.Unlock()
+		case msg.ID != "" && (msg.Type == "info" || msg.Type == "error"):
+			select {
+			case replies <- msg:
+			default:
+			}
+		case msg.Type == "error":
+			b.logf("error: %s", msg.Content)
+		}
+	}
+}
+
+func (b *bot) send(msg chatserver.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ws.SetWriteDeadline(time.Now().Add(requestTimeout))
+	return b.ws.WriteJSON(msg)
+}
+
+// request sends msg and waits for the server's answer, returning the code
+// of the error it answered with, if it did. Answers to earlier requests,
+// such as the rooms rejoined on signing in, are skipped.
+func (b *bot) request(msg chatserver.Message) (string, error) {
+	msg.ID = msg.Type
+	if err := b.send(msg); err != nil {
+		return "", err
+	}
+	timeout := time.After(requestTimeout)
+	for {
+		select {
+		case reply := <-b.replies:
+			if reply.ID != msg.ID {
+				continue
+			}
+			return reply.Code, nil
+		case <-timeout:
+			return "", fmt.Errorf("%s: no answer", msg.Type)
+		}
+	}
+}
+
+// expect sends msg, taking an error answer as a failure unless its code is
+// ok.
+func (b *bot) expect(msg chatserver.Message, ok string) error {
+	code, err := b.request(msg)
+	if err == nil && code != "" && code != ok {
+		err = fmt.Errorf("%s: server answered %s", msg.Type, code)
+	}
+	return err
+}
+
+// chat posts lines to the bot's rooms until it is time to go offline, ctx
+// is done or the connection is lost.
+func (b *bot) chat(ctx context.Context, lost <-chan struct{}) {
+	offline := time.NewTimer(jitter(b.cfg.Online))
+	defer offline.Stop()
+	for {
+		next := time.NewTimer(jitter(b.cfg.Interval))
+		select {
+		case <-ctx.Done():
+			next.Stop()
+			b.send(chatserver.Message{Type: "signout"})
+			b.ws.Close()
+			return
+		case <-lost:
+			next.Stop()
+			b.logf("connection lost")
+			return
+		case <-offline.C:
+			next.Stop()
+			b.goOffline()
+			return
+		case <-next.C:
+			if err := b.say(ctx); err != nil {
+				b.logf("send: %v", err)
+				b.ws.Close()
+				return
+			}
+		}
+	}
+}
+
+// say posts a line to one of the bot's rooms, after typing it for a moment.
+func (b *bot) say(ctx context.Context) error {
+	room := b.cfg.Rooms[rand.N(len(b.cfg.Rooms))]
+	line := b.cfg.Lines[rand.N(len(b.cfg.Lines))]
+	if err := b.send(chatserver.Message{Type: "typing", Room: room}); err != nil {
+		return err
+	}
+	if !sleep(ctx, time.Second+time.Duration(rand.N(2000))*time.Millisecond) {
+		return nil
+	}
+	return b.send(chatserver.Message{Type: "broadcast", Room: room, Content: line})
+}
+
+// goOffline leaves a room now and then, and then signs out or drops the
+// connection.
+func (b *bot) goOffline() {
+	if rand.Float64() < b.cfg.Leave {
+		room := b.cfg.Rooms[rand.N(len(b.cfg.Rooms))]
+		if err := b.expect(chatserver.Message{Type: "leave_room", Content: room}, ""); err == nil {
+			b.logf("left %s", room)
+		}
+	}
+	if rand.Float64() < b.cfg.Drop {
+		b.logf("dropping the connection")
+	} else {
+		b.send(chatserver.Message{Type: "signout"})
+		b.mu.Lock()
+		b.token = ""
+		b.mu.Unlock()
+		b.logf("signed out")
+	}
+	if err := b.ws.Close(); err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		b.logf("close: %v", err)
+	}
+}
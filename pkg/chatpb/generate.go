@@ -0,0 +1,5 @@
+// Package chatpb holds the gRPC service definition of the chat server and
+// the code generated from it.
+package chatpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chat.proto
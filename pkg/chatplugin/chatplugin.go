@@ -0,0 +1,263 @@
+// Package chatplugin lets programs extend the chat server without changing
+// it. A plugin is a separate binary that implements Plugin and calls Serve
+// from its main function; the server starts each configured plugin at
+// startup with Load and talks to it over gRPC through hashicorp/go-plugin.
+//
+// A minimal plugin:
+//
+//	type shout struct{ chatplugin.Base }
+//
+//	func (shout) Commands(ctx context.Context) ([]chatplugin.CommandInfo, error) {
+//		return []chatplugin.CommandInfo{{Name: "shout", Usage: "<text>", Help: "Say something loudly"}}, nil
+//	}
+//
+//	func (shout) OnCommand(ctx context.Context, cmd chatplugin.Command) (chatplugin.Reply, error) {
+//		if cmd.Name != "shout" {
+//			return chatplugin.Reply{}, nil
+//		}
+//		return chatplugin.Reply{Handled: true, Content: strings.ToUpper(cmd.Args), Broadcast: true}, nil
+//	}
+//
+//	func main() { chatplugin.Serve(shout{}) }
+package chatplugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	goplugin "github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+
+	"cli-chat-app/pkg/pluginpb"
+)
+
+// Message is a room message about to be posted.
+type Message struct {
+	Room    string
+	Sender  string
+	Content string
+	// Format is plain or markdown.
+	Format string
+}
+
+// Join is a user about to join a room.
+type Join struct {
+	Room string
+	User string
+}
+
+// Command is a room message starting with a slash: "/Name Args".
+type Command struct {
+	Room   string
+	Sender string
+	Name   string
+	Args   string
+}
+
+// CommandInfo describes a command a plugin answers. Usage shows its
+// arguments, such as "<text>", and Help says what it does in a line.
+type CommandInfo struct {
+	Name  string
+	Usage string
+	Help  string
+}
+
+// Verdict is a plugin's decision on a message or join. Reject refuses it,
+// telling the user Reason. Content, if set, replaces a message's content.
+type Verdict struct {
+	Reject  bool
+	Reason  string
+	Content string
+}
+
+// Reply answers a command. Handled is false if the plugin does not know the
+// command. Content is sent to the command's sender, or posted to the room
+// if Broadcast is set.
+type Reply struct {
+	Handled   bool
+	Content   string
+	Broadcast bool
+}
+
+// Plugin is what a plugin implements. The server calls it for every room
+// message, join and command, so the calls should be quick; one that takes
+// too long or fails is ignored. Commands is called once, when the server
+// starts, and the commands it lists are shown in /help; commands it does not
+// list are still offered to OnCommand if no one else answers them. Embed
+// Base to implement only some of them.
+type Plugin interface {
+	OnMessage(ctx context.Context, msg Message) (Verdict, error)
+	OnJoin(ctx context.Context, join Join) (Verdict, error)
+	OnCommand(ctx context.Context, cmd Command) (Reply, error)
+	Commands(ctx context.Context) ([]CommandInfo, error)
+}
+
+// Base accepts every message and join and handles no command.
+type Base struct{}
+
+func (Base) OnMessage(context.Context, Message) (Verdict, error) { return Verdict{}, nil }
+func (Base) OnJoin(context.Context, Join) (Verdict, error)       { return Verdict{}, nil }
+func (Base) OnCommand(context.Context, Command) (Reply, error)   { return Reply{}, nil }
+func (Base) Commands(context.Context) ([]CommandInfo, error)     { return nil, nil }
+
+// handshake keeps the server from starting binaries that are not plugins,
+// and plugins from being run by hand.
+var handshake = goplugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "CHAT_PLUGIN",
+	MagicCookieValue: "f3b1c9a2e8d74b6a",
+}
+
+// pluginName is the name the plugin is dispensed under.
+const pluginName = "chat"
+
+// Serve serves p to the chat server that started this process. It returns
+// when the server stops the plugin.
+func Serve(p Plugin) {
+	goplugin.Serve(&goplugin.ServeConfig{
+		HandshakeConfig: handshake,
+		Plugins:         goplugin.PluginSet{pluginName: &grpcPlugin{impl: p}},
+		GRPCServer:      goplugin.DefaultGRPCServer,
+	})
+}
+
+// Client is a started plugin.
+type Client struct {
+	Plugin
+	// Name is the plugin's file name, without any extension.
+	Name   string
+	client *goplugin.Client
+}
+
+// Load starts the plugin binary at path. Its log output is written to the
+// server's standard error.
+func Load(path string) (*Client, error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	client := goplugin.NewClient(&goplugin.ClientConfig{
+		HandshakeConfig:  handshake,
+		Plugins:          goplugin.PluginSet{pluginName: &grpcPlugin{}},
+		Cmd:              exec.Command(path),
+		AllowedProtocols: []goplugin.Protocol{goplugin.ProtocolGRPC},
+		Logger:           hclog.New(&hclog.LoggerOptions{Name: "plugin." + name, Output: os.Stderr, Level: hclog.Info}),
+	})
+	rpc, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return nil, fmt.Errorf("start plugin %s: %w", path, err)
+	}
+	raw, err := rpc.Dispense(pluginName)
+	if err != nil {
+		client.Kill()
+		return nil, fmt.Errorf("start plugin %s: %w", path, err)
+	}
+	return &Client{Plugin: raw.(Plugin), Name: name, client: client}, nil
+}
+
+// Close stops the plugin.
+func (c *Client) Close() {
+	c.client.Kill()
+}
+
+// grpcPlugin carries Plugin over gRPC: impl is served in the plugin, and
+// the server is handed a grpcClient.
+type grpcPlugin struct {
+	goplugin.NetRPCUnsupportedPlugin
+	impl Plugin
+}
+
+func (p *grpcPlugin) GRPCServer(broker *goplugin.GRPCBroker, s *grpc.Server) error {
+	pluginpb.RegisterPluginServer(s, &grpcServer{impl: p.impl})
+	return nil
+}
+
+func (p *grpcPlugin) GRPCClient(ctx context.Context, broker *goplugin.GRPCBroker, conn *grpc.ClientConn) (any, error) {
+	return &grpcClient{client: pluginpb.NewPluginClient(conn)}, nil
+}
+
+// grpcServer serves a Plugin inside the plugin process.
+type grpcServer struct {
+	pluginpb.UnimplementedPluginServer
+	impl Plugin
+}
+
+func (s *grpcServer) OnMessage(ctx context.Context, req *pluginpb.MessageEvent) (*pluginpb.Verdict, error) {
+	v, err := s.impl.OnMessage(ctx, Message{Room: req.Room, Sender: req.Sender, Content: req.Content, Format: req.Format})
+	if err != nil {
+		return nil, err
+	}
+	return &pluginpb.Verdict{Reject: v.Reject, Reason: v.Reason, Content: v.Content}, nil
+}
+
+func (s *grpcServer) OnJoin(ctx context.Context, req *pluginpb.JoinEvent) (*pluginpb.Verdict, error) {
+	v, err := s.impl.OnJoin(ctx, Join{Room: req.Room, User: req.User})
+	if err != nil {
+		return nil, err
+	}
+	return &pluginpb.Verdict{Reject: v.Reject, Reason: v.Reason, Content: v.Content}, nil
+}
+
+func (s *grpcServer) OnCommand(ctx context.Context, req *pluginpb.CommandEvent) (*pluginpb.CommandReply, error) {
+	r, err := s.impl.OnCommand(ctx, Command{Room: req.Room, Sender: req.Sender, Name: req.Name, Args: req.Args})
+	if err != nil {
+		return nil, err
+	}
+	return &pluginpb.CommandReply{Handled: r.Handled, Content: r.Content, Broadcast: r.Broadcast}, nil
+}
+
+func (s *grpcServer) Commands(ctx context.Context, req *pluginpb.CommandsRequest) (*pluginpb.CommandList, error) {
+	cmds, err := s.impl.Commands(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := &pluginpb.CommandList{}
+	for _, cmd := range cmds {
+		list.Commands = append(list.Commands, &pluginpb.CommandInfo{Name: cmd.Name, Usage: cmd.Usage, Help: cmd.Help})
+	}
+	return list, nil
+}
+
+// grpcClient is the server's side of a plugin.
+type grpcClient struct {
+	client pluginpb.PluginClient
+}
+
+func (c *grpcClient) OnMessage(ctx context.Context, msg Message) (Verdict, error) {
+	v, err := c.client.OnMessage(ctx, &pluginpb.MessageEvent{Room: msg.Room, Sender: msg.Sender, Content: msg.Content, Format: msg.Format})
+	if err != nil {
+		return Verdict{}, err
+	}
+	return Verdict{Reject: v.Reject, Reason: v.Reason, Content: v.Content}, nil
+}
+
+func (c *grpcClient) OnJoin(ctx context.Context, join Join) (Verdict, error) {
+	v, err := c.client.OnJoin(ctx, &pluginpb.JoinEvent{Room: join.Room, User: join.User})
+	if err != nil {
+		return Verdict{}, err
+	}
+	return Verdict{Reject: v.Reject, Reason: v.Reason, Content: v.Content}, nil
+}
+
+func (c *grpcClient) OnCommand(ctx context.Context, cmd Command) (Reply, error) {
+	r, err := c.client.OnCommand(ctx, &pluginpb.CommandEvent{Room: cmd.Room, Sender: cmd.Sender, Name: cmd.Name, Args: cmd.Args})
+	if err != nil {
+		return Reply{}, err
+	}
+	return Reply{Handled: r.Handled, Content: r.Content, Broadcast: r.Broadcast}, nil
+}
+
+func (c *grpcClient) Commands(ctx context.Context) ([]CommandInfo, error) {
+	list, err := c.client.Commands(ctx, &pluginpb.CommandsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]CommandInfo, 0, len(list.Commands))
+	for _, cmd := range list.Commands {
+		cmds = append(cmds, CommandInfo{Name: cmd.Name, Usage: cmd.Usage, Help: cmd.Help})
+	}
+	return cmds, nil
+}
@@ -0,0 +1,309 @@
+package chatserver
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AccountInfo describes an account in admin listings.
+type AccountInfo struct {
+	Username  string    `json:"username"`
+	Admin     bool      `json:"admin"`
+	Disabled  bool      `json:"disabled"`
+	Online    bool      `json:"online"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastSeen is shown to admins even if the user hides it.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// isAdmin reports whether username may run admin operations, either because
+// the account is flagged as admin or it was configured with WithAdmins.
+func (s *Server) isAdmin(username string) bool {
+	if s.admins[username] {
+		return true
+	}
+	account, err := s.accounts.Find(username)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			s.logger.Error("find account", "user", username, "err", err)
+		}
+		return false
+	}
+	return account.Admin
+}
+
+// requireAdmin returns the signed-in admin on c, reporting an error to c and
+// returning nil otherwise.
+func (s *Server) requireAdmin(c *Client) *User {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return nil
+	}
+	if !s.isAdmin(user.Username) {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "Admin privileges required"})
+		return nil
+	}
+	return user
+}
+
+// authenticateHTTP returns the user whose session token r carries as a
+// bearer token, answering with an error if there is none or the account is
+// disabled.
+func (s *Server) authenticateHTTP(w http.ResponseWriter, r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if key, ok := strings.CutPrefix(auth, "Bot "); ok {
+		account := s.authenticateBot(key)
+		if account == "" {
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return "", false
+		}
+		return account, true
+	}
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return "", false
+	}
+	return s.authenticateToken(w, token)
+}
+
+// authenticateToken returns the user whose session token it is, answering
+// with an error if it is invalid or the account is disabled.
+func (s *Server) authenticateToken(w http.ResponseWriter, token string) (string, bool) {
+	username, err := s.sessions.Verify(token)
+	if err != nil {
+		s.metrics.authFailure("invalid_session")
+		http.Error(w, "invalid or expired session", http.StatusUnauthorized)
+		return "", false
+	}
+	if account, err := s.accounts.Find(username); err != nil || account.Disabled {
+		http.Error(w, "account disabled", http.StatusForbidden)
+		return "", false
+	}
+	return username, true
+}
+
+// requireAdminHTTP checks that r carries the session token of an enabled
+// admin as a bearer token, answering with an error if it does not.
+func (s *Server) requireAdminHTTP(w http.ResponseWriter, r *http.Request) bool {
+	username, ok := s.authenticateHTTP(w, r)
+	if !ok {
+		return false
+	}
+	if !s.isAdmin(username) {
+		http.Error(w, "admin privileges required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleAdminListUsers(c *Client, msg Message) {
+	if s.requireAdmin(c) == nil {
+		return
+	}
+
+	accounts, err := s.accounts.List()
+	if err != nil {
+		c.reqLogger.Error("list accounts", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not list users"})
+		return
+	}
+
+	infos := make([]AccountInfo, 0, len(accounts))
+	for _, account := range accounts {
+		info := AccountInfo{
+			Username:  account.Username,
+			Admin:     account.Admin || s.admins[account.Username],
+			Disabled:  account.Disabled,
+			Online:    s.isOnline(account.Username),
+			CreatedAt: account.CreatedAt,
+		}
+		if !account.LastSeen.IsZero() {
+			info.LastSeen = &account.LastSeen
+		}
+		infos = append(infos, info)
+	}
+	c.Send(Message{Type: "users", Data: infos})
+}
+
+func (s *Server) handleAdminDisableUser(c *Client, msg Message) {
+	s.setDisabled(c, msg, true)
+}
+
+func (s *Server) handleAdminEnableUser(c *Client, msg Message) {
+	s.setDisabled(c, msg, false)
+}
+
+func (s *Server) setDisabled(c *Client, msg Message, disabled bool) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+
+	account, err := s.accounts.Find(msg.Target)
+	if err != nil {
+		s.sendAccountError(c, err)
+		return
+	}
+	account.Disabled = disabled
+	if err := s.accounts.Update(account); err != nil {
+		s.sendAccountError(c, err)
+		return
+	}
+
+	if disabled {
+		s.ForceSignout(msg.Target, "Your account has been disabled")
+		c.Reply(Message{Type: "info", Content: "User disabled", Target: msg.Target})
+	} else {
+		c.Reply(Message{Type: "info", Content: "User enabled", Target: msg.Target})
+	}
+	action := "enable_user"
+	if disabled {
+		action = "disable_user"
+	}
+	s.audit(AuditEntry{Actor: admin.Username, Action: action, Target: msg.Target})
+}
+
+func (s *Server) handleAdminSignoutUser(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+
+	if !s.ForceSignout(msg.Target, "You were signed out by an administrator") {
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "User is not signed in", Target: msg.Target})
+		return
+	}
+	c.Reply(Message{Type: "info", Content: "User signed out", Target: msg.Target})
+	s.audit(AuditEntry{Actor: admin.Username, Action: "signout_user", Target: msg.Target})
+}
+
+func (s *Server) handleAdminDeleteUser(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	if msg.Target == admin.Username {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "You cannot delete your own account"})
+		return
+	}
+
+	if err := s.accounts.Delete(msg.Target); err != nil {
+		s.sendAccountError(c, err)
+		return
+	}
+
+	s.ForceSignout(msg.Target, "Your account has been deleted")
+
+	s.userLock.Lock()
+	user := s.users[msg.Target]
+	delete(s.users, msg.Target)
+	s.userLock.Unlock()
+
+	if user != nil {
+		s.roomLock.Lock()
+		for name := range user.Rooms {
+			s.removeMemberLocked(name, user)
+		}
+		s.roomLock.Unlock()
+	}
+	s.dms.Drain(msg.Target)
+	if err := s.keys.DeleteKey(msg.Target); err != nil {
+		c.reqLogger.Error("delete public key", "target", msg.Target, "err", err)
+	}
+	if err := s.forgetBot(msg.Target); err != nil {
+		c.reqLogger.Error("delete bot", "target", msg.Target, "err", err)
+	}
+
+	c.Reply(Message{Type: "info", Content: "User deleted", Target: msg.Target})
+	s.audit(AuditEntry{Actor: admin.Username, Action: "delete_user", Target: msg.Target})
+}
+
+func (s *Server) sendAccountError(c *Client, err error) {
+	if errors.Is(err, ErrUserNotFound) {
+		c.Reply(Message{Type: "error", Code: CodeUserNotFound, Content: "User does not exist"})
+		return
+	}
+	c.reqLogger.Error("update account", "err", err)
+	c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Account update failed"})
+}
+
+// ForceSignout signs username out of every connection it has, and revokes
+// all of its session tokens. The connections stay open so the clients can
+// be told why. It reports whether the user was connected.
+func (s *Server) ForceSignout(username, reason string) bool {
+	s.sessions.RevokeUser(username)
+	return len(s.signoutConnections(username, reason, nil)) > 0
+}
+
+// signoutConnections signs username out of each of its connections but
+// keep, which may be nil, telling them why, and returns them.
+func (s *Server) signoutConnections(username, reason string, keep *Client) []*Client {
+	s.userLock.Lock()
+	user := s.users[username]
+	s.userLock.Unlock()
+	if user == nil {
+		return nil
+	}
+
+	var signedOut []*Client
+	offline := false
+	s.clientLock.Lock()
+	for _, c := range user.connections() {
+		if c == keep {
+			continue
+		}
+		if user.removeConn(c) {
+			offline = true
+		}
+		delete(s.clients, c)
+		c.session = ""
+		signedOut = append(signedOut, c)
+	}
+	s.clientLock.Unlock()
+
+	if offline {
+		s.announcePresence(user, false)
+		s.recordLastSeen(username)
+		s.dropMemberships(user)
+	}
+	for _, c := range signedOut {
+		c.Send(Message{Type: "signed_out", Content: reason})
+	}
+	return signedOut
+}
+
+// Kick signs username out and closes its connections. It reports whether
+// the user was connected.
+func (s *Server) Kick(username, reason string) bool {
+	s.sessions.RevokeUser(username)
+	signedOut := s.signoutConnections(username, reason, nil)
+	for _, c := range signedOut {
+		c.CloseAfterFlush()
+	}
+	return len(signedOut) > 0
+}
+
+// Announce sends text to every member of room as a message from the server.
+func (s *Server) Announce(room, text string) error {
+	s.roomLock.Lock()
+	_, exists := s.rooms[room]
+	s.roomLock.Unlock()
+	if !exists {
+		return ErrRoomNotFound
+	}
+
+	s.Broadcast(Message{Type: "broadcast", Sender: "server", Room: room, Content: text})
+	return nil
+}
+
+func (s *Server) isOnline(username string) bool {
+	if s.onlineElsewhere(username) {
+		return true
+	}
+
+	return s.onlineUser(username) != nil
+}
@@ -0,0 +1,59 @@
+package chatserver
+
+import "testing"
+
+func TestForceSignoutAllConnections(t *testing.T) {
+	tests := []struct {
+		name    string
+		signout func(s *Server, admin *Client)
+		closed  bool
+	}{
+		{"ForceSignout", func(s *Server, admin *Client) { s.ForceSignout("alice", "bye") }, false},
+		{"Kick", func(s *Server, admin *Client) { s.Kick("alice", "bye") }, true},
+		{"admin_signout_user", func(s *Server, admin *Client) {
+			do(s, admin, Message{Type: "admin_signout_user", Target: "alice"})
+		}, false},
+		{"admin_disable_user", func(s *Server, admin *Client) {
+			do(s, admin, Message{Type: "admin_disable_user", Target: "alice"})
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, WithAdmins("root"))
+			admin := signIn(t, s, "root")
+			// Signing in twice leaves the first connection signed in too.
+			first := signIn(t, s, "alice")
+			second := signIn(t, s, "alice")
+			if s.userOf(first) == nil {
+				t.Fatal("first connection signed out by the second signin")
+			}
+
+			tt.signout(s, admin)
+
+			for i, c := range []*Client{first, second} {
+				if s.userOf(c) != nil {
+					t.Errorf("connection %d still signed in", i+1)
+				}
+				if _, ok := find(drain(c), "signed_out"); !ok {
+					t.Errorf("connection %d not told it was signed out", i+1)
+				}
+				select {
+				case <-c.flush:
+					if !tt.closed {
+						t.Errorf("connection %d closed", i+1)
+					}
+				default:
+					if tt.closed {
+						t.Errorf("connection %d left open", i+1)
+					}
+				}
+				if code := errorCode(do(s, c, Message{Type: "create_room", Content: "general"})); code != CodeUnauthenticated {
+					t.Errorf("connection %d: create_room answered %q, want %q", i+1, code, CodeUnauthenticated)
+				}
+			}
+			if s.isOnline("alice") {
+				t.Error("alice still online")
+			}
+		})
+	}
+}
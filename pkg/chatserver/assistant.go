@@ -0,0 +1,314 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The assistant is a bot backed by a language model behind an
+// OpenAI-compatible chat completions API. It answers room messages that
+// @mention it, in rooms whose moderators turned it on with set_assistant,
+// replying to the message with the room's recent history as context. Each
+// user's questions are rate limited, and the tokens the API reports using
+// are counted against daily budgets for the server and for each room.
+
+// BridgeAssistant is the Bridge of the assistant's messages.
+const BridgeAssistant = "assistant"
+
+const (
+	// DefaultAssistantName is the name the assistant answers to by default.
+	DefaultAssistantName = "assistant"
+	// DefaultAssistantContext is how many room messages it is shown by
+	// default.
+	DefaultAssistantContext = 20
+	// DefaultAssistantTimeout bounds each API call by default.
+	DefaultAssistantTimeout = 60 * time.Second
+)
+
+// Assistant configures the assistant bot. APIURL is the API's base URL,
+// such as https://api.openai.com/v1, to which /chat/completions is added.
+type Assistant struct {
+	// Name is the name it posts as and answers to when @mentioned.
+	Name         string
+	APIURL       string
+	APIKey       string
+	Model        string
+	SystemPrompt string
+	// Context is how many of the room's latest messages it is shown.
+	Context int
+	// MaxTokens caps the length of each answer; zero leaves it to the API.
+	MaxTokens int
+	// RateLimit limits how often each user may ask it something.
+	RateLimit RateLimit
+	// DailyTokens and RoomDailyTokens cap the tokens used each UTC day, in
+	// all and in each room; zero does not cap them.
+	DailyTokens     int
+	RoomDailyTokens int
+	Timeout         time.Duration
+}
+
+// assistantBot is the state of the assistant.
+type assistantBot struct {
+	cfg    Assistant
+	client *http.Client
+	queue  chan Message
+	limits *rateLimiter
+
+	// The tokens used on day, in all and by room, guarded by mu.
+	mu       sync.Mutex
+	day      string
+	used     int
+	roomUsed map[string]int
+}
+
+func newAssistantBot(cfg Assistant) *assistantBot {
+	if cfg.Name == "" {
+		cfg.Name = DefaultAssistantName
+	}
+	if cfg.Context <= 0 {
+		cfg.Context = DefaultAssistantContext
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultAssistantTimeout
+	}
+	cfg.APIURL = strings.TrimSuffix(cfg.APIURL, "/")
+	return &assistantBot{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		queue:    make(chan Message, bridgeQueueSize),
+		limits:   newRateLimiter(),
+		roomUsed: make(map[string]int),
+	}
+}
+
+// enqueue queues msg to be answered if it mentions the assistant. It
+// reports false if the queue is full.
+func (a *assistantBot) enqueue(msg Message) bool {
+	if msg.Bridge == BridgeAssistant || msg.Deleted || !a.mentioned(msg.Content) {
+		return true
+	}
+	select {
+	case a.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *assistantBot) mentioned(content string) bool {
+	for _, name := range parseMentions(content) {
+		if strings.EqualFold(name, a.cfg.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// budgetLeft reports whether room has tokens left today.
+func (a *assistantBot) budgetLeft(room string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rollOverLocked(now)
+	if a.cfg.DailyTokens > 0 && a.used >= a.cfg.DailyTokens {
+		return false
+	}
+	return a.cfg.RoomDailyTokens <= 0 || a.roomUsed[room] < a.cfg.RoomDailyTokens
+}
+
+// spend counts tokens used in room.
+func (a *assistantBot) spend(room string, tokens int, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rollOverLocked(now)
+	a.used += tokens
+	a.roomUsed[room] += tokens
+}
+
+// rollOverLocked starts the counts afresh on a new day. The caller must
+// hold mu.
+func (a *assistantBot) rollOverLocked(now time.Time) {
+	day := now.UTC().Format(time.DateOnly)
+	if day != a.day {
+		a.day, a.used = day, 0
+		clear(a.roomUsed)
+	}
+}
+
+// chatCompletionMessage, chatCompletionRequest and chatCompletionResponse
+// hold the fields of the chat completions API the assistant uses.
+type chatCompletionMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatCompletionRequest struct {
+	Model     string                  `json:"model"`
+	Messages  []chatCompletionMessage `json:"messages"`
+	MaxTokens int                     `json:"max_tokens,omitempty"`
+}
+
+type chatCompletionResponse struct {
+	Choices []struct {
+		Message chatCompletionMessage `json:"message"`
+	} `json:"choices"`
+	Usage struct {
+		TotalTokens int `json:"total_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// complete asks the API to continue messages, returning the answer and the
+// tokens used.
+func (a *assistantBot) complete(ctx context.Context, messages []chatCompletionMessage) (string, int, error) {
+	data, err := json.Marshal(chatCompletionRequest{Model: a.cfg.Model, Messages: messages, MaxTokens: a.cfg.MaxTokens})
+	if err != nil {
+		return "", 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.APIURL+"/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+a.cfg.APIKey)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	var reply chatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", 0, fmt.Errorf("chat completions: %s", resp.Status)
+	}
+	if reply.Error != nil {
+		return "", 0, fmt.Errorf("chat completions: %s", reply.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("chat completions: %s", resp.Status)
+	}
+	if len(reply.Choices) == 0 {
+		return "", reply.Usage.TotalTokens, errors.New("chat completions: no choices")
+	}
+	return strings.TrimSpace(reply.Choices[0].Message.Content), reply.Usage.TotalTokens, nil
+}
+
+// runAssistant answers the messages queued for the assistant, one at a
+// time, until ctx is done.
+func (s *Server) runAssistant(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-s.assistant.queue:
+			s.answerAssistant(ctx, msg)
+		}
+	}
+}
+
+// answerAssistant has the assistant answer msg, which mentions it, or tells
+// the sender why it will not.
+func (s *Server) answerAssistant(ctx context.Context, msg Message) {
+	a := s.assistant
+	refuse := func(code, content string) {
+		s.sendTo(msg.Sender, Message{Type: "error", Code: code, Content: content, Room: msg.Room, MessageID: msg.MessageID})
+	}
+
+	s.roomLock.Lock()
+	room, ok := s.rooms[msg.Room]
+	enabled := ok && room.AssistantEnabled
+	s.roomLock.Unlock()
+	if !enabled {
+		refuse(CodeDisabled, "The assistant is turned off in this room")
+		return
+	}
+	now := time.Now()
+	if wait, ok := a.limits.allow(msg.Sender, "", a.cfg.RateLimit, now); !ok {
+		refuse(CodeRateLimited, fmt.Sprintf("You are asking the assistant too often; try again in %s", wait.Round(time.Second)))
+		return
+	}
+	if !a.budgetLeft(msg.Room, now) {
+		refuse(CodeLimitExceeded, "The assistant has used up its budget for today")
+		return
+	}
+
+	history, err := s.messages.Page(msg.Room, msg.Seq+1, a.cfg.Context)
+	if err != nil {
+		s.logger.Error("load messages", "room", msg.Room, "err", err)
+		return
+	}
+	messages := make([]chatCompletionMessage, 0, len(history)+2)
+	if a.cfg.SystemPrompt != "" {
+		messages = append(messages, chatCompletionMessage{Role: "system", Content: a.cfg.SystemPrompt})
+	}
+	for _, m := range history {
+		switch {
+		case m.Deleted || m.Content == "":
+		case m.Bridge == BridgeAssistant:
+			messages = append(messages, chatCompletionMessage{Role: "assistant", Content: m.Content})
+		default:
+			messages = append(messages, chatCompletionMessage{Role: "user", Content: m.Sender + ": " + m.Content})
+		}
+	}
+	if len(history) == 0 || history[len(history)-1].MessageID != msg.MessageID {
+		messages = append(messages, chatCompletionMessage{Role: "user", Content: msg.Sender + ": " + msg.Content})
+	}
+
+	answer, tokens, err := a.complete(ctx, messages)
+	a.spend(msg.Room, tokens, time.Now())
+	if err != nil {
+		s.logger.Warn("ask assistant", "room", msg.Room, "message_id", msg.MessageID, "err", err)
+		refuse(CodeInternal, "The assistant could not answer")
+		return
+	}
+	if answer == "" {
+		return
+	}
+	if utf8.RuneCountInString(answer) > s.maxContent {
+		answer = string([]rune(answer)[:s.maxContent-1]) + "…"
+	}
+	if _, err := s.relay(Message{Room: msg.Room, Sender: a.cfg.Name, Bridge: BridgeAssistant, Content: answer, ReplyTo: msg.MessageID}); err != nil {
+		s.logger.Warn("post assistant answer", "room", msg.Room, "err", err)
+	}
+}
+
+// handleSetAssistant lets a moderator turn the assistant on or off for the
+// room. It is off until turned on.
+func (s *Server) handleSetAssistant(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if s.assistant == nil {
+		c.Reply(Message{Type: "error", Code: CodeDisabled, Content: "The server has no assistant", Room: msg.Room})
+		return
+	}
+	if msg.Content != "on" && msg.Content != "off" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Assistant must be on or off", Room: msg.Room})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+
+	room.AssistantEnabled = msg.Content == "on"
+	s.saveRoomLocked(room)
+	s.fanoutLocked(room, Message{Type: "assistant", Sender: user.Username, Room: room.Name, Content: msg.Content})
+}
@@ -0,0 +1,345 @@
+package chatserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// defaultMaxAttachmentSize is the default limit on an uploaded file, in
+	// bytes.
+	defaultMaxAttachmentSize = 10 << 20
+	// maxAttachments caps how many attachments one message can carry.
+	maxAttachments = 10
+)
+
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrAttachmentTooLarge = errors.New("attachment too large")
+)
+
+// Attachment describes a file uploaded to POST /upload. Messages refer to
+// attachments by ID; the server fills in the rest when it sends them on.
+type Attachment struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Uploader string `json:"uploader,omitempty"`
+	// Room is the room the file was uploaded for. Only its members can
+	// fetch it, and it can only be attached to messages there.
+	Room      string    `json:"room,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	// URL is where the file is served, relative to the server.
+	URL string `json:"url,omitempty"`
+}
+
+// AttachmentStore keeps uploaded files.
+type AttachmentStore interface {
+	// Put stores the contents of r as the file described by a, failing
+	// with ErrAttachmentTooLarge, and storing nothing, if r yields more
+	// than a.Size bytes. a.Size is then updated to the size stored.
+	Put(ctx context.Context, a *Attachment, r io.Reader) error
+	// Get opens the attachment with the given ID; the caller closes it.
+	Get(ctx context.Context, id string) (Attachment, io.ReadCloser, error)
+	Stat(ctx context.Context, id string) (Attachment, error)
+}
+
+func newAttachmentID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validAttachmentID reports whether id could have come from
+// newAttachmentID, so it is safe to use in file names and object keys.
+func validAttachmentID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// limitedReader fails with ErrAttachmentTooLarge once more than n bytes
+// have been read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrAttachmentTooLarge
+	}
+	return n, err
+}
+
+// DirAttachmentStore keeps attachments as files in a directory, each beside
+// a JSON file describing it.
+type DirAttachmentStore struct {
+	dir string
+}
+
+// NewDirAttachmentStore stores attachments in dir, creating it if needed.
+func NewDirAttachmentStore(dir string) (*DirAttachmentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirAttachmentStore{dir: dir}, nil
+}
+
+func (d *DirAttachmentStore) Put(ctx context.Context, a *Attachment, r io.Reader) error {
+	tmp, err := os.CreateTemp(d.dir, a.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, &limitedReader{r: r, n: a.Size})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	a.Size = n
+
+	meta, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(d.dir, a.ID+".json"), meta, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(d.dir, a.ID))
+}
+
+func (d *DirAttachmentStore) Get(ctx context.Context, id string) (Attachment, io.ReadCloser, error) {
+	a, err := d.Stat(ctx, id)
+	if err != nil {
+		return a, nil, err
+	}
+	f, err := os.Open(filepath.Join(d.dir, id))
+	if errors.Is(err, os.ErrNotExist) {
+		err = ErrAttachmentNotFound
+	}
+	return a, f, err
+}
+
+func (d *DirAttachmentStore) Stat(ctx context.Context, id string) (Attachment, error) {
+	var a Attachment
+	if !validAttachmentID(id) {
+		return a, ErrAttachmentNotFound
+	}
+	meta, err := os.ReadFile(filepath.Join(d.dir, id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return a, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return a, err
+	}
+	err = json.Unmarshal(meta, &a)
+	return a, err
+}
+
+// attachmentURL is where the attachment with the given ID is served.
+func attachmentURL(id string) string {
+	return "/files/" + id
+}
+
+// handleUpload stores the file sent as the "file" part of a multipart form
+// for the room named by the room query parameter, which the user must be
+// in, and answers with its Attachment as JSON. It needs a session token as
+// a bearer token.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := s.authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		http.Error(w, "room is required", http.StatusBadRequest)
+		return
+	}
+	if !s.inRoom(username, room) {
+		http.Error(w, "you are not in that room", http.StatusForbidden)
+		return
+	}
+
+	// The form around the file adds a little to the body.
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxAttachmentSize+64<<10)
+	form, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "body must be multipart/form-data", http.StatusBadRequest)
+		return
+	}
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			http.Error(w, `form has no "file" part`, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "could not read form", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		s.storeAttachment(w, r, username, room, part.FileName(), part.Header.Get("Content-Type"), part)
+		return
+	}
+}
+
+func (s *Server) storeAttachment(w http.ResponseWriter, r *http.Request, username, room, name, contentType string, body io.Reader) {
+	name = filepath.Base(name)
+	if name == "." || name == string(filepath.Separator) || utf8.RuneCountInString(name) > maxFileName {
+		http.Error(w, fmt.Sprintf("file needs a name of at most %d characters", maxFileName), http.StatusBadRequest)
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	} else {
+		contentType = "application/octet-stream"
+	}
+
+	id, err := newAttachmentID()
+	if err != nil {
+		s.logger.Error("generate attachment id", "err", err)
+		http.Error(w, "could not store file", http.StatusInternalServerError)
+		return
+	}
+	a := Attachment{
+		ID:        id,
+		Name:      name,
+		Type:      contentType,
+		Size:      s.maxAttachmentSize,
+		Uploader:  username,
+		Room:      room,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.attachments.Put(r.Context(), &a, body); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.Is(err, ErrAttachmentTooLarge) || errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("files must be at most %d bytes", s.maxAttachmentSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.logger.Error("store attachment", "user", username, "err", err)
+		http.Error(w, "could not store file", http.StatusInternalServerError)
+		return
+	}
+	a.URL = attachmentURL(a.ID)
+	s.logger.Info("attachment uploaded", "user", username, "id", a.ID, "size", a.Size)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", a.URL)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// handleFile serves the attachment named by the path under /files/ to a
+// member of the room it was uploaded for. Files uploaded before rooms were
+// recorded are served to their uploader only.
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := s.authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+
+	a, body, err := s.attachments.Get(r.Context(), strings.TrimPrefix(r.URL.Path, "/files/"))
+	if err != nil {
+		if errors.Is(err, ErrAttachmentNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		s.logger.Error("load attachment", "err", err)
+		http.Error(w, "could not load file", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+	allowed := a.Uploader == username
+	if a.Room != "" {
+		allowed = s.inRoom(username, a.Room)
+	}
+	// Those who may not see the file are not told it exists.
+	if !allowed {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", a.Type)
+	w.Header().Set("Content-Length", fmt.Sprint(a.Size))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, body)
+}
+
+// resolveAttachments replaces the attachments msg refers to with their
+// stored details, replying to c and reporting false if any is missing or
+// was not uploaded by user for msg.Room.
+func (s *Server) resolveAttachments(c *Client, user *User, msg *Message) bool {
+	if len(msg.Attachments) == 0 {
+		return true
+	}
+	if s.attachments == nil {
+		c.Reply(Message{Type: "error", Code: CodeDisabled, Content: "Attachments are not enabled on this server", Room: msg.Room})
+		return false
+	}
+	if len(msg.Attachments) > maxAttachments {
+		c.Reply(Message{Type: "error", Code: CodeLimitExceeded, Content: fmt.Sprintf("A message can have at most %d attachments", maxAttachments), Room: msg.Room})
+		return false
+	}
+
+	resolved := make([]Attachment, 0, len(msg.Attachments))
+	for _, ref := range msg.Attachments {
+		a, err := s.attachments.Stat(context.Background(), ref.ID)
+		if err != nil || a.Uploader != user.Username || a.Room != msg.Room {
+			if err != nil && !errors.Is(err, ErrAttachmentNotFound) {
+				c.reqLogger.Error("load attachment", "id", ref.ID, "err", err)
+			}
+			c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Attachment " + ref.ID + " not found", Room: msg.Room})
+			return false
+		}
+		a.URL = attachmentURL(a.ID)
+		resolved = append(resolved, a)
+	}
+	msg.Attachments = resolved
+	return true
+}
+
+// inRoom reports whether username is in room.
+func (s *Server) inRoom(username, room string) bool {
+	user := s.loadUser(username)
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	return user.Rooms[room]
+}
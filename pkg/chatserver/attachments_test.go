@@ -0,0 +1,118 @@
+package chatserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// upload posts content to /upload for room as the user signed in on c,
+// returning the response.
+func upload(t *testing.T, s *Server, c *Client, room, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload?"+url.Values{"room": {room}}.Encode(), &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+c.session)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestAttachmentAccess(t *testing.T) {
+	store, err := NewDirAttachmentStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, WithAttachmentStore(store))
+	alice := signIn(t, s, "alice")
+	bob := signIn(t, s, "bob")
+	carol := signIn(t, s, "carol")
+	mustDo(t, s, alice, Message{Type: "create_room", Content: "general"})
+	mustDo(t, s, alice, Message{Type: "create_room", Content: "random"})
+	for _, join := range []struct {
+		c    *Client
+		room string
+	}{{alice, "general"}, {bob, "general"}, {alice, "random"}, {carol, "random"}} {
+		mustDo(t, s, join.c, Message{Type: "join_room", Content: join.room})
+	}
+
+	uploads := []struct {
+		name       string
+		by         *Client
+		room       string
+		wantStatus int
+	}{
+		{"member", alice, "general", http.StatusCreated},
+		{"no room", alice, "", http.StatusBadRequest},
+		{"not a member", carol, "general", http.StatusForbidden},
+	}
+	for _, tt := range uploads {
+		t.Run("upload "+tt.name, func(t *testing.T) {
+			if w := upload(t, s, tt.by, tt.room, "secret"); w.Code != tt.wantStatus {
+				t.Errorf("upload answered %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+
+	w := upload(t, s, alice, "general", "secret")
+	var a Attachment
+	if err := json.NewDecoder(w.Body).Decode(&a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Room != "general" {
+		t.Errorf("attachment room = %q, want general", a.Room)
+	}
+
+	fetches := []struct {
+		name       string
+		by         *Client
+		wantStatus int
+	}{
+		{"uploader", alice, http.StatusOK},
+		{"member", bob, http.StatusOK},
+		{"not a member", carol, http.StatusNotFound},
+	}
+	for _, tt := range fetches {
+		t.Run("fetch by "+tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, a.URL, nil)
+			r.Header.Set("Authorization", "Bearer "+tt.by.session)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("fetch answered %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.String() != "secret" {
+				t.Errorf("fetched %q, want %q", w.Body, "secret")
+			}
+		})
+	}
+
+	posts := []struct {
+		room     string
+		wantCode string
+	}{
+		{"general", ""},
+		{"random", CodeNotFound},
+	}
+	for _, tt := range posts {
+		t.Run("attach in "+tt.room, func(t *testing.T) {
+			msgs := do(s, alice, Message{Type: "broadcast", Room: tt.room, Content: "see this", Attachments: []Attachment{{ID: a.ID}}})
+			if code := errorCode(msgs); code != tt.wantCode {
+				t.Errorf("broadcast answered %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+}
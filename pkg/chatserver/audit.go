@@ -0,0 +1,49 @@
+package chatserver
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// auditSize is how many audit entries are kept.
+const auditSize = 1000
+
+// AuditEntry records a moderation or administrative action, whether taken
+// by a person or automatically by the server.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Actor is the username that acted, or "server" for automatic
+	// actions and "console" for the operator console.
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"`
+	Room   string `json:"room,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// auditLog keeps the most recent audit entries.
+type auditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+// audit records e, stamped with the current time, and logs it.
+func (s *Server) audit(e AuditEntry) {
+	e.Time = time.Now().UTC()
+	s.logger.Info("audit", "actor", e.Actor, "action", e.Action, "target", e.Target, "room", e.Room, "detail", e.Detail)
+
+	s.auditLog.mu.Lock()
+	defer s.auditLog.mu.Unlock()
+	if len(s.auditLog.entries) == auditSize {
+		s.auditLog.entries = slices.Delete(s.auditLog.entries, 0, 1)
+	}
+	s.auditLog.entries = append(s.auditLog.entries, e)
+}
+
+// AuditLog returns the recent audit entries, oldest first.
+func (s *Server) AuditLog() []AuditEntry {
+	s.auditLog.mu.Lock()
+	defer s.auditLog.mu.Unlock()
+	return slices.Clone(s.auditLog.entries)
+}
@@ -0,0 +1,85 @@
+package chatserver
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUserExists         = errors.New("username already exists")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrAccountDisabled    = errors.New("account is disabled")
+)
+
+// CredentialStore registers and verifies user passwords. Implementations
+// must never keep or compare plaintext passwords.
+type CredentialStore interface {
+	Register(username, password string) error
+	Authenticate(username, password string) error
+}
+
+// PasswordSetter is implemented by credential stores that can change a
+// user's password, which change_password needs. SetPassword records when
+// the password was changed on the account.
+type PasswordSetter interface {
+	SetPassword(username, password string) error
+}
+
+// BcryptStore hashes passwords with bcrypt and keeps the hashes in a
+// UserRepository.
+type BcryptStore struct {
+	repo UserRepository
+	cost int
+}
+
+func NewBcryptStore(repo UserRepository) *BcryptStore {
+	return &BcryptStore{
+		repo: repo,
+		cost: bcrypt.DefaultCost,
+	}
+}
+
+func (s *BcryptStore) Register(username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cost)
+	if err != nil {
+		return err
+	}
+	return s.repo.Create(&Account{Username: username, PasswordHash: hash})
+}
+
+func (s *BcryptStore) SetPassword(username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cost)
+	if err != nil {
+		return err
+	}
+	account, err := s.repo.Find(username)
+	if err != nil {
+		return err
+	}
+	account.PasswordHash = hash
+	account.PasswordChangedAt = time.Now().UTC()
+	return s.repo.Update(account)
+}
+
+func (s *BcryptStore) Authenticate(username, password string) error {
+	account, err := s.repo.Find(username)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			return err
+		}
+		// Compare against a dummy hash so unknown users take as long as known ones.
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+	if account.Disabled {
+		return ErrAccountDisabled
+	}
+	return nil
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
@@ -0,0 +1,106 @@
+package chatserver
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestBcryptStore returns a store hashing at the lowest cost, to keep
+// tests quick.
+func newTestBcryptStore(repo UserRepository) *BcryptStore {
+	store := NewBcryptStore(repo)
+	store.cost = bcrypt.MinCost
+	return store
+}
+
+func TestBcryptStoreAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		disabled bool
+		wantErr  error
+	}{
+		{"right password", "alice", "correct horse", false, nil},
+		{"wrong password", "alice", "battery staple", false, ErrInvalidCredentials},
+		{"unknown user", "bob", "correct horse", false, ErrInvalidCredentials},
+		{"empty password", "alice", "", false, ErrInvalidCredentials},
+		{"disabled", "alice", "correct horse", true, ErrAccountDisabled},
+		{"disabled, wrong password", "alice", "battery staple", true, ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewMemoryUserRepository()
+			store := newTestBcryptStore(repo)
+			if err := store.Register("alice", "correct horse"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.disabled {
+				account, _ := repo.Find("alice")
+				account.Disabled = true
+				repo.Update(account)
+			}
+			if err := store.Authenticate(tt.username, tt.password); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Authenticate = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBcryptStoreRegister(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	store := newTestBcryptStore(repo)
+	if err := store.Register("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Register("alice", "another"); !errors.Is(err, ErrUserExists) {
+		t.Errorf("second Register = %v, want %v", err, ErrUserExists)
+	}
+	account, err := repo.Find("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(account.PasswordHash) == "correct horse" {
+		t.Error("password stored in plain text")
+	}
+	if !account.PasswordChangedAt.IsZero() {
+		t.Error("PasswordChangedAt set on Register")
+	}
+}
+
+func TestBcryptStoreSetPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		wantErr  error
+	}{
+		{"known user", "alice", nil},
+		{"unknown user", "bob", ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewMemoryUserRepository()
+			store := newTestBcryptStore(repo)
+			if err := store.Register("alice", "correct horse"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.SetPassword(tt.username, "battery staple"); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SetPassword = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if err := store.Authenticate("alice", "battery staple"); err != nil {
+				t.Errorf("new password: %v", err)
+			}
+			if err := store.Authenticate("alice", "correct horse"); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("old password: %v, want %v", err, ErrInvalidCredentials)
+			}
+			if account, _ := repo.Find("alice"); account.PasswordChangedAt.IsZero() {
+				t.Error("PasswordChangedAt not set")
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+package chatserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Bot accounts are accounts for programs. Admins create them with scopes
+// and optionally a list of rooms, and the bot connects with the API key it
+// is given instead of signing in with a password: the key is sent as
+// "Authorization: Bot <key>" when opening the WebSocket connection or with
+// each REST request. Requests outside the bot's scopes or rooms are
+// refused, and bots have their own rate limit instead of the rooms'. Only a
+// hash of the key is kept, so it is shown just once.
+
+var ErrBotNotFound = errors.New("bot not found")
+
+// The scopes a bot may be given. read covers fetching history and room
+// state, write sending messages and changing anything.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+var botScopes = []string{ScopeRead, ScopeWrite}
+
+// Bot is a bot account and what it may do: Scopes, in Rooms or in any room
+// if Rooms is empty. Key is only set when the bot is created or its key is
+// rotated; KeyHash identifies it afterwards.
+type Bot struct {
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	Rooms     []string  `json:"rooms,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	KeyHash   string    `json:"-"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BotRequest is the Data of an admin_create_bot request.
+type BotRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Rooms  []string `json:"rooms,omitempty"`
+}
+
+// BotStore keeps the bot accounts. SaveBot replaces any bot of the same
+// name.
+type BotStore interface {
+	SaveBot(bot Bot) error
+	DeleteBot(name string) error
+	Bots() ([]Bot, error)
+}
+
+// MemoryBotStore keeps bots in memory.
+type MemoryBotStore struct {
+	mu   sync.Mutex
+	bots map[string]Bot
+}
+
+func NewMemoryBotStore() *MemoryBotStore {
+	return &MemoryBotStore{bots: make(map[string]Bot)}
+}
+
+func (m *MemoryBotStore) SaveBot(bot Bot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bots[bot.Name] = bot
+	return nil
+}
+
+func (m *MemoryBotStore) DeleteBot(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.bots[name]; !ok {
+		return ErrBotNotFound
+	}
+	delete(m.bots, name)
+	return nil
+}
+
+func (m *MemoryBotStore) Bots() ([]Bot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bots := make([]Bot, 0, len(m.bots))
+	for _, bot := range m.bots {
+		bots = append(bots, bot)
+	}
+	return bots, nil
+}
+
+// botReadTypes are the requests a bot needs the read scope for. Requests
+// not listed here or in botFreeTypes need the write scope.
+var botReadTypes = map[string]bool{
+	"presence_query":   true,
+	"room_members":     true,
+	"list_rooms":       true,
+	"get_pins":         true,
+	"whois":            true,
+	"get_read_markers": true,
+	"read":             true,
+	"list_starred":     true,
+	"list_scheduled":   true,
+	"get_thread":       true,
+	"sync":             true,
+	"history":          true,
+	"search":           true,
+	"get_key":          true,
+}
+
+// botFreeTypes are the requests a bot may make whatever its scopes. A bot
+// limited to some rooms may still only join or create those.
+var botFreeTypes = map[string]bool{
+	"signout":      true,
+	"join_room":    true,
+	"leave_room":   true,
+	"capabilities": true,
+	"hello":        true,
+}
+
+// allows reports whether the bot may make a request of type kind in rooms,
+// and if not, why.
+func (b Bot) allows(kind string, rooms ...string) (string, bool) {
+	switch {
+	case botFreeTypes[kind]:
+	case botReadTypes[kind]:
+		if !slices.Contains(b.Scopes, ScopeRead) {
+			return "Bot lacks the read scope", false
+		}
+	default:
+		if !slices.Contains(b.Scopes, ScopeWrite) {
+			return "Bot lacks the write scope", false
+		}
+	}
+	for _, room := range rooms {
+		if room != "" && len(b.Rooms) > 0 && !slices.Contains(b.Rooms, room) {
+			return "Bot may not use this room", false
+		}
+	}
+	return "", true
+}
+
+// requestRooms returns the rooms msg acts on. Most requests name theirs in
+// Room, but joining and creating one names it in Content, and a forward
+// posts to the room in Target.
+func requestRooms(msg Message) []string {
+	switch msg.Type {
+	case "join_room", "create_room":
+		return []string{msg.Content}
+	case "forward":
+		return []string{msg.Room, msg.Target}
+	}
+	return []string{msg.Room}
+}
+
+// newBotKey returns a new API key and its hash.
+func newBotKey() (key, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = hex.EncodeToString(b)
+	return key, hashBotKey(key), nil
+}
+
+// hashBotKey returns what is kept of a bot's API key.
+func hashBotKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadBots fills the in-memory index of bots from the store.
+func (s *Server) loadBots() {
+	bots, err := s.botStore.Bots()
+	if err != nil {
+		s.logger.Error("load bots", "err", err)
+		return
+	}
+	s.botLock.Lock()
+	for _, bot := range bots {
+		s.botAccounts[bot.Name] = bot
+	}
+	s.botLock.Unlock()
+}
+
+// botOf returns the bot account username is, if it is one.
+func (s *Server) botOf(username string) (Bot, bool) {
+	s.botLock.RLock()
+	defer s.botLock.RUnlock()
+	bot, ok := s.botAccounts[username]
+	return bot, ok
+}
+
+// botByKey returns the bot whose API key key is.
+func (s *Server) botByKey(key string) (Bot, bool) {
+	hash := hashBotKey(key)
+	s.botLock.RLock()
+	defer s.botLock.RUnlock()
+	for _, bot := range s.botAccounts {
+		if bot.KeyHash == hash {
+			return bot, true
+		}
+	}
+	return Bot{}, false
+}
+
+// authenticateBot returns the bot account the API key signs in as, or ""
+// if it is unknown or the account is disabled.
+func (s *Server) authenticateBot(key string) string {
+	bot, ok := s.botByKey(key)
+	if !ok {
+		s.metrics.authFailure("invalid_api_key")
+		return ""
+	}
+	if account, err := s.accounts.Find(bot.Name); err != nil || account.Disabled {
+		s.metrics.authFailure("account_disabled")
+		return ""
+	}
+	return bot.Name
+}
+
+// checkBotScope replies to c with an error and returns false if c is
+// signed in as a bot that may not make msg.
+func (s *Server) checkBotScope(c *Client, msg Message) bool {
+	user := s.userOf(c)
+	if user == nil {
+		return true
+	}
+	bot, ok := s.botOf(user.Username)
+	if !ok {
+		return true
+	}
+	if problem, ok := bot.allows(msg.Type, requestRooms(msg)...); !ok {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: problem, Room: msg.Room})
+		return false
+	}
+	return true
+}
+
+// Bots returns the bot accounts, oldest first.
+func (s *Server) Bots() []Bot {
+	s.botLock.RLock()
+	bots := make([]Bot, 0, len(s.botAccounts))
+	for _, bot := range s.botAccounts {
+		bots = append(bots, bot)
+	}
+	s.botLock.RUnlock()
+
+	slices.SortFunc(bots, func(a, b Bot) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return bots
+}
+
+// CreateBot creates the bot account req describes, returning it with its
+// API key. by names who created it.
+func (s *Server) CreateBot(req BotRequest, by string) (Bot, error) {
+	// The account gets a random password that is never shown, so it can
+	// only be used with the API key.
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		return Bot{}, err
+	}
+	key, hash, err := newBotKey()
+	if err != nil {
+		return Bot{}, err
+	}
+	if err := s.credentials.Register(req.Name, hex.EncodeToString(password)); err != nil {
+		return Bot{}, err
+	}
+	bot := Bot{
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		Rooms:     req.Rooms,
+		KeyHash:   hash,
+		CreatedBy: by,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.botStore.SaveBot(bot); err != nil {
+		if err := s.accounts.Delete(req.Name); err != nil {
+			s.logger.Error("delete account of failed bot", "bot", req.Name, "err", err)
+		}
+		return Bot{}, err
+	}
+
+	s.userLock.Lock()
+	s.users[bot.Name] = newUser(bot.Name)
+	s.userLock.Unlock()
+	s.botLock.Lock()
+	s.botAccounts[bot.Name] = bot
+	s.botLock.Unlock()
+	s.audit(AuditEntry{Actor: by, Action: "create_bot", Target: bot.Name,
+		Detail: fmt.Sprintf("scopes %s", strings.Join(bot.Scopes, ","))})
+	bot.Key = key
+	return bot, nil
+}
+
+// RotateBotKey gives the bot name a new API key, returning the bot with it.
+// The old key and the sessions it opened stop working. by names who rotated
+// it.
+func (s *Server) RotateBotKey(name, by string) (Bot, error) {
+	bot, ok := s.botOf(name)
+	if !ok {
+		return Bot{}, ErrBotNotFound
+	}
+	key, hash, err := newBotKey()
+	if err != nil {
+		return Bot{}, err
+	}
+	bot.KeyHash = hash
+	if err := s.botStore.SaveBot(bot); err != nil {
+		return Bot{}, err
+	}
+
+	s.botLock.Lock()
+	s.botAccounts[name] = bot
+	s.botLock.Unlock()
+	s.ForceSignout(name, "Your API key has been rotated")
+	s.audit(AuditEntry{Actor: by, Action: "rotate_bot_key", Target: name})
+	bot.Key = key
+	return bot, nil
+}
+
+// forgetBot drops the bot record of the account username, which is being
+// deleted, if it is a bot.
+func (s *Server) forgetBot(username string) error {
+	if _, ok := s.botOf(username); !ok {
+		return nil
+	}
+	if err := s.botStore.DeleteBot(username); err != nil && !errors.Is(err, ErrBotNotFound) {
+		return err
+	}
+	s.botLock.Lock()
+	delete(s.botAccounts, username)
+	s.botLock.Unlock()
+	s.dropBotCommands(username)
+	return nil
+}
+
+// checkBotRequest returns what is wrong with req, or "".
+func checkBotRequest(req BotRequest) string {
+	if len(req.Scopes) == 0 {
+		return "Bot needs at least one scope"
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(botScopes, scope) {
+			return fmt.Sprintf("Unknown scope %q; scopes are %s", scope, strings.Join(botScopes, ", "))
+		}
+	}
+	for _, room := range req.Rooms {
+		if room == "" {
+			return "Room names must not be empty"
+		}
+	}
+	return ""
+}
+
+// handleAdminCreateBot creates the bot account described by the BotRequest
+// in msg.Data, answering with it and its API key.
+func (s *Server) handleAdminCreateBot(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	var req BotRequest
+	if err := msg.DecodeData(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Request needs a name and scopes in data"})
+		return
+	}
+	if utf8.RuneCountInString(req.Name) > maxNameLength {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Bot name is too long"})
+		return
+	}
+	if problem := checkBotRequest(req); problem != "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: problem})
+		return
+	}
+	bot, err := s.CreateBot(req, admin.Username)
+	if err != nil {
+		if errors.Is(err, ErrUserExists) {
+			c.Reply(Message{Type: "error", Code: CodeAlreadyExists, Content: "Username already exists", Target: req.Name})
+			return
+		}
+		c.reqLogger.Error("create bot", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not create bot"})
+		return
+	}
+	c.Reply(Message{Type: "bot", Target: bot.Name, Data: bot})
+}
+
+// handleAdminRotateBotKey gives the bot msg.Target a new API key, answering
+// with it.
+func (s *Server) handleAdminRotateBotKey(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	bot, err := s.RotateBotKey(msg.Target, admin.Username)
+	if err != nil {
+		if errors.Is(err, ErrBotNotFound) {
+			c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "No such bot", Target: msg.Target})
+			return
+		}
+		c.reqLogger.Error("rotate bot key", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not rotate key", Target: msg.Target})
+		return
+	}
+	c.Reply(Message{Type: "bot", Target: bot.Name, Data: bot})
+}
+
+func (s *Server) handleAdminListBots(c *Client, msg Message) {
+	if s.requireAdmin(c) == nil {
+		return
+	}
+	c.Reply(Message{Type: "bots", Data: s.Bots()})
+}
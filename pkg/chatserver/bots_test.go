@@ -0,0 +1,45 @@
+package chatserver
+
+import "testing"
+
+func TestCheckBotScope(t *testing.T) {
+	tests := []struct {
+		name  string
+		bot   BotRequest
+		msg   Message
+		allow bool
+	}{
+		{"post to allowed room", BotRequest{Scopes: []string{ScopeWrite}, Rooms: []string{"ops"}}, Message{Type: "broadcast", Room: "ops"}, true},
+		{"post to other room", BotRequest{Scopes: []string{ScopeWrite}, Rooms: []string{"ops"}}, Message{Type: "broadcast", Room: "general"}, false},
+		{"post without write scope", BotRequest{Scopes: []string{ScopeRead}}, Message{Type: "broadcast", Room: "ops"}, false},
+		{"history with read scope", BotRequest{Scopes: []string{ScopeRead}}, Message{Type: "history", Room: "ops"}, true},
+		{"join allowed room", BotRequest{Rooms: []string{"ops"}}, Message{Type: "join_room", Content: "ops"}, true},
+		{"join other room", BotRequest{Rooms: []string{"ops"}}, Message{Type: "join_room", Content: "general"}, false},
+		{"join any room unrestricted", BotRequest{}, Message{Type: "join_room", Content: "general"}, true},
+		{"create other room", BotRequest{Scopes: []string{ScopeWrite}, Rooms: []string{"ops"}}, Message{Type: "create_room", Content: "general"}, false},
+		{"create allowed room", BotRequest{Scopes: []string{ScopeWrite}, Rooms: []string{"ops"}}, Message{Type: "create_room", Content: "ops"}, true},
+		{"forward out of allowed rooms", BotRequest{Scopes: []string{ScopeWrite}, Rooms: []string{"ops"}}, Message{Type: "forward", Room: "ops", Target: "general"}, false},
+		{"forward into allowed room", BotRequest{Scopes: []string{ScopeWrite}, Rooms: []string{"ops"}}, Message{Type: "forward", Room: "general", Target: "ops"}, false},
+		{"forward between allowed rooms", BotRequest{Scopes: []string{ScopeWrite}, Rooms: []string{"ops", "alerts"}}, Message{Type: "forward", Room: "ops", Target: "alerts"}, true},
+		{"leave other room", BotRequest{Rooms: []string{"ops"}}, Message{Type: "leave_room", Content: "general"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			tt.bot.Name = "deploybot"
+			if _, err := s.CreateBot(tt.bot, "test"); err != nil {
+				t.Fatal(err)
+			}
+			c := newTestClient(s)
+			s.signIn(c, "deploybot")
+			drain(c)
+
+			if got := s.checkBotScope(c, tt.msg); got != tt.allow {
+				t.Errorf("checkBotScope = %v, want %v", got, tt.allow)
+			}
+			if msgs := drain(c); !tt.allow && errorCode(msgs) != CodeForbidden {
+				t.Errorf("refusal answered %q, want %q", errorCode(msgs), CodeForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package chatserver
+
+import (
+	"errors"
+	"sync"
+	"unicode/utf8"
+)
+
+// Bridges mirror rooms to other chat networks. Each chat message sent to a
+// room on this instance is handed to them by onRoomMessage, and messages
+// from the other networks are posted to rooms with relay.
+
+const (
+	// bridgeQueueSize is how many room messages may wait for a bridge to
+	// send them before more are dropped.
+	bridgeQueueSize = 256
+	// maxBridgeIDs is how many pairs of message IDs a bridge remembers.
+	maxBridgeIDs = 10000
+)
+
+var ErrRelayTooLong = errors.New("relayed message is too long")
+
+// onRoomMessage hands a chat message just sent to a room to the bridges,
+// including the one that relayed it, which should skip its own, and to the
+// webhooks, and has it translated for members who asked. The caller must
+// hold roomLock; it never blocks.
+func (s *Server) onRoomMessage(msg Message) {
+	s.scheduleTranslationsLocked(msg)
+	s.emitEvent(EventMessagePosted, msg.Room, msg.Sender, &msg)
+	if s.matrix != nil && !s.matrix.enqueue(msg) {
+		s.logger.Warn("matrix queue full, dropping message", "room", msg.Room, "message_id", msg.MessageID)
+	}
+	if s.webhookBridges != nil && !s.webhookBridges.enqueue(msg) {
+		s.logger.Warn("webhook bridge queue full, dropping message", "room", msg.Room, "message_id", msg.MessageID)
+	}
+	if s.telegram != nil && !s.telegram.enqueue(msg) {
+		s.logger.Warn("telegram queue full, dropping message", "room", msg.Room, "message_id", msg.MessageID)
+	}
+	if s.federation != nil && !s.federation.enqueue(msg) {
+		s.logger.Warn("federation queue full, dropping message", "room", msg.Room, "message_id", msg.MessageID)
+	}
+	if s.assistant != nil && !s.assistant.enqueue(msg) {
+		s.logger.Warn("assistant queue full, dropping message", "room", msg.Room, "message_id", msg.MessageID)
+	}
+}
+
+// relay posts a message relayed by a bridge, which has set its Room, Sender
+// and Bridge, and returns it as sent. The room's content filter applies. A
+// reply to a message the room no longer has is posted as a plain message.
+func (s *Server) relay(msg Message) (Message, error) {
+	if utf8.RuneCountInString(msg.Content) > s.maxContent {
+		return msg, ErrRelayTooLong
+	}
+	msg.Type = "broadcast"
+	normalizeFormat(&msg)
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	room, ok := s.rooms[msg.Room]
+	if !ok {
+		return msg, ErrRoomNotFound
+	}
+	if s.filter != nil && !room.FilterDisabled {
+		content, err := s.filter.Filter(msg.Content)
+		if err != nil {
+			return msg, err
+		}
+		msg.Content = content
+	}
+	msg.ThreadID = ""
+	if msg.ReplyTo != "" {
+		parent, err := s.messages.Get(msg.Room, msg.ReplyTo)
+		switch {
+		case err != nil:
+			msg.ReplyTo = ""
+		case parent.ThreadID != "":
+			msg.ThreadID = parent.ThreadID
+		default:
+			msg.ThreadID = parent.MessageID
+		}
+	}
+
+	return s.postToRoomLocked(room, msg), nil
+}
+
+// bridgeIDs pairs the IDs of messages with the IDs of their copies on
+// another network, so that replies can be carried across. It forgets the
+// oldest pairs beyond maxBridgeIDs.
+type bridgeIDs struct {
+	mu       sync.Mutex
+	toRemote map[string]string
+	toLocal  map[string]string
+	// order lists the local IDs, oldest first.
+	order []string
+}
+
+func newBridgeIDs() *bridgeIDs {
+	return &bridgeIDs{toRemote: make(map[string]string), toLocal: make(map[string]string)}
+}
+
+// add records that the message local was copied as remote, or copied from
+// it.
+func (m *bridgeIDs) add(local, remote string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.toRemote[local]; ok {
+		return
+	}
+	m.toRemote[local] = remote
+	m.toLocal[remote] = local
+	m.order = append(m.order, local)
+	if len(m.order) > maxBridgeIDs {
+		oldest := m.order[0]
+		m.order = m.order[1:]
+		delete(m.toLocal, m.toRemote[oldest])
+		delete(m.toRemote, oldest)
+	}
+}
+
+// remote returns the ID of the copy of the message local, or "".
+func (m *bridgeIDs) remote(local string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.toRemote[local]
+}
+
+// local returns the ID of the message copied as remote, or "".
+func (m *bridgeIDs) local(remote string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.toLocal[remote]
+}
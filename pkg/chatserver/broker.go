@@ -0,0 +1,292 @@
+package chatserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Broker carries events between server instances that share rooms, so a
+// message sent on one instance reaches members connected to the others.
+// Payloads are opaque to the broker.
+type Broker interface {
+	Publish(ctx context.Context, payload []byte) error
+	// Subscribe calls handle with every payload published by any instance,
+	// including this one, until ctx is done or the subscription fails.
+	Subscribe(ctx context.Context, handle func(payload []byte)) error
+	Close() error
+}
+
+// Kinds of broker event.
+const (
+	eventRoom        = "room"
+	eventRoomCreated = "room_created"
+	eventPresence    = "presence"
+	eventStatus      = "status"
+	// eventDirect carries a message for one user, such as a direct message
+	// or its delivery receipt, to the instance they are connected to.
+	eventDirect = "direct"
+	// eventNode is an instance's heartbeat in cluster mode, or its
+	// farewell, and eventRoute carries a room message to the instance that
+	// owns the room.
+	eventNode  = "node"
+	eventRoute = "route"
+)
+
+// brokerEvent is what instances exchange through the broker.
+type brokerEvent struct {
+	// Origin identifies the publishing instance, which ignores its own
+	// events.
+	Origin  string  `json:"origin"`
+	Kind    string  `json:"kind"`
+	Message Message `json:"message"`
+	// PasswordHash accompanies room_created events for protected rooms.
+	PasswordHash []byte `json:"password_hash,omitempty"`
+	// Rooms lists the rooms of the user a presence or status event is
+	// about.
+	Rooms []string `json:"rooms,omitempty"`
+	// Target is the instance a route event is for.
+	Target string `json:"target,omitempty"`
+}
+
+// LocalBroker is a Broker that links servers running in the same process.
+type LocalBroker struct {
+	mu   sync.Mutex
+	subs map[chan []byte]bool
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{subs: make(map[chan []byte]bool)}
+}
+
+func (b *LocalBroker) Publish(ctx context.Context, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- payload:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *LocalBroker) Subscribe(ctx context.Context, handle func(payload []byte)) error {
+	ch := make(chan []byte, outboxSize)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case payload := <-ch:
+			handle(payload)
+		}
+	}
+}
+
+func (b *LocalBroker) Close() error {
+	return nil
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// outboxSize is how many events may wait to be published before new ones
+// are dropped.
+const outboxSize = 1024
+
+// publish queues an event for the other instances, if a broker is
+// configured. It never blocks, as it is called with locks held.
+func (s *Server) publish(ev brokerEvent) {
+	if s.broker == nil {
+		return
+	}
+	ev.Origin = s.instanceID
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		s.logger.Error("encode broker event", "kind", ev.Kind, "err", err)
+		return
+	}
+
+	select {
+	case s.outbox <- payload:
+	default:
+		s.logger.Warn("broker outbox full, dropping event", "kind", ev.Kind)
+	}
+}
+
+// runPublisher sends queued events to the broker, in order, until ctx is
+// done.
+func (s *Server) runPublisher(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-s.outbox:
+			pubCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			if err := s.broker.Publish(pubCtx, payload); err != nil {
+				s.logger.Error("broker publish", "err", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// onlineElsewhere reports whether username is signed in on another
+// instance.
+func (s *Server) onlineElsewhere(username string) bool {
+	s.presenceLock.Lock()
+	defer s.presenceLock.Unlock()
+	_, ok := s.remoteOnline[username]
+	return ok
+}
+
+// sendTo delivers msg to username wherever they are connected, reporting
+// whether it was sent. Messages for other instances count as sent once
+// published.
+func (s *Server) sendTo(username string, msg Message) bool {
+	if u := s.onlineUser(username); u != nil {
+		return u.Send(msg)
+	}
+	if s.onlineElsewhere(username) {
+		s.publish(brokerEvent{Kind: eventDirect, Message: msg})
+		return true
+	}
+	return false
+}
+
+// runBroker applies events from other instances until ctx is done,
+// resubscribing if the subscription drops.
+func (s *Server) runBroker(ctx context.Context) {
+	for {
+		err := s.broker.Subscribe(ctx, s.handleBrokerEvent)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Error("broker subscription", "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *Server) handleBrokerEvent(payload []byte) {
+	var ev brokerEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		s.logger.Error("decode broker event", "err", err)
+		return
+	}
+	if ev.Origin == s.instanceID {
+		return
+	}
+
+	msg := ev.Message
+	switch ev.Kind {
+	case eventRoom:
+		s.roomLock.Lock()
+		if room, exists := s.rooms[msg.Room]; exists {
+			switch msg.Type {
+			case "topic":
+				room.Topic = msg.Content
+			case "description":
+				room.Description = msg.Content
+			case "tags":
+				room.Tags, _ = parseTags(msg.Content)
+			case "filter":
+				room.FilterDisabled = msg.Content == "off"
+			case "fun":
+				room.FunDisabled = msg.Content == "off"
+			case "assistant":
+				room.AssistantEnabled = msg.Content == "on"
+			case "invite_only":
+				room.InviteOnly = msg.Content == "on"
+			case "files":
+				room.FilesEnabled = msg.Content == "on"
+			case "pinned":
+				if room.pinIndex(msg.MessageID) < 0 {
+					room.Pins = append(room.Pins, Pin{MessageID: msg.MessageID, PinnedBy: msg.Sender, PinnedAt: time.Now().UTC()})
+				}
+			case "unpinned":
+				if i := room.pinIndex(msg.MessageID); i >= 0 {
+					room.Pins = slices.Delete(room.Pins, i, i+1)
+				}
+			case "slow_mode":
+				room.SlowMode, _ = time.ParseDuration(msg.Content)
+				room.lastPosted = nil
+			case "broadcast":
+				room.LastActivity = time.Now().UTC()
+			}
+			s.deliverLocked(room, msg)
+		}
+		s.roomLock.Unlock()
+	case eventRoomCreated:
+		s.roomLock.Lock()
+		if _, exists := s.rooms[msg.Room]; !exists {
+			s.loadHistory(msg.Room)
+			s.rooms[msg.Room] = &Room{
+				Name:         msg.Room,
+				Owner:        msg.Sender,
+				Moderators:   make(map[string]bool),
+				Bans:         make(map[string]string),
+				Private:      msg.Private,
+				CreatedAt:    time.Now().UTC(),
+				LastActivity: time.Now().UTC(),
+				passwordHash: ev.PasswordHash,
+			}
+		}
+		s.roomLock.Unlock()
+	case eventDirect:
+		delivered := false
+		if u := s.onlineUser(msg.Target); u != nil && !(heldForTarget(msg.Type) && s.doNotDisturb(msg.Target)) {
+			delivered = u.Send(msg)
+		}
+		if !heldForTarget(msg.Type) {
+			break
+		}
+		if !delivered {
+			s.dms.Push(msg.Target, msg)
+		} else if isDirect(msg.Type) {
+			s.sendTo(msg.Sender, deliveryReceipt(msg))
+		}
+	case eventPresence:
+		s.presenceLock.Lock()
+		if msg.Content == "online" {
+			s.remoteOnline[msg.Sender] = ev.Origin
+		} else if s.remoteOnline[msg.Sender] == ev.Origin {
+			delete(s.remoteOnline, msg.Sender)
+		}
+		s.presenceLock.Unlock()
+
+		s.roomLock.Lock()
+		s.deliverToRoommatesLocked(ev.Rooms, msg)
+		s.roomLock.Unlock()
+	case eventStatus:
+		s.roomLock.Lock()
+		s.deliverToRoommatesLocked(ev.Rooms, msg)
+		s.roomLock.Unlock()
+	case eventNode:
+		s.handleNodeEvent(ev)
+	case eventRoute:
+		s.handleRouteEvent(ev)
+	}
+}
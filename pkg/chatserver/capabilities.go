@@ -0,0 +1,163 @@
+package chatserver
+
+import "slices"
+
+// ProtocolVersion is the version of the protocol this server speaks.
+// Clients that never say hello are taken to speak version 1.
+const ProtocolVersion = 1
+
+// minProtocolVersion is the oldest protocol version still served.
+const minProtocolVersion = 1
+
+// Features a server may offer in Capabilities and clients may ask for in
+// their hello.
+const (
+	FeatureTyping       = "typing"
+	FeaturePresence     = "presence"
+	FeatureReactions    = "reactions"
+	FeatureEdits        = "edits"
+	FeaturePins         = "pins"
+	FeatureReadReceipts = "read_receipts"
+	FeatureMentions     = "mentions"
+	FeatureThreads      = "threads"
+	FeatureMarkdown     = "markdown"
+	FeatureE2E          = "e2e"
+	FeatureFiles        = "files"
+	FeatureAttachments  = "attachments"
+	FeatureLinkPreviews = "link_previews"
+	FeatureTranslations = "translations"
+)
+
+// eventFeatures maps the events the server sends unasked to the feature
+// they belong to. A client that said hello without asking for a feature
+// is not sent its events.
+var eventFeatures = map[string]string{
+	"typing":         FeatureTyping,
+	"presence":       FeaturePresence,
+	"reactions":      FeatureReactions,
+	"edit":           FeatureEdits,
+	"deleted":        FeatureEdits,
+	"pinned":         FeaturePins,
+	"unpinned":       FeaturePins,
+	"read":           FeatureReadReceipts,
+	"read_marker":    FeatureReadReceipts,
+	"delivered":      FeatureReadReceipts,
+	"mention":        FeatureMentions,
+	"file_offer":     FeatureFiles,
+	"file_chunk":     FeatureFiles,
+	"file_complete":  FeatureFiles,
+	"file_cancelled": FeatureFiles,
+	"preview":        FeatureLinkPreviews,
+}
+
+// Capabilities is the Data of a capabilities message, describing what the
+// server supports so clients can adapt to it.
+type Capabilities struct {
+	// Protocol is the newest protocol version the server speaks.
+	Protocol int `json:"protocol"`
+	// Features lists the optional features the server offers.
+	Features []string `json:"features"`
+	// Formats lists the message formats accepted.
+	Formats []string `json:"formats"`
+	// MaxContent is the longest message content accepted, in characters.
+	MaxContent int `json:"max_content"`
+	// EmojiShortcodes maps the shortcodes the server knows, without their
+	// colons, to their emoji. When ExpandsEmoji is set the server replaces
+	// them in messages itself; otherwise clients may do so when showing
+	// messages.
+	EmojiShortcodes map[string]string `json:"emoji_shortcodes"`
+	ExpandsEmoji    bool              `json:"expands_emoji"`
+}
+
+// Hello is the Data of the hello message a client opens with: the protocol
+// version it speaks and the features it wants. Asking for no features at
+// all asks for every one.
+type Hello struct {
+	Protocol int      `json:"protocol"`
+	Features []string `json:"features,omitempty"`
+}
+
+// HelloReply is the Data of the server's answer to hello: the protocol
+// version the two will speak, the features agreed on, and the server's
+// capabilities.
+type HelloReply struct {
+	Protocol     int          `json:"protocol"`
+	Features     []string     `json:"features"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+// features lists the optional features this server offers.
+func (s *Server) features() []string {
+	features := []string{
+		FeatureTyping, FeaturePresence, FeatureReactions, FeatureEdits, FeaturePins,
+		FeatureReadReceipts, FeatureMentions, FeatureThreads, FeatureMarkdown, FeatureE2E,
+	}
+	if s.maxFileSize > 0 {
+		features = append(features, FeatureFiles)
+	}
+	if s.attachments != nil {
+		features = append(features, FeatureAttachments)
+	}
+	if s.previews != nil {
+		features = append(features, FeatureLinkPreviews)
+	}
+	if s.translator != nil {
+		features = append(features, FeatureTranslations)
+	}
+	return features
+}
+
+// capabilities describes this server.
+func (s *Server) capabilities() Capabilities {
+	return Capabilities{
+		Protocol:        ProtocolVersion,
+		Features:        s.features(),
+		Formats:         []string{FormatPlain, FormatMarkdown},
+		MaxContent:      s.maxContent,
+		EmojiShortcodes: emojiShortcodes,
+		ExpandsEmoji:    s.expandEmoji,
+	}
+}
+
+// handleCapabilities answers with the server's Capabilities. It needs no
+// sign-in, so clients can ask as soon as they connect.
+func (s *Server) handleCapabilities(c *Client, msg Message) {
+	c.Reply(Message{Type: "capabilities", Data: s.capabilities()})
+}
+
+// handleHello agrees a protocol version and set of features with the
+// client, which from then on is only sent the events of those features.
+func (s *Server) handleHello(c *Client, msg Message) {
+	var hello Hello
+	if err := msg.DecodeData(&hello); err != nil || hello.Protocol < 1 {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Hello needs the protocol version the client speaks"})
+		return
+	}
+	if hello.Protocol < minProtocolVersion {
+		c.Reply(Message{Type: "error", Code: CodeUnsupported, Content: "Protocol version is no longer supported; please upgrade"})
+		return
+	}
+
+	caps := s.capabilities()
+	agreed := caps.Features
+	if len(hello.Features) > 0 {
+		agreed = nil
+		for _, f := range caps.Features {
+			if slices.Contains(hello.Features, f) {
+				agreed = append(agreed, f)
+			}
+		}
+	}
+	wanted := make(map[string]bool, len(agreed))
+	for _, f := range agreed {
+		wanted[f] = true
+	}
+	c.features.Store(&wanted)
+	c.reqLogger.Debug("hello", "protocol", hello.Protocol, "features", agreed)
+
+	c.Reply(Message{Type: "hello", Data: HelloReply{
+		Protocol:     min(hello.Protocol, ProtocolVersion),
+		Features:     agreed,
+		Capabilities: caps,
+	}})
+}
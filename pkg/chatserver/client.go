@@ -0,0 +1,211 @@
+package chatserver
+
+import (
+	"log/slog"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sendBuffer is how many outbound messages may queue for a client before it
+// is considered too slow and disconnected.
+const sendBuffer = 256
+
+// Client is one WebSocket connection. All writes to the connection go
+// through its send queue and are performed by a single writer goroutine, as
+// gorilla/websocket allows only one concurrent writer.
+type Client struct {
+	conn *websocket.Conn
+	send chan Message
+	done chan struct{}
+	// ip is the address the client connected from.
+	ip netip.Addr
+
+	// session is the token the client signed in or resumed with.
+	session string
+
+	// request is the correlation ID of the request being handled and failed
+	// records whether it was answered with an error. Both belong to the
+	// connection's read loop.
+	request string
+	failed  bool
+
+	// logger carries the connection's ID and remote address. reqLogger adds
+	// the type of the request being handled, its room and the signed-in
+	// user, and belongs to the read loop like request.
+	logger    *slog.Logger
+	reqLogger *slog.Logger
+	metrics   *metrics
+
+	// keepalive sets the connection's ping schedule and deadlines.
+	// lastMessage is when, in Unix nanoseconds, the client last sent a
+	// message.
+	keepalive   Keepalive
+	lastMessage atomic.Int64
+
+	// compressMin is the size, in bytes, from which messages are compressed
+	// if the client negotiated compression.
+	compressMin int
+
+	// features holds the features agreed in the client's hello; it is nil
+	// for clients that never said hello, which are sent everything.
+	features atomic.Pointer[map[string]bool]
+
+	flush     chan struct{}
+	flushOnce sync.Once
+	closeOnce sync.Once
+	// closeFrame is written after the queue is flushed. It is set before
+	// flush is closed.
+	closeFrame []byte
+}
+
+func newClient(conn *websocket.Conn, logger *slog.Logger, m *metrics, keepalive Keepalive) *Client {
+	c := &Client{
+		conn:      conn,
+		send:      make(chan Message, sendBuffer),
+		done:      make(chan struct{}),
+		flush:     make(chan struct{}),
+		logger:    logger,
+		reqLogger: logger,
+		metrics:   m,
+		keepalive: keepalive,
+	}
+	c.lastMessage.Store(time.Now().UnixNano())
+	return c
+}
+
+// Send queues msg for delivery, stamping it with the current time if it has
+// none. It never blocks: if the client's queue is full the connection is
+// closed and Send reports false. Events of features the client did not ask
+// for are dropped.
+func (c *Client) Send(msg Message) bool {
+	if !c.wants(msg.Type) {
+		return true
+	}
+	if msg.Timestamp == "" {
+		msg.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return true
+	case <-c.done:
+		return false
+	default:
+		c.logger.Warn("send queue full, closing connection")
+		c.Close()
+		return false
+	}
+}
+
+// Reply sends msg in response to the request c is handling, tagging it with
+// the request's correlation ID. Unlike Send, it must only be called from
+// within a handler.
+func (c *Client) Reply(msg Message) bool {
+	msg.ID = c.request
+	if msg.Type == "error" {
+		c.failed = true
+	}
+	return c.Send(msg)
+}
+
+// Close shuts the connection down. It is safe to call more than once.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	})
+}
+
+// CloseAfterFlush closes the connection once the messages already queued
+// have been written.
+func (c *Client) CloseAfterFlush() {
+	c.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// CloseWith closes the connection with a close frame carrying code and
+// text, once the messages already queued have been written.
+func (c *Client) CloseWith(code int, text string) {
+	c.flushOnce.Do(func() {
+		c.closeFrame = websocket.FormatCloseMessage(code, text)
+		close(c.flush)
+	})
+}
+
+// wants reports whether the client is to be sent messages of msgType.
+func (c *Client) wants(msgType string) bool {
+	features := c.features.Load()
+	if features == nil {
+		return true
+	}
+	feature, ok := eventFeatures[msgType]
+	return !ok || (*features)[feature]
+}
+
+// write sends msg, giving up after the write timeout.
+func (c *Client) write(msg Message) error {
+	data, frameType, err := EncodeMessage(c.conn.Subprotocol(), msg)
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.keepalive.WriteTimeout))
+	// Small messages are not worth the cost of compressing.
+	c.conn.EnableWriteCompression(len(data) >= c.compressMin)
+	return c.conn.WriteMessage(frameType, data)
+}
+
+func (c *Client) writePump() {
+	ping := time.NewTicker(c.keepalive.PingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				c.logger.Debug("write failed", "err", err)
+				c.metrics.websocketError("write")
+				c.Close()
+				return
+			}
+		case now := <-ping.C:
+			if c.idle(now) {
+				c.logger.Info("closing idle connection")
+				c.CloseWith(websocket.CloseGoingAway, "idle timeout")
+				continue
+			}
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, now.Add(c.keepalive.WriteTimeout)); err != nil {
+				c.logger.Debug("ping failed", "err", err)
+				c.metrics.websocketError("write")
+				c.Close()
+				return
+			}
+		case <-c.flush:
+			for {
+				select {
+				case msg := <-c.send:
+					if err := c.write(msg); err != nil {
+						c.Close()
+						return
+					}
+				default:
+					c.conn.WriteControl(websocket.CloseMessage, c.closeFrame, time.Now().Add(time.Second))
+					c.Close()
+					return
+				}
+			}
+		}
+	}
+}
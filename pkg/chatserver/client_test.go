@@ -0,0 +1,68 @@
+package chatserver
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestSendFromManyGoroutines checks that messages sent to one client from
+// many goroutines at once all arrive intact, which only holds if they are
+// written by a single writer.
+func TestSendFromManyGoroutines(t *testing.T) {
+	const senders, each = 8, 25
+
+	s := New()
+	s.Handle("flood", func(c *Client, msg Message) {
+		var wg sync.WaitGroup
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < each; j++ {
+					c.Send(Message{Type: "flood", Content: fmt.Sprintf("%d/%d", i, j)})
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, msg := range []Message{
+		{Type: "signup", Sender: "alice", Content: "alice-password"},
+		{Type: "signin", Sender: "alice", Content: "alice-password"},
+		{Type: "flood"},
+	} {
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for len(seen) < senders*each {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("after %d messages: %v", len(seen), err)
+		}
+		if msg.Type != "flood" {
+			continue
+		}
+		if seen[msg.Content] {
+			t.Fatalf("%s delivered twice", msg.Content)
+		}
+		seen[msg.Content] = true
+	}
+}
@@ -0,0 +1,344 @@
+package chatserver
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster mode shares the work of a room between the instances linked by
+// a broker: every room is owned by one instance, picked by consistent
+// hashing of its name over the instances that are up. Room messages are
+// checked where their senders are connected and then routed to the room's
+// owner, which alone stores them, giving them their order, and sends them
+// to the room's members on every instance and to the bridges. The owner
+// also prunes the room's history. Instances learn of each other from the
+// heartbeats they publish; one not heard from for missedHeartbeats is
+// taken to have left, and its rooms pass to the others, as some rooms pass
+// to an instance that joins.
+
+// DefaultClusterHeartbeat is how often instances tell each other they are
+// up by default.
+const DefaultClusterHeartbeat = 2 * time.Second
+
+const (
+	// ringPoints is how many points each instance has on the hash ring;
+	// more spread the rooms more evenly.
+	ringPoints = 64
+	// missedHeartbeats is how many heartbeats an instance may miss before
+	// it is taken to have left.
+	missedHeartbeats = 3
+)
+
+// Cluster configures cluster mode. Node names this instance to operators;
+// it defaults to the host name.
+type Cluster struct {
+	Node      string
+	Heartbeat time.Duration
+}
+
+// ClusterNode describes an instance of the cluster.
+type ClusterNode struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Rooms is how many of the rooms it owns.
+	Rooms int  `json:"rooms"`
+	Self  bool `json:"self,omitempty"`
+}
+
+// hashRing assigns keys to the nodes whose points follow them on a ring.
+type hashRing struct {
+	points []uint64
+	nodes  []string
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newHashRing(nodes []string) hashRing {
+	type point struct {
+		hash uint64
+		node string
+	}
+	points := make([]point, 0, len(nodes)*ringPoints)
+	for _, node := range nodes {
+		for i := 0; i < ringPoints; i++ {
+			points = append(points, point{ringHash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	r := hashRing{points: make([]uint64, len(points)), nodes: make([]string, len(points))}
+	for i, p := range points {
+		r.points[i], r.nodes[i] = p.hash, p.node
+	}
+	return r
+}
+
+// owner returns the node key belongs to, or "" if the ring is empty.
+func (r hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[i]
+}
+
+// clusterMember is an instance heard from.
+type clusterMember struct {
+	name string
+	seen time.Time
+}
+
+// cluster is the state of cluster mode, guarded by mu.
+type cluster struct {
+	cfg     Cluster
+	mu      sync.Mutex
+	members map[string]clusterMember
+	ring    hashRing
+}
+
+func newCluster(cfg Cluster) *cluster {
+	if cfg.Node == "" {
+		cfg.Node, _ = os.Hostname()
+	}
+	if cfg.Heartbeat <= 0 {
+		cfg.Heartbeat = DefaultClusterHeartbeat
+	}
+	return &cluster{cfg: cfg, members: make(map[string]clusterMember)}
+}
+
+// roomOwner returns the instance that owns room: this one unless cluster
+// mode is on.
+func (s *Server) roomOwner(room string) string {
+	if s.cluster == nil {
+		return s.instanceID
+	}
+	s.cluster.mu.Lock()
+	defer s.cluster.mu.Unlock()
+	if owner := s.cluster.ring.owner(room); owner != "" {
+		return owner
+	}
+	return s.instanceID
+}
+
+// ownsRoom reports whether this instance owns room.
+func (s *Server) ownsRoom(room string) bool {
+	return s.roomOwner(room) == s.instanceID
+}
+
+// postToRoomLocked stamps msg, a message for room, and has the room's owner
+// store it and send it: this instance, or another it is routed to. It
+// returns msg as stamped; its Seq is only set when this instance owns the
+// room. The caller must hold roomLock.
+func (s *Server) postToRoomLocked(room *Room, msg Message) Message {
+	stamp(&msg)
+	if owner := s.roomOwner(room.Name); owner != s.instanceID {
+		s.publish(brokerEvent{Kind: eventRoute, Target: owner, Message: msg})
+		return msg
+	}
+	return s.commitLocked(room, msg)
+}
+
+// commitLocked stores msg, already stamped, and sends it to room's members
+// and the bridges, returning it as stored. The caller must hold roomLock.
+func (s *Server) commitLocked(room *Room, msg Message) Message {
+	if err := s.messages.Append(&msg); err != nil {
+		s.logger.Error("store message", "room", msg.Room, "err", err)
+	}
+	s.indexMessage(msg)
+	s.appendHistory(msg)
+	s.scheduleExpiry(msg)
+	room.LastActivity = time.Now().UTC()
+	s.fanoutLocked(room, msg)
+	s.onRoomMessage(msg)
+	if msg.Bridge == "" {
+		s.schedulePreview(msg)
+	}
+	return msg
+}
+
+// handleRouteEvent commits a room message routed here by the instance its
+// sender is connected to.
+func (s *Server) handleRouteEvent(ev brokerEvent) {
+	if ev.Target != s.instanceID {
+		return
+	}
+	msg := ev.Message
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	room, ok := s.rooms[msg.Room]
+	if !ok {
+		s.logger.Warn("routed message for unknown room", "room", msg.Room, "from", ev.Origin)
+		return
+	}
+	// The room may have changed hands on the way. It is stored here all the
+	// same, rather than sent around while the instances disagree.
+	s.commitLocked(room, msg)
+}
+
+// runCluster publishes heartbeats and drops instances that stop sending
+// them until ctx is done.
+func (s *Server) runCluster(ctx context.Context) {
+	cl := s.cluster
+	s.heardFrom(s.instanceID, cl.cfg.Node, time.Now())
+	s.publish(brokerEvent{Kind: eventNode, Message: Message{Sender: cl.cfg.Node, Content: "up"}})
+
+	ticker := time.NewTicker(cl.cfg.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.heardFrom(s.instanceID, cl.cfg.Node, now)
+			s.publish(brokerEvent{Kind: eventNode, Message: Message{Sender: cl.cfg.Node, Content: "up"}})
+			s.dropSilentNodes(now)
+		}
+	}
+}
+
+// leaveCluster tells the other instances this one is shutting down, so that
+// they take over its rooms without waiting for its heartbeats to stop. It
+// publishes directly rather than through the publisher, which may stop
+// first.
+func (s *Server) leaveCluster() {
+	if s.cluster == nil {
+		return
+	}
+	payload, err := json.Marshal(brokerEvent{Origin: s.instanceID, Kind: eventNode, Message: Message{Sender: s.cluster.cfg.Node, Content: "down"}})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.broker.Publish(ctx, payload); err != nil {
+		s.logger.Warn("leave cluster", "err", err)
+	}
+}
+
+// handleNodeEvent notes a heartbeat from another instance, or that it is
+// leaving.
+func (s *Server) handleNodeEvent(ev brokerEvent) {
+	if s.cluster == nil {
+		return
+	}
+	if ev.Message.Content == "down" {
+		s.updateCluster(func(members map[string]clusterMember) {
+			delete(members, ev.Origin)
+		})
+		return
+	}
+	s.heardFrom(ev.Origin, ev.Message.Sender, time.Now())
+}
+
+func (s *Server) heardFrom(id, name string, now time.Time) {
+	s.updateCluster(func(members map[string]clusterMember) {
+		members[id] = clusterMember{name: name, seen: now}
+	})
+}
+
+// dropSilentNodes forgets the instances that missed too many heartbeats.
+func (s *Server) dropSilentNodes(now time.Time) {
+	limit := missedHeartbeats * s.cluster.cfg.Heartbeat
+	s.updateCluster(func(members map[string]clusterMember) {
+		for id, m := range members {
+			if id != s.instanceID && now.Sub(m.seen) > limit {
+				delete(members, id)
+			}
+		}
+	})
+}
+
+// updateCluster applies change to the instances known, rebuilding the ring
+// and logging the rooms that change hands if they join or leave.
+func (s *Server) updateCluster(change func(members map[string]clusterMember)) {
+	cl := s.cluster
+	cl.mu.Lock()
+	before := make(map[string]string, len(cl.members))
+	for id, m := range cl.members {
+		before[id] = m.name
+	}
+	change(cl.members)
+	var joined, left []string
+	for id, m := range cl.members {
+		if _, ok := before[id]; !ok {
+			joined = append(joined, m.name)
+		}
+	}
+	for id, name := range before {
+		if _, ok := cl.members[id]; !ok {
+			left = append(left, name)
+		}
+	}
+	if len(joined) == 0 && len(left) == 0 {
+		cl.mu.Unlock()
+		return
+	}
+	old := cl.ring
+	ids := make([]string, 0, len(cl.members))
+	for id := range cl.members {
+		ids = append(ids, id)
+	}
+	cl.ring = newHashRing(ids)
+	ring := cl.ring
+	cl.mu.Unlock()
+
+	s.roomLock.Lock()
+	var gained, lost int
+	for name := range s.rooms {
+		was, is := old.owner(name) == s.instanceID, ring.owner(name) == s.instanceID
+		switch {
+		case is && !was:
+			gained++
+		case was && !is:
+			lost++
+		}
+	}
+	s.roomLock.Unlock()
+	s.logger.Info("cluster changed", "joined", joined, "left", left, "nodes", len(ids), "rooms_gained", gained, "rooms_lost", lost)
+}
+
+// ClusterNodes lists the instances of the cluster with the rooms each owns,
+// or nil when cluster mode is off.
+func (s *Server) ClusterNodes() []ClusterNode {
+	if s.cluster == nil {
+		return nil
+	}
+	cl := s.cluster
+	cl.mu.Lock()
+	nodes := make([]ClusterNode, 0, len(cl.members))
+	index := make(map[string]int, len(cl.members))
+	for id, m := range cl.members {
+		index[id] = len(nodes)
+		nodes = append(nodes, ClusterNode{ID: id, Name: m.name, Self: id == s.instanceID})
+	}
+	ring := cl.ring
+	cl.mu.Unlock()
+
+	s.roomLock.Lock()
+	for name := range s.rooms {
+		if i, ok := index[ring.owner(name)]; ok {
+			nodes[i].Rooms++
+		}
+	}
+	s.roomLock.Unlock()
+	slices.SortFunc(nodes, func(a, b ClusterNode) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.ID, b.ID))
+	})
+	return nodes
+}
@@ -0,0 +1,293 @@
+package chatserver
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Slash commands are room messages starting with a slash, such as
+// "/me waves", which the server answers instead of posting. They are looked
+// up in one registry, which holds the built-in commands, those added with
+// RegisterCommand, those plugins list, and those bots register over their
+// connection; a bot's commands are sent to it to answer. A command nobody
+// registered is offered to the plugins in case they answer it anyway, and is
+// otherwise refused. A message meant to start with a slash is sent with two,
+// and posted with one.
+
+// CommandFunc answers a command user sent in msg.Room, of which they are a
+// member. args is the rest of the line after the command's name.
+type CommandFunc func(c *Client, user *User, msg Message, args string)
+
+// Command is a slash command. Name is without the slash; Usage shows its
+// arguments, such as "<text>", and Help says what it does in a line.
+type Command struct {
+	Name  string      `json:"name"`
+	Usage string      `json:"usage,omitempty"`
+	Help  string      `json:"help"`
+	Run   CommandFunc `json:"-"`
+	// Bot is the bot account that answers the command, if a bot registered
+	// it.
+	Bot string `json:"bot,omitempty"`
+}
+
+// commandName matches the names commands may have.
+var commandName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// parseCommand splits "/name args" into its name and arguments.
+func parseCommand(content string) (name, args string, ok bool) {
+	rest, ok := strings.CutPrefix(content, "/")
+	if !ok {
+		return "", "", false
+	}
+	name, args, _ = strings.Cut(rest, " ")
+	name = strings.ToLower(name)
+	if !commandName.MatchString(name) {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(args), true
+}
+
+// RegisterCommand adds cmd, replacing any command of the same name,
+// including the built-in ones.
+func (s *Server) RegisterCommand(cmd Command) {
+	s.commandLock.Lock()
+	defer s.commandLock.Unlock()
+	s.commands[cmd.Name] = cmd
+}
+
+// Commands returns the registered commands, by name.
+func (s *Server) Commands() []Command {
+	s.commandLock.RLock()
+	cmds := make([]Command, 0, len(s.commands))
+	for _, cmd := range s.commands {
+		cmds = append(cmds, cmd)
+	}
+	s.commandLock.RUnlock()
+
+	slices.SortFunc(cmds, func(a, b Command) int { return strings.Compare(a.Name, b.Name) })
+	return cmds
+}
+
+func (s *Server) command(name string) (Command, bool) {
+	s.commandLock.RLock()
+	defer s.commandLock.RUnlock()
+	cmd, ok := s.commands[name]
+	return cmd, ok
+}
+
+// registerCommands adds the built-in commands and those the plugins list.
+// Plugins do not replace commands registered before them.
+func (s *Server) registerCommands() {
+	for _, cmd := range []Command{
+		{Name: "me", Usage: "<action>", Help: "Say what you are doing", Run: s.commandMe},
+		{Name: "topic", Usage: "[text]", Help: "Show the room's topic, or set it", Run: s.commandTopic},
+		{Name: "who", Help: "List the room's members", Run: s.commandWho},
+		{Name: "remind", Usage: "me in <duration> <text>", Help: "Set a reminder; /remind list and /remind cancel <id> manage them", Run: s.commandRemind},
+		{Name: "schedule", Usage: "in <duration> <text>", Help: "Post a message to the room later; \"at <time>\" takes an RFC 3339 time", Run: s.commandSchedule},
+		{Name: "translate", Usage: "<language> <message-id or text>", Help: "Translate a message, or some text, for yourself", Run: s.commandTranslate},
+		{Name: "poll", Usage: "<question> | <option> | <option> ...", Help: "Open a poll; /poll close <message-id> closes it", Run: s.commandPoll},
+		{Name: "help", Usage: "[command]", Help: "List the commands, or show how to use one", Run: s.commandHelp},
+	} {
+		s.RegisterCommand(cmd)
+	}
+	for _, cmd := range s.funCommands() {
+		s.RegisterCommand(cmd)
+	}
+
+	for _, p := range s.plugins {
+		ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+		infos, err := p.Commands(ctx)
+		cancel()
+		if err != nil {
+			s.logger.Warn("list plugin commands", "plugin", p.name, "err", err)
+			continue
+		}
+		for _, info := range infos {
+			name := strings.ToLower(info.Name)
+			if !commandName.MatchString(name) {
+				s.logger.Warn("plugin command name is not valid", "plugin", p.name, "command", info.Name)
+				continue
+			}
+			if _, taken := s.command(name); taken {
+				s.logger.Warn("plugin command is already registered", "plugin", p.name, "command", name)
+				continue
+			}
+			s.RegisterCommand(Command{Name: name, Usage: info.Usage, Help: info.Help, Run: s.pluginCommandFunc(p, name)})
+		}
+	}
+}
+
+// runCommand answers msg, from user, if it is a command, reporting whether
+// it was one, in which case it is not to be posted. A message escaping its
+// leading slash has one taken off.
+func (s *Server) runCommand(c *Client, user *User, msg *Message) bool {
+	if msg.Action {
+		return false
+	}
+	if rest, ok := strings.CutPrefix(msg.Content, "//"); ok {
+		msg.Content = "/" + rest
+		return false
+	}
+	name, args, ok := parseCommand(msg.Content)
+	if !ok {
+		return false
+	}
+	s.roomLock.Lock()
+	member := user.Rooms[msg.Room]
+	s.roomLock.Unlock()
+	if !member {
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return true
+	}
+
+	if cmd, ok := s.command(name); ok {
+		cmd.Run(c, user, *msg, args)
+		return true
+	}
+	for _, p := range s.plugins {
+		if s.offerPluginCommand(c, p, user, msg.Room, name, args) {
+			return true
+		}
+	}
+	c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Unknown command /" + name + "; /help lists them, and // starts a message with a slash", Room: msg.Room})
+	return true
+}
+
+// commandMe posts args as something the user is doing.
+func (s *Server) commandMe(c *Client, user *User, msg Message, args string) {
+	if args == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Usage: /me <action>", Room: msg.Room})
+		return
+	}
+	msg.Content, msg.Action = args, true
+	s.handleChat(c, msg)
+}
+
+// commandTopic shows the room's topic, or sets it to args.
+func (s *Server) commandTopic(c *Client, user *User, msg Message, args string) {
+	if args != "" {
+		s.handleSetTopic(c, Message{Type: "set_topic", Room: msg.Room, Content: args})
+		return
+	}
+	s.roomLock.Lock()
+	var topic string
+	if room, ok := s.rooms[msg.Room]; ok {
+		topic = room.Topic
+	}
+	s.roomLock.Unlock()
+	if topic == "" {
+		c.Reply(Message{Type: "info", Content: "The room has no topic", Room: msg.Room})
+		return
+	}
+	c.Reply(Message{Type: "info", Content: "Topic: " + topic, Room: msg.Room})
+}
+
+// commandWho lists the room's members.
+func (s *Server) commandWho(c *Client, user *User, msg Message, args string) {
+	s.handleRoomMembers(c, Message{Type: "room_members", Room: msg.Room})
+}
+
+// commandHelp lists the commands, or shows the usage of the one named in
+// args.
+func (s *Server) commandHelp(c *Client, user *User, msg Message, args string) {
+	if args == "" {
+		c.Reply(Message{Type: "commands", Room: msg.Room, Data: s.Commands()})
+		return
+	}
+	name := strings.TrimPrefix(strings.ToLower(args), "/")
+	cmd, ok := s.command(name)
+	if !ok {
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Unknown command /" + name, Room: msg.Room})
+		return
+	}
+	c.Reply(Message{Type: "commands", Room: msg.Room, Data: []Command{cmd}})
+}
+
+// handleRegisterCommand lets a bot add the command described by msg.Data.
+// When someone uses it, the bot is sent a command message whose Sender is
+// who used it, Room where, Target the command's name and Content its
+// arguments; the bot answers however it likes, such as by posting to the
+// room. A bot cannot take over a command someone else registered.
+func (s *Server) handleRegisterCommand(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	bot, ok := s.botOf(user.Username)
+	if !ok {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "Only bots can register commands"})
+		return
+	}
+	var req Command
+	if err := msg.DecodeData(&req); err != nil || !commandName.MatchString(req.Name) {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Command needs a name in data, of lowercase letters, digits, - and _"})
+		return
+	}
+	if utf8.RuneCountInString(req.Usage) > maxNameLength || utf8.RuneCountInString(req.Help) > maxTopicLength {
+		c.Reply(Message{Type: "error", Code: CodeTooLarge, Content: "Command usage or help is too long", Target: req.Name})
+		return
+	}
+
+	s.commandLock.Lock()
+	if existing, ok := s.commands[req.Name]; ok && existing.Bot != bot.Name {
+		s.commandLock.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeAlreadyExists, Content: "That command is taken", Target: req.Name})
+		return
+	}
+	s.commands[req.Name] = Command{Name: req.Name, Usage: req.Usage, Help: req.Help, Bot: bot.Name, Run: s.botCommandFunc(bot.Name, req.Name)}
+	s.commandLock.Unlock()
+	c.Reply(Message{Type: "info", Content: "Command registered", Target: req.Name})
+}
+
+// handleUnregisterCommand lets a bot remove the command it registered named
+// msg.Content.
+func (s *Server) handleUnregisterCommand(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	s.commandLock.Lock()
+	cmd, ok := s.commands[msg.Content]
+	if !ok || cmd.Bot == "" || cmd.Bot != user.Username {
+		s.commandLock.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "You have no such command", Target: msg.Content})
+		return
+	}
+	delete(s.commands, msg.Content)
+	s.commandLock.Unlock()
+	c.Reply(Message{Type: "info", Content: "Command unregistered", Target: msg.Content})
+}
+
+// botCommandFunc sends the command name to the bot botName to answer.
+func (s *Server) botCommandFunc(botName, name string) CommandFunc {
+	return func(c *Client, user *User, msg Message, args string) {
+		bot, ok := s.botOf(botName)
+		if !ok {
+			c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Unknown command /" + name, Room: msg.Room})
+			return
+		}
+		if _, ok := bot.allows("broadcast", msg.Room); !ok {
+			c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "That command is not available in this room", Room: msg.Room})
+			return
+		}
+		if !s.sendTo(botName, Message{Type: "command", Sender: user.Username, Room: msg.Room, Target: name, Content: args}) {
+			c.Reply(Message{Type: "error", Code: CodeDisabled, Content: "The bot that answers /" + name + " is not connected", Room: msg.Room})
+		}
+	}
+}
+
+// dropBotCommands removes the commands the bot botName registered.
+func (s *Server) dropBotCommands(botName string) {
+	s.commandLock.Lock()
+	defer s.commandLock.Unlock()
+	for name, cmd := range s.commands {
+		if cmd.Bot == botName {
+			delete(s.commands, name)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// DebugStats is the snapshot served at /debug/stats: the server's Stats
+// plus the runtime state and queue backlogs useful for finding where
+// messages are stuck.
+type DebugStats struct {
+	Stats
+	Goroutines  int    `json:"goroutines"`
+	HeapAlloc   uint64 `json:"heap_alloc_bytes"`
+	NumGC       uint32 `json:"num_gc"`
+	Broadcast   int    `json:"broadcast_backlog"`
+	Outbox      int    `json:"broker_outbox_backlog"`
+	OutboxCap   int    `json:"broker_outbox_capacity"`
+	SendQueued  int    `json:"send_queued"`
+	SendMax     int    `json:"send_queue_max"`
+	SendBuffer  int    `json:"send_queue_capacity"`
+	QueuedDMs   int    `json:"queued_dms"`
+	RemoteUsers int    `json:"remote_users"`
+}
+
+// DebugStats takes a DebugStats snapshot.
+func (s *Server) DebugStats() DebugStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	d := DebugStats{
+		Stats:      s.Stats(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		NumGC:      mem.NumGC,
+		Broadcast:  len(s.broadcast),
+		Outbox:     len(s.outbox),
+		OutboxCap:  cap(s.outbox),
+		SendBuffer: sendBuffer,
+	}
+
+	s.connLock.Lock()
+	for c := range s.conns {
+		queued := len(c.send)
+		d.SendQueued += queued
+		d.SendMax = max(d.SendMax, queued)
+	}
+	s.connLock.Unlock()
+
+	s.dms.mu.Lock()
+	for _, queued := range s.dms.pending {
+		d.QueuedDMs += len(queued)
+	}
+	s.dms.mu.Unlock()
+
+	s.presenceLock.Lock()
+	d.RemoteUsers = len(s.remoteOnline)
+	s.presenceLock.Unlock()
+	return d
+}
+
+// registerDebug serves net/http/pprof under /debug/pprof/ and DebugStats at
+// /debug/stats, both to admins only.
+func (s *Server) registerDebug() {
+	admin := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if s.requireAdminHTTP(w, r) {
+				h(w, r)
+			}
+		}
+	}
+	s.mux.HandleFunc("/debug/pprof/", admin(pprof.Index))
+	s.mux.HandleFunc("/debug/pprof/cmdline", admin(pprof.Cmdline))
+	s.mux.HandleFunc("/debug/pprof/profile", admin(pprof.Profile))
+	s.mux.HandleFunc("/debug/pprof/symbol", admin(pprof.Symbol))
+	s.mux.HandleFunc("/debug/pprof/trace", admin(pprof.Trace))
+	s.mux.HandleFunc("/debug/stats", admin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(s.DebugStats())
+	}))
+}
@@ -0,0 +1,233 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// defaultRoomPage and maxRoomPage bound how many rooms a listing
+	// returns at once.
+	defaultRoomPage = 50
+	maxRoomPage     = 200
+	// maxRoomTags and maxTagLength limit the tags on a room.
+	maxRoomTags  = 5
+	maxTagLength = 24
+)
+
+// RoomQuery filters and orders the room directory.
+type RoomQuery struct {
+	// Words must all appear in a room's name, topic or description,
+	// ignoring case.
+	Words []string
+	// Tags must all be on the room.
+	Tags []string
+	// ActiveWithin keeps rooms with activity that recent; zero keeps all.
+	ActiveWithin time.Duration
+	// ByActivity orders rooms most recently active first instead of by
+	// name.
+	ByActivity bool
+	// Offset and Limit select the page.
+	Offset int
+	Limit  int
+}
+
+// ParseRoomQuery parses a directory search such as "golang tag:help
+// active:24h sort:active". Plain words match names, topics and
+// descriptions; tag: requires a tag; active: requires activity within a
+// duration; sort:active lists the most recently active rooms first.
+func ParseRoomQuery(q string) (RoomQuery, error) {
+	var query RoomQuery
+	for _, term := range strings.Fields(strings.ToLower(q)) {
+		key, value, ok := strings.Cut(term, ":")
+		if !ok {
+			query.Words = append(query.Words, term)
+			continue
+		}
+		switch key {
+		case "tag":
+			query.Tags = append(query.Tags, value)
+		case "active":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return query, fmt.Errorf("active: %q is not a duration such as 24h", value)
+			}
+			query.ActiveWithin = d
+		case "sort":
+			switch value {
+			case "active":
+				query.ByActivity = true
+			case "name":
+				query.ByActivity = false
+			default:
+				return query, fmt.Errorf("sort: %q is not name or active", value)
+			}
+		default:
+			return query, fmt.Errorf("unknown search term %q", key+":")
+		}
+	}
+	return query, nil
+}
+
+// RoomPage is one page of the room directory. Next is the cursor for the
+// following page, empty on the last.
+type RoomPage struct {
+	Rooms []RoomInfo `json:"rooms"`
+	Next  string     `json:"next,omitempty"`
+}
+
+// FindRooms returns the page of public rooms matching q.
+func (s *Server) FindRooms(q RoomQuery) RoomPage {
+	now := time.Now()
+	var matched []RoomInfo
+	for _, room := range s.roomInfos(false) {
+		if q.matches(room, now) {
+			matched = append(matched, room)
+		}
+	}
+	if q.ByActivity {
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].LastActivity.After(matched[j].LastActivity) })
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultRoomPage
+	}
+	limit = min(limit, maxRoomPage)
+	start := min(max(q.Offset, 0), len(matched))
+	end := min(start+limit, len(matched))
+
+	page := RoomPage{Rooms: matched[start:end]}
+	if page.Rooms == nil {
+		page.Rooms = []RoomInfo{}
+	}
+	if end < len(matched) {
+		page.Next = strconv.Itoa(end)
+	}
+	return page
+}
+
+func (q RoomQuery) matches(room RoomInfo, now time.Time) bool {
+	if q.ActiveWithin > 0 && now.Sub(room.LastActivity) > q.ActiveWithin {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !slices.Contains(room.Tags, tag) {
+			return false
+		}
+	}
+	text := strings.ToLower(room.Name + " " + room.Topic + " " + room.Description)
+	for _, word := range q.Words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCursor turns a page cursor back into an offset.
+func parseCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	offset, err := strconv.Atoi(cursor)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return offset, nil
+}
+
+// handleListRooms replies with a page of the public rooms, filtered by the
+// search in msg.Content. msg.Limit sets the page size and msg.Cursor, taken
+// from the previous page, continues a listing. Anyone connected may ask,
+// signed in or not, so clients can show rooms before signin.
+func (s *Server) handleListRooms(c *Client, msg Message) {
+	q, err := ParseRoomQuery(msg.Content)
+	if err == nil {
+		q.Offset, err = parseCursor(msg.Cursor)
+	}
+	if err != nil {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Invalid room search: " + err.Error()})
+		return
+	}
+	q.Limit = msg.Limit
+	c.Reply(Message{Type: "rooms", Content: msg.Content, Data: s.FindRooms(q)})
+}
+
+// handleRoomsHTTP serves GET /rooms, a page of the public rooms as JSON.
+// The q parameter takes the same search as list_rooms; limit and cursor
+// page through the results.
+func (s *Server) handleRoomsHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	q, err := ParseRoomQuery(params.Get("q"))
+	if err == nil {
+		q.Offset, err = parseCursor(params.Get("cursor"))
+	}
+	if err == nil && params.Get("limit") != "" {
+		if q.Limit, err = strconv.Atoi(params.Get("limit")); err != nil {
+			err = fmt.Errorf("invalid limit %q", params.Get("limit"))
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.FindRooms(q))
+}
+
+// parseTags splits a comma or space separated list of tags, lowercased
+// and without duplicates.
+func parseTags(list string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.FieldsFunc(strings.ToLower(list), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if utf8.RuneCountInString(tag) > maxTagLength || strings.Contains(tag, ":") {
+			return nil, fmt.Errorf("tag %q must be at most %d characters and not contain ':'", tag, maxTagLength)
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxRoomTags {
+		return nil, fmt.Errorf("a room may have at most %d tags", maxRoomTags)
+	}
+	return tags, nil
+}
+
+// handleSetTags lets a moderator replace the room's directory tags with the
+// comma separated list in msg.Content; an empty list clears them.
+func (s *Server) handleSetTags(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	tags, err := parseTags(msg.Content)
+	if err != nil {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Invalid tags: " + err.Error(), Room: msg.Room})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+
+	room.Tags = tags
+	s.saveRoomLocked(room)
+	s.fanoutLocked(room, Message{Type: "tags", Sender: user.Username, Room: room.Name, Content: strings.Join(tags, ",")})
+}
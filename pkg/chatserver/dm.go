@@ -0,0 +1,126 @@
+package chatserver
+
+import (
+	"errors"
+	"sync"
+)
+
+// maxQueuedDMs caps how many direct messages and notices are held for an
+// offline user; the oldest are dropped first.
+const maxQueuedDMs = 100
+
+// dmQueue holds direct messages, and notices such as mentions, for users who
+// are not connected.
+type dmQueue struct {
+	mu      sync.Mutex
+	pending map[string][]Message
+}
+
+func newDMQueue() *dmQueue {
+	return &dmQueue{pending: make(map[string][]Message)}
+}
+
+func (q *dmQueue) Push(username string, msg Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queued := append(q.pending[username], msg)
+	if len(queued) > maxQueuedDMs {
+		queued = queued[len(queued)-maxQueuedDMs:]
+	}
+	q.pending[username] = queued
+}
+
+func (q *dmQueue) Drain(username string) []Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queued := q.pending[username]
+	delete(q.pending, username)
+	return queued
+}
+
+// handleDirectMessage delivers a message to msg.Target regardless of rooms,
+// on whichever instance they are connected to, queueing it if the target is
+// offline or in do-not-disturb.
+func (s *Server) handleDirectMessage(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if msg.Target == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Direct message must name a target"})
+		return
+	}
+	if _, err := s.accounts.Find(msg.Target); err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			c.reqLogger.Error("find account", "target", msg.Target, "err", err)
+		}
+		c.Reply(Message{Type: "error", Code: CodeUserNotFound, Content: "User does not exist"})
+		return
+	}
+
+	if !s.checkRate(c, user, "", s.rateLimit) {
+		return
+	}
+
+	msg.Sender = user.Username
+	msg.Room = ""
+	if msg.Type == "dm" {
+		msg.Encrypted = nil
+	}
+	normalizeFormat(&msg)
+	s.expandEmojiIn(&msg)
+	stamp(&msg)
+
+	delivered, remote, held := false, false, false
+	if target := s.onlineUser(msg.Target); target != nil {
+		if held = s.doNotDisturb(msg.Target); !held {
+			delivered = target.Send(msg)
+		}
+	} else if s.onlineElsewhere(msg.Target) {
+		// The target's instance queues or delivers it and sends the receipt.
+		s.publish(brokerEvent{Kind: eventDirect, Message: msg})
+		remote = true
+	}
+	if !delivered && !remote {
+		s.dms.Push(msg.Target, msg)
+	}
+	if msg.Target != user.Username {
+		c.Send(msg)
+		if delivered {
+			c.Send(deliveryReceipt(msg))
+		}
+		if held {
+			c.Reply(Message{Type: "info", Content: msg.Target + " is not to be disturbed; they will get your message later", Target: msg.Target})
+		}
+	}
+}
+
+// deliverQueuedDMs sends c any direct messages and notices queued while user
+// was offline or in do-not-disturb and lets the senders of the messages know
+// they have now been delivered. Nothing is sent while the user is still in do-not-disturb.
+func (s *Server) deliverQueuedDMs(c *Client, user *User) {
+	if s.doNotDisturb(user.Username) {
+		return
+	}
+	for _, msg := range s.dms.Drain(user.Username) {
+		if !c.Send(msg) {
+			continue
+		}
+		if isDirect(msg.Type) && msg.Sender != user.Username {
+			s.sendTo(msg.Sender, deliveryReceipt(msg))
+		}
+	}
+}
+
+// isDirect reports whether msgType is a direct message, plain or encrypted.
+func isDirect(msgType string) bool {
+	return msgType == "dm" || msgType == "encrypted_dm"
+}
+
+// deliveryReceipt tells the sender of msg that its recipient received it.
+func deliveryReceipt(msg Message) Message {
+	return Message{Type: "delivered", Sender: msg.Target, Target: msg.Sender, MessageID: msg.MessageID}
+}
@@ -0,0 +1,134 @@
+package chatserver
+
+import (
+	"regexp"
+	"strings"
+)
+
+// emojiShortcodes maps the shortcodes the server knows, without their
+// colons, to the emoji they stand for. The names follow those common to
+// GitHub and Slack.
+var emojiShortcodes = map[string]string{
+	"+1":                    "👍",
+	"-1":                    "👎",
+	"100":                   "💯",
+	"angry":                 "😠",
+	"beers":                 "🍻",
+	"blush":                 "😊",
+	"boom":                  "💥",
+	"broken_heart":          "💔",
+	"bug":                   "🐛",
+	"cake":                  "🍰",
+	"clap":                  "👏",
+	"coffee":                "☕",
+	"confused":              "😕",
+	"cool":                  "🆒",
+	"crossed_fingers":       "🤞",
+	"cry":                   "😢",
+	"exclamation":           "❗",
+	"exploding_head":        "🤯",
+	"eyes":                  "👀",
+	"face_with_monocle":     "🧐",
+	"facepalm":              "🤦",
+	"fire":                  "🔥",
+	"ghost":                 "👻",
+	"grimacing":             "😬",
+	"grin":                  "😁",
+	"grinning":              "😀",
+	"handshake":             "🤝",
+	"heart":                 "❤️",
+	"heart_eyes":            "😍",
+	"heavy_check_mark":      "✔️",
+	"hourglass":             "⌛",
+	"hugs":                  "🤗",
+	"innocent":              "😇",
+	"joy":                   "😂",
+	"kiss":                  "😘",
+	"laughing":              "😆",
+	"memo":                  "📝",
+	"money_mouth_face":      "🤑",
+	"muscle":                "💪",
+	"nerd_face":             "🤓",
+	"neutral_face":          "😐",
+	"no_entry":              "⛔",
+	"ok":                    "🆗",
+	"ok_hand":               "👌",
+	"open_mouth":            "😮",
+	"partying_face":         "🥳",
+	"pensive":               "😔",
+	"pleading_face":         "🥺",
+	"point_down":            "👇",
+	"point_left":            "👈",
+	"point_right":           "👉",
+	"point_up":              "☝️",
+	"poop":                  "💩",
+	"pray":                  "🙏",
+	"question":              "❓",
+	"raised_hands":          "🙌",
+	"relaxed":               "☺️",
+	"relieved":              "😌",
+	"robot":                 "🤖",
+	"rocket":                "🚀",
+	"rofl":                  "🤣",
+	"rolling_eyes":          "🙄",
+	"scream":                "😱",
+	"see_no_evil":           "🙈",
+	"shrug":                 "🤷",
+	"skull":                 "💀",
+	"sleeping":              "😴",
+	"slightly_smiling_face": "🙂",
+	"smile":                 "😄",
+	"smiley":                "😃",
+	"smirk":                 "😏",
+	"sob":                   "😭",
+	"sparkles":              "✨",
+	"speech_balloon":        "💬",
+	"star":                  "⭐",
+	"star_struck":           "🤩",
+	"stuck_out_tongue":      "😛",
+	"sunglasses":            "😎",
+	"sweat_smile":           "😅",
+	"tada":                  "🎉",
+	"thinking":              "🤔",
+	"thought_balloon":       "💭",
+	"thumbsdown":            "👎",
+	"thumbsup":              "👍",
+	"tired_face":            "😫",
+	"trophy":                "🏆",
+	"unamused":              "😒",
+	"upside_down_face":      "🙃",
+	"warning":               "⚠️",
+	"wave":                  "👋",
+	"white_check_mark":      "✅",
+	"wink":                  "😉",
+	"x":                     "❌",
+	"yum":                   "😋",
+	"zap":                   "⚡",
+	"zipper_mouth_face":     "🤐",
+}
+
+// shortcodePattern finds :name: shortcodes.
+var shortcodePattern = regexp.MustCompile(`:[a-z0-9_+-]+:`)
+
+// expandShortcodes replaces the known shortcodes in s with their emoji.
+func expandShortcodes(s string) string {
+	return shortcodePattern.ReplaceAllStringFunc(s, func(code string) string {
+		if emoji, ok := emojiShortcodes[strings.Trim(code, ":")]; ok {
+			return emoji
+		}
+		return code
+	})
+}
+
+// expandEmojiIn expands the shortcodes in msg.Content, if the server is
+// set to, leaving markdown code as written.
+func (s *Server) expandEmojiIn(msg *Message) {
+	if !s.expandEmoji {
+		return
+	}
+	if msg.Format == FormatMarkdown {
+		msg.Content = outsideCode(msg.Content, expandShortcodes)
+		return
+	}
+	msg.Content = expandShortcodes(msg.Content)
+}
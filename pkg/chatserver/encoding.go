@@ -0,0 +1,67 @@
+package chatserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Wire encodings of the message envelope. Clients choose one by asking for
+// it as a WebSocket subprotocol; JSON, in text frames, is used when they ask
+// for none. MessagePack, in binary frames, is smaller and quicker to parse,
+// for high-volume bots. Both use Message's json field names.
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+// encodings are the subprotocols offered, in order of preference.
+var encodings = []string{EncodingMsgpack, EncodingJSON}
+
+// EncodeMessage encodes msg in encoding, returning it with the type of
+// WebSocket frame it is sent in.
+func EncodeMessage(encoding string, msg Message) (data []byte, frameType int, err error) {
+	switch encoding {
+	case "", EncodingJSON:
+		data, err = json.Marshal(msg)
+		return data, websocket.TextMessage, err
+	case EncodingMsgpack:
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		err = enc.Encode(msg)
+		return buf.Bytes(), websocket.BinaryMessage, err
+	}
+	return nil, 0, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// DecodeMessage decodes a frame encoded in encoding into msg.
+func DecodeMessage(encoding string, data []byte, msg *Message) error {
+	switch encoding {
+	case "", EncodingJSON:
+		return json.Unmarshal(data, msg)
+	case EncodingMsgpack:
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		return dec.Decode(msg)
+	}
+	return fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// decodeFrame parses a client frame in encoding, rejecting fields Message
+// does not have.
+func decodeFrame(encoding string, data []byte) (msg Message, problems []FieldError) {
+	if encoding != EncodingMsgpack {
+		return decodeMessage(data)
+	}
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	dec.DisallowUnknownFields(true)
+	if err := dec.Decode(&msg); err != nil {
+		return msg, []FieldError{{Problem: "message is not a valid MessagePack map: " + err.Error()}}
+	}
+	return msg, nil
+}
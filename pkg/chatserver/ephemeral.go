@@ -0,0 +1,122 @@
+package chatserver
+
+import (
+	"errors"
+	"time"
+)
+
+// maxExpiresIn caps how long a self-destructing message can live.
+const maxExpiresIn = 7 * 24 * time.Hour
+
+// expired reports whether msg was sent to self-destruct at or before now.
+func (m Message) expired(now time.Time) bool {
+	if m.ExpiresAt == "" {
+		return false
+	}
+	at, err := time.Parse(time.RFC3339Nano, m.ExpiresAt)
+	return err == nil && !now.Before(at)
+}
+
+// withoutExpired drops the messages that have self-destructed but whose
+// deletion has not run yet.
+func withoutExpired(messages []Message) []Message {
+	now := time.Now()
+	kept := messages[:0]
+	for _, m := range messages {
+		if !m.expired(now) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// setExpiry turns msg.ExpiresIn into msg.ExpiresAt, replying to c and
+// reporting false if it is out of range.
+func setExpiry(c *Client, msg *Message) bool {
+	msg.ExpiresAt = ""
+	if msg.ExpiresIn == 0 {
+		return true
+	}
+	if msg.ExpiresIn < 0 || msg.ExpiresIn > int(maxExpiresIn/time.Second) {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "expires_in must be a number of seconds up to a week", Room: msg.Room})
+		return false
+	}
+	lifetime := time.Duration(msg.ExpiresIn) * time.Second
+	msg.ExpiresAt = time.Now().UTC().Add(lifetime).Format(time.RFC3339Nano)
+	return true
+}
+
+// scheduleExpiry arranges for msg to be deleted when it expires, if it was
+// sent to self-destruct.
+func (s *Server) scheduleExpiry(msg Message) {
+	if msg.ExpiresAt == "" || msg.Deleted {
+		return
+	}
+	at, err := time.Parse(time.RFC3339Nano, msg.ExpiresAt)
+	if err != nil {
+		s.logger.Error("bad message expiry", "room", msg.Room, "message_id", msg.MessageID, "err", err)
+		return
+	}
+
+	key := msg.Room + "\x00" + msg.MessageID
+	s.expiryLock.Lock()
+	defer s.expiryLock.Unlock()
+	if s.expiryTimers == nil {
+		s.expiryTimers = make(map[string]*time.Timer)
+	}
+	if _, ok := s.expiryTimers[key]; ok {
+		return
+	}
+	s.expiryTimers[key] = time.AfterFunc(time.Until(at), func() {
+		s.expiryLock.Lock()
+		delete(s.expiryTimers, key)
+		s.expiryLock.Unlock()
+		s.expireMessage(msg.Room, msg.MessageID)
+	})
+}
+
+// scheduleExpiries schedules the deletion of room's stored messages that
+// are still waiting to self-destruct, such as after a restart.
+func (s *Server) scheduleExpiries(room string) {
+	messages, err := s.messages.Messages(room)
+	if err != nil {
+		s.logger.Error("load messages", "room", room, "err", err)
+		return
+	}
+	for _, msg := range messages {
+		s.scheduleExpiry(msg)
+	}
+}
+
+// stopExpiries cancels the pending deletions of self-destructing messages;
+// they are scheduled again when the server next starts.
+func (s *Server) stopExpiries() {
+	s.expiryLock.Lock()
+	defer s.expiryLock.Unlock()
+	for key, timer := range s.expiryTimers {
+		timer.Stop()
+		delete(s.expiryTimers, key)
+	}
+}
+
+// expireMessage deletes a self-destructing message whose time is up.
+func (s *Server) expireMessage(room, id string) {
+	s.messageLock.Lock()
+	defer s.messageLock.Unlock()
+
+	stored, err := s.messages.Get(room, id)
+	if err != nil {
+		if !errors.Is(err, ErrMessageNotFound) {
+			s.logger.Error("load message", "room", room, "message_id", id, "err", err)
+		}
+		return
+	}
+	if stored.Deleted {
+		return
+	}
+	if err := s.removeMessage(stored, "server", "expired"); err != nil {
+		s.logger.Error("expire message", "room", room, "message_id", id, "err", err)
+		return
+	}
+	s.logger.Debug("message expired", "room", room, "message_id", id)
+}
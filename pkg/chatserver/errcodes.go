@@ -0,0 +1,50 @@
+package chatserver
+
+// Error codes identify the failure an error message reports, so clients can
+// act on it, or word it themselves, without parsing its Content. Any details,
+// such as the fields that failed validation or how long to wait before
+// retrying, are in the message's Data.
+const (
+	// CodeInvalidRequest means the request was malformed or a value in it
+	// was not acceptable.
+	CodeInvalidRequest = "invalid_request"
+	// CodeUnknownType means the server does not handle the message type.
+	CodeUnknownType = "unknown_type"
+	// CodeUnsupported means the client's protocol version is too old.
+	CodeUnsupported = "unsupported"
+	// CodeUnauthenticated means the request needs a signed-in user, or the
+	// credentials or session given were not valid.
+	CodeUnauthenticated = "unauthenticated"
+	CodeAccountDisabled = "account_disabled"
+	// CodeForbidden means the user may not do what they asked.
+	CodeForbidden = "forbidden"
+	// CodeBanned means the user or their address is banned.
+	CodeBanned = "banned"
+	// CodeNotMember means the request needs the user to be in the room.
+	CodeNotMember        = "not_member"
+	CodePasswordRequired = "password_required"
+	CodeWrongPassword    = "wrong_password"
+	CodeRoomNotFound     = "room_not_found"
+	CodeUserNotFound     = "user_not_found"
+	// CodeNotFound means something else the request refers to, such as a
+	// message, invite or file, does not exist.
+	CodeNotFound      = "not_found"
+	CodeAlreadyExists = "already_exists"
+	// CodeGone means the room or message has been archived or deleted.
+	CodeGone = "gone"
+	// CodeDisabled means the feature is turned off on the server or in
+	// the room.
+	CodeDisabled = "disabled"
+	// CodeTooLarge means a value was longer or bigger than allowed.
+	CodeTooLarge = "too_large"
+	// CodeLimitExceeded means the user or room already has as many of
+	// something as allowed.
+	CodeLimitExceeded = "limit_exceeded"
+	// CodeRateLimited means the user is sending too fast, or is muted; Data
+	// says when to retry.
+	CodeRateLimited    = "rate_limited"
+	CodeSpam           = "spam"
+	CodeContentBlocked = "content_blocked"
+	// CodeInternal means the server failed to carry out the request.
+	CodeInternal = "internal"
+)
@@ -0,0 +1,128 @@
+package chatserver
+
+import (
+	"fmt"
+	"time"
+)
+
+// What the janitor does with a room that has stood empty too long.
+const (
+	ExpireArchive = "archive"
+	ExpireDelete  = "delete"
+)
+
+// EmptyRoomPolicy removes rooms that have had no members and no messages
+// for IdleFor, unless they are marked permanent. Archived rooms keep their
+// history but cannot be joined until their owner creates them again;
+// deleted rooms lose their history too. A zero IdleFor keeps rooms forever.
+type EmptyRoomPolicy struct {
+	IdleFor time.Duration
+	// Action is ExpireArchive, the default, or ExpireDelete.
+	Action string
+}
+
+// expireRooms applies the empty room policy, telling the owner of each room
+// it archives or deletes.
+func (s *Server) expireRooms(now time.Time) {
+	policy := s.emptyRooms
+	if policy.IdleFor <= 0 {
+		return
+	}
+
+	s.userLock.Lock()
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	s.userLock.Unlock()
+
+	s.roomLock.Lock()
+	joined := make(map[string]bool, len(s.rooms))
+	for _, u := range users {
+		for name := range u.Rooms {
+			joined[name] = true
+		}
+	}
+	var expired []*Room
+	for name, room := range s.rooms {
+		if room.Permanent || room.Archived || joined[name] || len(room.Members) > 0 {
+			continue
+		}
+		if now.Sub(room.LastActivity) < policy.IdleFor {
+			continue
+		}
+		if policy.Action == ExpireDelete {
+			delete(s.rooms, name)
+			if err := s.roomStore.DeleteRoom(name); err != nil {
+				s.logger.Error("delete room", "room", name, "err", err)
+			}
+		} else {
+			room.Archived = true
+			s.saveRoomLocked(room)
+		}
+		expired = append(expired, room)
+	}
+	s.roomLock.Unlock()
+
+	event, action, verb := "room_archived", "archive_room", "archived"
+	if policy.Action == ExpireDelete {
+		event, action, verb = "room_deleted", "delete_room", "deleted"
+	}
+	for _, room := range expired {
+		if policy.Action == ExpireDelete {
+			s.pruneMessages(room.Name, now, 0)
+		}
+		notice := Message{
+			Type:    event,
+			Target:  room.Owner,
+			Room:    room.Name,
+			Content: fmt.Sprintf("Your room %s was %s after %s with no members or messages", room.Name, verb, policy.IdleFor),
+		}
+		stamp(&notice)
+		if !s.sendTo(room.Owner, notice) {
+			s.dms.Push(room.Owner, notice)
+		}
+		s.audit(AuditEntry{Actor: "server", Action: action, Target: room.Owner, Room: room.Name})
+	}
+}
+
+// SetRoomPermanent marks a room as exempt from the empty room policy, or
+// makes it subject to it again.
+func (s *Server) SetRoomPermanent(name string, permanent bool, by string) error {
+	s.roomLock.Lock()
+	room, exists := s.rooms[name]
+	if exists {
+		room.Permanent = permanent
+		s.saveRoomLocked(room)
+	}
+	s.roomLock.Unlock()
+	if !exists {
+		return ErrRoomNotFound
+	}
+
+	action := "set_permanent"
+	if !permanent {
+		action = "clear_permanent"
+	}
+	s.audit(AuditEntry{Actor: by, Action: action, Room: name})
+	return nil
+}
+
+// handleAdminSetPermanent lets an admin exempt a room from the empty room
+// policy. msg.Content is on or off.
+func (s *Server) handleAdminSetPermanent(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	if msg.Content != "on" && msg.Content != "off" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Permanent must be on or off", Room: msg.Room})
+		return
+	}
+
+	if err := s.SetRoomPermanent(msg.Room, msg.Content == "on", admin.Username); err != nil {
+		c.Reply(Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: msg.Room})
+		return
+	}
+	c.Reply(Message{Type: "info", Content: "Room permanence updated", Room: msg.Room})
+}
@@ -0,0 +1,94 @@
+package chatserver
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// ExportHistory writes the full history of room to w, oldest message first,
+// as a JSON array of messages or as CSV with a header row. format is "json"
+// or "csv".
+func (s *Server) ExportHistory(w io.Writer, room, format string) error {
+	if format != "json" && format != "csv" {
+		return ErrUnknownFormat
+	}
+
+	s.roomLock.Lock()
+	_, exists := s.rooms[room]
+	s.roomLock.Unlock()
+	if !exists {
+		return ErrRoomNotFound
+	}
+
+	messages, err := s.messages.Messages(room)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		if messages == nil {
+			messages = []Message{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(messages)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"seq", "message_id", "timestamp", "sender", "content", "edited", "deleted", "reply_to", "thread_id"})
+	for _, m := range messages {
+		cw.Write([]string{
+			strconv.FormatUint(m.Seq, 10), m.MessageID, m.Timestamp, m.Sender, m.Content,
+			strconv.FormatBool(m.Edited), strconv.FormatBool(m.Deleted), m.ReplyTo, m.ThreadID,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// handleExport serves GET /admin/export?room=<room>&format=json|csv to
+// admins, who authenticate with their session token as a bearer token.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.requireAdminHTTP(w, r) {
+		return
+	}
+
+	room := r.URL.Query().Get("room")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", room+"."+format))
+
+	if err := s.ExportHistory(w, room, format); err != nil {
+		if errors.Is(err, ErrRoomNotFound) {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "room does not exist", http.StatusNotFound)
+			return
+		}
+		s.logger.Error("export history", "room", room, "format", format, "err", err)
+		http.Error(w, "export failed", http.StatusInternalServerError)
+	}
+}
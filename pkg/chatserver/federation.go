@@ -0,0 +1,664 @@
+package chatserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Federation links this server with others so that they share rooms. Each
+// pair of servers shares a secret and keeps one WebSocket link, which
+// either may dial to the other's /federation endpoint; every frame on it
+// is signed with the secret. A room is shared by giving it the same name
+// on both servers and listing it for the peer on each. Messages posted to
+// a shared room, and its members joining and leaving, are sent to the
+// peers it is shared with, which post the messages as sent by
+// user@server and pass everything on to their own peers. Frames carry the
+// servers they passed through, and messages their ID on the server they
+// began on, so that nothing comes back or is posted twice however the
+// servers are linked.
+
+// BridgeFederation is the Bridge of messages posted on another server.
+const BridgeFederation = "federation"
+
+const (
+	// federationHelloTimeout bounds the exchange of hellos on a new link.
+	federationHelloTimeout = 10 * time.Second
+	// maxFederationSkew is how far a peer's clock may be from ours.
+	maxFederationSkew = 5 * time.Minute
+	// federationRetry and maxFederationRetry bound how long dialing a peer
+	// pauses after a failure, doubling from one to the other.
+	federationRetry    = 5 * time.Second
+	maxFederationRetry = 2 * time.Minute
+	// maxFederationFrame is the largest frame accepted from a peer.
+	maxFederationFrame = 1 << 20
+)
+
+// Federation configures the links to other servers. Name is this server's,
+// as its peers know it.
+type Federation struct {
+	Name  string
+	Peers []FederationPeer
+}
+
+// FederationPeer is a server to share Rooms with. Name is its name, as it
+// introduces itself, and Secret signs the frames both ways. URL is its
+// federation endpoint, such as wss://chat.example.org/federation; when it
+// is empty the peer is left to dial this server. One of each pair is
+// enough.
+type FederationPeer struct {
+	Name   string
+	URL    string
+	Secret string
+	Rooms  []string
+}
+
+// federatedMessage is a room message as sent between servers. ID and
+// ReplyTo are "server/message ID" on the server the message began on.
+type federatedMessage struct {
+	ID      string `json:"id"`
+	Sender  string `json:"sender"`
+	Content string `json:"content"`
+	Format  string `json:"format,omitempty"`
+	Action  bool   `json:"action,omitempty"`
+	ReplyTo string `json:"reply_to,omitempty"`
+}
+
+// federationFrame is what servers tell each other: hello, opening a link;
+// message, a room message; joined and left, about a member; and members,
+// listing all of a room's members on the server the frame began on.
+type federationFrame struct {
+	Type string `json:"type"`
+	// Server is the server that sent the frame over the link, and Time
+	// when.
+	Server string    `json:"server"`
+	Time   time.Time `json:"time"`
+	// Via lists the servers the frame has passed through, the one it began
+	// on first.
+	Via     []string          `json:"via,omitempty"`
+	Room    string            `json:"room,omitempty"`
+	User    string            `json:"user,omitempty"`
+	Users   []string          `json:"users,omitempty"`
+	Message *federatedMessage `json:"message,omitempty"`
+}
+
+// origin is the server the frame began on.
+func (f federationFrame) origin() string {
+	if len(f.Via) == 0 {
+		return ""
+	}
+	return f.Via[0]
+}
+
+// federationEnvelope carries a frame with its signature, the hex HMAC-SHA256
+// of the frame's bytes under the link's secret.
+type federationEnvelope struct {
+	Frame json.RawMessage `json:"frame"`
+	Sig   string          `json:"sig"`
+}
+
+func federationSig(secret string, frame []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(frame)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// federationLink is an open link to a peer.
+type federationLink struct {
+	peer FederationPeer
+	conn *websocket.Conn
+	// send queues signed envelopes for the link's writer.
+	send chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *federationLink) close() {
+	l.once.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+// federation is the state of the links to other servers. peers and rooms
+// are not changed after they are set up.
+type federation struct {
+	name  string
+	peers map[string]FederationPeer
+	// rooms maps each shared room to the peers it is shared with.
+	rooms map[string][]string
+	queue chan federationFrame
+	// ids pairs the IDs of messages posted here from other servers with
+	// their "server/message ID" where they began.
+	ids *bridgeIDs
+
+	// links holds the open link to each peer, and members the members of
+	// each shared room on other servers, as user@server, with the peer each
+	// was heard of from. Both are guarded by mu.
+	mu      sync.Mutex
+	links   map[string]*federationLink
+	members map[string]map[string]string
+}
+
+func newFederation(cfg Federation) *federation {
+	f := &federation{
+		name:    cfg.Name,
+		peers:   make(map[string]FederationPeer),
+		rooms:   make(map[string][]string),
+		queue:   make(chan federationFrame, bridgeQueueSize),
+		ids:     newBridgeIDs(),
+		links:   make(map[string]*federationLink),
+		members: make(map[string]map[string]string),
+	}
+	for _, peer := range cfg.Peers {
+		f.peers[peer.Name] = peer
+		for _, room := range peer.Rooms {
+			f.rooms[room] = append(f.rooms[room], peer.Name)
+		}
+	}
+	return f
+}
+
+// shares reports whether room is shared with the peer named peer.
+func (f *federation) shares(room, peer string) bool {
+	return slices.Contains(f.rooms[room], peer)
+}
+
+// originKey returns the "server/message ID" of the local message id where
+// it began, or "" if id is.
+func (f *federation) originKey(id string) string {
+	if id == "" {
+		return ""
+	}
+	if key := f.ids.remote(id); key != "" {
+		return key
+	}
+	return f.name + "/" + id
+}
+
+// localID returns the ID here of the message whose "server/message ID" is
+// key, or "" if it is not here.
+func (f *federation) localID(key string) string {
+	if id, ok := strings.CutPrefix(key, f.name+"/"); ok {
+		return id
+	}
+	return f.ids.local(key)
+}
+
+// push queues frame to be sent to the peers its room is shared with. It
+// reports false if the queue is full.
+func (f *federation) push(frame federationFrame) bool {
+	select {
+	case f.queue <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueue queues msg to be sent to the peers its room is shared with, if it
+// was posted here. It reports false if the queue is full.
+func (f *federation) enqueue(msg Message) bool {
+	if msg.Bridge == BridgeFederation || len(f.rooms[msg.Room]) == 0 || msg.Sender == "" || msg.Content == "" || msg.Deleted {
+		return true
+	}
+	return f.push(federationFrame{
+		Type: "message",
+		Via:  []string{f.name},
+		Room: msg.Room,
+		Message: &federatedMessage{
+			ID:      f.name + "/" + msg.MessageID,
+			Sender:  msg.Sender,
+			Content: msg.Content,
+			Format:  msg.Format,
+			Action:  msg.Action,
+			ReplyTo: f.originKey(msg.ReplyTo),
+		},
+	})
+}
+
+// broadcastFederation sends frame to the peers its room is shared with that it has
+// not passed through.
+func (s *Server) broadcastFederation(frame federationFrame) {
+	f := s.federation
+	for _, name := range f.rooms[frame.Room] {
+		if slices.Contains(frame.Via, name) {
+			continue
+		}
+		f.mu.Lock()
+		link := f.links[name]
+		f.mu.Unlock()
+		if link != nil {
+			s.sendFederation(link, frame)
+		}
+	}
+}
+
+// sendFederation signs frame and queues it on link, dropping it if the
+// link is backed up.
+func (s *Server) sendFederation(link *federationLink, frame federationFrame) {
+	frame.Server, frame.Time = s.federation.name, time.Now().UTC()
+	data, err := s.signFederation(link.peer, frame)
+	if err != nil {
+		s.logger.Error("encode federation frame", "peer", link.peer.Name, "err", err)
+		return
+	}
+	select {
+	case link.send <- data:
+	default:
+		s.logger.Warn("federation link backed up, dropping frame", "peer", link.peer.Name, "type", frame.Type, "room", frame.Room)
+	}
+}
+
+func (s *Server) signFederation(peer FederationPeer, frame federationFrame) ([]byte, error) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(federationEnvelope{Frame: data, Sig: federationSig(peer.Secret, data)})
+}
+
+// readFederation reads the next frame from conn, which must be signed with
+// the secret of the peer it claims to come from. With peer empty, any
+// configured peer is accepted.
+func (s *Server) readFederation(conn *websocket.Conn, peer string) (FederationPeer, federationFrame, error) {
+	var env federationEnvelope
+	var frame federationFrame
+	if err := conn.ReadJSON(&env); err != nil {
+		return FederationPeer{}, frame, err
+	}
+	if err := json.Unmarshal(env.Frame, &frame); err != nil {
+		return FederationPeer{}, frame, err
+	}
+	p, ok := s.federation.peers[frame.Server]
+	if !ok || (peer != "" && frame.Server != peer) {
+		return p, frame, fmt.Errorf("frame from unknown server %q", frame.Server)
+	}
+	if !hmac.Equal([]byte(env.Sig), []byte(federationSig(p.Secret, env.Frame))) {
+		return p, frame, fmt.Errorf("frame from %s has a bad signature", frame.Server)
+	}
+	return p, frame, nil
+}
+
+// runFederation dials the peers it has URLs for and sends the queued frames
+// until ctx is done, then closes the links.
+func (s *Server) runFederation(ctx context.Context) {
+	f := s.federation
+	for _, peer := range f.peers {
+		if peer.URL != "" {
+			go s.dialFederation(ctx, peer)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			f.mu.Lock()
+			for _, link := range f.links {
+				link.close()
+			}
+			f.mu.Unlock()
+			return
+		case frame := <-f.queue:
+			s.broadcastFederation(frame)
+		}
+	}
+}
+
+// dialFederation keeps a link open to peer until ctx is done, dialing it
+// again whenever the link fails.
+func (s *Server) dialFederation(ctx context.Context, peer FederationPeer) {
+	wait := federationRetry
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, peer.URL, nil)
+		if err == nil {
+			var linked bool
+			linked, err = s.runFederationLink(conn, peer.Name)
+			if linked {
+				wait = federationRetry
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Warn("federation link", "peer", peer.Name, "err", err)
+		}
+		// Some jitter keeps two servers dialing each other from colliding
+		// every time.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait + rand.N(wait/2)):
+		}
+		wait = min(wait*2, maxFederationRetry)
+	}
+}
+
+// handleFederation accepts a link from a peer.
+func (s *Server) handleFederation(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Warn("federation upgrade", "ip", s.clientIP(r), "err", err)
+		return
+	}
+	if _, err := s.runFederationLink(conn, ""); err != nil {
+		s.logger.Warn("federation link", "ip", s.clientIP(r), "err", err)
+	}
+}
+
+// runFederationLink exchanges hellos over conn, with peer if it was dialed
+// or whichever peer introduces itself if not, and then relays frames until
+// the link fails. It reports whether the hellos were exchanged.
+func (s *Server) runFederationLink(conn *websocket.Conn, peer string) (bool, error) {
+	f := s.federation
+	defer conn.Close()
+	conn.SetReadLimit(maxFederationFrame)
+	conn.SetReadDeadline(time.Now().Add(federationHelloTimeout))
+	conn.SetWriteDeadline(time.Now().Add(federationHelloTimeout))
+
+	hello := func(p FederationPeer) error {
+		data, err := s.signFederation(p, federationFrame{Type: "hello", Server: f.name, Time: time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+	if peer != "" {
+		if err := hello(f.peers[peer]); err != nil {
+			return false, err
+		}
+	}
+	p, frame, err := s.readFederation(conn, peer)
+	if err != nil {
+		return false, err
+	}
+	if frame.Type != "hello" {
+		return false, fmt.Errorf("%s did not say hello", p.Name)
+	}
+	if skew := time.Since(frame.Time); skew > maxFederationSkew || skew < -maxFederationSkew {
+		return false, fmt.Errorf("%s's clock is %s off", p.Name, skew.Round(time.Second))
+	}
+	if peer == "" {
+		if err := hello(p); err != nil {
+			return false, err
+		}
+	}
+
+	link := &federationLink{peer: p, conn: conn, send: make(chan []byte, bridgeQueueSize), done: make(chan struct{})}
+	f.mu.Lock()
+	if _, ok := f.links[p.Name]; ok {
+		f.mu.Unlock()
+		return false, fmt.Errorf("already linked to %s", p.Name)
+	}
+	f.links[p.Name] = link
+	f.mu.Unlock()
+	s.logger.Info("federation link up", "peer", p.Name)
+	defer s.dropFederationLink(link)
+
+	go s.writeFederation(link)
+	s.sendFederationMembers(link)
+
+	conn.SetReadDeadline(time.Now().Add(s.keepalive.PongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(s.keepalive.PongTimeout))
+	})
+	for {
+		_, frame, err := s.readFederation(conn, p.Name)
+		if err != nil {
+			select {
+			case <-link.done:
+				return true, nil
+			default:
+			}
+			return true, err
+		}
+		conn.SetReadDeadline(time.Now().Add(s.keepalive.PongTimeout))
+		s.receiveFederation(p.Name, frame)
+	}
+}
+
+// writeFederation sends link's queued frames, and pings, until it closes.
+func (s *Server) writeFederation(link *federationLink) {
+	ticker := time.NewTicker(s.keepalive.PingInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-link.done:
+			return
+		case data := <-link.send:
+			link.conn.SetWriteDeadline(time.Now().Add(s.keepalive.WriteTimeout))
+			err = link.conn.WriteMessage(websocket.TextMessage, data)
+		case <-ticker.C:
+			err = link.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.keepalive.WriteTimeout))
+		}
+		if err != nil {
+			link.close()
+			return
+		}
+	}
+}
+
+// dropFederationLink forgets link, and the remote members heard of over it.
+func (s *Server) dropFederationLink(link *federationLink) {
+	f := s.federation
+	link.close()
+	f.mu.Lock()
+	if f.links[link.peer.Name] == link {
+		delete(f.links, link.peer.Name)
+	}
+	gone := make(map[string][]string)
+	for room, members := range f.members {
+		for name, via := range members {
+			if via == link.peer.Name {
+				delete(members, name)
+				gone[room] = append(gone[room], name)
+			}
+		}
+	}
+	f.mu.Unlock()
+	s.logger.Info("federation link down", "peer", link.peer.Name)
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	for room, names := range gone {
+		for _, name := range names {
+			s.announceRemoteMemberLocked(room, name, false)
+		}
+	}
+}
+
+// sendFederationMembers tells a newly linked peer the members of the rooms
+// shared with it.
+func (s *Server) sendFederationMembers(link *federationLink) {
+	s.userLock.Lock()
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	s.userLock.Unlock()
+
+	s.roomLock.Lock()
+	frames := make([]federationFrame, 0, len(link.peer.Rooms))
+	for _, room := range link.peer.Rooms {
+		if _, ok := s.rooms[room]; !ok {
+			continue
+		}
+		frame := federationFrame{Type: "members", Via: []string{s.federation.name}, Room: room}
+		for _, u := range users {
+			if u.Rooms[room] {
+				frame.Users = append(frame.Users, u.Username)
+			}
+		}
+		frames = append(frames, frame)
+	}
+	s.roomLock.Unlock()
+
+	for _, frame := range frames {
+		s.sendFederation(link, frame)
+	}
+}
+
+// federateMembership tells the peers a room is shared with that username
+// joined it or left it.
+func (s *Server) federateMembership(room, username string, joined bool) {
+	if s.federation == nil || len(s.federation.rooms[room]) == 0 {
+		return
+	}
+	frame := federationFrame{Type: "left", Via: []string{s.federation.name}, Room: room, User: username}
+	if joined {
+		frame.Type = "joined"
+	}
+	if !s.federation.push(frame) {
+		s.logger.Warn("federation queue full, dropping membership", "room", room, "user", username)
+	}
+}
+
+// receiveFederation acts on frame, from the peer named peer, and passes it
+// on to the other peers its room is shared with.
+func (s *Server) receiveFederation(peer string, frame federationFrame) {
+	f := s.federation
+	origin := frame.origin()
+	if origin == "" || slices.Contains(frame.Via, f.name) {
+		return
+	}
+	if !f.shares(frame.Room, peer) {
+		s.logger.Warn("federation frame for a room not shared with the peer", "peer", peer, "room", frame.Room)
+		return
+	}
+
+	switch frame.Type {
+	case "message":
+		m := frame.Message
+		if m == nil || f.ids.local(m.ID) != "" {
+			return
+		}
+		msg := Message{
+			Room:    frame.Room,
+			Sender:  m.Sender + "@" + origin,
+			Bridge:  BridgeFederation,
+			Content: m.Content,
+			Format:  m.Format,
+			Action:  m.Action,
+			ReplyTo: f.localID(m.ReplyTo),
+		}
+		sent, err := s.relay(msg)
+		if err != nil {
+			s.logger.Warn("relay federated message", "peer", peer, "room", frame.Room, "err", err)
+			return
+		}
+		f.ids.add(sent.MessageID, m.ID)
+	case "joined", "left":
+		s.setRemoteMember(frame.Room, frame.User+"@"+origin, peer, frame.Type == "joined")
+	case "members":
+		s.setRemoteMembers(frame.Room, origin, peer, frame.Users)
+	default:
+		return
+	}
+
+	frame.Via = append(slices.Clip(frame.Via), f.name)
+	s.broadcastFederation(frame)
+}
+
+// setRemoteMember records that name, a user on another server heard of from
+// peer, joined room or left it, telling the room.
+func (s *Server) setRemoteMember(room, name, peer string, joined bool) {
+	f := s.federation
+	f.mu.Lock()
+	members := f.members[room]
+	_, known := members[name]
+	switch {
+	case joined && members == nil:
+		f.members[room] = map[string]string{name: peer}
+	case joined:
+		members[name] = peer
+	default:
+		delete(members, name)
+	}
+	f.mu.Unlock()
+
+	if joined != known {
+		s.roomLock.Lock()
+		s.announceRemoteMemberLocked(room, name, joined)
+		s.roomLock.Unlock()
+	}
+}
+
+// setRemoteMembers replaces the members of room on the server origin with
+// users, heard of from peer.
+func (s *Server) setRemoteMembers(room, origin, peer string, users []string) {
+	f := s.federation
+	suffix := "@" + origin
+	f.mu.Lock()
+	members := f.members[room]
+	if members == nil {
+		members = make(map[string]string)
+		f.members[room] = members
+	}
+	var left []string
+	for name := range members {
+		if strings.HasSuffix(name, suffix) && !slices.Contains(users, strings.TrimSuffix(name, suffix)) {
+			delete(members, name)
+			left = append(left, name)
+		}
+	}
+	var joined []string
+	for _, user := range users {
+		if _, ok := members[user+suffix]; !ok {
+			joined = append(joined, user+suffix)
+		}
+		members[user+suffix] = peer
+	}
+	f.mu.Unlock()
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	for _, name := range left {
+		s.announceRemoteMemberLocked(room, name, false)
+	}
+	for _, name := range joined {
+		s.announceRemoteMemberLocked(room, name, true)
+	}
+}
+
+// announceRemoteMemberLocked tells room that name, a user on another server,
+// joined or left it. The caller must hold roomLock.
+func (s *Server) announceRemoteMemberLocked(room, name string, joined bool) {
+	r, ok := s.rooms[room]
+	if !ok {
+		return
+	}
+	event := Message{Type: "remote_left", Sender: name, Room: room}
+	if joined {
+		event.Type = "remote_joined"
+	}
+	s.fanoutLocked(r, event)
+}
+
+// remoteMembers lists the members of room on other servers.
+func (s *Server) remoteMembers(room string) []RoomMember {
+	if s.federation == nil {
+		return nil
+	}
+	f := s.federation
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	members := make([]RoomMember, 0, len(f.members[room]))
+	for name := range f.members[room] {
+		i := strings.LastIndexByte(name, '@')
+		members = append(members, RoomMember{Username: name, Role: "member", Server: name[i+1:]})
+	}
+	return members
+}
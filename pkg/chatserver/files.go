@@ -0,0 +1,286 @@
+package chatserver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// defaultMaxFileSize is the default limit on a shared file, in bytes.
+	defaultMaxFileSize = 1 << 20
+	// maxFileName limits the names of shared files, in characters.
+	maxFileName = 255
+	// maxTransfersPerClient caps the files one connection can be sending
+	// at a time.
+	maxTransfersPerClient = 3
+	// transferIdle is how long a transfer may go without a chunk before it
+	// is abandoned.
+	transferIdle = 2 * time.Minute
+)
+
+// FileInfo describes a file shared in a room. In a file_offer request the
+// sender gives Name, Size and optionally Type; the server adds ID, which
+// file_chunk and file_complete requests then name, and ChunkSize, the most
+// bytes one chunk may carry. Offset is where a chunk's bytes begin.
+type FileInfo struct {
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Type      string `json:"type,omitempty"`
+	ChunkSize int    `json:"chunk_size,omitempty"`
+	Offset    int64  `json:"offset,omitempty"`
+}
+
+// fileTransfer is a file being relayed from its sender to a room.
+type fileTransfer struct {
+	info     FileInfo
+	room     string
+	sender   string
+	client   *Client
+	received int64
+	lastSeen time.Time
+}
+
+// fileTransfers tracks the files being sent through this instance.
+type fileTransfers struct {
+	mu        sync.Mutex
+	transfers map[string]*fileTransfer
+}
+
+func newFileTransfers() *fileTransfers {
+	return &fileTransfers{transfers: make(map[string]*fileTransfer)}
+}
+
+// chunkSize is the most bytes one file_chunk can carry, given that it
+// travels base64-encoded in Content.
+func (s *Server) chunkSize() int {
+	return s.maxContent / 4 * 3
+}
+
+// relayLocked sends msg to the members of room other than the sender and to
+// the other instances. The caller must hold roomLock.
+func (s *Server) relayLocked(room *Room, sender *User, msg Message) {
+	for _, u := range room.Members {
+		if u != sender {
+			u.Send(msg)
+		}
+	}
+	s.publish(brokerEvent{Kind: eventRoom, Message: msg})
+}
+
+// handleSetFiles lets a room's owner allow or forbid file sharing.
+// msg.Content is on or off.
+func (s *Server) handleSetFiles(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if msg.Content != "on" && msg.Content != "off" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "File sharing must be on or off", Room: msg.Room})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireOwnerLocked(c, user, msg, "change file sharing")
+	if room == nil {
+		return
+	}
+
+	room.FilesEnabled = msg.Content == "on"
+	s.saveRoomLocked(room)
+	s.fanoutLocked(room, Message{Type: "files", Sender: user.Username, Room: room.Name, Content: msg.Content})
+}
+
+// handleFileOffer starts sending the file described in msg.File to
+// msg.Room. The sender is answered with the offer as the room sees it,
+// carrying the ID to send chunks under.
+func (s *Server) handleFileOffer(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if msg.File == nil || msg.File.Name == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "A file offer needs a file name and size", Room: msg.Room})
+		return
+	}
+	switch {
+	case s.maxFileSize <= 0:
+		c.Reply(Message{Type: "error", Code: CodeDisabled, Content: "File sharing is disabled on this server", Room: msg.Room})
+		return
+	case msg.File.Size <= 0 || msg.File.Size > s.maxFileSize:
+		c.Reply(Message{Type: "error", Code: CodeTooLarge, Content: fmt.Sprintf("Files must be between 1 and %d bytes", s.maxFileSize), Room: msg.Room})
+		return
+	case utf8.RuneCountInString(msg.File.Name) > maxFileName || utf8.RuneCountInString(msg.File.Type) > maxNameLength:
+		c.Reply(Message{Type: "error", Code: CodeTooLarge, Content: "File name or type is too long", Room: msg.Room})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room, exists := s.rooms[msg.Room]
+	if !exists || !user.Rooms[msg.Room] {
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return
+	}
+	if !room.FilesEnabled {
+		c.Reply(Message{Type: "error", Code: CodeDisabled, Content: "File sharing is off in this room", Room: room.Name})
+		return
+	}
+
+	now := time.Now().UTC()
+	info := FileInfo{
+		ID:        newMessageID(now),
+		Name:      msg.File.Name,
+		Size:      msg.File.Size,
+		Type:      msg.File.Type,
+		ChunkSize: s.chunkSize(),
+	}
+
+	s.files.mu.Lock()
+	sending := 0
+	for _, t := range s.files.transfers {
+		if t.client == c {
+			sending++
+		}
+	}
+	if sending >= maxTransfersPerClient {
+		s.files.mu.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeLimitExceeded, Content: "You are already sending too many files", Room: room.Name})
+		return
+	}
+	s.files.transfers[info.ID] = &fileTransfer{info: info, room: room.Name, sender: user.Username, client: c, lastSeen: now}
+	s.files.mu.Unlock()
+
+	offer := Message{Type: "file_offer", Sender: user.Username, Room: room.Name, File: &info, Timestamp: now.Format(time.RFC3339Nano)}
+	c.Reply(offer)
+	s.relayLocked(room, user, offer)
+}
+
+// lookupTransfer returns the transfer named in msg if c is sending it,
+// replying with an error otherwise.
+func (s *Server) lookupTransfer(c *Client, msg Message) *fileTransfer {
+	if msg.File == nil || msg.File.ID == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Request must name a file id", Room: msg.Room})
+		return nil
+	}
+	t, ok := s.files.transfers[msg.File.ID]
+	if !ok || t.client != c || t.room != msg.Room {
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "No such file transfer", Room: msg.Room})
+		return nil
+	}
+	return t
+}
+
+// handleFileChunk relays the next part of a file, base64-encoded in
+// msg.Content, to its room. Chunks must arrive in order.
+func (s *Server) handleFileChunk(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(msg.Content)
+	if err != nil || len(data) == 0 {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "File chunks must be non-empty base64", Room: msg.Room})
+		return
+	}
+
+	s.files.mu.Lock()
+	t := s.lookupTransfer(c, msg)
+	if t == nil {
+		s.files.mu.Unlock()
+		return
+	}
+	if msg.File.Offset != t.received {
+		s.files.mu.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "File chunk is out of order", Room: msg.Room})
+		return
+	}
+	if len(data) > s.chunkSize() || t.received+int64(len(data)) > t.info.Size {
+		s.files.mu.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeTooLarge, Content: "File chunk is too large", Room: msg.Room})
+		return
+	}
+	t.received += int64(len(data))
+	t.lastSeen = time.Now()
+	chunk := Message{Type: "file_chunk", Sender: user.Username, Room: t.room, File: &FileInfo{ID: t.info.ID, Offset: msg.File.Offset}, Content: msg.Content}
+	s.files.mu.Unlock()
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	if room, exists := s.rooms[chunk.Room]; exists {
+		s.relayLocked(room, user, chunk)
+	}
+}
+
+// handleFileComplete finishes a transfer once all of the file has been
+// sent, telling the room it can be saved.
+func (s *Server) handleFileComplete(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.files.mu.Lock()
+	t := s.lookupTransfer(c, msg)
+	if t == nil {
+		s.files.mu.Unlock()
+		return
+	}
+	if t.received != t.info.Size {
+		s.files.mu.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "File is incomplete", Room: msg.Room})
+		return
+	}
+	delete(s.files.transfers, t.info.ID)
+	s.files.mu.Unlock()
+
+	info := t.info
+	done := Message{Type: "file_complete", Sender: user.Username, Room: t.room, File: &info}
+	c.Reply(done)
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	if room, exists := s.rooms[t.room]; exists {
+		s.relayLocked(room, user, done)
+	}
+}
+
+// cancelTransfers abandons the transfers matching drop, telling their rooms
+// so receivers can discard what they have.
+func (s *Server) cancelTransfers(drop func(*fileTransfer) bool) {
+	s.files.mu.Lock()
+	var cancelled []*fileTransfer
+	for id, t := range s.files.transfers {
+		if drop(t) {
+			delete(s.files.transfers, id)
+			cancelled = append(cancelled, t)
+		}
+	}
+	s.files.mu.Unlock()
+	if len(cancelled) == 0 {
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	for _, t := range cancelled {
+		if room, exists := s.rooms[t.room]; exists {
+			s.fanoutLocked(room, Message{Type: "file_cancelled", Sender: t.sender, Room: t.room, File: &FileInfo{ID: t.info.ID}})
+		}
+	}
+}
+
+// pruneTransfers abandons transfers that have stalled.
+func (s *Server) pruneTransfers(now time.Time) {
+	s.cancelTransfers(func(t *fileTransfer) bool { return now.Sub(t.lastSeen) > transferIdle })
+}
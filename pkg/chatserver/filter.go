@@ -0,0 +1,124 @@
+package chatserver
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrContentRejected = errors.New("content rejected by filter")
+
+// ContentFilter inspects room messages before they are stored and fanned
+// out. It returns the content to use in their place, or ErrContentRejected
+// if they must not be sent at all.
+type ContentFilter interface {
+	Filter(content string) (string, error)
+}
+
+// WordFilter matches a list of words case-insensitively, as whole words. It
+// masks them with asterisks, or rejects the message if Reject is set.
+type WordFilter struct {
+	Reject bool
+	words  map[string]bool
+}
+
+func NewWordFilter(words []string, reject bool) *WordFilter {
+	f := &WordFilter{Reject: reject, words: make(map[string]bool, len(words))}
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			f.words[strings.ToLower(w)] = true
+		}
+	}
+	return f
+}
+
+func (f *WordFilter) Filter(content string) (string, error) {
+	var b strings.Builder
+	matched := false
+	for i := 0; i < len(content); {
+		r, size := utf8.DecodeRuneInString(content[i:])
+		if !isWordRune(r) {
+			b.WriteString(content[i : i+size])
+			i += size
+			continue
+		}
+
+		end := i
+		for end < len(content) {
+			r, size := utf8.DecodeRuneInString(content[end:])
+			if !isWordRune(r) {
+				break
+			}
+			end += size
+		}
+		word := content[i:end]
+		if f.words[strings.ToLower(word)] {
+			matched = true
+			b.WriteString(strings.Repeat("*", utf8.RuneCountInString(word)))
+		} else {
+			b.WriteString(word)
+		}
+		i = end
+	}
+
+	if !matched {
+		return content, nil
+	}
+	if f.Reject {
+		return "", ErrContentRejected
+	}
+	return b.String(), nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\''
+}
+
+// filterContentLocked runs content through the server's filter unless room
+// has it turned off, replying to c if it is rejected. room may be nil. The
+// caller must hold roomLock.
+func (s *Server) filterContentLocked(c *Client, room *Room, content string) (string, bool) {
+	if s.filter == nil || (room != nil && room.FilterDisabled) {
+		return content, true
+	}
+	filtered, err := s.filter.Filter(content)
+	if err != nil {
+		if !errors.Is(err, ErrContentRejected) {
+			c.reqLogger.Error("filter content", "err", err)
+		}
+		reply := Message{Type: "error", Code: CodeContentBlocked, Content: "Message contains blocked words"}
+		if room != nil {
+			reply.Room = room.Name
+		}
+		c.Reply(reply)
+		return "", false
+	}
+	return filtered, true
+}
+
+// handleSetFilter lets a moderator turn the content filter off or back on
+// for their room. msg.Content is "on" or "off".
+func (s *Server) handleSetFilter(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if msg.Content != "on" && msg.Content != "off" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Filter must be on or off", Room: msg.Room})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+
+	room.FilterDisabled = msg.Content == "off"
+	s.saveRoomLocked(room)
+	s.fanoutLocked(room, Message{Type: "filter", Sender: user.Username, Room: room.Name, Content: msg.Content})
+}
@@ -0,0 +1,90 @@
+package chatserver
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Message formats. Plain is the default and is sent as an empty Format.
+const (
+	FormatPlain    = "plain"
+	FormatMarkdown = "markdown"
+)
+
+// htmlTag matches a raw HTML tag or comment, which markdown renderers would
+// otherwise pass through.
+var htmlTag = regexp.MustCompile(`<!--.*?-->|</?[A-Za-z][A-Za-z0-9-]*(\s[^<>]*)?/?>`)
+
+// codeFence reports whether line opens or closes a fenced code block.
+func codeFence(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "```")
+}
+
+// normalizeFormat checks msg.Format, replacing plain with the empty
+// default, and sanitises the content of markdown messages.
+func normalizeFormat(msg *Message) {
+	if msg.Format == FormatPlain {
+		msg.Format = ""
+	}
+	if msg.Format == FormatMarkdown {
+		msg.Content = sanitizeMarkdown(msg.Content)
+	}
+}
+
+// sanitizeMarkdown makes markdown safe to render: control characters other
+// than newlines and tabs are dropped, raw HTML outside code is removed, and
+// a code block left open is closed.
+func sanitizeMarkdown(content string) string {
+	content = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, content)
+
+	content = outsideCode(content, func(text string) string {
+		return htmlTag.ReplaceAllString(text, "")
+	})
+	if openCodeBlock(content) {
+		content += "\n```"
+	}
+	return content
+}
+
+// openCodeBlock reports whether markdown ends inside a fenced code block.
+func openCodeBlock(content string) bool {
+	inCode := false
+	for _, line := range strings.Split(content, "\n") {
+		if codeFence(line) {
+			inCode = !inCode
+		}
+	}
+	return inCode
+}
+
+// outsideCode applies fn to the parts of markdown content that are not
+// code, leaving code blocks and spans as written.
+func outsideCode(content string, fn func(string) string) string {
+	lines := strings.Split(content, "\n")
+	inCode := false
+	for i, line := range lines {
+		if codeFence(line) {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+		// Odd segments between backticks are inline code, unless the last
+		// backtick is left unmatched.
+		parts := strings.Split(line, "`")
+		for j := range parts {
+			if j%2 == 0 || j == len(parts)-1 {
+				parts[j] = fn(parts[j])
+			}
+		}
+		lines[i] = strings.Join(parts, "`")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,62 @@
+package chatserver
+
+// Forward attributes a forwarded message to the one it copies.
+type Forward struct {
+	Sender    string `json:"sender"`
+	Room      string `json:"room"`
+	MessageID string `json:"message_id"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+// handleForward copies msg.MessageID in msg.Room into the room named in
+// msg.Target, as a message from the sender that credits the original. The
+// sender must belong to both rooms, and the copy is checked like any other
+// message posted to the target room.
+func (s *Server) handleForward(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	original, ok := s.lookupMessage(c, user, msg)
+	if !ok {
+		return
+	}
+	if original.Deleted {
+		c.Reply(Message{Type: "error", Code: CodeGone, Content: "Deleted messages cannot be forwarded", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+	if original.ExpiresAt != "" {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "Self-destructing messages cannot be forwarded", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+
+	from := Forward{
+		Sender:    original.Sender,
+		Room:      original.Room,
+		MessageID: original.MessageID,
+		Timestamp: original.Timestamp,
+	}
+	// A forward of a forward credits the message first forwarded.
+	if original.Forwarded != nil {
+		from = *original.Forwarded
+	}
+	copied := Message{
+		Type:        "broadcast",
+		Room:        msg.Target,
+		Content:     original.Content,
+		Format:      original.Format,
+		Attachments: original.Attachments,
+		Preview:     original.Preview,
+		Forwarded:   &from,
+	}
+
+	// The copy does not mention anyone again.
+	s.roomLock.Lock()
+	_, ok = s.postLocked(c, user, copied, nil)
+	s.roomLock.Unlock()
+	if ok {
+		c.Reply(Message{Type: "info", Content: "Message forwarded to " + msg.Target, Room: msg.Room, MessageID: msg.MessageID})
+	}
+}
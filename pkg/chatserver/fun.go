@@ -0,0 +1,169 @@
+package chatserver
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The fun commands, /roll, /flip and /8ball, post their results to the room
+// as the server, with Bridge set to server. Moderators can turn them off
+// for a room with set_fun.
+
+// BridgeServer is the Bridge of messages the server posts itself.
+const BridgeServer = "server"
+
+// Limits on /roll, so a roll fits in a message.
+const (
+	maxDice      = 100
+	maxDieSides  = 1000
+	maxShownDice = 20
+)
+
+// diceSpec matches the NdM+K notation /roll takes: N dice of M sides, plus
+// or minus K. N defaults to 1.
+var diceSpec = regexp.MustCompile(`^(\d*)d(\d+)([+-]\d+)?$`)
+
+// eightBallAnswers are the magic 8-ball's answers.
+var eightBallAnswers = []string{
+	"It is certain.", "It is decidedly so.", "Without a doubt.", "Yes, definitely.",
+	"You may rely on it.", "As I see it, yes.", "Most likely.", "Outlook good.",
+	"Yes.", "Signs point to yes.", "Reply hazy, try again.", "Ask again later.",
+	"Better not tell you now.", "Cannot predict now.", "Concentrate and ask again.",
+	"Don't count on it.", "My reply is no.", "My sources say no.", "Outlook not so good.",
+	"Very doubtful.",
+}
+
+// funCommands are the fun commands, to be registered with the built-in ones.
+func (s *Server) funCommands() []Command {
+	return []Command{
+		{Name: "roll", Usage: "[NdM+K]", Help: "Roll dice, such as 2d6+1; one six-sided die by default", Run: s.commandRoll},
+		{Name: "flip", Help: "Flip a coin", Run: s.commandFlip},
+		{Name: "8ball", Usage: "<question>", Help: "Ask the magic 8-ball", Run: s.commandEightBall},
+	}
+}
+
+// roll rolls the dice spec describes, returning the result laid out, or
+// what is wrong with spec.
+func roll(spec string) (string, bool) {
+	m := diceSpec.FindStringSubmatch(strings.ToLower(spec))
+	if m == nil {
+		return "Dice must be written like 2d6, d20 or 3d8+2", false
+	}
+	n, sides := 1, 0
+	if m[1] != "" {
+		n, _ = strconv.Atoi(m[1])
+	}
+	sides, _ = strconv.Atoi(m[2])
+	modifier, _ := strconv.Atoi(m[3])
+	if n < 1 || n > maxDice || sides < 2 || sides > maxDieSides {
+		return fmt.Sprintf("Roll 1 to %d dice of 2 to %d sides", maxDice, maxDieSides), false
+	}
+
+	total := modifier
+	shown := make([]string, 0, min(n, maxShownDice))
+	for i := 0; i < n; i++ {
+		r := rand.IntN(sides) + 1
+		total += r
+		if i < maxShownDice {
+			shown = append(shown, strconv.Itoa(r))
+		}
+	}
+	rolls := strings.Join(shown, " + ")
+	if n > maxShownDice {
+		rolls += " + …"
+	}
+	if m[3] != "" {
+		rolls += " " + m[3][:1] + " " + m[3][1:]
+	}
+	if n == 1 && m[3] == "" {
+		return strconv.Itoa(total), true
+	}
+	return fmt.Sprintf("%s = %d", rolls, total), true
+}
+
+func (s *Server) commandRoll(c *Client, user *User, msg Message, args string) {
+	spec := args
+	if spec == "" {
+		spec = "1d6"
+	}
+	result, ok := roll(spec)
+	if !ok {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: result, Room: msg.Room})
+		return
+	}
+	s.postFun(c, user, msg, fmt.Sprintf("🎲 %s rolled %s: %s", user.Username, spec, result))
+}
+
+func (s *Server) commandFlip(c *Client, user *User, msg Message, args string) {
+	side := "heads"
+	if rand.IntN(2) == 1 {
+		side = "tails"
+	}
+	s.postFun(c, user, msg, fmt.Sprintf("🪙 %s flipped a coin: %s", user.Username, side))
+}
+
+func (s *Server) commandEightBall(c *Client, user *User, msg Message, args string) {
+	if args == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Usage: /8ball <question>", Room: msg.Room})
+		return
+	}
+	answer := eightBallAnswers[rand.IntN(len(eightBallAnswers))]
+	s.postFun(c, user, msg, fmt.Sprintf("🎱 %s asked: %s — %s", user.Username, args, answer))
+}
+
+// postFun posts the result of a fun command, msg, to its room, unless the
+// room has turned them off. The command counts as a message from user
+// against the rate limit, slow mode and spam checks, so it cannot be used
+// to flood the room.
+func (s *Server) postFun(c *Client, user *User, msg Message, content string) {
+	s.roomLock.Lock()
+	r, ok := s.rooms[msg.Room]
+	if !ok {
+		s.roomLock.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: msg.Room})
+		return
+	}
+	if r.FunDisabled {
+		s.roomLock.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeDisabled, Content: "Fun commands are turned off in this room", Room: msg.Room})
+		return
+	}
+	allowed := s.checkFloodLocked(c, user, r, msg.Content)
+	s.roomLock.Unlock()
+	if !allowed {
+		return
+	}
+	if _, err := s.relay(Message{Room: msg.Room, Sender: "server", Bridge: BridgeServer, Content: content}); err != nil {
+		c.reqLogger.Warn("post fun command", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not post the result", Room: msg.Room})
+	}
+}
+
+// handleSetFun lets a moderator turn the fun commands on or off for the
+// room.
+func (s *Server) handleSetFun(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if msg.Content != "on" && msg.Content != "off" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Fun commands must be on or off", Room: msg.Room})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+
+	room.FunDisabled = msg.Content == "off"
+	s.saveRoomLocked(room)
+	s.fanoutLocked(room, Message{Type: "fun", Sender: user.Username, Room: room.Name, Content: msg.Content})
+}
@@ -0,0 +1,45 @@
+package chatserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFunCommandsAreLimited(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		slowMode time.Duration
+		wantCode string
+	}{
+		{"no limits", nil, 0, ""},
+		{"rate limit", []Option{WithRateLimit(RateLimit{Rate: 0.001, Burst: 1})}, 0, CodeRateLimited},
+		{"slow mode", nil, time.Minute, CodeRateLimited},
+		{"spam", []Option{WithSpamPolicy(SpamPolicy{RepeatLimit: 2, RepeatWindow: time.Minute, MuteFor: time.Minute})}, 0, CodeSpam},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.opts...)
+			owner := signIn(t, s, "alice")
+			mustDo(t, s, owner, Message{Type: "create_room", Content: "general"})
+			c := signIn(t, s, "bob")
+			mustDo(t, s, c, Message{Type: "join_room", Content: "general"})
+			s.roomLock.Lock()
+			s.rooms["general"].SlowMode = tt.slowMode
+			s.roomLock.Unlock()
+
+			flip := Message{Type: "broadcast", Room: "general", Content: "/flip"}
+			msgs := mustDo(t, s, c, flip)
+			if _, ok := find(msgs, "broadcast"); !ok {
+				t.Fatal("first /flip not posted")
+			}
+			msgs = do(s, c, flip)
+			if code := errorCode(msgs); code != tt.wantCode {
+				t.Errorf("second /flip answered %q, want %q", code, tt.wantCode)
+			}
+			if _, posted := find(msgs, "broadcast"); posted != (tt.wantCode == "") {
+				t.Errorf("second /flip posted = %v", posted)
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package chatserver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"cli-chat-app/pkg/chatpb"
+)
+
+// grpcService serves the gRPC API. Each call is handled by the handler of
+// the matching WebSocket request, run for a Client with no connection whose
+// replies are collected to answer the call.
+type grpcService struct {
+	chatpb.UnimplementedChatServiceServer
+	s *Server
+}
+
+// errorDomain names this server in the ErrorInfo details of failed calls.
+const errorDomain = "cli-chat-app"
+
+// grpcCodes maps error codes to the nearest gRPC status codes.
+var grpcCodes = map[string]codes.Code{
+	CodeInvalidRequest:   codes.InvalidArgument,
+	CodeUnknownType:      codes.Unimplemented,
+	CodeUnsupported:      codes.FailedPrecondition,
+	CodeUnauthenticated:  codes.Unauthenticated,
+	CodeAccountDisabled:  codes.PermissionDenied,
+	CodeForbidden:        codes.PermissionDenied,
+	CodeBanned:           codes.PermissionDenied,
+	CodeNotMember:        codes.FailedPrecondition,
+	CodePasswordRequired: codes.PermissionDenied,
+	CodeWrongPassword:    codes.PermissionDenied,
+	CodeRoomNotFound:     codes.NotFound,
+	CodeUserNotFound:     codes.NotFound,
+	CodeNotFound:         codes.NotFound,
+	CodeAlreadyExists:    codes.AlreadyExists,
+	CodeGone:             codes.FailedPrecondition,
+	CodeDisabled:         codes.FailedPrecondition,
+	CodeTooLarge:         codes.InvalidArgument,
+	CodeLimitExceeded:    codes.ResourceExhausted,
+	CodeRateLimited:      codes.ResourceExhausted,
+	CodeSpam:             codes.ResourceExhausted,
+	CodeContentBlocked:   codes.InvalidArgument,
+	CodeInternal:         codes.Internal,
+}
+
+// rpcError turns an error message into a gRPC status carrying its code.
+func rpcError(msg Message) error {
+	code, ok := grpcCodes[msg.Code]
+	if !ok {
+		code = codes.Unknown
+	}
+	st := status.New(code, msg.Content)
+	if detailed, err := st.WithDetails(&errdetails.ErrorInfo{Reason: msg.Code, Domain: errorDomain}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// peerAddr is the address a call came from, refusing banned ones.
+func (g *grpcService) peerAddr(ctx context.Context) (netip.Addr, error) {
+	var ip netip.Addr
+	if p, ok := peer.FromContext(ctx); ok {
+		if addr, err := netip.ParseAddrPort(p.Addr.String()); err == nil {
+			ip = addr.Addr().Unmap()
+		}
+	}
+	if g.s.ipBanned(ip) {
+		g.s.logger.Info("refused banned address", "ip", ip)
+		return ip, rpcError(Message{Code: CodeBanned, Content: "Your address has been banned"})
+	}
+	return ip, nil
+}
+
+// sessionToken is the bearer token in ctx's authorization metadata.
+func sessionToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(v, "Bearer "); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+// call handles msg as a request from the user whose session token is in
+// ctx, or from nobody if there is none.
+func (g *grpcService) call(ctx context.Context, msg Message) ([]Message, error) {
+	ip, err := g.peerAddr(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var username string
+	if token := sessionToken(ctx); token != "" {
+		if username, err = g.s.sessions.Verify(token); err != nil {
+			g.s.metrics.authFailure("invalid_session")
+			return nil, rpcError(Message{Code: CodeUnauthenticated, Content: "Invalid or expired session"})
+		}
+		if account, err := g.s.accounts.Find(username); err != nil || account.Disabled {
+			g.s.metrics.authFailure("account_disabled")
+			return nil, rpcError(Message{Code: CodeUnauthenticated, Content: "Invalid or expired session"})
+		}
+	}
+	replies, failure := g.s.call(ip, "grpc", username, msg)
+	if failure != nil {
+		return nil, rpcError(*failure)
+	}
+	return replies, nil
+}
+
+func (g *grpcService) SignUp(ctx context.Context, req *chatpb.SignUpRequest) (*chatpb.SignUpResponse, error) {
+	if _, err := g.call(ctx, Message{Type: "signup", Sender: req.Username, Content: req.Password}); err != nil {
+		return nil, err
+	}
+	return &chatpb.SignUpResponse{}, nil
+}
+
+// SignIn checks the user's password and issues a session token. Unlike the
+// WebSocket signin it does not connect the user; Subscribe does that.
+func (g *grpcService) SignIn(ctx context.Context, req *chatpb.SignInRequest) (*chatpb.SignInResponse, error) {
+	if _, err := g.peerAddr(ctx); err != nil {
+		return nil, err
+	}
+	if err := g.s.credentials.Authenticate(req.Username, req.Password); err != nil {
+		switch {
+		case errors.Is(err, ErrAccountDisabled):
+			g.s.metrics.authFailure("account_disabled")
+			return nil, rpcError(Message{Code: CodeAccountDisabled, Content: "Account is disabled"})
+		case errors.Is(err, ErrInvalidCredentials):
+			g.s.logger.Warn("grpc signin failed", "user", req.Username)
+			g.s.metrics.authFailure("invalid_credentials")
+		default:
+			g.s.logger.Error("grpc signin", "err", err)
+		}
+		return nil, rpcError(Message{Code: CodeUnauthenticated, Content: "Invalid username or password"})
+	}
+	token, err := g.s.sessions.Issue(req.Username)
+	if err != nil {
+		g.s.logger.Error("issue session", "err", err)
+		return nil, rpcError(Message{Code: CodeInternal, Content: "Signin failed"})
+	}
+	return &chatpb.SignInResponse{Token: token}, nil
+}
+
+func (g *grpcService) ListRooms(ctx context.Context, req *chatpb.ListRoomsRequest) (*chatpb.ListRoomsResponse, error) {
+	replies, err := g.call(ctx, Message{Type: "list_rooms", Content: req.Query, Limit: int(req.Limit), Cursor: req.Cursor})
+	if err != nil {
+		return nil, err
+	}
+	resp := &chatpb.ListRoomsResponse{}
+	for _, reply := range replies {
+		var page RoomPage
+		if reply.Type != "rooms" || reply.DecodeData(&page) != nil {
+			continue
+		}
+		for _, room := range page.Rooms {
+			resp.Rooms = append(resp.Rooms, &chatpb.Room{
+				Name:        room.Name,
+				Owner:       room.Owner,
+				Topic:       room.Topic,
+				Description: room.Description,
+				Tags:        room.Tags,
+				Members:     int32(room.Members),
+				Online:      int32(room.Online),
+				Protected:   room.Protected,
+				InviteOnly:  room.InviteOnly,
+			})
+		}
+		resp.Next = page.Next
+	}
+	return resp, nil
+}
+
+func (g *grpcService) CreateRoom(ctx context.Context, req *chatpb.CreateRoomRequest) (*chatpb.CreateRoomResponse, error) {
+	if _, err := g.call(ctx, Message{Type: "create_room", Content: req.Name, Private: req.Private, Password: req.Password}); err != nil {
+		return nil, err
+	}
+	return &chatpb.CreateRoomResponse{}, nil
+}
+
+func (g *grpcService) JoinRoom(ctx context.Context, req *chatpb.JoinRoomRequest) (*chatpb.JoinRoomResponse, error) {
+	if _, err := g.call(ctx, Message{Type: "join_room", Content: req.Room, Password: req.Password, Invite: req.Invite}); err != nil {
+		return nil, err
+	}
+	return &chatpb.JoinRoomResponse{}, nil
+}
+
+func (g *grpcService) LeaveRoom(ctx context.Context, req *chatpb.LeaveRoomRequest) (*chatpb.LeaveRoomResponse, error) {
+	if _, err := g.call(ctx, Message{Type: "leave_room", Content: req.Room}); err != nil {
+		return nil, err
+	}
+	return &chatpb.LeaveRoomResponse{}, nil
+}
+
+func (g *grpcService) SendMessage(ctx context.Context, req *chatpb.SendMessageRequest) (*chatpb.SendMessageResponse, error) {
+	msg := Message{Type: "broadcast", Room: req.Room, Content: req.Content, Format: req.Format, ReplyTo: req.ReplyTo}
+	if _, err := g.call(ctx, msg); err != nil {
+		return nil, err
+	}
+	return &chatpb.SendMessageResponse{}, nil
+}
+
+// Subscribe resumes the caller's session on a Client whose messages are
+// streamed to them, until either side ends the stream.
+func (g *grpcService) Subscribe(req *chatpb.SubscribeRequest, stream chatpb.ChatService_SubscribeServer) error {
+	ctx := stream.Context()
+	ip, err := g.peerAddr(ctx)
+	if err != nil {
+		return err
+	}
+	c := g.s.newCallClient(ip, "grpc")
+
+	g.s.connWG.Add(1)
+	defer g.s.connWG.Done()
+	defer g.s.disconnect(c)
+	g.s.connLock.Lock()
+	g.s.conns[c] = true
+	g.s.connLock.Unlock()
+
+	g.s.dispatch(c, Message{Type: "resume", Content: sessionToken(ctx)}, nil)
+	if g.s.userOf(c) == nil {
+		for {
+			select {
+			case reply := <-c.send:
+				if reply.Type == "error" {
+					return rpcError(reply)
+				}
+			default:
+				return rpcError(Message{Code: CodeUnauthenticated, Content: "Invalid or expired session"})
+			}
+		}
+	}
+
+	for {
+		select {
+		case msg := <-c.send:
+			if err := stream.Send(eventOf(msg)); err != nil {
+				return err
+			}
+		case <-c.flush:
+			// The server is closing the connection; send what is queued.
+			for {
+				select {
+				case msg := <-c.send:
+					if err := stream.Send(eventOf(msg)); err != nil {
+						return err
+					}
+				default:
+					return status.Error(codes.Unavailable, "connection closed by the server")
+				}
+			}
+		case <-c.done:
+			return status.Error(codes.Unavailable, "connection closed by the server")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// eventOf converts msg for a Subscribe stream.
+func eventOf(msg Message) *chatpb.Event {
+	e := &chatpb.Event{
+		Type:      msg.Type,
+		Sender:    msg.Sender,
+		Target:    msg.Target,
+		Content:   msg.Content,
+		Format:    msg.Format,
+		Room:      msg.Room,
+		MessageId: msg.MessageID,
+		Seq:       msg.Seq,
+		Timestamp: msg.Timestamp,
+		ReplyTo:   msg.ReplyTo,
+		ThreadId:  msg.ThreadID,
+		Edited:    msg.Edited,
+		Deleted:   msg.Deleted,
+		Mentions:  msg.Mentions,
+		Code:      msg.Code,
+	}
+	if msg.Data != nil {
+		e.Data, _ = json.Marshal(msg.Data)
+	}
+	return e
+}
+
+// newGRPCServer makes the gRPC server for the API, using opts.
+func (s *Server) newGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(opts...)
+	chatpb.RegisterChatServiceServer(srv, &grpcService{s: s})
+	return srv
+}
+
+// grpcTLSConfig is the TLS configuration of the gRPC listener, serving the
+// same certificate as the main listener.
+func (s *Server) grpcTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.tlsConfig != nil {
+		cfg = s.tlsConfig.Clone()
+	}
+	if s.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(s.tlsCert, s.tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
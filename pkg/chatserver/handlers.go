@@ -0,0 +1,248 @@
+package chatserver
+
+import (
+	"errors"
+)
+
+func (s *Server) handleSignup(c *Client, msg Message) {
+	if problem := usernameProblem(msg.Sender); problem != "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: problem})
+		return
+	}
+	if err := s.credentials.Register(msg.Sender, msg.Content); err != nil {
+		if errors.Is(err, ErrUserExists) {
+			c.Reply(Message{Type: "error", Code: CodeAlreadyExists, Content: "Username already exists"})
+			return
+		}
+		c.reqLogger.Error("signup", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Signup failed"})
+		return
+	}
+
+	s.userLock.Lock()
+	s.users[msg.Sender] = newUser(msg.Sender)
+	s.userLock.Unlock()
+
+	c.Reply(Message{Type: "info", Content: "Signup successful"})
+}
+
+func (s *Server) handleSignin(c *Client, msg Message) {
+	if err := s.credentials.Authenticate(msg.Sender, msg.Content); err != nil {
+		switch {
+		case errors.Is(err, ErrAccountDisabled):
+			s.metrics.authFailure("account_disabled")
+			c.Reply(Message{Type: "error", Code: CodeAccountDisabled, Content: "Account is disabled"})
+			return
+		case errors.Is(err, ErrInvalidCredentials):
+			c.reqLogger.Warn("signin failed", "user", msg.Sender)
+			s.metrics.authFailure("invalid_credentials")
+		default:
+			c.reqLogger.Error("signin", "err", err)
+		}
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "Invalid username or password"})
+		return
+	}
+	s.signIn(c, msg.Sender)
+}
+
+// signIn issues a session for username, whose identity has been checked,
+// and attaches c to it, rejoining the user's rooms.
+func (s *Server) signIn(c *Client, username string) {
+	token, err := s.sessions.Issue(username)
+	if err != nil {
+		c.reqLogger.Error("issue session", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Signin failed"})
+		return
+	}
+
+	user := s.loadUser(username)
+	s.attach(c, user, token)
+	rejoined := s.rejoinRooms(user)
+
+	c.Reply(Message{Type: "info", Content: "Signin successful"})
+	c.Send(Message{Type: "session", Content: token})
+	for _, name := range rejoined {
+		c.Reply(Message{Type: "info", Content: "Rejoined room", Room: name})
+	}
+	s.sendSyncState(c, user, rejoined)
+	s.deliverQueuedDMs(c, user)
+}
+
+// handleResume signs a reconnecting client back in with the session token it
+// was given at signin, restoring its identity and rooms.
+func (s *Server) handleResume(c *Client, msg Message) {
+	username, err := s.sessions.Verify(msg.Content)
+	if err != nil {
+		s.metrics.authFailure("invalid_session")
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "Invalid or expired session"})
+		return
+	}
+	if account, err := s.accounts.Find(username); err != nil || account.Disabled {
+		s.metrics.authFailure("account_disabled")
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "Invalid or expired session"})
+		return
+	}
+
+	user := s.loadUser(username)
+	s.attach(c, user, msg.Content)
+	rejoined := s.rejoinRooms(user)
+
+	c.Reply(Message{Type: "info", Content: "Resume successful"})
+	for _, name := range rejoined {
+		c.Reply(Message{Type: "info", Content: "Rejoined room", Room: name})
+	}
+	s.sendSyncState(c, user, rejoined)
+	s.deliverQueuedDMs(c, user)
+}
+
+// rejoinRooms lists user as a member of the rooms they were in when they
+// last disconnected, forgetting those that no longer exist, and returns
+// their names.
+func (s *Server) rejoinRooms(user *User) []string {
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	var rejoined []string
+	for name := range user.Rooms {
+		room, exists := s.rooms[name]
+		if !exists {
+			delete(user.Rooms, name)
+			continue
+		}
+		if !room.hasMember(user) {
+			room.Members = append(room.Members, user)
+		}
+		rejoined = append(rejoined, name)
+	}
+	return rejoined
+}
+
+// loadUser returns the in-memory user for username, creating it if needed.
+// Accounts outlive the process, so it may not exist yet.
+func (s *Server) loadUser(username string) *User {
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		user = newUser(username)
+		s.users[username] = user
+	}
+	return user
+}
+
+// attach binds user to c for the session identified by token.
+func (s *Server) attach(c *Client, user *User, token string) {
+	s.clientLock.Lock()
+	if prev := s.clients[c]; prev != nil && prev != user {
+		prev.removeConn(c)
+	}
+	s.clients[c] = user
+	user.addConn(c)
+	c.session = token
+	s.clientLock.Unlock()
+
+	s.announcePresence(user, true)
+	s.recordLastSeen(user.Username)
+	s.loadTranslateTo(user)
+	c.logger.Info("signed in", "user", user.Username)
+}
+
+func (s *Server) handleSignout(c *Client) {
+	s.clientLock.Lock()
+	user, ok := s.clients[c]
+	detached := ok && user.removeConn(c)
+	delete(s.clients, c)
+	s.clientLock.Unlock()
+
+	if detached {
+		s.announcePresence(user, false)
+		s.recordLastSeen(user.Username)
+		s.dropMemberships(user)
+	}
+	c.reqLogger.Info("signed out")
+	s.sessions.Revoke(c.session)
+	c.session = ""
+	c.Reply(Message{Type: "info", Content: "Signout successful"})
+}
+
+func (s *Server) handleChat(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if msg.Room == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Message must name a room"})
+		return
+	}
+	// Forwards, previews, bridges, polls and translations are for the server to add.
+	msg.Forwarded, msg.Preview, msg.Bridge, msg.Poll, msg.Translations = nil, nil, "", nil, nil
+	s.postChat(c, user, msg)
+}
+
+// postChat runs msg, a chat message from user, past commands, plugins and
+// scripts, and posts it.
+func (s *Server) postChat(c *Client, user *User, msg Message) {
+	if s.runCommand(c, user, &msg) || !s.pluginsAllowMessage(c, user, &msg) {
+		return
+	}
+	posts, ok := s.scriptsAllowMessage(c, user, &msg)
+	if !ok {
+		return
+	}
+	if !s.resolveAttachments(c, user, &msg) {
+		return
+	}
+	mentioned := s.mentionedUsers(msg.Content)
+
+	s.roomLock.Lock()
+	msg, ok = s.postLocked(c, user, msg, mentioned)
+	s.roomLock.Unlock()
+
+	if ok {
+		s.notifyMentions(msg)
+		s.relayScriptPosts(posts)
+	}
+}
+
+// checkFloodLocked replies to c with an error and returns false if user may
+// not post content to room now, being over the rate limit, in slow mode or
+// muted, or if content looks like spam. Commands that post for the user are
+// checked like messages. The caller must hold roomLock.
+func (s *Server) checkFloodLocked(c *Client, user *User, room *Room, content string) bool {
+	return s.checkRate(c, user, room.Name, s.rateLimitFor(room)) &&
+		s.checkSlowModeLocked(c, user, room) &&
+		s.checkSpamLocked(c, user, room, content)
+}
+
+// postLocked checks and records a chat message from user and sends it to
+// the room, returning it as sent. Of the mentioned users, those in the room
+// are listed in its Mentions. The caller must hold roomLock.
+func (s *Server) postLocked(c *Client, user *User, msg Message, mentioned []*User) (Message, bool) {
+	if !user.Rooms[msg.Room] {
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return msg, false
+	}
+	room := s.rooms[msg.Room]
+	if !s.checkFloodLocked(c, user, room, msg.Content) {
+		return msg, false
+	}
+	content, ok := s.filterContentLocked(c, room, msg.Content)
+	if !ok {
+		return msg, false
+	}
+	msg.Content = content
+	normalizeFormat(&msg)
+	s.expandEmojiIn(&msg)
+
+	msg.Sender = user.Username
+	if !s.resolveThread(c, &msg) {
+		return msg, false
+	}
+	if !setExpiry(c, &msg) {
+		return msg, false
+	}
+	msg.Mentions = mentionsLocked(room, mentioned, user.Username)
+	return s.postToRoomLocked(room, msg), true
+}
@@ -0,0 +1,209 @@
+package chatserver
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSignin(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      Message
+		disabled bool
+		wantCode string
+	}{
+		{"right password", Message{Type: "signin", Sender: "alice", Content: "alice-password"}, false, ""},
+		{"wrong password", Message{Type: "signin", Sender: "alice", Content: "guess"}, false, CodeUnauthenticated},
+		{"unknown user", Message{Type: "signin", Sender: "bob", Content: "bob-password"}, false, CodeUnauthenticated},
+		{"disabled", Message{Type: "signin", Sender: "alice", Content: "alice-password"}, true, CodeAccountDisabled},
+		{"no password", Message{Type: "signin", Sender: "alice"}, false, CodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			c := newTestClient(s)
+			mustDo(t, s, c, Message{Type: "signup", Sender: "alice", Content: "alice-password"})
+			if tt.disabled {
+				account, _ := s.accounts.Find("alice")
+				account.Disabled = true
+				s.accounts.Update(account)
+			}
+
+			msgs := do(s, c, tt.msg)
+			if code := errorCode(msgs); code != tt.wantCode {
+				t.Fatalf("signin answered %q, want %q", code, tt.wantCode)
+			}
+			signedIn := tt.wantCode == ""
+			if got := s.userOf(c) != nil; got != signedIn {
+				t.Errorf("signed in = %v, want %v", got, signedIn)
+			}
+			if _, ok := find(msgs, "session"); ok != signedIn {
+				t.Errorf("session token sent = %v, want %v", ok, signedIn)
+			}
+		})
+	}
+}
+
+func TestSignupDuplicate(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(s)
+	mustDo(t, s, c, Message{Type: "signup", Sender: "alice", Content: "alice-password"})
+	if code := errorCode(do(s, c, Message{Type: "signup", Sender: "alice", Content: "other"})); code != CodeAlreadyExists {
+		t.Errorf("second signup answered %q, want %q", code, CodeAlreadyExists)
+	}
+}
+
+func TestSignupUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		ok       bool
+	}{
+		{"plain", "alice", true},
+		{"punctuation", "alice_b-c.d", true},
+		{"accents", "zoë", true},
+		{"longest", strings.Repeat("u", maxNameLength), true},
+		{"empty", "", false},
+		{"too long", strings.Repeat("u", maxNameLength+1), false},
+		{"at sign", "alice@example.com", false},
+		{"leading at sign", "@alice", false},
+		{"space", "alice b", false},
+		{"slash", "a/b", false},
+		{"newline", "a\nb", false},
+		{"escape", "a\x1bb", false},
+		{"reserved server", "server", false},
+		{"reserved system", "System", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			c := newTestClient(s)
+			code := errorCode(do(s, c, Message{Type: "signup", Sender: tt.username, Content: "password"}))
+			if tt.ok && code != "" {
+				t.Errorf("signup %q answered %q", tt.username, code)
+			}
+			if !tt.ok && code != CodeInvalidRequest {
+				t.Errorf("signup %q answered %q, want %q", tt.username, code, CodeInvalidRequest)
+			}
+			if _, err := s.accounts.Find(tt.username); (err == nil) != tt.ok {
+				t.Errorf("account created = %v, want %v", err == nil, tt.ok)
+			}
+		})
+	}
+}
+
+func TestResume(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   func(s *Server, c *Client)
+		wantCode string
+	}{
+		{"after dropping the connection", nil, ""},
+		{"after signing out", func(s *Server, c *Client) {
+			do(s, c, Message{Type: "signout"})
+		}, CodeUnauthenticated},
+		{"after being signed out", func(s *Server, c *Client) {
+			s.ForceSignout("alice", "bye")
+		}, CodeUnauthenticated},
+		{"after being disabled", func(s *Server, c *Client) {
+			account, _ := s.accounts.Find("alice")
+			account.Disabled = true
+			s.accounts.Update(account)
+		}, CodeUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			c := signIn(t, s, "alice")
+			token := c.session
+			if tt.before != nil {
+				tt.before(s, c)
+			}
+
+			resumed := newTestClient(s)
+			msgs := do(s, resumed, Message{Type: "resume", Content: token})
+			if code := errorCode(msgs); code != tt.wantCode {
+				t.Fatalf("resume answered %q, want %q", code, tt.wantCode)
+			}
+			if got := s.userOf(resumed) != nil; got != (tt.wantCode == "") {
+				t.Errorf("signed in = %v", got)
+			}
+		})
+	}
+}
+
+func TestSignedInOnSeveralConnections(t *testing.T) {
+	s := newTestServer(t)
+	bob := signIn(t, s, "bob")
+	mustDo(t, s, bob, Message{Type: "create_room", Content: "general"})
+	mustDo(t, s, bob, Message{Type: "join_room", Content: "general"})
+	first := signIn(t, s, "alice")
+	second := signIn(t, s, "alice")
+	mustDo(t, s, first, Message{Type: "join_room", Content: "general"})
+	drain(first)
+	drain(second)
+
+	received := func(c *Client, msgType, content string) bool {
+		for _, msg := range drain(c) {
+			if msg.Type == msgType && msg.Content == content {
+				return true
+			}
+		}
+		return false
+	}
+
+	mustDo(t, s, bob, Message{Type: "broadcast", Room: "general", Content: "hello"})
+	for i, c := range []*Client{first, second} {
+		if !received(c, "broadcast", "hello") {
+			t.Errorf("connection %d missed the room message", i+1)
+		}
+	}
+	mustDo(t, s, bob, Message{Type: "dm", Target: "alice", Content: "psst"})
+	for i, c := range []*Client{first, second} {
+		if !received(c, "dm", "psst") {
+			t.Errorf("connection %d missed the direct message", i+1)
+		}
+	}
+
+	s.disconnect(first)
+	if !s.isOnline("alice") {
+		t.Fatal("alice offline while still connected on the second connection")
+	}
+	mustDo(t, s, bob, Message{Type: "broadcast", Room: "general", Content: "still there?"})
+	if !received(second, "broadcast", "still there?") {
+		t.Error("second connection stopped getting room messages after the first closed")
+	}
+
+	s.disconnect(second)
+	if s.isOnline("alice") {
+		t.Error("alice online after both connections closed")
+	}
+}
+
+// TestSignInWhileDelivering is meant to be run with -race: connections
+// signing in and out must not race with messages being delivered to them.
+func TestSignInWhileDelivering(t *testing.T) {
+	s := newTestServer(t)
+	bob := signIn(t, s, "bob")
+	mustDo(t, s, bob, Message{Type: "create_room", Content: "general"})
+	mustDo(t, s, bob, Message{Type: "join_room", Content: "general"})
+	alice := signIn(t, s, "alice")
+	mustDo(t, s, alice, Message{Type: "join_room", Content: "general"})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			c := newTestClient(s)
+			do(s, c, Message{Type: "signin", Sender: "alice", Content: "alice-password"})
+			s.disconnect(c)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		do(s, bob, Message{Type: "broadcast", Room: "general", Content: "hello"})
+		drain(alice)
+	}
+	wg.Wait()
+}
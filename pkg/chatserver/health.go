@@ -0,0 +1,67 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Pinger is implemented by stores and brokers that can check their
+// connection. /readyz pings every one the server uses.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// readyTimeout bounds how long /readyz waits for each check.
+const readyTimeout = 2 * time.Second
+
+// handleHealthz serves GET /healthz, which succeeds whenever the process is
+// able to serve HTTP.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz serves GET /readyz, which checks the storage backends and
+// broker and answers 503 if any of them is unreachable. The body reports
+// each check's result.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]any{
+		"accounts":     s.accounts,
+		"messages":     s.messages,
+		"search":       s.search,
+		"read_markers": s.readMarkers,
+	}
+	if s.broker != nil {
+		checks["broker"] = s.broker
+	}
+
+	ready := true
+	results := make(map[string]string, len(checks))
+	for name, backend := range checks {
+		p, ok := backend.(Pinger)
+		if !ok {
+			results[name] = "ok"
+			continue
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		err := p.Ping(ctx)
+		cancel()
+		if err != nil {
+			s.logger.Warn("readiness check failed", "check", name, "err", err)
+			results[name] = err.Error()
+			ready = false
+			continue
+		}
+		results[name] = "ok"
+	}
+
+	status := "ok"
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": results})
+}
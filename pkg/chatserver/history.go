@@ -0,0 +1,238 @@
+package chatserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// historyLock serialises appends to room history files.
+var historyLock sync.Mutex
+
+// HistoryFile is the name of the file a room's history is kept in. Each
+// line is one JSON-encoded Message: the chat messages themselves, and the
+// edit, deleted, reactions and preview events that changed them later.
+func HistoryFile(room string) string {
+	return fmt.Sprintf("chat_history_%s.jsonl", room)
+}
+
+// historyPath is where room's history file is kept.
+func (s *Server) historyPath(room string) string {
+	return filepath.Join(s.historyDir, HistoryFile(room))
+}
+
+// appendHistory writes entry to the end of its room's history file.
+func (s *Server) appendHistory(entry Message) {
+	if !s.historyFiles {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		s.logger.Error("encode history", "room", entry.Room, "err", err)
+		return
+	}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	defer s.metrics.observeHistoryWrite(time.Now())
+
+	file, err := os.OpenFile(s.historyPath(entry.Room), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		s.logger.Error("open history", "room", entry.Room, "err", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		s.logger.Error("write history", "room", entry.Room, "err", err)
+	}
+}
+
+// compactHistory rewrites room's history file from the message store, so
+// it holds only the messages still kept, in their current state.
+func (s *Server) compactHistory(room string) {
+	if !s.historyFiles {
+		return
+	}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	messages, err := s.messages.Messages(room)
+	if err != nil {
+		s.logger.Error("load messages", "room", room, "err", err)
+		return
+	}
+
+	path := s.historyPath(room)
+	tmp, err := os.CreateTemp(s.historyDir, HistoryFile(room)+".*.tmp")
+	if err != nil {
+		s.logger.Error("compact history", "room", room, "err", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			s.logger.Error("compact history", "room", room, "err", err)
+			tmp.Close()
+			return
+		}
+	}
+	if err := w.Flush(); err != nil {
+		s.logger.Error("compact history", "room", room, "err", err)
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		s.logger.Error("compact history", "room", room, "err", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		s.logger.Error("compact history", "room", room, "err", err)
+	}
+}
+
+// loadHistory replays room's history file into the message store and search
+// index, applying later edits, deletions and reactions to the messages they
+// refer to. It does nothing if the store already holds messages for room.
+func (s *Server) loadHistory(room string) {
+	if !s.historyFiles {
+		return
+	}
+	if existing, err := s.messages.Page(room, 0, 1); err != nil || len(existing) > 0 {
+		return
+	}
+
+	file, err := os.Open(s.historyPath(room))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Error("open history", "room", room, "err", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry Message
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			s.logger.Error("bad history entry", "file", file.Name(), "err", err)
+			continue
+		}
+		entry.Room = room
+		if err := s.replayHistory(entry); err != nil && !errors.Is(err, ErrMessageNotFound) {
+			s.logger.Error("replay history", "file", file.Name(), "message_id", entry.MessageID, "err", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		s.logger.Error("read history", "file", file.Name(), "err", err)
+	}
+}
+
+// replayHistory applies one history entry to the message store.
+func (s *Server) replayHistory(entry Message) error {
+	if entry.Type != "edit" && entry.Type != "deleted" && entry.Type != "reactions" && entry.Type != "preview" {
+		// A message stored just before the file was compacted can be
+		// written to it twice.
+		if _, err := s.messages.Get(entry.Room, entry.MessageID); err == nil {
+			return nil
+		}
+		// A self-destructing message that expired while the server was
+		// down comes back only as a tombstone.
+		if entry.expired(time.Now()) {
+			entry = tombstoneOf(entry)
+		}
+		if err := s.messages.Append(&entry); err != nil {
+			return err
+		}
+		if entry.Deleted {
+			return nil
+		}
+		return s.search.Index(entry)
+	}
+
+	stored, err := s.messages.Get(entry.Room, entry.MessageID)
+	if err != nil {
+		return err
+	}
+	switch entry.Type {
+	case "edit":
+		stored.Content = entry.Content
+		stored.Edited = true
+	case "deleted":
+		stored = tombstoneOf(stored)
+	case "reactions":
+		stored.Reactions = entry.Reactions
+	case "preview":
+		stored.Preview = entry.Preview
+	}
+	if err := s.messages.Update(stored); err != nil {
+		return err
+	}
+	if stored.Deleted {
+		return s.search.Remove(stored.Room, stored.MessageID)
+	}
+	return s.search.Index(stored)
+}
+
+// defaultHistoryPage and maxHistoryPage bound how many messages a single
+// history response carries.
+const (
+	defaultHistoryPage = 50
+	maxHistoryPage     = 200
+)
+
+// handleHistory sends a page of msg.Room's messages older than msg.Before,
+// or the latest ones if it is 0.
+func (s *Server) handleHistory(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	member := user.Rooms[msg.Room]
+	s.roomLock.Unlock()
+	if !member {
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return
+	}
+
+	s.sendHistoryPage(c, msg.Room, msg.Before, msg.Limit)
+}
+
+// sendHistoryPage sends c up to limit of room's messages with a sequence
+// number below before. The reply's Before is the cursor for the next older
+// page, or 0 once the start of the room is reached.
+func (s *Server) sendHistoryPage(c *Client, room string, before uint64, limit int) {
+	switch {
+	case limit <= 0:
+		limit = defaultHistoryPage
+	case limit > maxHistoryPage:
+		limit = maxHistoryPage
+	}
+
+	page, err := s.messages.Page(room, before, limit)
+	if err != nil {
+		c.reqLogger.Error("load history", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not load history", Room: room})
+		return
+	}
+
+	reply := Message{Type: "history", Room: room}
+	if len(page) > 0 && page[0].Seq > 1 {
+		reply.Before = page[0].Seq
+	}
+	reply.Data = withoutExpired(page)
+	c.Send(reply)
+}
@@ -0,0 +1,283 @@
+package chatserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Hooks let integrations such as CI pipelines and monitoring systems post
+// to a room. Admins add a hook with a name and a room, and anything that
+// knows its token can POST a message to /hooks/{token}; the message is sent
+// to the room with the hook's name as its sender and Bridge set to hook.
+// Only a hash of the token is kept, so it is shown just once.
+
+var ErrHookNotFound = errors.New("hook not found")
+
+// BridgeHook is the Bridge of messages posted through hooks.
+const BridgeHook = "hook"
+
+// Hook posts the messages sent to its URL to Room as Name. Token is only
+// set when the hook is added; TokenHash identifies it afterwards.
+type Hook struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Room      string    `json:"room"`
+	Token     string    `json:"token,omitempty"`
+	TokenHash string    `json:"-"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HookRequest is the Data of an admin_add_hook request.
+type HookRequest struct {
+	Name string `json:"name"`
+	Room string `json:"room"`
+}
+
+// hookPayload is the body of a post to a hook. Text is accepted in place
+// of Content so that tools which speak Slack's webhook payloads work.
+type hookPayload struct {
+	Content string `json:"content"`
+	Text    string `json:"text"`
+	Format  string `json:"format"`
+	ReplyTo string `json:"reply_to"`
+}
+
+// HookStore keeps the hooks admins add.
+type HookStore interface {
+	AddHook(hook Hook) error
+	RemoveHook(id string) error
+	Hooks() ([]Hook, error)
+}
+
+// MemoryHookStore keeps hooks in memory.
+type MemoryHookStore struct {
+	mu    sync.Mutex
+	hooks map[string]Hook
+}
+
+func NewMemoryHookStore() *MemoryHookStore {
+	return &MemoryHookStore{hooks: make(map[string]Hook)}
+}
+
+func (m *MemoryHookStore) AddHook(hook Hook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks[hook.ID] = hook
+	return nil
+}
+
+func (m *MemoryHookStore) RemoveHook(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.hooks[id]; !ok {
+		return ErrHookNotFound
+	}
+	delete(m.hooks, id)
+	return nil
+}
+
+func (m *MemoryHookStore) Hooks() ([]Hook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hooks := make([]Hook, 0, len(m.hooks))
+	for _, hook := range m.hooks {
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// hashHookToken returns what is kept of a hook's token.
+func hashHookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadHooks fills the in-memory index of hooks from the store.
+func (s *Server) loadHooks() {
+	hooks, err := s.hookStore.Hooks()
+	if err != nil {
+		s.logger.Error("load hooks", "err", err)
+		return
+	}
+	s.hookLock.Lock()
+	for _, hook := range hooks {
+		s.hooks[hook.TokenHash] = hook
+	}
+	s.hookLock.Unlock()
+}
+
+// Hooks returns the hooks, oldest first.
+func (s *Server) Hooks() []Hook {
+	s.hookLock.RLock()
+	hooks := make([]Hook, 0, len(s.hooks))
+	for _, hook := range s.hooks {
+		hooks = append(hooks, hook)
+	}
+	s.hookLock.RUnlock()
+
+	slices.SortFunc(hooks, func(a, b Hook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return hooks
+}
+
+// AddHook adds a hook for req, returning it with its token. by names who
+// added it.
+func (s *Server) AddHook(req HookRequest, by string) (Hook, error) {
+	s.roomLock.Lock()
+	_, ok := s.rooms[req.Room]
+	s.roomLock.Unlock()
+	if !ok {
+		return Hook{}, ErrRoomNotFound
+	}
+
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		return Hook{}, err
+	}
+	hook := Hook{
+		ID:        newMessageID(time.Now()),
+		Name:      req.Name,
+		Room:      req.Room,
+		Token:     hex.EncodeToString(token),
+		CreatedBy: by,
+		CreatedAt: time.Now().UTC(),
+	}
+	hook.TokenHash = hashHookToken(hook.Token)
+	stored := hook
+	stored.Token = ""
+	if err := s.hookStore.AddHook(stored); err != nil {
+		return Hook{}, err
+	}
+
+	s.hookLock.Lock()
+	s.hooks[hook.TokenHash] = stored
+	s.hookLock.Unlock()
+	s.audit(AuditEntry{Actor: by, Action: "add_hook", Target: hook.ID, Detail: hook.Name + " in " + hook.Room})
+	return hook, nil
+}
+
+// RemoveHook removes the hook id, after which its token is refused. by
+// names who removed it.
+func (s *Server) RemoveHook(id, by string) error {
+	if err := s.hookStore.RemoveHook(id); err != nil {
+		return err
+	}
+
+	s.hookLock.Lock()
+	for hash, hook := range s.hooks {
+		if hook.ID == id {
+			delete(s.hooks, hash)
+		}
+	}
+	s.hookLock.Unlock()
+	s.audit(AuditEntry{Actor: by, Action: "remove_hook", Target: id})
+	return nil
+}
+
+// handleHook serves POST /hooks/{token}, posting the message in the body to
+// the room of the hook the token belongs to.
+func (s *Server) handleHook(w http.ResponseWriter, r *http.Request) {
+	s.hookLock.RLock()
+	hook, ok := s.hooks[hashHookToken(r.PathValue("token"))]
+	s.hookLock.RUnlock()
+	if !ok {
+		writeFailure(w, Message{Type: "error", Code: CodeNotFound, Content: "No such hook"})
+		return
+	}
+	var p hookPayload
+	body := http.MaxBytesReader(w, r.Body, int64(s.maxContent)*utf8.UTFMax+readLimitSlack)
+	if err := json.NewDecoder(body).Decode(&p); err != nil {
+		writeFailure(w, Message{Type: "error", Code: CodeInvalidRequest, Content: "Invalid payload"})
+		return
+	}
+	msg := Message{Room: hook.Room, Sender: hook.Name, Bridge: BridgeHook, Content: p.Content, Format: p.Format, ReplyTo: p.ReplyTo}
+	if msg.Content == "" {
+		msg.Content = p.Text
+	}
+	if strings.TrimSpace(msg.Content) == "" {
+		writeFailure(w, Message{Type: "error", Code: CodeInvalidRequest, Content: "Payload has no content"})
+		return
+	}
+
+	sent, err := s.relay(msg)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRoomNotFound):
+			writeFailure(w, Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: hook.Room})
+		case errors.Is(err, ErrRelayTooLong):
+			writeFailure(w, Message{Type: "error", Code: CodeTooLarge, Content: "Message is too large"})
+		case errors.Is(err, ErrContentRejected):
+			writeFailure(w, Message{Type: "error", Code: CodeContentBlocked, Content: "Message contains blocked words"})
+		default:
+			s.logger.Error("post hook message", "hook", hook.ID, "room", hook.Room, "err", err)
+			writeFailure(w, Message{Type: "error", Code: CodeInternal, Content: "Could not post message"})
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		MessageID string `json:"message_id"`
+	}{sent.MessageID})
+}
+
+// handleAdminAddHook adds the hook described by the HookRequest in
+// msg.Data, answering with it and its token.
+func (s *Server) handleAdminAddHook(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	var req HookRequest
+	if err := msg.DecodeData(&req); err != nil || strings.TrimSpace(req.Name) == "" || req.Room == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Request needs a name and a room in data"})
+		return
+	}
+	if utf8.RuneCountInString(req.Name) > maxNameLength {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Hook name is too long"})
+		return
+	}
+	hook, err := s.AddHook(req, admin.Username)
+	if err != nil {
+		if errors.Is(err, ErrRoomNotFound) {
+			c.Reply(Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: req.Room})
+			return
+		}
+		c.reqLogger.Error("add hook", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not add hook"})
+		return
+	}
+	c.Reply(Message{Type: "hook", Target: hook.ID, Room: hook.Room, Data: hook})
+}
+
+// handleAdminRemoveHook removes the hook whose ID is msg.Target.
+func (s *Server) handleAdminRemoveHook(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	if err := s.RemoveHook(msg.Target, admin.Username); err != nil {
+		if errors.Is(err, ErrHookNotFound) {
+			c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "No such hook", Target: msg.Target})
+			return
+		}
+		c.reqLogger.Error("remove hook", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not remove hook", Target: msg.Target})
+		return
+	}
+	c.Reply(Message{Type: "info", Content: "Hook removed", Target: msg.Target})
+}
+
+func (s *Server) handleAdminListHooks(c *Client, msg Message) {
+	if s.requireAdmin(c) == nil {
+		return
+	}
+	c.Reply(Message{Type: "hooks", Data: s.Hooks()})
+}
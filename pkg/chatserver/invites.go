@@ -0,0 +1,216 @@
+package chatserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// maxInvites caps the outstanding invite codes of one room.
+const maxInvites = 100
+
+// Invite lets whoever holds Code join an invite-only room. An invite with
+// MaxUses set is spent after that many joins; one with ExpiresAt set stops
+// working then.
+type Invite struct {
+	Code      string     `json:"code"`
+	Room      string     `json:"room"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	MaxUses   int        `json:"max_uses,omitempty"`
+	Uses      int        `json:"uses"`
+}
+
+func (i *Invite) expired(now time.Time) bool {
+	return i.ExpiresAt != nil && !now.Before(*i.ExpiresAt)
+}
+
+func newInviteCode() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// useInviteLocked admits a joiner on code, counting the use and dropping the
+// invite once it is spent. It reports false if the code is unknown, spent or
+// expired. The caller must hold roomLock.
+func (s *Server) useInviteLocked(room *Room, code string) bool {
+	invite, ok := room.Invites[code]
+	if !ok {
+		return false
+	}
+	if invite.expired(time.Now()) {
+		delete(room.Invites, code)
+		s.saveRoomLocked(room)
+		return false
+	}
+	invite.Uses++
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		delete(room.Invites, code)
+	}
+	s.saveRoomLocked(room)
+	return true
+}
+
+// requireOwnerLocked returns the room named in msg if user owns it, replying
+// to c with an error and returning nil otherwise. The caller must hold
+// roomLock.
+func (s *Server) requireOwnerLocked(c *Client, user *User, msg Message, action string) *Room {
+	room, exists := s.rooms[msg.Room]
+	if !exists {
+		c.Reply(Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: msg.Room})
+		return nil
+	}
+	if room.Owner != user.Username {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "Only the room owner can " + action, Room: room.Name})
+		return nil
+	}
+	return room
+}
+
+// handleSetInviteOnly lets a room's owner require an invite code to join.
+// msg.Content is on or off.
+func (s *Server) handleSetInviteOnly(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if msg.Content != "on" && msg.Content != "off" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Invite-only must be on or off", Room: msg.Room})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireOwnerLocked(c, user, msg, "make it invite-only")
+	if room == nil {
+		return
+	}
+
+	room.InviteOnly = msg.Content == "on"
+	s.saveRoomLocked(room)
+	s.fanoutLocked(room, Message{Type: "invite_only", Sender: user.Username, Room: room.Name, Content: msg.Content})
+}
+
+// handleCreateInvite gives a room's owner a new invite code. msg.Content is
+// how long it lasts as a Go duration such as "24h", or empty for no limit,
+// and msg.Limit how many joins it allows, or 0 for any number.
+func (s *Server) handleCreateInvite(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	now := time.Now().UTC()
+	invite := &Invite{Room: msg.Room, CreatedBy: user.Username, CreatedAt: now, MaxUses: msg.Limit}
+	if msg.Content != "" {
+		ttl, err := time.ParseDuration(msg.Content)
+		if err != nil || ttl <= 0 {
+			c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Invite lifetime must be a positive duration such as 24h", Room: msg.Room})
+			return
+		}
+		expires := now.Add(ttl)
+		invite.ExpiresAt = &expires
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		c.reqLogger.Error("generate invite code", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not create an invite", Room: msg.Room})
+		return
+	}
+	invite.Code = code
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireOwnerLocked(c, user, msg, "create invites")
+	if room == nil {
+		return
+	}
+	room.pruneInvites(now)
+	if len(room.Invites) >= maxInvites {
+		c.Reply(Message{Type: "error", Code: CodeLimitExceeded, Content: "The room has too many invites; revoke some first", Room: room.Name})
+		return
+	}
+
+	if room.Invites == nil {
+		room.Invites = make(map[string]*Invite)
+	}
+	room.Invites[code] = invite
+	s.saveRoomLocked(room)
+	c.Reply(Message{Type: "invite", Room: room.Name, Content: code, Data: *invite})
+}
+
+// handleRevokeInvite lets a room's owner withdraw the invite code in
+// msg.Content.
+func (s *Server) handleRevokeInvite(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireOwnerLocked(c, user, msg, "revoke invites")
+	if room == nil {
+		return
+	}
+	if _, ok := room.Invites[msg.Content]; !ok {
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "No such invite", Room: room.Name})
+		return
+	}
+
+	delete(room.Invites, msg.Content)
+	s.saveRoomLocked(room)
+	c.Reply(Message{Type: "info", Content: "Invite revoked", Room: room.Name})
+}
+
+// handleListInvites sends a room's owner its outstanding invites, oldest
+// first.
+func (s *Server) handleListInvites(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireOwnerLocked(c, user, msg, "list invites")
+	if room == nil {
+		return
+	}
+	if room.pruneInvites(time.Now()) {
+		s.saveRoomLocked(room)
+	}
+
+	invites := make([]Invite, 0, len(room.Invites))
+	for _, invite := range room.Invites {
+		invites = append(invites, *invite)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt.Before(invites[j].CreatedAt) })
+	c.Reply(Message{Type: "invites", Room: room.Name, Data: invites})
+}
+
+// pruneInvites drops the room's expired invites, reporting whether there
+// were any.
+func (r *Room) pruneInvites(now time.Time) bool {
+	pruned := false
+	for code, invite := range r.Invites {
+		if invite.expired(now) {
+			delete(r.Invites, code)
+			pruned = true
+		}
+	}
+	return pruned
+}
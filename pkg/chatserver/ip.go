@@ -0,0 +1,64 @@
+package chatserver
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIP returns the address r came from. If it came through a trusted
+// proxy, X-Forwarded-For is followed back to the first address that is not
+// one of the trusted proxies.
+func (s *Server) clientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && s.trustedProxy(addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+	}
+	return addr
+}
+
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireIP counts a new connection from addr, reporting false if addr
+// already has as many as allowed.
+func (s *Server) acquireIP(addr netip.Addr) bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if s.maxConnsPerIP > 0 && s.ipConns[addr] >= s.maxConnsPerIP {
+		return false
+	}
+	s.ipConns[addr]++
+	return true
+}
+
+func (s *Server) releaseIP(addr netip.Addr) {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if s.ipConns[addr]--; s.ipConns[addr] <= 0 {
+		delete(s.ipConns, addr)
+	}
+}
@@ -0,0 +1,214 @@
+package chatserver
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrIPBanNotFound = errors.New("ip ban not found")
+
+// IPBan refuses connections from every address in Prefix.
+type IPBan struct {
+	Prefix    netip.Prefix `json:"prefix"`
+	Reason    string       `json:"reason,omitempty"`
+	CreatedBy string       `json:"created_by,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// IPBanStore keeps the IP deny-list.
+type IPBanStore interface {
+	// AddIPBan adds ban, replacing any existing ban on the same prefix.
+	AddIPBan(ban IPBan) error
+	RemoveIPBan(prefix netip.Prefix) error
+	IPBans() ([]IPBan, error)
+}
+
+// MemoryIPBanStore keeps IP bans in memory.
+type MemoryIPBanStore struct {
+	mu   sync.Mutex
+	bans map[netip.Prefix]IPBan
+}
+
+func NewMemoryIPBanStore() *MemoryIPBanStore {
+	return &MemoryIPBanStore{bans: make(map[netip.Prefix]IPBan)}
+}
+
+func (m *MemoryIPBanStore) AddIPBan(ban IPBan) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bans[ban.Prefix] = ban
+	return nil
+}
+
+func (m *MemoryIPBanStore) RemoveIPBan(prefix netip.Prefix) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.bans[prefix]; !ok {
+		return ErrIPBanNotFound
+	}
+	delete(m.bans, prefix)
+	return nil
+}
+
+func (m *MemoryIPBanStore) IPBans() ([]IPBan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bans := make([]IPBan, 0, len(m.bans))
+	for _, ban := range m.bans {
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+// ParseIPPrefix parses an address or CIDR, taking a bare address as the
+// prefix covering only itself.
+func ParseIPPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// loadIPBans fills the in-memory deny-list from the store.
+func (s *Server) loadIPBans() {
+	bans, err := s.ipBanStore.IPBans()
+	if err != nil {
+		s.logger.Error("load ip bans", "err", err)
+		return
+	}
+	s.ipBanLock.Lock()
+	s.ipBans = bans
+	s.ipBanLock.Unlock()
+}
+
+// ipBanned reports whether addr is covered by a ban.
+func (s *Server) ipBanned(addr netip.Addr) bool {
+	s.ipBanLock.RLock()
+	defer s.ipBanLock.RUnlock()
+	for _, ban := range s.ipBans {
+		if ban.Prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPBans returns the deny-list, ordered by prefix.
+func (s *Server) IPBans() []IPBan {
+	s.ipBanLock.RLock()
+	bans := slices.Clone(s.ipBans)
+	s.ipBanLock.RUnlock()
+
+	slices.SortFunc(bans, func(a, b IPBan) int { return strings.Compare(a.Prefix.String(), b.Prefix.String()) })
+	return bans
+}
+
+// BanIP refuses further connections from prefix and closes those already
+// open from it. by names who added the ban.
+func (s *Server) BanIP(prefix netip.Prefix, reason, by string) error {
+	ban := IPBan{Prefix: prefix.Masked(), Reason: reason, CreatedBy: by, CreatedAt: time.Now().UTC()}
+	if err := s.ipBanStore.AddIPBan(ban); err != nil {
+		return err
+	}
+
+	s.ipBanLock.Lock()
+	s.ipBans = slices.DeleteFunc(s.ipBans, func(b IPBan) bool { return b.Prefix == ban.Prefix })
+	s.ipBans = append(s.ipBans, ban)
+	s.ipBanLock.Unlock()
+
+	s.connLock.Lock()
+	var banned []*Client
+	for c := range s.conns {
+		if ban.Prefix.Contains(c.ip) {
+			banned = append(banned, c)
+		}
+	}
+	s.connLock.Unlock()
+
+	for _, c := range banned {
+		c.Send(Message{Type: "error", Code: CodeBanned, Content: "Your address has been banned"})
+		c.CloseWith(websocket.ClosePolicyViolation, "banned")
+	}
+	s.audit(AuditEntry{Actor: by, Action: "ban_ip", Target: ban.Prefix.String(),
+		Detail: fmt.Sprintf("%s; closed %d connections", reason, len(banned))})
+	return nil
+}
+
+// UnbanIP lifts the ban on exactly prefix. by names who lifted it.
+func (s *Server) UnbanIP(prefix netip.Prefix, by string) error {
+	prefix = prefix.Masked()
+	if err := s.ipBanStore.RemoveIPBan(prefix); err != nil {
+		return err
+	}
+
+	s.ipBanLock.Lock()
+	s.ipBans = slices.DeleteFunc(s.ipBans, func(b IPBan) bool { return b.Prefix == prefix })
+	s.ipBanLock.Unlock()
+	s.audit(AuditEntry{Actor: by, Action: "unban_ip", Target: prefix.String()})
+	return nil
+}
+
+// handleAdminBanIP bans the address or CIDR in msg.Target, with msg.Content
+// as the reason.
+func (s *Server) handleAdminBanIP(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	prefix, err := ParseIPPrefix(msg.Target)
+	if err != nil {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Target must be an IP address or CIDR", Target: msg.Target})
+		return
+	}
+	if err := s.BanIP(prefix, msg.Content, admin.Username); err != nil {
+		c.reqLogger.Error("ban ip", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not ban address", Target: msg.Target})
+		return
+	}
+	c.Reply(Message{Type: "info", Content: "Address banned", Target: prefix.String()})
+}
+
+func (s *Server) handleAdminUnbanIP(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	prefix, err := ParseIPPrefix(msg.Target)
+	if err != nil {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Target must be an IP address or CIDR", Target: msg.Target})
+		return
+	}
+	if err := s.UnbanIP(prefix, admin.Username); err != nil {
+		if errors.Is(err, ErrIPBanNotFound) {
+			c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Address is not banned", Target: msg.Target})
+			return
+		}
+		c.reqLogger.Error("unban ip", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not unban address", Target: msg.Target})
+		return
+	}
+	c.Reply(Message{Type: "info", Content: "Address unbanned", Target: prefix.String()})
+}
+
+func (s *Server) handleAdminListIPBans(c *Client, msg Message) {
+	if s.requireAdmin(c) == nil {
+		return
+	}
+	c.Reply(Message{Type: "ip_bans", Data: s.IPBans()})
+}
@@ -0,0 +1,47 @@
+package chatserver
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Keepalive sets how the server detects dead and idle connections.
+type Keepalive struct {
+	// PingInterval is how often the server pings each client.
+	PingInterval time.Duration
+	// PongTimeout is how long a connection may go without sending anything,
+	// pongs included, before it is considered dead. It should exceed
+	// PingInterval.
+	PongTimeout time.Duration
+	// WriteTimeout bounds each write to a client.
+	WriteTimeout time.Duration
+	// IdleTimeout closes connections that send no messages, other than
+	// pongs, for that long. Zero keeps idle connections open.
+	IdleTimeout time.Duration
+}
+
+// DefaultKeepalive is used unless WithKeepalive says otherwise.
+var DefaultKeepalive = Keepalive{
+	PingInterval: 30 * time.Second,
+	PongTimeout:  60 * time.Second,
+	WriteTimeout: 10 * time.Second,
+}
+
+// extendReadDeadline gives the client another PongTimeout to be heard from.
+func (c *Client) extendReadDeadline() error {
+	return c.conn.SetReadDeadline(time.Now().Add(c.keepalive.PongTimeout))
+}
+
+// idle reports whether the client has sent no messages for IdleTimeout.
+func (c *Client) idle(now time.Time) bool {
+	if c.keepalive.IdleTimeout <= 0 {
+		return false
+	}
+	return now.Sub(time.Unix(0, c.lastMessage.Load())) >= c.keepalive.IdleTimeout
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
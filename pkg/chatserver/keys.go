@@ -0,0 +1,141 @@
+package chatserver
+
+import (
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// KeyAlgorithm is the only kind of public key users can publish: an X25519
+// key, which clients combine with their own to agree on the key that
+// encrypts their direct messages.
+const KeyAlgorithm = "x25519"
+
+// x25519KeySize is the length of an X25519 public key, in bytes.
+const x25519KeySize = 32
+
+var ErrKeyNotFound = errors.New("public key not found")
+
+// PublicKey is a user's published key, base64-encoded in Key.
+type PublicKey struct {
+	Username  string    `json:"username"`
+	Algorithm string    `json:"algorithm"`
+	Key       string    `json:"key"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Ciphertext is the payload of an encrypted_dm, which the server relays
+// without being able to read. SenderKey is the public key the sender
+// encrypted with, so the recipient can notice it changing; Nonce and Data
+// are base64-encoded.
+type Ciphertext struct {
+	Algorithm string `json:"algorithm"`
+	SenderKey string `json:"sender_key"`
+	Nonce     string `json:"nonce"`
+	Data      string `json:"data"`
+}
+
+// KeyStore keeps the public key each user has published.
+type KeyStore interface {
+	// SetKey publishes key, replacing any the user had before.
+	SetKey(key PublicKey) error
+	Key(username string) (PublicKey, error)
+	DeleteKey(username string) error
+}
+
+// MemoryKeyStore keeps public keys in memory.
+type MemoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]PublicKey
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: make(map[string]PublicKey)}
+}
+
+func (m *MemoryKeyStore) SetKey(key PublicKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[key.Username] = key
+	return nil
+}
+
+func (m *MemoryKeyStore) Key(username string) (PublicKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.keys[username]
+	if !ok {
+		return PublicKey{}, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+func (m *MemoryKeyStore) DeleteKey(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, username)
+	return nil
+}
+
+// validPublicKey reports whether key is a base64-encoded X25519 key.
+func validPublicKey(key string) bool {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(raw) == x25519KeySize
+}
+
+// handlePublishKey publishes msg.Content as the sender's public key.
+func (s *Server) handlePublishKey(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if !validPublicKey(msg.Content) {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Public key must be a base64-encoded X25519 key"})
+		return
+	}
+
+	key := PublicKey{Username: user.Username, Algorithm: KeyAlgorithm, Key: msg.Content, UpdatedAt: time.Now().UTC()}
+	if err := s.keys.SetKey(key); err != nil {
+		c.reqLogger.Error("store public key", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not publish key"})
+		return
+	}
+	c.Reply(Message{Type: "info", Content: "Public key published"})
+}
+
+// handleGetKey answers with the public key of msg.Target as a key message.
+func (s *Server) handleGetKey(c *Client, msg Message) {
+	if s.userOf(c) == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	key, err := s.keys.Key(msg.Target)
+	if err != nil {
+		if !errors.Is(err, ErrKeyNotFound) {
+			c.reqLogger.Error("load public key", "target", msg.Target, "err", err)
+		}
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: msg.Target + " has not published a key", Target: msg.Target})
+		return
+	}
+	c.Reply(Message{Type: "key", Target: msg.Target, Data: key})
+}
+
+// handleEncryptedDM relays msg.Encrypted to msg.Target like a direct
+// message. Only its size is checked; the server cannot read it.
+func (s *Server) handleEncryptedDM(c *Client, msg Message) {
+	e := msg.Encrypted
+	if e == nil || e.Algorithm != KeyAlgorithm || !validPublicKey(e.SenderKey) || e.Nonce == "" || e.Data == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Encrypted message needs an x25519 sender key, a nonce and data", Target: msg.Target})
+		return
+	}
+	// Ciphertext may take up to four bytes per character of the plain
+	// text, and base64 a third more.
+	if len(e.Nonce) > maxNameLength || len(e.Data) > s.maxContent*4*4/3+64 {
+		c.Reply(Message{Type: "error", Code: CodeTooLarge, Content: "Encrypted message is too long", Target: msg.Target})
+		return
+	}
+	msg.Content, msg.Format = "", ""
+	s.handleDirectMessage(c, msg)
+}
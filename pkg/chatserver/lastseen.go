@@ -0,0 +1,98 @@
+package chatserver
+
+import (
+	"errors"
+	"time"
+)
+
+// WhoisInfo is the Data of a whois reply. LastSeen is when the user was
+// last active if they are online, or when they went offline if not. It is
+// left out for users who hide it.
+type WhoisInfo struct {
+	Username string     `json:"username"`
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Bot      bool       `json:"bot,omitempty"`
+}
+
+// recordLastSeen stores the current time as when username was last online.
+func (s *Server) recordLastSeen(username string) {
+	if err := s.accounts.SetLastSeen(username, time.Now()); err != nil && !errors.Is(err, ErrUserNotFound) {
+		s.logger.Error("record last seen", "user", username, "err", err)
+	}
+}
+
+// lastActive returns when username last sent a message on any of their
+// connections to this instance, if they have one.
+func (s *Server) lastActive(username string) (time.Time, bool) {
+	user := s.onlineUser(username)
+	if user == nil {
+		return time.Time{}, false
+	}
+	var last int64
+	for _, c := range user.connections() {
+		last = max(last, c.lastMessage.Load())
+	}
+	return time.Unix(0, last).UTC(), true
+}
+
+func (s *Server) handleWhois(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	account, err := s.accounts.Find(msg.Target)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			c.reqLogger.Error("find account", "target", msg.Target, "err", err)
+		}
+		c.Reply(Message{Type: "error", Code: CodeUserNotFound, Content: "User does not exist", Target: msg.Target})
+		return
+	}
+
+	info := WhoisInfo{Username: account.Username, Online: s.isOnline(account.Username)}
+	_, info.Bot = s.botOf(account.Username)
+	if !account.HideLastSeen || account.Username == user.Username {
+		if at, ok := s.lastActive(account.Username); ok {
+			info.LastSeen = &at
+		} else if !account.LastSeen.IsZero() {
+			info.LastSeen = &account.LastSeen
+		}
+	}
+	c.Reply(Message{Type: "whois", Target: account.Username, Data: info})
+}
+
+// handleSetLastSeen lets a user hide when they were last online from
+// others, with Content "off", or show it again with "on".
+func (s *Server) handleSetLastSeen(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	var hide bool
+	switch msg.Content {
+	case "on":
+	case "off":
+		hide = true
+	default:
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Last seen must be on or off"})
+		return
+	}
+
+	account, err := s.accounts.Find(user.Username)
+	if err == nil {
+		account.HideLastSeen = hide
+		err = s.accounts.Update(account)
+	}
+	if err != nil {
+		s.sendAccountError(c, err)
+		return
+	}
+	if hide {
+		c.Reply(Message{Type: "info", Content: "Last seen hidden from other users"})
+	} else {
+		c.Reply(Message{Type: "info", Content: "Last seen visible to other users"})
+	}
+}
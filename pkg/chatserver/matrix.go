@@ -0,0 +1,410 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Matrix bridge mirrors rooms to a Matrix homeserver as an application
+// service. Each sender in a mirrored room is puppeted by a Matrix user in
+// the bridge's namespace, which is registered and joined to the Matrix room
+// the first time they speak. Messages from other Matrix users are posted to
+// the room with their Matrix user ID as the sender. Message IDs are mapped
+// to Matrix event IDs so that replies are carried across both ways. Edits,
+// deletions and reactions are not mirrored.
+//
+// The homeserver is told about the bridge by a registration file giving the
+// server's URL, the two tokens and an exclusive users namespace matching the
+// puppets, such as "@chat_.*:example.org". Puppets are joined to private
+// Matrix rooms by being invited by the bridge's own user, which must have
+// been invited to them first.
+
+// MatrixConfig configures the Matrix bridge. Homeserver is the base URL of
+// the homeserver's client-server API and Domain its server name. ASToken is
+// the token the bridge sends to the homeserver and HSToken the one the
+// homeserver sends to the bridge. Puppets are named UserPrefix followed by
+// the escaped username. Rooms maps the local rooms to mirror to the IDs of
+// their Matrix rooms.
+type MatrixConfig struct {
+	Homeserver string
+	Domain     string
+	ASToken    string
+	HSToken    string
+	UserPrefix string
+	Rooms      map[string]string
+}
+
+const (
+	// matrixTimeout bounds each request to the homeserver.
+	matrixTimeout = 30 * time.Second
+	// maxMatrixTxns is how many transaction IDs the bridge remembers.
+	maxMatrixTxns = 1000
+	// maxMatrixTransaction is the largest transaction accepted from the
+	// homeserver, in bytes.
+	maxMatrixTransaction = 10 << 20
+)
+
+// matrixBridge is the state of the Matrix bridge. puppets and joined belong
+// to the worker sending messages to the homeserver.
+type matrixBridge struct {
+	cfg    MatrixConfig
+	client *http.Client
+	queue  chan Message
+	// rooms maps Matrix room IDs back to local rooms.
+	rooms map[string]string
+	// puppets holds the puppets set up, and joined the puppets joined to
+	// Matrix rooms, as "user room".
+	puppets map[string]bool
+	joined  map[string]bool
+
+	// events pairs message IDs with event IDs.
+	events *bridgeIDs
+
+	// mu guards txns, the transactions handled, in txnOrder.
+	mu       sync.Mutex
+	txns     map[string]bool
+	txnOrder []string
+}
+
+func newMatrixBridge(cfg MatrixConfig) *matrixBridge {
+	b := &matrixBridge{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: matrixTimeout},
+		queue:   make(chan Message, bridgeQueueSize),
+		rooms:   make(map[string]string),
+		puppets: make(map[string]bool),
+		joined:  make(map[string]bool),
+		events:  newBridgeIDs(),
+		txns:    make(map[string]bool),
+	}
+	for room, id := range cfg.Rooms {
+		b.rooms[id] = room
+	}
+	return b
+}
+
+// matrixError is an error response from the homeserver, or one sent to it.
+type matrixError struct {
+	Status  int    `json:"-"`
+	ErrCode string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("matrix: %d %s: %s", e.Status, e.ErrCode, e.Message)
+}
+
+// matrixContent is the content of an m.room.message event.
+type matrixContent struct {
+	MsgType   string          `json:"msgtype"`
+	Body      string          `json:"body"`
+	RelatesTo *matrixRelation `json:"m.relates_to,omitempty"`
+}
+
+type matrixRelation struct {
+	RelType   string          `json:"rel_type,omitempty"`
+	InReplyTo *matrixEventRef `json:"m.in_reply_to,omitempty"`
+}
+
+type matrixEventRef struct {
+	EventID string `json:"event_id"`
+}
+
+// matrixEvent is an event pushed by the homeserver. Content is only decoded
+// as a message's.
+type matrixEvent struct {
+	Type    string        `json:"type"`
+	RoomID  string        `json:"room_id"`
+	Sender  string        `json:"sender"`
+	EventID string        `json:"event_id"`
+	Content matrixContent `json:"content"`
+}
+
+// enqueue queues msg to be sent to the homeserver if its room is mirrored
+// and it did not come from there. It reports false if the queue is full.
+func (b *matrixBridge) enqueue(msg Message) bool {
+	if msg.Bridge == "matrix" || b.cfg.Rooms[msg.Room] == "" {
+		return true
+	}
+	select {
+	case b.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// firstSeen reports whether the transaction id has not been handled
+// before, recording that it has. Homeservers resend transactions they
+// have no answer to.
+func (b *matrixBridge) firstSeen(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.txns[id] {
+		return false
+	}
+	b.txns[id] = true
+	b.txnOrder = append(b.txnOrder, id)
+	if len(b.txnOrder) > maxMatrixTxns {
+		delete(b.txns, b.txnOrder[0])
+		b.txnOrder = b.txnOrder[1:]
+	}
+	return true
+}
+
+// isPuppet reports whether userID is one of the bridge's puppets.
+func (b *matrixBridge) isPuppet(userID string) bool {
+	return strings.HasPrefix(userID, "@"+b.cfg.UserPrefix) && strings.HasSuffix(userID, ":"+b.cfg.Domain)
+}
+
+// authorized reports whether r carries the homeserver's token, as a bearer
+// token or, from older homeservers, the access_token parameter.
+func (b *matrixBridge) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		writeJSON(w, http.StatusUnauthorized, matrixError{ErrCode: "M_UNAUTHORIZED", Message: "Missing token"})
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.cfg.HSToken)) != 1 {
+		writeJSON(w, http.StatusForbidden, matrixError{ErrCode: "M_FORBIDDEN", Message: "Bad token"})
+		return false
+	}
+	return true
+}
+
+// do makes a client-server API request as the application service, or as
+// the puppet asUser if it is set, decoding the response into out unless it
+// is nil.
+func (b *matrixBridge) do(ctx context.Context, method, path, asUser string, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := strings.TrimSuffix(b.cfg.Homeserver, "/") + path
+	if asUser != "" {
+		u += "?user_id=" + url.QueryEscape(asUser)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.cfg.ASToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		merr := &matrixError{Status: resp.StatusCode}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(merr)
+		return merr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// puppet returns the ID of the Matrix user puppeting sender, registering
+// it and setting its display name the first time. Senders relayed from
+// other bridges get puppets of their own.
+func (b *matrixBridge) puppet(ctx context.Context, msg Message) (string, error) {
+	name := msg.Sender
+	if msg.Bridge != "" {
+		name = msg.Bridge + "/" + msg.Sender
+	}
+	localpart := b.cfg.UserPrefix + matrixLocalpart(name)
+	userID := "@" + localpart + ":" + b.cfg.Domain
+	if b.puppets[userID] {
+		return userID, nil
+	}
+
+	register := map[string]any{"type": "m.login.application_service", "username": localpart, "inhibit_login": true}
+	var merr *matrixError
+	if err := b.do(ctx, http.MethodPost, "/_matrix/client/v3/register", "", register, nil); err != nil &&
+		!(errors.As(err, &merr) && merr.ErrCode == "M_USER_IN_USE") {
+		return "", err
+	}
+	displayName := map[string]string{"displayname": name}
+	if err := b.do(ctx, http.MethodPut, "/_matrix/client/v3/profile/"+url.PathEscape(userID)+"/displayname", userID, displayName, nil); err != nil {
+		return "", err
+	}
+	b.puppets[userID] = true
+	return userID, nil
+}
+
+// join joins the puppet userID to roomID unless it has been already,
+// having the bridge's own user invite it if the room is not public.
+func (b *matrixBridge) join(ctx context.Context, userID, roomID string) error {
+	key := userID + " " + roomID
+	if b.joined[key] {
+		return nil
+	}
+	path := "/_matrix/client/v3/join/" + url.PathEscape(roomID)
+	err := b.do(ctx, http.MethodPost, path, userID, struct{}{}, nil)
+	var merr *matrixError
+	if errors.As(err, &merr) && merr.ErrCode == "M_FORBIDDEN" {
+		invite := map[string]string{"user_id": userID}
+		if err = b.do(ctx, http.MethodPost, "/_matrix/client/v3/rooms/"+url.PathEscape(roomID)+"/invite", "", invite, nil); err == nil {
+			err = b.do(ctx, http.MethodPost, path, userID, struct{}{}, nil)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	b.joined[key] = true
+	return nil
+}
+
+// send mirrors msg to its Matrix room as its sender's puppet. The message
+// ID is the transaction ID, so a retried send is not posted twice.
+func (b *matrixBridge) send(ctx context.Context, msg Message) error {
+	if msg.Sender == "" || msg.Content == "" || msg.Deleted {
+		return nil
+	}
+	roomID := b.cfg.Rooms[msg.Room]
+	puppet, err := b.puppet(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if err := b.join(ctx, puppet, roomID); err != nil {
+		return err
+	}
+
+	content := matrixContent{MsgType: "m.text", Body: msg.Content}
+	if msg.ReplyTo != "" {
+		if eventID := b.events.remote(msg.ReplyTo); eventID != "" {
+			content.RelatesTo = &matrixRelation{InReplyTo: &matrixEventRef{EventID: eventID}}
+		}
+	}
+	var sent matrixEventRef
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/send/m.room.message/" + url.PathEscape(msg.MessageID)
+	if err := b.do(ctx, http.MethodPut, path, puppet, content, &sent); err != nil {
+		return err
+	}
+	b.events.add(msg.MessageID, sent.EventID)
+	return nil
+}
+
+// runMatrix sends the messages queued for the Matrix bridge until ctx is
+// done, one at a time so that they arrive in order.
+func (s *Server) runMatrix(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-s.matrix.queue:
+			if err := s.matrix.send(ctx, msg); err != nil {
+				s.logger.Warn("send to matrix", "room", msg.Room, "message_id", msg.MessageID, "err", err)
+			}
+		}
+	}
+}
+
+// handleMatrixTransaction serves PUT /_matrix/app/v1/transactions/{txnId},
+// the events the homeserver pushes to the bridge.
+func (s *Server) handleMatrixTransaction(w http.ResponseWriter, r *http.Request) {
+	b := s.matrix
+	if !b.authorized(w, r) {
+		return
+	}
+	var txn struct {
+		Events []matrixEvent `json:"events"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMatrixTransaction)).Decode(&txn); err != nil {
+		writeJSON(w, http.StatusBadRequest, matrixError{ErrCode: "M_NOT_JSON", Message: "Invalid transaction"})
+		return
+	}
+	if b.firstSeen(r.PathValue("txnId")) {
+		for _, ev := range txn.Events {
+			s.relayMatrixEvent(ev)
+		}
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// handleMatrixPing serves POST /_matrix/app/v1/ping, with which the
+// homeserver checks that it can reach the bridge.
+func (s *Server) handleMatrixPing(w http.ResponseWriter, r *http.Request) {
+	if s.matrix.authorized(w, r) {
+		writeJSON(w, http.StatusOK, struct{}{})
+	}
+}
+
+// relayMatrixEvent posts ev to its room if it is a message to a mirrored
+// room from someone other than a puppet.
+func (s *Server) relayMatrixEvent(ev matrixEvent) {
+	b := s.matrix
+	room, ok := b.rooms[ev.RoomID]
+	if !ok || ev.Type != "m.room.message" || b.isPuppet(ev.Sender) || ev.Content.Body == "" {
+		return
+	}
+	msg := Message{Room: room, Sender: ev.Sender, Bridge: "matrix", Content: ev.Content.Body}
+	if rel := ev.Content.RelatesTo; rel != nil {
+		if rel.RelType == "m.replace" {
+			return
+		}
+		if rel.InReplyTo != nil {
+			msg.ReplyTo = b.events.local(rel.InReplyTo.EventID)
+			msg.Content = stripReplyFallback(msg.Content)
+		}
+	}
+
+	sent, err := s.relay(msg)
+	if err != nil {
+		s.logger.Warn("relay matrix event", "room", room, "event_id", ev.EventID, "err", err)
+		return
+	}
+	b.events.add(sent.MessageID, ev.EventID)
+}
+
+// stripReplyFallback removes the quote of the message replied to that
+// Matrix clients put at the start of a reply's body.
+func stripReplyFallback(body string) string {
+	if !strings.HasPrefix(body, "> ") {
+		return body
+	}
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, ">") {
+			return strings.TrimLeft(strings.Join(lines[i:], "\n"), "\n")
+		}
+	}
+	return body
+}
+
+// matrixLocalpart escapes name for a Matrix user ID as the specification
+// suggests for names from other networks: uppercase letters become _ and
+// the lowercase letter, _ becomes __, and other bytes not allowed become
+// =xx.
+func matrixLocalpart(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.':
+			b.WriteByte(c)
+		case c >= 'A' && c <= 'Z':
+			b.WriteByte('_')
+			b.WriteByte(c - 'A' + 'a')
+		case c == '_':
+			b.WriteString("__")
+		default:
+			fmt.Fprintf(&b, "=%02x", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package chatserver
+
+import (
+	"strings"
+)
+
+// maxMentions caps how many @mentions of one message are resolved.
+const maxMentions = 50
+
+// parseMentions returns the distinct usernames written as @name in content,
+// in order of first appearance, without trailing punctuation.
+func parseMentions(content string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(content) {
+		if len(word) < 2 || word[0] != '@' {
+			continue
+		}
+		name := strings.TrimRight(word[1:], ".,:;!?)'\"")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		if len(names) == maxMentions {
+			break
+		}
+	}
+	return names
+}
+
+// mentionedUsers looks up the known users mentioned in content.
+func (s *Server) mentionedUsers(content string) []*User {
+	names := parseMentions(content)
+	if len(names) == 0 {
+		return nil
+	}
+
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+
+	var users []*User
+	for _, name := range names {
+		if u, ok := s.users[name]; ok {
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+// mentionsLocked returns the usernames of the members of room among users,
+// leaving out sender. The caller must hold roomLock.
+func mentionsLocked(room *Room, users []*User, sender string) []string {
+	var names []string
+	for _, u := range users {
+		if u.Username != sender && u.Rooms[room.Name] {
+			names = append(names, u.Username)
+		}
+	}
+	return names
+}
+
+// notifyMentions sends each user mentioned in msg a mention notification,
+// queueing it for those who are offline or in do-not-disturb. It goes to
+// them whether or not they are watching the room.
+func (s *Server) notifyMentions(msg Message) {
+	for _, name := range msg.Mentions {
+		notice := Message{
+			Type:      "mention",
+			Sender:    msg.Sender,
+			Target:    name,
+			Room:      msg.Room,
+			Content:   msg.Content,
+			MessageID: msg.MessageID,
+			Timestamp: msg.Timestamp,
+		}
+		if s.doNotDisturb(name) || !s.sendTo(name, notice) {
+			s.dms.Push(name, notice)
+		}
+	}
+}
+
+// heldForTarget reports whether a message of the given type sent to one
+// user is queued while they are offline or in do-not-disturb.
+func heldForTarget(msgType string) bool {
+	return isDirect(msgType) || msgType == "mention"
+}
@@ -0,0 +1,429 @@
+package chatserver
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// MessageStore keeps room messages so they can be looked up and changed by
+// ID after they have been sent.
+type MessageStore interface {
+	// Append stores msg and sets msg.Seq to the next sequence number of its
+	// room, starting from 1.
+	Append(msg *Message) error
+	Get(room, id string) (Message, error)
+	Update(msg Message) error
+	// Messages returns a room's messages, oldest first.
+	Messages(room string) ([]Message, error)
+	// Page returns up to limit of a room's messages with a sequence number
+	// below before, or the latest ones if before is 0, oldest first.
+	Page(room string, before uint64, limit int) ([]Message, error)
+	// Since returns up to limit of a room's messages with a sequence number
+	// above seq, or all of them if limit is 0, oldest first.
+	Since(room string, seq uint64, limit int) ([]Message, error)
+	// Prune removes a room's messages sent before the given time, unless it
+	// is zero, and all but its newest keep messages, if keep is positive. It
+	// returns the IDs of the messages removed.
+	Prune(room string, before time.Time, keep int) ([]string, error)
+}
+
+// MemoryMessageStore keeps messages in memory.
+type MemoryMessageStore struct {
+	mu    sync.RWMutex
+	rooms map[string]*memoryRoom
+}
+
+type memoryRoom struct {
+	// messages is ordered by sequence number, which is dense, so a message's
+	// position is its Seq less that of the first message kept.
+	messages []Message
+	index    map[string]int
+	lastSeq  uint64
+}
+
+func NewMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{rooms: make(map[string]*memoryRoom)}
+}
+
+// position returns where the message with sequence number seq sits in r, or
+// would sit, clamped to the messages kept.
+func (r *memoryRoom) position(seq uint64) int {
+	if len(r.messages) == 0 || seq < r.messages[0].Seq {
+		return 0
+	}
+	return min(int(seq-r.messages[0].Seq), len(r.messages))
+}
+
+func (m *MemoryMessageStore) Append(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.rooms[msg.Room]
+	if r == nil {
+		r = &memoryRoom{index: make(map[string]int)}
+		m.rooms[msg.Room] = r
+	}
+	r.lastSeq++
+	msg.Seq = r.lastSeq
+	r.index[msg.MessageID] = len(r.messages)
+	r.messages = append(r.messages, *msg)
+	return nil
+}
+
+func (m *MemoryMessageStore) Get(room, id string) (Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := m.rooms[room]
+	if r == nil {
+		return Message{}, ErrMessageNotFound
+	}
+	i, ok := r.index[id]
+	if !ok {
+		return Message{}, ErrMessageNotFound
+	}
+	return r.messages[i], nil
+}
+
+func (m *MemoryMessageStore) Update(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.rooms[msg.Room]
+	if r == nil {
+		return ErrMessageNotFound
+	}
+	i, ok := r.index[msg.MessageID]
+	if !ok {
+		return ErrMessageNotFound
+	}
+	r.messages[i] = msg
+	return nil
+}
+
+func (m *MemoryMessageStore) Messages(room string) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if r := m.rooms[room]; r != nil {
+		return append([]Message(nil), r.messages...), nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryMessageStore) Page(room string, before uint64, limit int) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := m.rooms[room]
+	if r == nil {
+		return nil, nil
+	}
+	end := len(r.messages)
+	if before > 0 {
+		end = r.position(before)
+	}
+	start := max(end-limit, 0)
+	return append([]Message(nil), r.messages[start:end]...), nil
+}
+
+func (m *MemoryMessageStore) Since(room string, seq uint64, limit int) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := m.rooms[room]
+	if r == nil {
+		return nil, nil
+	}
+	start := r.position(seq + 1)
+	if start >= len(r.messages) {
+		return nil, nil
+	}
+	end := len(r.messages)
+	if limit > 0 {
+		end = min(start+limit, end)
+	}
+	return append([]Message(nil), r.messages[start:end]...), nil
+}
+
+func (m *MemoryMessageStore) Prune(room string, before time.Time, keep int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.rooms[room]
+	if r == nil {
+		return nil, nil
+	}
+	drop := 0
+	if keep > 0 && len(r.messages) > keep {
+		drop = len(r.messages) - keep
+	}
+	if !before.IsZero() {
+		for drop < len(r.messages) && messageTimeOf(r.messages[drop]).Before(before) {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return nil, nil
+	}
+
+	removed := make([]string, drop)
+	for i, msg := range r.messages[:drop] {
+		removed[i] = msg.MessageID
+		delete(r.index, msg.MessageID)
+	}
+	r.messages = append([]Message(nil), r.messages[drop:]...)
+	for i, msg := range r.messages {
+		r.index[msg.MessageID] = i
+	}
+	return removed, nil
+}
+
+var (
+	idLock    sync.Mutex
+	idEntropy = ulid.Monotonic(rand.Reader, 0)
+)
+
+// newMessageID returns a ULID, so IDs sort in the order messages were sent.
+func newMessageID(t time.Time) string {
+	idLock.Lock()
+	defer idLock.Unlock()
+	return ulid.MustNew(ulid.Timestamp(t), idEntropy).String()
+}
+
+// messageTimeOf is when msg was sent, or now if it carries no valid
+// timestamp.
+func messageTimeOf(msg Message) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, msg.Timestamp); err == nil {
+		return t
+	}
+	return time.Now().UTC()
+}
+
+// stamp gives msg a new ID and the current time.
+func stamp(msg *Message) {
+	now := time.Now().UTC()
+	msg.MessageID = newMessageID(now)
+	msg.Timestamp = now.Format(time.RFC3339Nano)
+}
+
+// lookupMessage loads the message msg refers to in a room the user belongs
+// to, reporting failures to c.
+func (s *Server) lookupMessage(c *Client, user *User, msg Message) (Message, bool) {
+	if msg.Room == "" || msg.MessageID == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Request needs a room and a message_id"})
+		return Message{}, false
+	}
+
+	s.roomLock.Lock()
+	member := user.Rooms[msg.Room]
+	s.roomLock.Unlock()
+	if !member {
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return Message{}, false
+	}
+
+	stored, err := s.messages.Get(msg.Room, msg.MessageID)
+	if err != nil {
+		if !errors.Is(err, ErrMessageNotFound) {
+			c.reqLogger.Error("load message", "message_id", msg.MessageID, "err", err)
+		}
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Message not found", Room: msg.Room, MessageID: msg.MessageID})
+		return Message{}, false
+	}
+	return stored, true
+}
+
+// handleEdit replaces the content of one of the sender's earlier messages
+// and tells the room about it.
+func (s *Server) handleEdit(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.messageLock.Lock()
+	defer s.messageLock.Unlock()
+
+	stored, ok := s.lookupMessage(c, user, msg)
+	if !ok {
+		return
+	}
+	if stored.Deleted {
+		c.Reply(Message{Type: "error", Code: CodeGone, Content: "Message was deleted", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+	if stored.Sender != user.Username {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "You can only edit your own messages", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+	if stored.Poll != nil {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "Polls cannot be edited", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+
+	s.roomLock.Lock()
+	content, ok := s.filterContentLocked(c, s.rooms[stored.Room], msg.Content)
+	s.roomLock.Unlock()
+	if !ok {
+		return
+	}
+
+	// An edit keeps the message's format.
+	stored.Content = content
+	if stored.Format == FormatMarkdown {
+		stored.Content = sanitizeMarkdown(content)
+	}
+	s.expandEmojiIn(&stored)
+	stored.Edited = true
+	// Translations are of what it said before.
+	stored.Translations = nil
+	if err := s.messages.Update(stored); err != nil {
+		c.reqLogger.Error("edit message", "message_id", msg.MessageID, "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not edit message", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+	s.indexMessage(stored)
+
+	event := Message{Type: "edit", Sender: user.Username, Room: stored.Room, MessageID: stored.MessageID, Content: stored.Content, Format: stored.Format}
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	s.appendHistory(event)
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	if room, exists := s.rooms[stored.Room]; exists {
+		s.fanoutLocked(room, event)
+	}
+}
+
+// tombstoneOf is what remains of msg once it is deleted: who sent it and
+// where it sat in the room, but none of its content.
+func tombstoneOf(msg Message) Message {
+	return Message{
+		Type:      msg.Type,
+		Sender:    msg.Sender,
+		Room:      msg.Room,
+		MessageID: msg.MessageID,
+		Timestamp: msg.Timestamp,
+		Seq:       msg.Seq,
+		Deleted:   true,
+	}
+}
+
+// handleDelete replaces a message with a tombstone. Senders may delete their
+// own messages and room moderators may delete any.
+func (s *Server) handleDelete(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.messageLock.Lock()
+	defer s.messageLock.Unlock()
+
+	stored, ok := s.lookupMessage(c, user, msg)
+	if !ok {
+		return
+	}
+	if stored.Deleted {
+		c.Reply(Message{Type: "error", Code: CodeGone, Content: "Message already deleted", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+
+	s.roomLock.Lock()
+	room := s.rooms[stored.Room]
+	allowed := stored.Sender == user.Username || (room != nil && room.IsModerator(user.Username))
+	s.roomLock.Unlock()
+	if !allowed {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "You cannot delete that message", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+
+	if err := s.removeMessage(stored, user.Username, ""); err != nil {
+		c.reqLogger.Error("delete message", "message_id", msg.MessageID, "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not delete message", Room: msg.Room, MessageID: msg.MessageID})
+	}
+}
+
+// removeMessage replaces stored with a tombstone and tells its room that by
+// deleted it, giving reason as the Content of the deleted event. The caller
+// must hold messageLock.
+func (s *Server) removeMessage(stored Message, by, reason string) error {
+	tombstone := tombstoneOf(stored)
+	if err := s.messages.Update(tombstone); err != nil {
+		return err
+	}
+	if err := s.search.Remove(tombstone.Room, tombstone.MessageID); err != nil {
+		s.logger.Error("remove from search index", "room", stored.Room, "message_id", stored.MessageID, "err", err)
+	}
+
+	event := Message{Type: "deleted", Sender: by, Room: stored.Room, MessageID: stored.MessageID, Content: reason}
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	s.appendHistory(event)
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	if room, exists := s.rooms[stored.Room]; exists {
+		s.fanoutLocked(room, event)
+		if s.unpinLocked(room, stored.MessageID) {
+			s.fanoutLocked(room, Message{Type: "unpinned", Sender: by, Room: room.Name, MessageID: stored.MessageID})
+		}
+	}
+	return nil
+}
+
+// handleSync sends the messages of msg.Room with a sequence number above
+// msg.SinceSeq, so a reconnecting client can catch up on exactly what it
+// missed, followed by a sync_complete marker carrying the last sequence
+// sent. At most msg.Limit messages, capped at maxHistoryPage, are sent at a
+// time; if more remain the marker has More set and the client syncs again
+// from its Seq.
+func (s *Server) handleSync(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	member := user.Rooms[msg.Room]
+	s.roomLock.Unlock()
+	if !member {
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return
+	}
+
+	limit := msg.Limit
+	if limit <= 0 || limit > maxHistoryPage {
+		limit = maxHistoryPage
+	}
+	missed, err := s.messages.Since(msg.Room, msg.SinceSeq, limit+1)
+	if err != nil {
+		c.reqLogger.Error("sync room", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not sync room", Room: msg.Room})
+		return
+	}
+
+	more := len(missed) > limit
+	if more {
+		missed = missed[:limit]
+	}
+	last := msg.SinceSeq
+	now := time.Now()
+	for _, m := range missed {
+		last = m.Seq
+		if m.expired(now) {
+			continue
+		}
+		c.Send(m)
+	}
+	c.Send(Message{Type: "sync_complete", Room: msg.Room, Seq: last, More: more})
+}
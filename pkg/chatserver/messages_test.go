@@ -0,0 +1,113 @@
+package chatserver
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemoryMessageStoreSince(t *testing.T) {
+	store := NewMemoryMessageStore()
+	for i := 1; i <= 5; i++ {
+		for _, room := range []string{"lobby", "dev"} {
+			msg := Message{Type: "broadcast", Room: room, MessageID: fmt.Sprintf("%s-%d", room, i)}
+			if err := store.Append(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Seq != uint64(i) {
+				t.Fatalf("message %d in %s numbered %d", i, room, msg.Seq)
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		room  string
+		since uint64
+		limit int
+		want  []uint64
+	}{
+		{"from the start", "lobby", 0, 0, []uint64{1, 2, 3, 4, 5}},
+		{"missed some", "lobby", 3, 0, []uint64{4, 5}},
+		{"limited", "lobby", 1, 2, []uint64{2, 3}},
+		{"limit past the end", "lobby", 3, 10, []uint64{4, 5}},
+		{"up to date", "lobby", 5, 0, nil},
+		{"ahead", "lobby", 9, 0, nil},
+		{"unknown room", "ops", 0, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := store.Since(tt.room, tt.since, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []uint64
+			for _, msg := range msgs {
+				if msg.Room != tt.room {
+					t.Errorf("message from %s returned for %s", msg.Room, tt.room)
+				}
+				got = append(got, msg.Seq)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Since(%s, %d, %d) = %v, want %v", tt.room, tt.since, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSyncPages checks that a backlog longer than a client's send queue is
+// synced a page at a time rather than overflowing the queue.
+func TestSyncPages(t *testing.T) {
+	const backlog = sendBuffer + 50
+
+	s := newTestServer(t)
+	c := signIn(t, s, "alice")
+	mustDo(t, s, c, Message{Type: "create_room", Content: "general"})
+	mustDo(t, s, c, Message{Type: "join_room", Content: "general"})
+	for i := 1; i <= backlog; i++ {
+		msg := Message{Type: "broadcast", Sender: "bob", Room: "general", MessageID: fmt.Sprintf("m%d", i)}
+		if err := s.messages.Append(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []uint64
+	var since uint64
+	for pages := 1; ; pages++ {
+		if pages > backlog {
+			t.Fatal("sync never completed")
+		}
+		msgs := mustDo(t, s, c, Message{Type: "sync", Room: "general", SinceSeq: since})
+		select {
+		case <-c.done:
+			t.Fatal("client disconnected during sync")
+		default:
+		}
+		done, ok := find(msgs, "sync_complete")
+		if !ok {
+			t.Fatal("no sync_complete")
+		}
+		for _, msg := range msgs {
+			if msg.Type == "broadcast" {
+				got = append(got, msg.Seq)
+			}
+		}
+		if len(msgs)-1 > maxHistoryPage {
+			t.Errorf("page %d carried %d messages", pages, len(msgs)-1)
+		}
+		since = done.Seq
+		if !done.More {
+			break
+		}
+	}
+	if len(got) != backlog {
+		t.Fatalf("synced %d messages, want %d", len(got), backlog)
+	}
+	for i, seq := range got {
+		if seq != uint64(i+1) {
+			t.Fatalf("message %d has seq %d", i+1, seq)
+		}
+	}
+	if since != backlog {
+		t.Errorf("last sync_complete at %d, want %d", since, backlog)
+	}
+}
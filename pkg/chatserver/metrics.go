@@ -0,0 +1,102 @@
+package chatserver
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the server's Prometheus collectors. Each server has its own
+// registry so several can run in one process.
+type metrics struct {
+	registry        *prometheus.Registry
+	messages        *prometheus.CounterVec
+	websocketErrors *prometheus.CounterVec
+	historyWrites   prometheus.Histogram
+	authFailures    *prometheus.CounterVec
+}
+
+func newMetrics(s *Server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_messages_received_total",
+			Help: "Messages received from clients, by type.",
+		}, []string{"type"}),
+		websocketErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_websocket_errors_total",
+			Help: "WebSocket failures, by operation: upgrade, read, write or timeout.",
+		}, []string{"op"}),
+		historyWrites: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "chat_history_write_seconds",
+			Help:    "Time taken to append an entry to a history file.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_auth_failures_total",
+			Help: "Failed signins and resumes, by reason.",
+		}, []string{"reason"}),
+	}
+
+	m.registry.MustRegister(
+		m.messages,
+		m.websocketErrors,
+		m.historyWrites,
+		m.authFailures,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chat_connected_clients",
+			Help: "Open WebSocket connections, signed in or not.",
+		}, func() float64 {
+			s.connLock.Lock()
+			defer s.connLock.Unlock()
+			return float64(len(s.conns))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chat_signed_in_clients",
+			Help: "Connections with a signed-in user.",
+		}, func() float64 {
+			s.clientLock.Lock()
+			defer s.clientLock.Unlock()
+			return float64(len(s.clients))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chat_active_rooms",
+			Help: "Rooms that currently exist.",
+		}, func() float64 {
+			s.roomLock.Lock()
+			defer s.roomLock.Unlock()
+			return float64(len(s.rooms))
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// countMessage records a message received from a client. Unregistered types
+// are counted together so clients cannot create unbounded label values.
+func (m *metrics) countMessage(msgType string, known bool) {
+	if !known {
+		msgType = "unknown"
+	}
+	m.messages.WithLabelValues(msgType).Inc()
+}
+
+func (m *metrics) websocketError(op string) {
+	m.websocketErrors.WithLabelValues(op).Inc()
+}
+
+func (m *metrics) authFailure(reason string) {
+	m.authFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) observeHistoryWrite(start time.Time) {
+	m.historyWrites.Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
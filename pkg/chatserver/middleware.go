@@ -0,0 +1,115 @@
+package chatserver
+
+// Every request passes through a pipeline of stages on its way to its
+// handler: auth, then validation, then rate limiting, then filtering. Each
+// stage runs its built-in checks, if it has any, and then the middleware
+// added to it with Use, in the order they were added. Any of them may answer
+// the request and stop it there by not calling the next handler.
+//
+// Limits and filters that depend on the room, such as a room's own rate
+// limit or the word filter a room can turn off, are applied by the handlers
+// that post to rooms, as they need the room's state under roomLock.
+
+// Stage is a point in the request pipeline.
+type Stage int
+
+const (
+	// StageAuth refuses requests that need a signed-in user from
+	// connections that are not signed in, and requests a bot's scopes do
+	// not allow.
+	StageAuth Stage = iota
+	// StageValidate refuses requests whose fields are missing or malformed.
+	StageValidate
+	// StageRateLimit is for limits on how often requests are made.
+	StageRateLimit
+	// StageFilter is for checks on what requests contain.
+	StageFilter
+
+	stageCount
+)
+
+// Middleware wraps a handler in something that runs before it, and may
+// answer the request itself instead of calling next.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// publicTypes are the built-in requests that can be made without signing in.
+var publicTypes = map[string]bool{
+	"signup":         true,
+	"signin":         true,
+	"resume":         true,
+	"reset_password": true,
+	"signout":        true,
+	"list_rooms":     true,
+	"capabilities":   true,
+	"hello":          true,
+}
+
+// HandlePublic registers h like Handle, for requests that can be made
+// without signing in.
+func (s *Server) HandlePublic(msgType string, h HandlerFunc) {
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+	s.handlers[msgType] = h
+	s.public[msgType] = true
+}
+
+// Use adds mw to stage, after its built-in checks and any middleware added
+// to it before. It applies to every request type, built-in or not.
+func (s *Server) Use(stage Stage, mw ...Middleware) {
+	if stage < 0 || stage >= stageCount {
+		panic("chatserver: unknown stage")
+	}
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+	s.middleware[stage] = append(s.middleware[stage], mw...)
+}
+
+// pipeline wraps h in the stages, so that calling it runs each stage in
+// turn and then h.
+func (s *Server) pipeline(h HandlerFunc) HandlerFunc {
+	builtin := [stageCount]Middleware{
+		StageAuth:     s.authenticateRequest,
+		StageValidate: s.validateRequest,
+	}
+
+	s.handlerLock.RLock()
+	defer s.handlerLock.RUnlock()
+	for stage := stageCount - 1; stage >= 0; stage-- {
+		for i := len(s.middleware[stage]) - 1; i >= 0; i-- {
+			h = s.middleware[stage][i](h)
+		}
+		if builtin[stage] != nil {
+			h = builtin[stage](h)
+		}
+	}
+	return h
+}
+
+// authenticateRequest is the built-in auth stage.
+func (s *Server) authenticateRequest(next HandlerFunc) HandlerFunc {
+	return func(c *Client, msg Message) {
+		s.handlerLock.RLock()
+		public := s.public[msg.Type]
+		s.handlerLock.RUnlock()
+		if !public && s.userOf(c) == nil {
+			c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+			return
+		}
+		if !s.checkBotScope(c, msg) {
+			return
+		}
+		next(c, msg)
+	}
+}
+
+// validateRequest is the built-in validation stage.
+func (s *Server) validateRequest(next HandlerFunc) HandlerFunc {
+	return func(c *Client, msg Message) {
+		if problems := s.validate(msg); problems != nil {
+			c.reqLogger.Debug("invalid message", "problems", problems)
+			c.Reply(invalidMessage(problems))
+			return
+		}
+		next(c, msg)
+	}
+}
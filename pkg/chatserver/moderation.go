@@ -0,0 +1,283 @@
+package chatserver
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// requireModeratorLocked looks up the room named in msg and checks that the
+// signed-in user moderates it. It reports errors to c and returns nil on
+// failure. The caller must hold roomLock.
+func (s *Server) requireModeratorLocked(c *Client, user *User, msg Message) *Room {
+	room, exists := s.rooms[msg.Room]
+	if !exists {
+		c.Reply(Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: msg.Room})
+		return nil
+	}
+	if !room.IsModerator(user.Username) {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "You are not a moderator of that room", Room: room.Name})
+		return nil
+	}
+	return room
+}
+
+func (s *Server) handleGrantModerator(c *Client, msg Message) {
+	s.setModerator(c, msg, true)
+}
+
+func (s *Server) handleRevokeModerator(c *Client, msg Message) {
+	s.setModerator(c, msg, false)
+}
+
+// setModerator grants or revokes moderator status. Only the room owner may
+// change roles.
+func (s *Server) setModerator(c *Client, msg Message, grant bool) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room, exists := s.rooms[msg.Room]
+	if !exists {
+		c.Reply(Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: msg.Room})
+		return
+	}
+	if room.Owner != user.Username {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "Only the room owner can change moderators", Room: room.Name})
+		return
+	}
+	if msg.Target == "" || msg.Target == room.Owner {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Invalid moderator target", Room: room.Name})
+		return
+	}
+
+	role := "member"
+	if grant {
+		room.Moderators[msg.Target] = true
+		role = "moderator"
+	} else {
+		delete(room.Moderators, msg.Target)
+	}
+	s.saveRoomLocked(room)
+
+	s.fanoutLocked(room, Message{Type: "role", Sender: user.Username, Target: msg.Target, Room: room.Name, Content: role})
+}
+
+// handleKick removes msg.Target from a room. Moderators cannot kick the owner
+// or each other; only the owner can remove a moderator.
+func (s *Server) handleKick(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+	if !room.canModerate(user.Username, msg.Target) {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "You cannot kick that user", Room: room.Name})
+		return
+	}
+	if !s.ejectLocked(room, msg.Target, user.Username, "kicked", msg.Content) {
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "User is not in that room", Room: room.Name})
+	}
+}
+
+// handleBan removes msg.Target from a room, if present, and stops them from
+// joining it again until unbanned.
+func (s *Server) handleBan(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+	if msg.Target == "" || !room.canModerate(user.Username, msg.Target) {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "You cannot ban that user", Room: room.Name})
+		return
+	}
+
+	room.Bans[msg.Target] = msg.Content
+	s.saveRoomLocked(room)
+	if !s.ejectLocked(room, msg.Target, user.Username, "banned", msg.Content) {
+		c.Reply(Message{Type: "info", Content: msg.Target + " was banned", Target: msg.Target, Room: room.Name})
+	}
+}
+
+func (s *Server) handleUnban(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+	if _, banned := room.Bans[msg.Target]; !banned {
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "User is not banned from that room", Room: room.Name})
+		return
+	}
+
+	delete(room.Bans, msg.Target)
+	s.saveRoomLocked(room)
+	c.Reply(Message{Type: "info", Content: msg.Target + " was unbanned", Target: msg.Target, Room: room.Name})
+}
+
+// ejectLocked removes the member named username from room, tells them why
+// with an event of the given type, and informs the remaining members. It
+// reports false if username was not a member. The caller must hold roomLock.
+func (s *Server) ejectLocked(room *Room, username, by, event, reason string) bool {
+	var target *User
+	for _, u := range room.Members {
+		if u.Username == username {
+			target = u
+			break
+		}
+	}
+	if target == nil {
+		return false
+	}
+
+	if reason == "" {
+		reason = "No reason given"
+	}
+
+	s.removeMemberLocked(room.Name, target)
+	target.Send(Message{Type: event, Sender: by, Room: room.Name, Content: reason})
+	s.fanoutLocked(room, Message{Type: "info", Sender: by, Target: username, Room: room.Name, Content: username + " was " + event})
+	return true
+}
+
+// handleSetSlowMode lets a moderator require members to wait between
+// messages. msg.Content is the wait as a Go duration such as "30s", or
+// "off".
+func (s *Server) handleSetSlowMode(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	var interval time.Duration
+	if msg.Content != "off" {
+		d, err := time.ParseDuration(msg.Content)
+		if err != nil || d < 0 {
+			c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Slow mode must be a duration such as 30s, or off", Room: msg.Room})
+			return
+		}
+		interval = d
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+
+	room.SlowMode = interval
+	room.lastPosted = nil
+	s.saveRoomLocked(room)
+	s.fanoutLocked(room, Message{Type: "slow_mode", Sender: user.Username, Room: room.Name, Content: interval.String()})
+}
+
+// checkSlowModeLocked enforces room's slow mode on user, replying to c with
+// how long is left to wait if they posted too recently. Moderators are
+// exempt. The caller must hold roomLock.
+func (s *Server) checkSlowModeLocked(c *Client, user *User, room *Room) bool {
+	if room.SlowMode <= 0 || room.IsModerator(user.Username) {
+		return true
+	}
+
+	now := time.Now()
+	if wait := room.lastPosted[user.Username].Add(room.SlowMode).Sub(now); wait > 0 {
+		c.Reply(Message{
+			Type:    "error",
+			Code:    CodeRateLimited,
+			Content: fmt.Sprintf("Slow mode is on; you can send another message in %s", wait.Round(time.Second)),
+			Room:    room.Name,
+			Data:    RateLimited{RetryAfterMS: wait.Milliseconds()},
+		})
+		return false
+	}
+	if room.lastPosted == nil {
+		room.lastPosted = make(map[string]time.Time)
+	}
+	room.lastPosted[user.Username] = now
+	return true
+}
+
+// handleSetTopic lets a moderator set the room's one-line topic; an empty
+// Content clears it.
+func (s *Server) handleSetTopic(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if utf8.RuneCountInString(msg.Content) > maxTopicLength {
+		c.Reply(Message{Type: "error", Code: CodeTooLarge, Content: fmt.Sprintf("Topic must be at most %d characters", maxTopicLength), Room: msg.Room})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+
+	room.Topic = msg.Content
+	s.saveRoomLocked(room)
+	s.fanoutLocked(room, Message{Type: "topic", Sender: user.Username, Room: room.Name, Content: room.Topic})
+}
+
+// handleSetDescription lets a moderator set the room's longer description,
+// shown in room listings; an empty Content clears it.
+func (s *Server) handleSetDescription(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if utf8.RuneCountInString(msg.Content) > maxDescriptionLength {
+		c.Reply(Message{Type: "error", Code: CodeTooLarge, Content: fmt.Sprintf("Description must be at most %d characters", maxDescriptionLength), Room: msg.Room})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+
+	room.Description = msg.Content
+	s.saveRoomLocked(room)
+	s.fanoutLocked(room, Message{Type: "description", Sender: user.Username, Room: room.Name, Content: room.Description})
+}
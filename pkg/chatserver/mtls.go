@@ -0,0 +1,98 @@
+package chatserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// botListener is an additional TLS listener for bots and services. Instead
+// of signing in with a password, they present a client certificate issued
+// by clientCA, whose names are looked up in accounts.
+type botListener struct {
+	addr     string
+	clientCA string
+	// accounts maps a certificate's subject alternative names or common
+	// name to the account it signs in as.
+	accounts map[string]string
+}
+
+// botTLSConfig is the TLS configuration of the bot listener: that of the
+// main listener, but requiring a certificate signed by the client CA.
+func (s *Server) botTLSConfig() (*tls.Config, error) {
+	pem, err := os.ReadFile(s.bots.clientCA)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("client CA %s holds no certificates", s.bots.clientCA)
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.tlsConfig != nil {
+		cfg = s.tlsConfig.Clone()
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.ClientCAs = pool
+	return cfg, nil
+}
+
+// certNames lists the names a client certificate was issued to, subject
+// alternative names before the common name.
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// botAccount finds the account the certificate is mapped to, and the name
+// it was mapped by.
+func (s *Server) botAccount(cert *x509.Certificate) (account, name string, ok bool) {
+	for _, name := range certNames(cert) {
+		if account, ok := s.bots.accounts[name]; ok {
+			return account, name, true
+		}
+	}
+	return "", "", false
+}
+
+// handleBotConnections serves WebSocket connections on the bot listener,
+// signing each in as the account its client certificate is mapped to.
+func (s *Server) handleBotConnections(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	account, name, ok := s.botAccount(cert)
+	if !ok {
+		s.logger.Warn("refused unmapped client certificate", "subject", cert.Subject.String(), "ip", s.clientIP(r))
+		s.metrics.authFailure("unknown_certificate")
+		http.Error(w, "certificate is not mapped to an account", http.StatusForbidden)
+		return
+	}
+	found, err := s.accounts.Find(account)
+	if err != nil || found.Disabled {
+		if err != nil && !errors.Is(err, ErrUserNotFound) {
+			s.logger.Error("find bot account", "account", account, "err", err)
+		}
+		s.logger.Warn("refused client certificate", "name", name, "account", account)
+		s.metrics.authFailure("account_disabled")
+		http.Error(w, "account is unavailable", http.StatusForbidden)
+		return
+	}
+
+	s.logger.Info("client certificate accepted", "name", name, "account", account)
+	s.serveConn(w, r, account)
+}
@@ -0,0 +1,60 @@
+package chatserver
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSBroker is a Broker built on a NATS subject.
+type NATSBroker struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNATSBroker connects to the NATS server at url, such as
+// nats://localhost:4222, and exchanges events on subject. The connection
+// reconnects on its own if the server goes away.
+func NewNATSBroker(url, subject string) (*NATSBroker, error) {
+	conn, err := nats.Connect(url, nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &NATSBroker{conn: conn, subject: subject}, nil
+}
+
+func (b *NATSBroker) Publish(ctx context.Context, payload []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.conn.Publish(b.subject, payload)
+}
+
+func (b *NATSBroker) Subscribe(ctx context.Context, handle func(payload []byte)) error {
+	ch := make(chan *nats.Msg, outboxSize)
+	sub, err := b.conn.ChanSubscribe(b.subject, ch)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-ch:
+			handle(m.Data)
+		}
+	}
+}
+
+// Ping reports whether the connection is up, flushing it to check that the
+// server still answers.
+func (b *NATSBroker) Ping(ctx context.Context) error {
+	return b.conn.FlushWithContext(ctx)
+}
+
+func (b *NATSBroker) Close() error {
+	b.conn.Close()
+	return nil
+}
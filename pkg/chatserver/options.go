@@ -0,0 +1,383 @@
+package chatserver
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"cli-chat-app/pkg/chatplugin"
+)
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithAddr sets the address Run listens on. The default is ":8000".
+func WithAddr(addr string) Option {
+	return func(s *Server) { s.addr = addr }
+}
+
+// WithUserRepository sets where accounts are stored. The default is an
+// in-memory repository.
+func WithUserRepository(repo UserRepository) Option {
+	return func(s *Server) { s.accounts = repo }
+}
+
+// WithMessageStore sets where room messages are kept for lookups by ID. The
+// default is an in-memory store.
+func WithMessageStore(store MessageStore) Option {
+	return func(s *Server) { s.messages = store }
+}
+
+// WithHistoryFiles sets whether room history is written to, and replayed
+// from, per-room JSON Lines files. It is on by default; turn it off when the
+// MessageStore is itself durable.
+func WithHistoryFiles(enabled bool) Option {
+	return func(s *Server) { s.historyFiles = enabled }
+}
+
+// WithHistoryDir sets the directory history files are kept in. The default
+// is the working directory.
+func WithHistoryDir(dir string) Option {
+	return func(s *Server) { s.historyDir = dir }
+}
+
+// WithRetention sets how much history rooms keep unless their owner
+// overrides it. By default history is kept forever.
+func WithRetention(policy RetentionPolicy) Option {
+	return func(s *Server) { s.retention = policy }
+}
+
+// WithEmptyRoomPolicy sets when rooms left without members or messages are
+// archived or deleted. By default they are kept forever.
+func WithEmptyRoomPolicy(policy EmptyRoomPolicy) Option {
+	return func(s *Server) { s.emptyRooms = policy }
+}
+
+// WithMaxContentLength sets the longest Content, in characters, the server
+// accepts from clients. The default is 4000.
+func WithMaxContentLength(n int) Option {
+	return func(s *Server) { s.maxContent = n }
+}
+
+// WithMaxFileSize sets the largest file, in bytes, members may share in
+// rooms that allow it. Zero turns file sharing off. The default is 1 MiB.
+func WithMaxFileSize(n int64) Option {
+	return func(s *Server) { s.maxFileSize = n }
+}
+
+// WithAttachmentStore enables POST /upload and GET /files/, keeping
+// uploaded files in store, and lets chat messages carry attachments.
+func WithAttachmentStore(store AttachmentStore) Option {
+	return func(s *Server) { s.attachments = store }
+}
+
+// WithMaxAttachmentSize sets the largest file, in bytes, that can be
+// uploaded. The default is 10 MiB.
+func WithMaxAttachmentSize(n int64) Option {
+	return func(s *Server) { s.maxAttachmentSize = n }
+}
+
+// WithEmojiShortcodes sets whether :shortcode: emoji in messages are
+// replaced with the emoji themselves. Either way, clients can fetch the
+// shortcodes known with a capabilities request.
+func WithEmojiShortcodes(expand bool) Option {
+	return func(s *Server) { s.expandEmoji = expand }
+}
+
+// WithLinkPreviews turns on previews of links in chat messages to the given
+// hosts and their subdomains. Pages are only ever fetched from these hosts.
+func WithLinkPreviews(hosts []string) Option {
+	return func(s *Server) {
+		if len(hosts) > 0 {
+			s.previews = newLinkPreviewer(hosts)
+		}
+	}
+}
+
+// WithTranslator turns on /translate and automatic translation of room
+// messages, using t.
+func WithTranslator(t Translator) Option {
+	return func(s *Server) {
+		s.translator = t
+		if t != nil {
+			s.translateSlots = make(chan struct{}, maxTranslations)
+		}
+	}
+}
+
+// WithMaxConnsPerIP limits how many WebSocket connections may be open from
+// one address at a time; further upgrades are refused with 429. Zero, the
+// default, allows any number.
+func WithMaxConnsPerIP(n int) Option {
+	return func(s *Server) { s.maxConnsPerIP = n }
+}
+
+// WithTrustedProxies sets the proxies whose X-Forwarded-For header is
+// believed when working out a client's address.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(s *Server) { s.trustedProxies = prefixes }
+}
+
+// WithAllowedOrigins lets web pages from the origins matching patterns
+// connect, besides those served by the server itself. A pattern is a host,
+// with an optional port and scheme, and may contain wildcards, as in
+// *.example.com. Connections from other origins are refused with 403.
+func WithAllowedOrigins(patterns ...string) Option {
+	return func(s *Server) { s.allowedOrigins = patterns }
+}
+
+// WithAnyOrigin lets web pages from any origin connect, which is useful in
+// development. It is off by default.
+func WithAnyOrigin(enabled bool) Option {
+	return func(s *Server) { s.anyOrigin = enabled }
+}
+
+// WithCompression negotiates per-message deflate compression with clients
+// that support it and compresses the messages sent to them that are at
+// least threshold bytes long. Compression is off by default.
+func WithCompression(threshold int) Option {
+	return func(s *Server) {
+		s.upgrader.EnableCompression = true
+		s.compressMin = threshold
+	}
+}
+
+// WithContentFilter runs room messages and edits through f before they are
+// stored, unless a moderator turns it off for the room. By default nothing
+// is filtered.
+func WithContentFilter(f ContentFilter) Option {
+	return func(s *Server) { s.filter = f }
+}
+
+// WithSpamPolicy sets when room messages count as spam and how long their
+// senders are muted for. By default nothing is treated as spam.
+func WithSpamPolicy(policy SpamPolicy) Option {
+	return func(s *Server) { s.spamPolicy = policy }
+}
+
+// WithRateLimit sets how fast each user may send messages to a room, unless
+// its owner overrides it, and direct messages. By default there is no limit.
+func WithRateLimit(limit RateLimit) Option {
+	return func(s *Server) { s.rateLimit = limit }
+}
+
+// WithBotRateLimit sets how fast each bot may send messages, in place of
+// the limits on users and any room's own. By default bots are limited as
+// users are.
+func WithBotRateLimit(limit RateLimit) Option {
+	return func(s *Server) { s.botRateLimit = &limit }
+}
+
+// WithPlugin adds a plugin, after any added before it. Its replies to
+// commands are posted as name.
+func WithPlugin(name string, p chatplugin.Plugin) Option {
+	return func(s *Server) { s.plugins = append(s.plugins, namedPlugin{name: name, Plugin: p}) }
+}
+
+// WithScripts adds Lua scripts, after any added before them.
+func WithScripts(scripts ...*Script) Option {
+	return func(s *Server) { s.scripts = append(s.scripts, scripts...) }
+}
+
+// WithBroker connects the server to other instances through b, so rooms,
+// room messages, direct messages and presence are shared between them. Instances should also
+// share their stores, for example through PostgreSQL.
+func WithBroker(b Broker) Option {
+	return func(s *Server) { s.broker = b }
+}
+
+// WithCluster turns on cluster mode, in which the instances linked by the
+// broker each own some of the rooms. It needs WithBroker.
+func WithCluster(cfg Cluster) Option {
+	return func(s *Server) { s.cluster = newCluster(cfg) }
+}
+
+// WithSearchIndex sets the index used for message search. The default
+// scans messages in memory.
+func WithSearchIndex(index SearchIndex) Option {
+	return func(s *Server) { s.search = index }
+}
+
+// WithReadMarkerStore sets where read markers are kept. The default is an
+// in-memory store.
+func WithReadMarkerStore(store ReadMarkerStore) Option {
+	return func(s *Server) { s.readMarkers = store }
+}
+
+// WithStarStore sets where users' starred messages are kept. The default is
+// an in-memory store.
+func WithStarStore(store StarStore) Option {
+	return func(s *Server) { s.stars = store }
+}
+
+// WithScheduleStore sets where scheduled messages and reminders are kept
+// until they are sent. The default is an in-memory store.
+func WithScheduleStore(store ScheduleStore) Option {
+	return func(s *Server) { s.scheduleStore = store }
+}
+
+// WithKeyStore sets where users' public keys for encrypted direct messages
+// are kept. The default is an in-memory store.
+func WithKeyStore(store KeyStore) Option {
+	return func(s *Server) { s.keys = store }
+}
+
+// WithIPBanStore sets where the IP deny-list is kept. The default is an
+// in-memory store.
+func WithIPBanStore(store IPBanStore) Option {
+	return func(s *Server) { s.ipBanStore = store }
+}
+
+// WithWebhookStore sets where the webhooks admins register are kept. The
+// default is an in-memory store.
+func WithWebhookStore(store WebhookStore) Option {
+	return func(s *Server) { s.webhookStore = store }
+}
+
+// WithHookStore sets where the hooks integrations post through are kept.
+// The default is an in-memory store.
+func WithHookStore(store HookStore) Option {
+	return func(s *Server) { s.hookStore = store }
+}
+
+// WithBotStore sets where bot accounts' scopes and API keys are kept. The
+// default is an in-memory store.
+func WithBotStore(store BotStore) Option {
+	return func(s *Server) { s.botStore = store }
+}
+
+// WithRoomStore sets where rooms, their settings and their members are
+// kept. The default is an in-memory store.
+func WithRoomStore(store RoomStore) Option {
+	return func(s *Server) { s.roomStore = store }
+}
+
+// WithCredentialStore sets the store used by signup and signin. The default
+// is a bcrypt store backed by the user repository.
+func WithCredentialStore(store CredentialStore) Option {
+	return func(s *Server) { s.credentials = store }
+}
+
+// WithTLS serves over TLS using the given certificate and key files.
+func WithTLS(certFile, keyFile string) Option {
+	return func(s *Server) {
+		s.tlsCert = certFile
+		s.tlsKey = keyFile
+	}
+}
+
+// WithTLSConfig serves over TLS using cfg. Certificates may come from cfg
+// itself or be combined with WithTLS.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(s *Server) { s.tlsConfig = cfg }
+}
+
+// WithHTTPRedirect starts an additional plain HTTP listener on addr that
+// redirects every request to the TLS listener. It has no effect without TLS.
+func WithHTTPRedirect(addr string) Option {
+	return func(s *Server) { s.redirectAddr = addr }
+}
+
+// WithBotListener starts an additional TLS listener on addr for bots and
+// services. It requires a client certificate signed by a CA in clientCAFile
+// and signs the connection in as the account that one of the certificate's
+// subject alternative names or its common name maps to in accounts. It has
+// no effect without TLS.
+func WithBotListener(addr, clientCAFile string, accounts map[string]string) Option {
+	return func(s *Server) {
+		s.bots = &botListener{addr: addr, clientCA: clientCAFile, accounts: accounts}
+	}
+}
+
+// WithGRPC serves the gRPC API on addr, alongside the WebSocket endpoint.
+// It uses the server's TLS certificate when TLS is enabled.
+func WithGRPC(addr string) Option {
+	return func(s *Server) { s.grpcAddr = addr }
+}
+
+// WithLineProtocol accepts plain TCP connections on addr speaking the line
+// protocol, for chatting with netcat or telnet. It is never encrypted.
+func WithLineProtocol(addr string) Option {
+	return func(s *Server) { s.lineAddr = addr }
+}
+
+// WithMatrixBridge mirrors the rooms in cfg.Rooms to a Matrix homeserver,
+// serving the application service API under /_matrix/app/v1/.
+func WithMatrixBridge(cfg MatrixConfig) Option {
+	return func(s *Server) { s.matrix = newMatrixBridge(cfg) }
+}
+
+// WithWebhookBridges joins rooms to Slack and Discord channels through
+// their webhooks, accepting the channels' messages at /bridges/{token}.
+func WithWebhookBridges(bridges ...WebhookBridge) Option {
+	return func(s *Server) { s.webhookBridges = newWebhookBridges(bridges) }
+}
+
+// WithAssistant adds the assistant bot a describes.
+func WithAssistant(a Assistant) Option {
+	return func(s *Server) { s.assistant = newAssistantBot(a) }
+}
+
+// WithTelegramBridges relays rooms to Telegram groups through bots, in
+// both directions.
+func WithTelegramBridges(bridges ...TelegramBridge) Option {
+	return func(s *Server) { s.telegram = newTelegramBridges(bridges) }
+}
+
+// WithFederation links this server with the peers in cfg, sharing rooms
+// with them.
+func WithFederation(cfg Federation) Option {
+	return func(s *Server) { s.federation = newFederation(cfg) }
+}
+
+// WithMetrics sets whether Prometheus metrics are served at /metrics. It is
+// on by default.
+func WithMetrics(enabled bool) Option {
+	return func(s *Server) { s.metricsEnabled = enabled }
+}
+
+// WithDebugEndpoints sets whether net/http/pprof and a runtime snapshot
+// are served under /debug/ to admins. It is off by default.
+func WithDebugEndpoints(enabled bool) Option {
+	return func(s *Server) { s.debugEnabled = enabled }
+}
+
+// WithLogger sets where the server logs. The default is slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) { s.logger = logger }
+}
+
+// WithShutdownGrace sets how long clients are given, after being told the
+// server is shutting down, before their connections are closed. The default
+// is 5s.
+func WithShutdownGrace(d time.Duration) Option {
+	return func(s *Server) { s.shutdownGrace = d }
+}
+
+// WithKeepalive sets how often clients are pinged and how long
+// connections may stay silent or idle. The default is DefaultKeepalive.
+func WithKeepalive(k Keepalive) Option {
+	return func(s *Server) { s.keepalive = k }
+}
+
+// WithSessionKey sets the HMAC key used to sign session tokens. By default a
+// random key is generated, so tokens do not survive a restart.
+func WithSessionKey(key []byte) Option {
+	return func(s *Server) { s.sessionKey = key }
+}
+
+// WithSessionTTL sets how long session tokens stay valid. The default is 24h.
+func WithSessionTTL(ttl time.Duration) Option {
+	return func(s *Server) { s.sessionTTL = ttl }
+}
+
+// WithAdmins grants admin privileges to the given usernames in addition to
+// accounts flagged as admin in the user repository.
+func WithAdmins(usernames ...string) Option {
+	return func(s *Server) {
+		for _, name := range usernames {
+			s.admins[name] = true
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package chatserver
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// originAllowed reports whether a WebSocket upgrade may come from the page
+// in r's Origin header. Requests without one come from other programs than
+// browsers and are allowed, as are pages served by this server and those
+// matching an allowed pattern.
+func (s *Server) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || s.anyOrigin {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, pattern := range s.allowedOrigins {
+		if originMatches(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// originMatches reports whether origin matches pattern. A pattern is a host,
+// with or without a port and optionally prefixed by a scheme, and may use
+// wildcards: *.example.com matches every subdomain of example.com.
+func originMatches(pattern string, origin *url.URL) bool {
+	pattern = strings.ToLower(pattern)
+	if scheme, host, ok := strings.Cut(pattern, "://"); ok {
+		if scheme != strings.ToLower(origin.Scheme) {
+			return false
+		}
+		pattern = host
+	}
+	for _, host := range []string{origin.Host, origin.Hostname()} {
+		if ok, _ := path.Match(pattern, strings.ToLower(host)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidOriginPattern reports whether pattern is well formed for
+// WithAllowedOrigins.
+func ValidOriginPattern(pattern string) bool {
+	if _, host, ok := strings.Cut(pattern, "://"); ok {
+		pattern = host
+	}
+	_, err := path.Match(pattern, "")
+	return pattern != "" && err == nil
+}
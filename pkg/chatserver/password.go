@@ -0,0 +1,209 @@
+package chatserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// A user who forgot their password is given a reset token by an admin, or
+// by the operator at the console, out of band, such as by email. Sending it
+// back in a reset_password request sets a new password and signs the user
+// out everywhere. Tokens are good for one use within resetTokenTTL, and
+// only the latest one made for a user is; they are kept hashed, in memory,
+// so a restart voids them.
+
+// resetTokenTTL is how long a reset token is good for.
+const resetTokenTTL = time.Hour
+
+// ErrInvalidResetToken is returned for reset tokens that are unknown,
+// used or expired.
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// resetTokens holds the outstanding reset tokens by the SHA-256 of each.
+type resetTokens struct {
+	mu     sync.Mutex
+	tokens map[string]resetToken
+}
+
+type resetToken struct {
+	username string
+	expires  time.Time
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateResetToken makes a token that lets username set a new password,
+// replacing any made before, and returns it with when it expires. by names
+// who asked for it.
+func (s *Server) CreateResetToken(username, by string) (string, time.Time, error) {
+	if _, err := s.accounts.Find(username); err != nil {
+		return "", time.Time{}, err
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(raw)
+	expires := time.Now().Add(resetTokenTTL).UTC()
+
+	rt := &s.resetTokens
+	rt.mu.Lock()
+	if rt.tokens == nil {
+		rt.tokens = make(map[string]resetToken)
+	}
+	for hash, t := range rt.tokens {
+		if t.username == username || time.Now().After(t.expires) {
+			delete(rt.tokens, hash)
+		}
+	}
+	rt.tokens[hashResetToken(token)] = resetToken{username: username, expires: expires}
+	rt.mu.Unlock()
+
+	s.audit(AuditEntry{Actor: by, Action: "create_reset_token", Target: username})
+	return token, expires, nil
+}
+
+// claimResetToken voids token and returns what it was made for, so that of
+// two resets racing with one token only one goes ahead.
+func (s *Server) claimResetToken(token string) (resetToken, error) {
+	rt := &s.resetTokens
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	hash := hashResetToken(token)
+	t, ok := rt.tokens[hash]
+	if !ok || time.Now().After(t.expires) {
+		return resetToken{}, ErrInvalidResetToken
+	}
+	delete(rt.tokens, hash)
+	return t, nil
+}
+
+// restoreResetToken makes a claimed token good again after a reset that
+// failed, so it can be tried again, unless a newer one has been made for
+// the user since.
+func (s *Server) restoreResetToken(token string, t resetToken) {
+	rt := &s.resetTokens
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, other := range rt.tokens {
+		if other.username == t.username {
+			return
+		}
+	}
+	rt.tokens[hashResetToken(token)] = t
+}
+
+// handleChangePassword changes the user's password to msg.Content, given
+// their current one in msg.Password. Their other sessions are signed out:
+// every token they were issued is revoked and their other connections are
+// signed out; this connection is sent a new token.
+func (s *Server) handleChangePassword(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	setter, ok := s.credentials.(PasswordSetter)
+	if !ok {
+		c.Reply(Message{Type: "error", Code: CodeDisabled, Content: "The server cannot change passwords"})
+		return
+	}
+	if err := s.credentials.Authenticate(user.Username, msg.Password); err != nil {
+		if !errors.Is(err, ErrInvalidCredentials) {
+			c.reqLogger.Error("change password", "err", err)
+			c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Password change failed"})
+			return
+		}
+		c.reqLogger.Warn("change password failed", "user", user.Username)
+		s.metrics.authFailure("invalid_credentials")
+		c.Reply(Message{Type: "error", Code: CodeWrongPassword, Content: "Current password is wrong"})
+		return
+	}
+	if err := setter.SetPassword(user.Username, msg.Content); err != nil {
+		s.sendAccountError(c, err)
+		return
+	}
+
+	s.sessions.RevokeUser(user.Username)
+	s.signoutConnections(user.Username, "Your password was changed", c)
+	token, err := s.sessions.Issue(user.Username)
+	if err != nil {
+		// The password is changed all the same; the user signs in again.
+		c.reqLogger.Error("issue session", "err", err)
+	}
+	s.clientLock.Lock()
+	c.session = token
+	s.clientLock.Unlock()
+
+	s.audit(AuditEntry{Actor: user.Username, Action: "change_password", Target: user.Username})
+	c.Reply(Message{Type: "info", Content: "Password changed; your other sessions were signed out"})
+	if token != "" {
+		c.Send(Message{Type: "session", Content: token})
+	}
+}
+
+// loadPasswordChanges revokes the session tokens issued before each user
+// last changed their password, which outlive restarts when the session key
+// is configured.
+func (s *Server) loadPasswordChanges() {
+	accounts, err := s.accounts.List()
+	if err != nil {
+		s.logger.Error("load accounts", "err", err)
+		return
+	}
+	for _, account := range accounts {
+		if !account.PasswordChangedAt.IsZero() {
+			s.sessions.RevokeUserBefore(account.Username, account.PasswordChangedAt)
+		}
+	}
+}
+
+// handleAdminResetPassword lets an admin make a reset token for the user
+// msg.Target, which they are sent to hand over.
+func (s *Server) handleAdminResetPassword(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	token, expires, err := s.CreateResetToken(msg.Target, admin.Username)
+	if err != nil {
+		s.sendAccountError(c, err)
+		return
+	}
+	c.Reply(Message{Type: "reset_token", Target: msg.Target, Content: token, ExpiresAt: expires.Format(time.RFC3339)})
+}
+
+// handleResetPassword sets a new password, msg.Content, for the user the
+// reset token msg.Password was made for, and signs them out everywhere.
+// It can be made without signing in.
+func (s *Server) handleResetPassword(c *Client, msg Message) {
+	setter, ok := s.credentials.(PasswordSetter)
+	if !ok {
+		c.Reply(Message{Type: "error", Code: CodeDisabled, Content: "The server cannot change passwords"})
+		return
+	}
+	claimed, err := s.claimResetToken(msg.Password)
+	if err != nil {
+		c.reqLogger.Warn("reset password failed", "err", err)
+		s.metrics.authFailure("invalid_reset_token")
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "Invalid or expired reset token"})
+		return
+	}
+	username := claimed.username
+	if err := setter.SetPassword(username, msg.Content); err != nil {
+		s.restoreResetToken(msg.Password, claimed)
+		s.sendAccountError(c, err)
+		return
+	}
+
+	s.ForceSignout(username, "Your password was reset")
+	s.audit(AuditEntry{Actor: username, Action: "reset_password", Target: username})
+	c.Reply(Message{Type: "info", Content: "Password reset; sign in with the new one", Target: username})
+}
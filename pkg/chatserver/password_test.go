@@ -0,0 +1,270 @@
+package chatserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  string
+		wantCode string
+	}{
+		{"right password", "alice-password", ""},
+		{"wrong password", "guess", CodeWrongPassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			other := signIn(t, s, "alice")
+			c := signIn(t, s, "alice")
+			oldToken := c.session
+
+			msgs := do(s, c, Message{Type: "change_password", Password: tt.current, Content: "new-password"})
+			if code := errorCode(msgs); code != tt.wantCode {
+				t.Fatalf("change_password answered %q, want %q", code, tt.wantCode)
+			}
+			changed := tt.wantCode == ""
+
+			if s.userOf(c) == nil {
+				t.Error("changing connection signed out")
+			}
+			if got := s.userOf(other) == nil; got != changed {
+				t.Errorf("other connection signed out = %v, want %v", got, changed)
+			}
+			if _, err := s.sessions.Verify(oldToken); (err != nil) != changed {
+				t.Errorf("old token revoked = %v, want %v", err != nil, changed)
+			}
+			if !changed {
+				return
+			}
+			session, ok := find(msgs, "session")
+			if !ok {
+				t.Fatal("no new session token sent")
+			}
+			if _, err := s.sessions.Verify(session.Content); err != nil {
+				t.Errorf("new token: %v", err)
+			}
+			if _, ok := find(drain(other), "signed_out"); !ok {
+				t.Error("other connection not told it was signed out")
+			}
+			if !s.isOnline("alice") {
+				t.Error("alice went offline")
+			}
+			if err := s.credentials.Authenticate("alice", "new-password"); err != nil {
+				t.Errorf("new password: %v", err)
+			}
+		})
+	}
+}
+
+// failingUpdates is a repository whose updates fail while fail is set.
+type failingUpdates struct {
+	*MemoryUserRepository
+	fail bool
+}
+
+func (r *failingUpdates) Update(account *Account) error {
+	if r.fail {
+		return errors.New("disk full")
+	}
+	return r.MemoryUserRepository.Update(account)
+}
+
+func TestResetPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      func(s *Server, token string) string
+		failUpdate bool
+		wantCode   string
+		// usable reports whether the token still works afterwards.
+		usable bool
+	}{
+		{"valid token", nil, false, "", false},
+		{"unknown token", func(s *Server, token string) string { return "0123456789abcdef" }, false, CodeUnauthenticated, true},
+		{"expired token", func(s *Server, token string) string {
+			rt := &s.resetTokens
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+			hash := hashResetToken(token)
+			t := rt.tokens[hash]
+			t.expires = time.Now().Add(-time.Minute)
+			rt.tokens[hash] = t
+			return token
+		}, false, CodeUnauthenticated, false},
+		{"replaced token", func(s *Server, token string) string {
+			s.CreateResetToken("alice", "test")
+			return token
+		}, false, CodeUnauthenticated, false},
+		{"password not saved", nil, true, CodeInternal, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &failingUpdates{MemoryUserRepository: NewMemoryUserRepository()}
+			s := newTestServer(t, WithUserRepository(repo))
+			signedIn := signIn(t, s, "alice")
+			token, _, err := s.CreateResetToken("alice", "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sent := token
+			if tt.token != nil {
+				sent = tt.token(s, token)
+			}
+
+			repo.fail = tt.failUpdate
+			c := newTestClient(s)
+			code := errorCode(do(s, c, Message{Type: "reset_password", Password: sent, Content: "new-password"}))
+			if code != tt.wantCode {
+				t.Fatalf("reset_password answered %q, want %q", code, tt.wantCode)
+			}
+			reset := tt.wantCode == ""
+			if got := s.userOf(signedIn) == nil; got != reset {
+				t.Errorf("signed out = %v, want %v", got, reset)
+			}
+			if err := s.credentials.Authenticate("alice", "new-password"); (err == nil) != reset {
+				t.Errorf("new password works = %v, want %v", err == nil, reset)
+			}
+
+			repo.fail = false
+			_, err = s.claimResetToken(token)
+			if (err == nil) != tt.usable {
+				t.Errorf("token usable afterwards = %v, want %v", err == nil, tt.usable)
+			}
+		})
+	}
+}
+
+func TestClaimResetToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token func(s *Server, token string) string
+		want  error
+	}{
+		{"valid token", nil, nil},
+		{"unknown token", func(s *Server, token string) string { return "0123456789abcdef" }, ErrInvalidResetToken},
+		{"expired token", func(s *Server, token string) string {
+			rt := &s.resetTokens
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+			hash := hashResetToken(token)
+			t := rt.tokens[hash]
+			t.expires = time.Now().Add(-time.Minute)
+			rt.tokens[hash] = t
+			return token
+		}, ErrInvalidResetToken},
+		{"replaced token", func(s *Server, token string) string {
+			s.CreateResetToken("alice", "test")
+			return token
+		}, ErrInvalidResetToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(WithHistoryFiles(false), WithMetrics(false), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+			if err := s.accounts.Create(&Account{Username: "alice"}); err != nil {
+				t.Fatal(err)
+			}
+			token, _, err := s.CreateResetToken("alice", "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := s.resetTokens.tokens[token]; ok {
+				t.Fatal("token kept unhashed")
+			}
+			if tt.token != nil {
+				token = tt.token(s, token)
+			}
+
+			claimed, err := s.claimResetToken(token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("claimResetToken = %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if claimed.username != "alice" {
+				t.Errorf("token made for alice claimed for %q", claimed.username)
+			}
+			if _, err := s.claimResetToken(token); !errors.Is(err, ErrInvalidResetToken) {
+				t.Errorf("second claim = %v, want %v", err, ErrInvalidResetToken)
+			}
+			s.restoreResetToken(token, claimed)
+			if _, err := s.claimResetToken(token); err != nil {
+				t.Errorf("claim after restore = %v", err)
+			}
+		})
+	}
+}
+
+func TestRestoreResetTokenAfterReplacement(t *testing.T) {
+	s := New(WithHistoryFiles(false), WithMetrics(false), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err := s.accounts.Create(&Account{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := s.CreateResetToken("alice", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := s.claimResetToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, _, err := s.CreateResetToken("alice", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.restoreResetToken(token, claimed)
+	if _, err := s.claimResetToken(token); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("replaced token restored: claim = %v", err)
+	}
+	if _, err := s.claimResetToken(newer); err != nil {
+		t.Errorf("newer token: claim = %v", err)
+	}
+}
+
+// TestResetPasswordConcurrently is meant to be run with -race: of several
+// resets sent at once with one token, exactly one may succeed.
+func TestResetPasswordConcurrently(t *testing.T) {
+	const resets = 10
+
+	s := newTestServer(t)
+	signIn(t, s, "alice")
+	token, _, err := s.CreateResetToken("alice", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var succeeded atomic.Int32
+	for i := 0; i < resets; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := newTestClient(s)
+			msgs := do(s, c, Message{Type: "reset_password", Password: token, Content: fmt.Sprintf("new-password-%d", i)})
+			if errorCode(msgs) == "" {
+				succeeded.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := succeeded.Load(); n != 1 {
+		t.Errorf("%d resets succeeded with one token, want 1", n)
+	}
+}
+
+func TestCreateResetTokenUnknownUser(t *testing.T) {
+	s := New(WithHistoryFiles(false), WithMetrics(false), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if _, _, err := s.CreateResetToken("nobody", "test"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("CreateResetToken = %v, want %v", err, ErrUserNotFound)
+	}
+}
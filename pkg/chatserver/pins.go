@@ -0,0 +1,141 @@
+package chatserver
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// maxPins caps how many messages a room can have pinned.
+const maxPins = 50
+
+// Pin records that a moderator pinned a message to its room.
+type Pin struct {
+	MessageID string    `json:"message_id"`
+	PinnedBy  string    `json:"pinned_by"`
+	PinnedAt  time.Time `json:"pinned_at"`
+}
+
+// PinnedMessage is one entry of the Data of a pins reply.
+type PinnedMessage struct {
+	Pin
+	Message Message `json:"message"`
+}
+
+func (r *Room) pinIndex(messageID string) int {
+	return slices.IndexFunc(r.Pins, func(p Pin) bool { return p.MessageID == messageID })
+}
+
+// unpinLocked drops messageID from room's pins, reporting whether it was
+// pinned. The caller must hold roomLock.
+func (s *Server) unpinLocked(room *Room, messageID string) bool {
+	i := room.pinIndex(messageID)
+	if i < 0 {
+		return false
+	}
+	room.Pins = slices.Delete(room.Pins, i, i+1)
+	s.saveRoomLocked(room)
+	return true
+}
+
+// handlePin lets a moderator pin msg.MessageID in msg.Room.
+func (s *Server) handlePin(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+	stored, err := s.messages.Get(room.Name, msg.MessageID)
+	if err != nil {
+		if !errors.Is(err, ErrMessageNotFound) {
+			c.reqLogger.Error("load message", "message_id", msg.MessageID, "err", err)
+		}
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Message not found", Room: room.Name, MessageID: msg.MessageID})
+		return
+	}
+	if stored.Deleted {
+		c.Reply(Message{Type: "error", Code: CodeGone, Content: "Deleted messages cannot be pinned", Room: room.Name, MessageID: msg.MessageID})
+		return
+	}
+	if room.pinIndex(msg.MessageID) >= 0 {
+		c.Reply(Message{Type: "error", Code: CodeAlreadyExists, Content: "Message is already pinned", Room: room.Name, MessageID: msg.MessageID})
+		return
+	}
+	if len(room.Pins) >= maxPins {
+		c.Reply(Message{Type: "error", Code: CodeLimitExceeded, Content: "The room has too many pins; unpin some first", Room: room.Name})
+		return
+	}
+
+	room.Pins = append(room.Pins, Pin{MessageID: msg.MessageID, PinnedBy: user.Username, PinnedAt: time.Now().UTC()})
+	s.saveRoomLocked(room)
+	s.fanoutLocked(room, Message{Type: "pinned", Sender: user.Username, Room: room.Name, MessageID: msg.MessageID})
+}
+
+// handleUnpin lets a moderator unpin msg.MessageID in msg.Room.
+func (s *Server) handleUnpin(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room := s.requireModeratorLocked(c, user, msg)
+	if room == nil {
+		return
+	}
+	if !s.unpinLocked(room, msg.MessageID) {
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Message is not pinned", Room: room.Name, MessageID: msg.MessageID})
+		return
+	}
+	s.fanoutLocked(room, Message{Type: "unpinned", Sender: user.Username, Room: room.Name, MessageID: msg.MessageID})
+}
+
+// handleGetPins sends a member of msg.Room its pinned messages, in the order
+// they were pinned. Pins of messages since pruned or deleted are left out.
+func (s *Server) handleGetPins(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	room, exists := s.rooms[msg.Room]
+	member := user.Rooms[msg.Room]
+	var pins []Pin
+	if exists {
+		pins = slices.Clone(room.Pins)
+	}
+	s.roomLock.Unlock()
+	if !exists || !member {
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return
+	}
+
+	pinned := make([]PinnedMessage, 0, len(pins))
+	for _, pin := range pins {
+		stored, err := s.messages.Get(msg.Room, pin.MessageID)
+		if err != nil {
+			if !errors.Is(err, ErrMessageNotFound) {
+				c.reqLogger.Error("load message", "message_id", pin.MessageID, "err", err)
+			}
+			continue
+		}
+		if stored.Deleted {
+			continue
+		}
+		pinned = append(pinned, PinnedMessage{Pin: pin, Message: stored})
+	}
+	c.Reply(Message{Type: "pins", Room: msg.Room, Data: pinned})
+}
@@ -0,0 +1,125 @@
+package chatserver
+
+import (
+	"context"
+	"time"
+
+	"cli-chat-app/pkg/chatplugin"
+)
+
+// Plugins extend the server from outside it. Each is asked about every room
+// message sent by a user and every join before they happen, and may refuse
+// them or change a message. The commands they list are added to the slash
+// commands, and commands nobody registered are offered to them too. Plugins
+// are asked in the order they were added. A plugin that fails or takes longer
+// than pluginTimeout is skipped, so a broken plugin does not stop the chat.
+
+// pluginTimeout bounds each call to a plugin.
+const pluginTimeout = 2 * time.Second
+
+// BridgePlugin is the Bridge of messages plugins post to rooms.
+const BridgePlugin = "plugin"
+
+// namedPlugin is a plugin and the name it posts and is logged as.
+type namedPlugin struct {
+	name string
+	chatplugin.Plugin
+}
+
+// pluginCommandFunc answers the command name, which p listed, through p.
+func (s *Server) pluginCommandFunc(p namedPlugin, name string) CommandFunc {
+	return func(c *Client, user *User, msg Message, args string) {
+		if !s.offerPluginCommand(c, p, user, msg.Room, name, args) {
+			c.Reply(Message{Type: "error", Code: CodeUnsupported, Content: "The command could not be run", Room: msg.Room})
+		}
+	}
+}
+
+// offerPluginCommand offers the command name, sent by user in room, to p.
+// It reports whether p answered it.
+func (s *Server) offerPluginCommand(c *Client, p namedPlugin, user *User, room, name, args string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	reply, err := p.OnCommand(ctx, chatplugin.Command{Room: room, Sender: user.Username, Name: name, Args: args})
+	cancel()
+	if err != nil {
+		c.reqLogger.Warn("plugin command", "plugin", p.name, "command", name, "err", err)
+		return false
+	}
+	if !reply.Handled {
+		return false
+	}
+	if reply.Content == "" {
+		return true
+	}
+	if !reply.Broadcast {
+		c.Reply(Message{Type: "info", Sender: p.name, Room: room, Content: reply.Content})
+		return true
+	}
+	// A reply posted to the room counts as a message from the user.
+	s.roomLock.Lock()
+	r, ok := s.rooms[room]
+	allowed := ok && s.checkFloodLocked(c, user, r, "/"+name+" "+args)
+	s.roomLock.Unlock()
+	if !allowed {
+		if !ok {
+			c.Reply(Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: room})
+		}
+		return true
+	}
+	if _, err := s.relay(Message{Room: room, Sender: p.name, Bridge: BridgePlugin, Content: reply.Content}); err != nil {
+		c.reqLogger.Warn("post plugin reply", "plugin", p.name, "command", name, "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not post the command's reply", Room: room})
+	}
+	return true
+}
+
+// pluginsAllowMessage asks the plugins about msg, from user, applying any
+// changes they make to its content. If one rejects it, it replies to c and
+// returns false.
+func (s *Server) pluginsAllowMessage(c *Client, user *User, msg *Message) bool {
+	for _, p := range s.plugins {
+		ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+		v, err := p.OnMessage(ctx, chatplugin.Message{Room: msg.Room, Sender: user.Username, Content: msg.Content, Format: msg.Format})
+		cancel()
+		if err != nil {
+			c.reqLogger.Warn("plugin message check", "plugin", p.name, "err", err)
+			continue
+		}
+		if v.Reject {
+			c.Reply(Message{Type: "error", Code: CodeContentBlocked, Content: rejection("Message rejected", v.Reason), Room: msg.Room})
+			return false
+		}
+		if v.Content != "" {
+			msg.Content = v.Content
+		}
+	}
+	return true
+}
+
+// pluginsAllowJoin asks the plugins whether user may join room. If one
+// refuses, it replies to c and returns false.
+func (s *Server) pluginsAllowJoin(c *Client, user *User, room string) bool {
+	for _, p := range s.plugins {
+		ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+		v, err := p.OnJoin(ctx, chatplugin.Join{Room: room, User: user.Username})
+		cancel()
+		if err != nil {
+			c.reqLogger.Warn("plugin join check", "plugin", p.name, "err", err)
+			continue
+		}
+		if v.Reject {
+			c.Reply(Message{Type: "error", Code: CodeForbidden, Content: rejection("You may not join that room", v.Reason), Room: room})
+			return false
+		}
+	}
+	return true
+}
+
+// rejection is what a user is told when a plugin refuses them, with the
+// plugin's reason if it gave one.
+func rejection(what, reason string) string {
+	if reason == "" {
+		return what
+	}
+	return what + ": " + reason
+}
@@ -0,0 +1,318 @@
+package chatserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Long polling is a fallback transport for networks whose proxies break
+// WebSockets. POST /poll opens a connection and returns its ID. Requests
+// are posted to /poll/{id}, one message object per request, and are
+// handled exactly as if they had arrived on a WebSocket; the replies and
+// events for the connection are fetched with GET /poll/{id}?cursor=N,
+// which waits for messages when there are none. DELETE /poll/{id} closes
+// the connection.
+//
+// Each message fetched is numbered, and the cursor returned with a batch
+// is the number of its last message. Passing it to the next fetch
+// acknowledges the batch; until then it is sent again, so a batch lost
+// with a dropped response is not lost with it.
+
+const (
+	// pollWait is how long a fetch waits for messages before returning
+	// none.
+	pollWait = 25 * time.Second
+	// pollExpiry closes connections that have not fetched for that long,
+	// and forgets closed ones whose last messages were never fetched.
+	pollExpiry = time.Minute
+	// maxPollBatch is how many messages one fetch returns at most.
+	maxPollBatch = 100
+)
+
+// PollOpened is the body of the reply to POST /poll.
+type PollOpened struct {
+	ID string `json:"id"`
+}
+
+// PollBatch is the body of the reply to GET /poll/{id}. Closed is set on
+// the last batch of a connection that has closed.
+type PollBatch struct {
+	Messages []Message `json:"messages"`
+	Cursor   uint64    `json:"cursor"`
+	Closed   bool      `json:"closed,omitempty"`
+}
+
+// pollConn is a long-polling connection. Its Client's messages are moved
+// from the send queue into queue, where they wait to be fetched.
+type pollConn struct {
+	id string
+	c  *Client
+	// reqLock serializes the connection's requests, as a WebSocket's read
+	// loop does.
+	reqLock sync.Mutex
+
+	// mu guards the rest. queue holds the messages numbered acked+1
+	// onwards. wake is closed, and replaced, when messages arrive or the
+	// connection closes.
+	mu       sync.Mutex
+	queue    []Message
+	acked    uint64
+	wake     chan struct{}
+	closed   bool
+	lastPoll time.Time
+}
+
+func newPollID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// push queues msg to be fetched. It reports false if too many are waiting.
+func (p *pollConn) push(msg Message) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) >= sendBuffer {
+		return false
+	}
+	p.queue = append(p.queue, msg)
+	p.wakeLocked()
+	return true
+}
+
+func (p *pollConn) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.wakeLocked()
+}
+
+func (p *pollConn) wakeLocked() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+// take acknowledges the messages up to cursor and returns those after it,
+// with the cursor that acknowledges them, whether they are the last the
+// connection will have, and a channel closed when that changes. It reports
+// false if cursor is ahead of the messages.
+func (p *pollConn) take(cursor uint64) (batch PollBatch, wake <-chan struct{}, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastPoll = time.Now()
+	if cursor > p.acked+uint64(len(p.queue)) {
+		return batch, nil, false
+	}
+	if cursor > p.acked {
+		p.queue = p.queue[cursor-p.acked:]
+		p.acked = cursor
+	}
+	n := min(len(p.queue), maxPollBatch)
+	batch.Messages = append([]Message{}, p.queue[:n]...)
+	batch.Cursor = p.acked + uint64(n)
+	batch.Closed = p.closed && n == len(p.queue)
+	return batch, p.wake, true
+}
+
+// idleSince is when the connection last fetched.
+func (p *pollConn) idleSince() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastPoll
+}
+
+// run moves the client's messages into the queue until the connection
+// closes, then forgets it once its last messages are fetched or expire.
+func (s *Server) runPoll(p *pollConn) {
+	c := p.c
+	defer time.AfterFunc(pollExpiry, func() { s.forgetPoll(p) })
+	defer p.close()
+	defer s.releaseIP(c.ip)
+	defer s.connWG.Done()
+	defer s.disconnect(c)
+
+	check := time.NewTicker(c.keepalive.PingInterval)
+	defer check.Stop()
+	for {
+		select {
+		case msg := <-c.send:
+			if !p.push(msg) {
+				c.logger.Warn("poll queue full, closing connection")
+				c.Close()
+				return
+			}
+		case <-c.flush:
+			for {
+				select {
+				case msg := <-c.send:
+					p.push(msg)
+				default:
+					c.Close()
+					return
+				}
+			}
+		case <-c.done:
+			return
+		case now := <-check.C:
+			if now.Sub(p.idleSince()) >= pollExpiry {
+				c.logger.Info("poll connection expired")
+				c.Close()
+				return
+			}
+			if c.idle(now) {
+				c.logger.Info("connection idle, closing")
+				c.CloseAfterFlush()
+			}
+		}
+	}
+}
+
+// forgetPoll drops p from the open polls.
+func (s *Server) forgetPoll(p *pollConn) {
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+	if s.polls[p.id] == p {
+		delete(s.polls, p.id)
+	}
+}
+
+// pollFor returns the connection r names, answering r if there is none.
+func (s *Server) pollFor(w http.ResponseWriter, r *http.Request) *pollConn {
+	s.pollLock.Lock()
+	p := s.polls[r.PathValue("id")]
+	s.pollLock.Unlock()
+	if p == nil {
+		writeFailure(w, Message{Type: "error", Code: CodeNotFound, Content: "No such connection"})
+	}
+	return p
+}
+
+// handlePollOpen serves POST /poll, opening a connection as a WebSocket
+// upgrade would.
+func (s *Server) handlePollOpen(w http.ResponseWriter, r *http.Request) {
+	ip := s.clientIP(r)
+	if s.ipBanned(ip) {
+		s.logger.Info("refused banned address", "ip", ip)
+		writeFailure(w, Message{Type: "error", Code: CodeBanned, Content: "Your address has been banned"})
+		return
+	}
+	if !s.originAllowed(r) {
+		s.logger.Warn("refused origin", "ip", ip, "origin", r.Header.Get("Origin"))
+		writeFailure(w, Message{Type: "error", Code: CodeForbidden, Content: "Origin not allowed"})
+		return
+	}
+	id, err := newPollID()
+	if err != nil {
+		s.logger.Error("generate poll ID", "err", err)
+		writeFailure(w, Message{Type: "error", Code: CodeInternal, Content: "Could not open connection"})
+		return
+	}
+	if !s.acquireIP(ip) {
+		s.logger.Warn("too many connections", "ip", ip)
+		writeFailure(w, Message{Type: "error", Code: CodeLimitExceeded, Content: "Too many connections"})
+		return
+	}
+
+	c := s.newCallClient(ip, "poll")
+	p := &pollConn{id: id, c: c, wake: make(chan struct{}), lastPoll: time.Now()}
+	s.connWG.Add(1)
+	s.connLock.Lock()
+	s.conns[c] = true
+	s.connLock.Unlock()
+	s.pollLock.Lock()
+	s.polls[id] = p
+	s.pollLock.Unlock()
+	go s.runPoll(p)
+	c.logger.Debug("connected")
+
+	writeJSON(w, http.StatusCreated, PollOpened{ID: id})
+}
+
+// handlePollSend serves POST /poll/{id}, handling the message in the body
+// as a request on the connection. Its replies are fetched with the rest of
+// the connection's messages.
+func (s *Server) handlePollSend(w http.ResponseWriter, r *http.Request) {
+	p := s.pollFor(w, r)
+	if p == nil {
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.maxContent)*utf8.UTFMax+readLimitSlack))
+	if err != nil {
+		writeFailure(w, Message{Type: "error", Code: CodeTooLarge, Content: "Message is too large"})
+		return
+	}
+	select {
+	case <-p.c.done:
+		writeFailure(w, Message{Type: "error", Code: CodeGone, Content: "Connection is closed"})
+		return
+	default:
+	}
+
+	p.reqLock.Lock()
+	defer p.reqLock.Unlock()
+	p.c.lastMessage.Store(time.Now().UnixNano())
+	msg, problems := decodeMessage(body)
+	s.dispatch(p.c, msg, problems)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlePollFetch serves GET /poll/{id}, the connection's messages after
+// the cursor parameter, waiting up to pollWait for some if there are none.
+func (s *Server) handlePollFetch(w http.ResponseWriter, r *http.Request) {
+	p := s.pollFor(w, r)
+	if p == nil {
+		return
+	}
+	var cursor uint64
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeFailure(w, Message{Type: "error", Code: CodeInvalidRequest, Content: "Invalid cursor " + strconv.Quote(v)})
+			return
+		}
+	}
+
+	timeout := time.NewTimer(pollWait)
+	defer timeout.Stop()
+	for {
+		batch, wake, ok := p.take(cursor)
+		if !ok {
+			writeFailure(w, Message{Type: "error", Code: CodeInvalidRequest, Content: "Cursor is ahead of the connection's messages"})
+			return
+		}
+		if len(batch.Messages) > 0 || batch.Closed {
+			if batch.Closed {
+				s.forgetPoll(p)
+			}
+			writeJSON(w, http.StatusOK, batch)
+			return
+		}
+		select {
+		case <-wake:
+		case <-timeout.C:
+			writeJSON(w, http.StatusOK, batch)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handlePollClose serves DELETE /poll/{id}, closing the connection.
+func (s *Server) handlePollClose(w http.ResponseWriter, r *http.Request) {
+	p := s.pollFor(w, r)
+	if p == nil {
+		return
+	}
+	s.forgetPoll(p)
+	p.c.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,274 @@
+package chatserver
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Polls are opened with "/poll Question? | Option | Option ...", which posts
+// a chat message carrying the poll. Members vote with a vote request naming
+// the option by number, or by reacting to the poll with that number's keycap
+// emoji. Each member has one vote, which a later vote moves, and every vote
+// sends the room a poll event with the tally. The poll's creator or a room
+// moderator closes it with close_poll or "/poll close <message-id>", which
+// posts the final tally in reply to it. This has nothing to do with the
+// long-polling transport in poll.go.
+
+// maxPollOptions is the most options a poll may have: as many as there are
+// keycap emoji to vote with.
+const maxPollOptions = 10
+
+// Poll is a question and its options, with who voted for each.
+type Poll struct {
+	Question string       `json:"question"`
+	Options  []PollOption `json:"options"`
+	Closed   bool         `json:"closed,omitempty"`
+}
+
+type PollOption struct {
+	Text   string   `json:"text"`
+	Voters []string `json:"voters,omitempty"`
+}
+
+// pollKeycaps are the emoji that vote for the options in order.
+var pollKeycaps = []string{"1️⃣", "2️⃣", "3️⃣", "4️⃣", "5️⃣", "6️⃣", "7️⃣", "8️⃣", "9️⃣", "🔟"}
+
+// keycapOption returns the option, counting from 0, that the reaction emoji
+// votes for. Keycaps without the emoji presentation selector count too.
+func keycapOption(emoji string) (int, bool) {
+	i := slices.Index(pollKeycaps, emoji)
+	if i < 0 {
+		i = slices.Index(pollKeycaps, strings.Replace(emoji, "⃣", "️⃣", 1))
+	}
+	return i, i >= 0
+}
+
+// clone returns a copy of p that can be changed without changing p.
+func (p *Poll) clone() *Poll {
+	c := *p
+	c.Options = make([]PollOption, len(p.Options))
+	for i, o := range p.Options {
+		c.Options[i] = PollOption{Text: o.Text, Voters: slices.Clone(o.Voters)}
+	}
+	return &c
+}
+
+// vote records user's vote for the option at index, counting from 0,
+// moving any vote they made before; an index of -1 withdraws their vote. It
+// reports whether anything changed.
+func (p *Poll) vote(user string, index int) bool {
+	changed := false
+	for i := range p.Options {
+		voters := p.Options[i].Voters
+		j, has := slices.BinarySearch(voters, user)
+		switch {
+		case i == index && !has:
+			p.Options[i].Voters = slices.Insert(voters, j, user)
+			changed = true
+		case i != index && has:
+			p.Options[i].Voters = slices.Delete(voters, j, j+1)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// votedFor returns the option user voted for, or -1.
+func (p *Poll) votedFor(user string) int {
+	for i, o := range p.Options {
+		if _, has := slices.BinarySearch(o.Voters, user); has {
+			return i
+		}
+	}
+	return -1
+}
+
+// text lays p out for clients that do not show polls, and for bridges.
+func (p *Poll) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Poll: %s", p.Question)
+	for i, o := range p.Options {
+		fmt.Fprintf(&b, "\n%s %s", pollKeycaps[i], o.Text)
+	}
+	return b.String()
+}
+
+// tally lays out the votes on p.
+func (p *Poll) tally() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Poll closed: %s", p.Question)
+	for _, o := range p.Options {
+		votes := "votes"
+		if len(o.Voters) == 1 {
+			votes = "vote"
+		}
+		fmt.Fprintf(&b, "\n%s: %d %s", o.Text, len(o.Voters), votes)
+	}
+	return b.String()
+}
+
+// parsePoll reads "Question | Option | Option ...", returning what is wrong
+// with it if it is not a poll.
+func parsePoll(args string) (*Poll, string) {
+	parts := strings.Split(args, "|")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) < 3 || parts[0] == "" {
+		return nil, "Usage: /poll <question> | <option> | <option> ..."
+	}
+	if len(parts)-1 > maxPollOptions {
+		return nil, fmt.Sprintf("A poll may have at most %d options", maxPollOptions)
+	}
+	if utf8.RuneCountInString(parts[0]) > maxTopicLength {
+		return nil, fmt.Sprintf("The question must be at most %d characters", maxTopicLength)
+	}
+	poll := &Poll{Question: parts[0]}
+	for _, text := range parts[1:] {
+		if text == "" {
+			return nil, "Options must not be empty"
+		}
+		if utf8.RuneCountInString(text) > maxNameLength {
+			return nil, fmt.Sprintf("Options must be at most %d characters", maxNameLength)
+		}
+		poll.Options = append(poll.Options, PollOption{Text: text})
+	}
+	return poll, ""
+}
+
+// commandPoll opens a poll, or with "close <message-id>" closes one.
+func (s *Server) commandPoll(c *Client, user *User, msg Message, args string) {
+	if rest, ok := strings.CutPrefix(args, "close"); ok && !strings.Contains(rest, "|") {
+		id := strings.TrimSpace(rest)
+		if id == "" {
+			c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Usage: /poll close <message-id>", Room: msg.Room})
+			return
+		}
+		s.handleClosePoll(c, Message{Type: "close_poll", Room: msg.Room, MessageID: id})
+		return
+	}
+	poll, problem := parsePoll(args)
+	if poll == nil {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: problem, Room: msg.Room})
+		return
+	}
+	s.postChat(c, user, Message{Type: "broadcast", Room: msg.Room, Content: poll.text(), Poll: poll})
+}
+
+// handleVote votes for option msg.Content, counting from 1, in the poll
+// opened by msg.MessageID.
+func (s *Server) handleVote(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	option, err := strconv.Atoi(msg.Content)
+	if err != nil {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Vote must be an option's number", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+
+	s.messageLock.Lock()
+	stored, ok := s.lookupPoll(c, user, msg)
+	if !ok {
+		s.messageLock.Unlock()
+		return
+	}
+	if option < 1 || option > len(stored.Poll.Options) {
+		s.messageLock.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: fmt.Sprintf("Vote must be between 1 and %d", len(stored.Poll.Options)), Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+	stored.Poll = stored.Poll.clone()
+	if !stored.Poll.vote(user.Username, option-1) {
+		s.messageLock.Unlock()
+		return
+	}
+	err = s.messages.Update(stored)
+	s.messageLock.Unlock()
+	if err != nil {
+		c.reqLogger.Error("record vote", "message_id", msg.MessageID, "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not record vote", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+	s.sendPoll(user, stored)
+}
+
+// handleClosePoll closes the poll opened by msg.MessageID and posts its
+// final tally. Only the poll's creator and room moderators may close it.
+func (s *Server) handleClosePoll(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.messageLock.Lock()
+	stored, ok := s.lookupPoll(c, user, msg)
+	if !ok {
+		s.messageLock.Unlock()
+		return
+	}
+	if stored.Sender != user.Username {
+		s.roomLock.Lock()
+		room := s.rooms[stored.Room]
+		moderator := room != nil && room.IsModerator(user.Username)
+		s.roomLock.Unlock()
+		if !moderator {
+			s.messageLock.Unlock()
+			c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "Only the poll's creator or a moderator can close it", Room: msg.Room, MessageID: msg.MessageID})
+			return
+		}
+	}
+	stored.Poll = stored.Poll.clone()
+	stored.Poll.Closed = true
+	err := s.messages.Update(stored)
+	s.messageLock.Unlock()
+	if err != nil {
+		c.reqLogger.Error("close poll", "message_id", msg.MessageID, "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not close poll", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+	s.sendPoll(user, stored)
+
+	if _, err := s.relay(Message{Room: stored.Room, Sender: user.Username, Content: stored.Poll.tally(), ReplyTo: stored.MessageID}); err != nil {
+		c.reqLogger.Warn("post poll tally", "message_id", stored.MessageID, "err", err)
+	}
+}
+
+// lookupPoll returns the open poll msg refers to, replying to c if there is
+// none. The caller must hold messageLock.
+func (s *Server) lookupPoll(c *Client, user *User, msg Message) (Message, bool) {
+	stored, ok := s.lookupMessage(c, user, msg)
+	switch {
+	case !ok:
+		return Message{}, false
+	case stored.Deleted:
+		c.Reply(Message{Type: "error", Code: CodeGone, Content: "Message was deleted", Room: msg.Room, MessageID: msg.MessageID})
+	case stored.Poll == nil:
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "That message is not a poll", Room: msg.Room, MessageID: msg.MessageID})
+	case stored.Poll.Closed:
+		c.Reply(Message{Type: "error", Code: CodeGone, Content: "The poll is closed", Room: msg.Room, MessageID: msg.MessageID})
+	default:
+		return stored, true
+	}
+	return Message{}, false
+}
+
+// sendPoll tells the room of poll, a message opening a poll, what its votes
+// are now that user has voted or closed it.
+func (s *Server) sendPoll(user *User, poll Message) {
+	event := Message{Type: "poll", Sender: user.Username, Room: poll.Room, MessageID: poll.MessageID, Poll: poll.Poll}
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	s.appendHistory(event)
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	if room, exists := s.rooms[poll.Room]; exists {
+		s.fanoutLocked(room, event)
+	}
+}
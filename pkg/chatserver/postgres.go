@@ -0,0 +1,704 @@
+package chatserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	username      TEXT PRIMARY KEY,
+	password_hash BYTEA NOT NULL,
+	admin         BOOLEAN NOT NULL DEFAULT FALSE,
+	disabled      BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at    TIMESTAMPTZ NOT NULL,
+	updated_at    TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hide_last_seen BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS translate_to TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS read_markers (
+	username     TEXT NOT NULL,
+	conversation TEXT NOT NULL,
+	message_id   TEXT NOT NULL,
+	updated_at   TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (username, conversation)
+);
+
+CREATE TABLE IF NOT EXISTS stars (
+	username   TEXT NOT NULL,
+	room       TEXT NOT NULL,
+	message_id TEXT NOT NULL,
+	starred_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (username, room, message_id)
+);
+
+CREATE TABLE IF NOT EXISTS public_keys (
+	username   TEXT PRIMARY KEY,
+	algorithm  TEXT NOT NULL,
+	key        TEXT NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ip_bans (
+	prefix     TEXT PRIMARY KEY,
+	reason     TEXT NOT NULL,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id         TEXT PRIMARY KEY,
+	url        TEXT NOT NULL,
+	events     JSONB NOT NULL,
+	rooms      JSONB NOT NULL,
+	secret     TEXT NOT NULL,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS hooks (
+	id         TEXT PRIMARY KEY,
+	name       TEXT NOT NULL,
+	room       TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS bots (
+	name       TEXT PRIMARY KEY,
+	scopes     JSONB NOT NULL,
+	rooms      JSONB NOT NULL,
+	key_hash   TEXT NOT NULL UNIQUE,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rooms (
+	name       TEXT PRIMARY KEY,
+	owner      TEXT NOT NULL,
+	settings   JSONB NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS room_members (
+	room      TEXT NOT NULL,
+	username  TEXT NOT NULL,
+	joined_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (room, username)
+);
+
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+	id         TEXT PRIMARY KEY,
+	sender     TEXT NOT NULL,
+	room       TEXT NOT NULL,
+	content    TEXT NOT NULL,
+	reminder   BOOLEAN NOT NULL DEFAULT FALSE,
+	send_at    TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS room_sequences (
+	room TEXT PRIMARY KEY,
+	seq  BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	room       TEXT NOT NULL,
+	seq        BIGINT NOT NULL,
+	message_id TEXT NOT NULL,
+	sender     TEXT NOT NULL,
+	content    TEXT NOT NULL,
+	deleted    BOOLEAN NOT NULL DEFAULT FALSE,
+	sent_at    TIMESTAMPTZ NOT NULL,
+	body       JSONB NOT NULL,
+	PRIMARY KEY (room, seq),
+	UNIQUE (room, message_id)
+);
+
+CREATE INDEX IF NOT EXISTS messages_content_search ON messages USING GIN (to_tsvector('simple', content));`
+
+// PostgresStore keeps accounts, per-user state and room messages in
+// PostgreSQL, for deployments that outgrow a SQLite file and per-room
+// history files. Messages are reached through MessageStore.
+type PostgresStore struct {
+	db       *sql.DB
+	messages *PostgresMessageStore
+}
+
+// PostgresMessageStore is the MessageStore half of a PostgresStore. It also
+// serves message search straight from the messages table.
+type PostgresMessageStore struct {
+	db *sql.DB
+
+	appendMessage *sql.Stmt
+	getMessage    *sql.Stmt
+	updateMessage *sql.Stmt
+}
+
+// OpenPostgresStore connects to the database at dsn, a PostgreSQL URL or
+// key=value connection string, and creates any missing tables.
+func OpenPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(postgresSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	m := &PostgresMessageStore{db: db}
+	// Sending a message is the hot path, so its statements are prepared once.
+	for _, stmt := range []struct {
+		dst   **sql.Stmt
+		query string
+	}{
+		{&m.appendMessage, `
+			WITH next AS (
+				INSERT INTO room_sequences (room, seq) VALUES ($1, 1)
+				ON CONFLICT (room) DO UPDATE SET seq = room_sequences.seq + 1
+				RETURNING seq
+			)
+			INSERT INTO messages (room, seq, message_id, sender, content, deleted, sent_at, body)
+			SELECT $1, next.seq, $2, $3, $4, $5, $6, jsonb_set($7::jsonb, '{seq}', to_jsonb(next.seq))
+			FROM next
+			RETURNING seq`},
+		{&m.getMessage, `SELECT body FROM messages WHERE room = $1 AND message_id = $2`},
+		{&m.updateMessage, `UPDATE messages SET content = $3, deleted = $4, body = $5 WHERE room = $1 AND message_id = $2`},
+	} {
+		if *stmt.dst, err = db.Prepare(stmt.query); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &PostgresStore{db: db, messages: m}, nil
+}
+
+func (p *PostgresStore) Close() error {
+	return p.db.Close()
+}
+
+func (p *PostgresStore) Ping(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
+
+func (m *PostgresMessageStore) Ping(ctx context.Context) error {
+	return m.db.PingContext(ctx)
+}
+
+func (p *PostgresStore) AddStar(username string, star Star) error {
+	_, err := p.db.Exec(
+		`INSERT INTO stars (username, room, message_id, starred_at) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+		username, star.Room, star.MessageID, star.StarredAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) RemoveStar(username, room, messageID string) error {
+	res, err := p.db.Exec(`DELETE FROM stars WHERE username = $1 AND room = $2 AND message_id = $3`, username, room, messageID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrStarNotFound
+	}
+	return nil
+}
+
+func (p *PostgresStore) Stars(username string) ([]Star, error) {
+	return scanStars(p.db.Query(`SELECT room, message_id, starred_at FROM stars WHERE username = $1`, username))
+}
+
+func (p *PostgresStore) SetKey(key PublicKey) error {
+	_, err := p.db.Exec(
+		`INSERT INTO public_keys (username, algorithm, key, updated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username) DO UPDATE SET algorithm = excluded.algorithm, key = excluded.key, updated_at = excluded.updated_at`,
+		key.Username, key.Algorithm, key.Key, key.UpdatedAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) Key(username string) (PublicKey, error) {
+	key := PublicKey{Username: username}
+	err := p.db.QueryRow(`SELECT algorithm, key, updated_at FROM public_keys WHERE username = $1`, username).
+		Scan(&key.Algorithm, &key.Key, &key.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, ErrKeyNotFound
+	}
+	return key, err
+}
+
+func (p *PostgresStore) DeleteKey(username string) error {
+	_, err := p.db.Exec(`DELETE FROM public_keys WHERE username = $1`, username)
+	return err
+}
+
+func (p *PostgresStore) AddIPBan(ban IPBan) error {
+	_, err := p.db.Exec(
+		`INSERT INTO ip_bans (prefix, reason, created_by, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (prefix) DO UPDATE SET reason = excluded.reason, created_by = excluded.created_by, created_at = excluded.created_at`,
+		ban.Prefix.String(), ban.Reason, ban.CreatedBy, ban.CreatedAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) RemoveIPBan(prefix netip.Prefix) error {
+	res, err := p.db.Exec(`DELETE FROM ip_bans WHERE prefix = $1`, prefix.String())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrIPBanNotFound
+	}
+	return nil
+}
+
+func (p *PostgresStore) IPBans() ([]IPBan, error) {
+	return scanIPBans(p.db.Query(`SELECT prefix, reason, created_by, created_at FROM ip_bans`))
+}
+
+func (p *PostgresStore) AddWebhook(hook Webhook) error {
+	events, rooms, err := encodeWebhookLists(hook)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(
+		`INSERT INTO webhooks (id, url, events, rooms, secret, created_by, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		hook.ID, hook.URL, events, rooms, hook.Secret, hook.CreatedBy, hook.CreatedAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) RemoveWebhook(id string) error {
+	res, err := p.db.Exec(`DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (p *PostgresStore) Webhooks() ([]Webhook, error) {
+	return scanWebhooks(p.db.Query(`SELECT id, url, events, rooms, secret, created_by, created_at FROM webhooks`))
+}
+
+func (p *PostgresStore) AddHook(hook Hook) error {
+	_, err := p.db.Exec(
+		`INSERT INTO hooks (id, name, room, token_hash, created_by, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		hook.ID, hook.Name, hook.Room, hook.TokenHash, hook.CreatedBy, hook.CreatedAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) RemoveHook(id string) error {
+	res, err := p.db.Exec(`DELETE FROM hooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrHookNotFound
+	}
+	return nil
+}
+
+func (p *PostgresStore) Hooks() ([]Hook, error) {
+	return scanHooks(p.db.Query(`SELECT id, name, room, token_hash, created_by, created_at FROM hooks`))
+}
+
+func (p *PostgresStore) SaveBot(bot Bot) error {
+	scopes, rooms, err := encodeBotLists(bot)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(
+		`INSERT INTO bots (name, scopes, rooms, key_hash, created_by, created_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (name) DO UPDATE SET scopes = excluded.scopes, rooms = excluded.rooms, key_hash = excluded.key_hash`,
+		bot.Name, scopes, rooms, bot.KeyHash, bot.CreatedBy, bot.CreatedAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) DeleteBot(name string) error {
+	res, err := p.db.Exec(`DELETE FROM bots WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBotNotFound
+	}
+	return nil
+}
+
+func (p *PostgresStore) Bots() ([]Bot, error) {
+	return scanBots(p.db.Query(`SELECT name, scopes, rooms, key_hash, created_by, created_at FROM bots`))
+}
+
+func (p *PostgresStore) SaveRoom(room RoomRecord) error {
+	settings, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(
+		`INSERT INTO rooms (name, owner, settings, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE SET owner = excluded.owner, settings = excluded.settings`,
+		room.Name, room.Owner, settings, room.CreatedAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) DeleteRoom(name string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM room_members WHERE room = $1`, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM rooms WHERE name = $1`, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresStore) Rooms() ([]RoomRecord, error) {
+	return scanRooms(p.db.Query(`SELECT name, owner, settings, created_at FROM rooms`))
+}
+
+func (p *PostgresStore) AddRoomMember(room, username string) error {
+	_, err := p.db.Exec(
+		`INSERT INTO room_members (room, username, joined_at) VALUES ($1, $2, $3) ON CONFLICT (room, username) DO NOTHING`,
+		room, username, time.Now().UTC(),
+	)
+	return err
+}
+
+func (p *PostgresStore) RemoveRoomMember(room, username string) error {
+	_, err := p.db.Exec(`DELETE FROM room_members WHERE room = $1 AND username = $2`, room, username)
+	return err
+}
+
+func (p *PostgresStore) RoomMembers() (map[string][]string, error) {
+	return scanRoomMembers(p.db.Query(`SELECT room, username FROM room_members`))
+}
+
+func (p *PostgresStore) AddScheduled(msg ScheduledMessage) error {
+	_, err := p.db.Exec(
+		`INSERT INTO scheduled_messages (id, sender, room, content, reminder, send_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		msg.ID, msg.Sender, msg.Room, msg.Content, msg.Reminder, msg.At, msg.CreatedAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) RemoveScheduled(id string) error {
+	res, err := p.db.Exec(`DELETE FROM scheduled_messages WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrScheduledNotFound
+	}
+	return nil
+}
+
+func (p *PostgresStore) Scheduled() ([]ScheduledMessage, error) {
+	return scanScheduled(p.db.Query(`SELECT id, sender, room, content, reminder, send_at, created_at FROM scheduled_messages`))
+}
+
+// MessageStore returns the store for room messages kept in the same
+// database.
+func (p *PostgresStore) MessageStore() *PostgresMessageStore {
+	return p.messages
+}
+
+func (p *PostgresStore) Create(account *Account) error {
+	now := time.Now().UTC()
+	_, err := p.db.Exec(
+		`INSERT INTO users (username, password_hash, admin, disabled, hide_last_seen, translate_to, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		account.Username, account.PasswordHash, account.Admin, account.Disabled, account.HideLastSeen, account.TranslateTo, now, now,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrUserExists
+		}
+		return err
+	}
+
+	account.CreatedAt = now
+	account.UpdatedAt = now
+	return nil
+}
+
+func (p *PostgresStore) Find(username string) (*Account, error) {
+	account, err := scanAccount(p.db.QueryRow(
+		`SELECT `+accountColumns+` FROM users WHERE username = $1`, username,
+	))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return account, nil
+}
+
+func (p *PostgresStore) List() ([]*Account, error) {
+	rows, err := p.db.Query(`SELECT ` + accountColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []*Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (p *PostgresStore) Update(account *Account) error {
+	now := time.Now().UTC()
+	res, err := p.db.Exec(
+		`UPDATE users SET password_hash = $1, admin = $2, disabled = $3, hide_last_seen = $4, translate_to = $5, password_changed_at = $6, updated_at = $7 WHERE username = $8`,
+		account.PasswordHash, account.Admin, account.Disabled, account.HideLastSeen, account.TranslateTo, nullTime(account.PasswordChangedAt), now, account.Username,
+	)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+
+	account.UpdatedAt = now
+	return nil
+}
+
+func (p *PostgresStore) SetLastSeen(username string, at time.Time) error {
+	res, err := p.db.Exec(`UPDATE users SET last_seen_at = $1 WHERE username = $2`, at.UTC(), username)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+func (p *PostgresStore) Delete(username string) error {
+	res, err := p.db.Exec(`DELETE FROM users WHERE username = $1`, username)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+func (p *PostgresStore) SetReadMarker(username, conversation, messageID string) error {
+	_, err := p.db.Exec(
+		`INSERT INTO read_markers (username, conversation, message_id, updated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username, conversation) DO UPDATE SET message_id = excluded.message_id, updated_at = excluded.updated_at`,
+		username, conversation, messageID, time.Now().UTC(),
+	)
+	return err
+}
+
+func (p *PostgresStore) ReadMarkers(username string) (map[string]string, error) {
+	rows, err := p.db.Query(`SELECT conversation, message_id FROM read_markers WHERE username = $1`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	markers := make(map[string]string)
+	for rows.Next() {
+		var conversation, id string
+		if err := rows.Scan(&conversation, &id); err != nil {
+			return nil, err
+		}
+		markers[conversation] = id
+	}
+	return markers, rows.Err()
+}
+
+func (m *PostgresMessageStore) Append(msg *Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var seq uint64
+	err = m.appendMessage.QueryRow(
+		msg.Room, msg.MessageID, msg.Sender, msg.Content, msg.Deleted, messageTimeOf(*msg), body,
+	).Scan(&seq)
+	if err != nil {
+		return err
+	}
+	msg.Seq = seq
+	return nil
+}
+
+func (m *PostgresMessageStore) Get(room, id string) (Message, error) {
+	var body []byte
+	if err := m.getMessage.QueryRow(room, id).Scan(&body); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Message{}, ErrMessageNotFound
+		}
+		return Message{}, err
+	}
+	var msg Message
+	err := json.Unmarshal(body, &msg)
+	return msg, err
+}
+
+func (m *PostgresMessageStore) Update(msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	res, err := m.updateMessage.Exec(msg.Room, msg.MessageID, msg.Content, msg.Deleted, body)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+func (m *PostgresMessageStore) Messages(room string) ([]Message, error) {
+	return m.queryMessages(`SELECT body FROM messages WHERE room = $1 ORDER BY seq`, room)
+}
+
+func (m *PostgresMessageStore) Page(room string, before uint64, limit int) ([]Message, error) {
+	if before == 0 {
+		before = 1<<63 - 1
+	}
+	page, err := m.queryMessages(
+		`SELECT body FROM messages WHERE room = $1 AND seq < $2 ORDER BY seq DESC LIMIT $3`,
+		room, int64(before), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+		page[i], page[j] = page[j], page[i]
+	}
+	return page, nil
+}
+
+func (m *PostgresMessageStore) Since(room string, seq uint64, limit int) ([]Message, error) {
+	if limit > 0 {
+		return m.queryMessages(`SELECT body FROM messages WHERE room = $1 AND seq > $2 ORDER BY seq LIMIT $3`, room, int64(seq), limit)
+	}
+	return m.queryMessages(`SELECT body FROM messages WHERE room = $1 AND seq > $2 ORDER BY seq`, room, int64(seq))
+}
+
+func (m *PostgresMessageStore) Prune(room string, before time.Time, keep int) ([]string, error) {
+	var conds []string
+	args := []any{room}
+	if !before.IsZero() {
+		args = append(args, before)
+		conds = append(conds, `sent_at < $`+strconv.Itoa(len(args)))
+	}
+	if keep > 0 {
+		args = append(args, keep)
+		conds = append(conds, `seq <= (SELECT MAX(seq) FROM messages WHERE room = $1) - $`+strconv.Itoa(len(args)))
+	}
+	if len(conds) == 0 {
+		return nil, nil
+	}
+
+	rows, err := m.db.Query(
+		`DELETE FROM messages WHERE room = $1 AND (`+strings.Join(conds, ` OR `)+`) RETURNING message_id`, args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var removed []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		removed = append(removed, id)
+	}
+	return removed, rows.Err()
+}
+
+// Index and Remove are no-ops: searches read the messages table, which
+// Append and Update already keep current.
+func (m *PostgresMessageStore) Index(msg Message) error      { return nil }
+func (m *PostgresMessageStore) Remove(room, id string) error { return nil }
+
+func (m *PostgresMessageStore) Search(q SearchQuery) ([]Message, error) {
+	args := []any{q.Room}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	query := `SELECT body FROM messages WHERE room = $1 AND NOT deleted`
+	if q.Text != "" {
+		query += ` AND to_tsvector('simple', content) @@ plainto_tsquery('simple', ` + arg(q.Text) + `)`
+	}
+	if q.Sender != "" {
+		query += ` AND sender = ` + arg(q.Sender)
+	}
+	if !q.Since.IsZero() {
+		query += ` AND sent_at >= ` + arg(q.Since)
+	}
+	if !q.Until.IsZero() {
+		query += ` AND sent_at <= ` + arg(q.Until)
+	}
+	query += ` ORDER BY seq DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ` + arg(q.Limit)
+	}
+	return m.queryMessages(query, args...)
+}
+
+func (m *PostgresMessageStore) queryMessages(query string, args ...any) ([]Message, error) {
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var body []byte
+		if err := rows.Scan(&body); err != nil {
+			return nil, err
+		}
+		var msg Message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
@@ -0,0 +1,73 @@
+package chatserver
+
+import (
+	"slices"
+	"time"
+)
+
+// announcePresence tells the members of user's rooms, here and on other
+// instances, that user came online or went offline.
+func (s *Server) announcePresence(user *User, online bool) {
+	status := "offline"
+	if online {
+		status = "online"
+	}
+	msg := Message{Type: "presence", Sender: user.Username, Content: status, Timestamp: time.Now().UTC().Format(time.RFC3339Nano)}
+
+	s.roomLock.Lock()
+	rooms := make([]string, 0, len(user.Rooms))
+	for name := range user.Rooms {
+		rooms = append(rooms, name)
+	}
+	s.deliverToRoommatesLocked(rooms, msg)
+	s.roomLock.Unlock()
+
+	s.publish(brokerEvent{Kind: eventPresence, Message: msg, Rooms: rooms})
+}
+
+// deliverToRoommatesLocked sends an event about msg.Sender once to every
+// other connected member of rooms. The caller must hold roomLock.
+func (s *Server) deliverToRoommatesLocked(rooms []string, msg Message) {
+	sent := map[*User]bool{}
+	for _, name := range rooms {
+		room, exists := s.rooms[name]
+		if !exists {
+			continue
+		}
+		for _, u := range room.Members {
+			if u.Username == msg.Sender || sent[u] {
+				continue
+			}
+			sent[u] = true
+			u.Send(msg)
+		}
+	}
+}
+
+// handlePresenceQuery replies with the members of msg.Room connected to
+// this instance, sorted by name.
+func (s *Server) handlePresenceQuery(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	room, exists := s.rooms[msg.Room]
+	if !exists || !user.Rooms[msg.Room] {
+		s.roomLock.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return
+	}
+	online := make([]string, 0, len(room.Members))
+	for _, u := range room.Members {
+		if u.Online() {
+			online = append(online, u.Username)
+		}
+	}
+	s.roomLock.Unlock()
+
+	slices.Sort(online)
+	c.Reply(Message{Type: "presence_list", Room: msg.Room, Data: online})
+}
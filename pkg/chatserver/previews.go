@@ -0,0 +1,251 @@
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// previewTimeout bounds fetching one page for a preview, redirects
+	// included.
+	previewTimeout = 5 * time.Second
+	// maxPreviewBody is how much of a page is read looking for its title
+	// and description.
+	maxPreviewBody = 512 << 10
+	// maxPreviewRedirects caps the redirects followed for a preview.
+	maxPreviewRedirects = 3
+	// maxPreviewFetches caps the previews being fetched at once; links
+	// posted while it is reached go without.
+	maxPreviewFetches = 8
+	// maxPreviewTitle and maxPreviewDescription limit the text kept from a
+	// page, in characters.
+	maxPreviewTitle       = 200
+	maxPreviewDescription = 500
+)
+
+// LinkPreview summarises the page at a link in a chat message.
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// linkPattern finds http and https links in message content.
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// linkPreviewer fetches previews of links to the hosts it allows.
+type linkPreviewer struct {
+	allow  []string
+	client *http.Client
+	slots  chan struct{}
+}
+
+// newLinkPreviewer previews links to the given hosts and their subdomains.
+func newLinkPreviewer(allow []string) *linkPreviewer {
+	p := &linkPreviewer{slots: make(chan struct{}, maxPreviewFetches)}
+	for _, host := range allow {
+		p.allow = append(p.allow, strings.ToLower(strings.TrimPrefix(host, ".")))
+	}
+	p.client = &http.Client{
+		Timeout: previewTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxPreviewRedirects {
+				return errors.New("too many redirects")
+			}
+			if !p.allowed(req.URL) {
+				return errors.New("redirect to a host that is not allowed")
+			}
+			return nil
+		},
+	}
+	return p
+}
+
+// allowed reports whether u is an http or https link to an allowed host.
+func (p *linkPreviewer) allowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range p.allow {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// link returns the first link in content that may be previewed.
+func (p *linkPreviewer) link(content string) (string, bool) {
+	for _, raw := range linkPattern.FindAllString(content, -1) {
+		// Punctuation after a link usually belongs to the sentence.
+		raw = strings.TrimRight(raw, ".,;:!?)]}'")
+		if u, err := url.Parse(raw); err == nil && p.allowed(u) {
+			return u.String(), true
+		}
+	}
+	return "", false
+}
+
+// fetch loads the page at link and reads its preview from the head.
+func (p *linkPreviewer) fetch(ctx context.Context, link string) (LinkPreview, error) {
+	preview := LinkPreview{URL: link}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return preview, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "cli-chat-app link preview")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return preview, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return preview, errors.New("page answered " + resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return preview, errors.New("page is not HTML")
+	}
+
+	parsePreview(io.LimitReader(resp.Body, maxPreviewBody), &preview)
+	if preview.Title == "" && preview.Description == "" {
+		return preview, errors.New("page has no title or description")
+	}
+	return preview, nil
+}
+
+// parsePreview fills in preview from the title and meta tags of an HTML
+// page, preferring Open Graph tags to the plain ones.
+func parsePreview(r io.Reader, preview *LinkPreview) {
+	var title, description string
+	z := html.NewTokenizer(r)
+head:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			break head
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "body":
+				break head
+			case "title":
+				if z.Next() == html.TextToken && title == "" {
+					title = string(z.Text())
+				}
+			case "meta":
+				var key, content string
+				for _, attr := range tok.Attr {
+					switch attr.Key {
+					case "property", "name":
+						key = strings.ToLower(attr.Val)
+					case "content":
+						content = attr.Val
+					}
+				}
+				switch key {
+				case "og:title":
+					preview.Title = content
+				case "og:description":
+					preview.Description = content
+				case "og:site_name":
+					preview.SiteName = content
+				case "description":
+					description = content
+				}
+			}
+		case html.EndTagToken:
+			if z.Token().Data == "head" {
+				break head
+			}
+		}
+	}
+	if preview.Title == "" {
+		preview.Title = title
+	}
+	if preview.Description == "" {
+		preview.Description = description
+	}
+	preview.Title = previewText(preview.Title, maxPreviewTitle)
+	preview.Description = previewText(preview.Description, maxPreviewDescription)
+	preview.SiteName = previewText(preview.SiteName, maxPreviewTitle)
+}
+
+// previewText collapses the whitespace in s and cuts it to limit
+// characters.
+func previewText(s string, limit int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	return string([]rune(s)[:limit-1]) + "…"
+}
+
+// schedulePreview fetches a preview of the first allowed link in msg in the
+// background, then adds it to the stored message and tells the room.
+func (s *Server) schedulePreview(msg Message) {
+	if s.previews == nil || msg.Deleted || msg.Preview != nil {
+		return
+	}
+	link, ok := s.previews.link(msg.Content)
+	if !ok {
+		return
+	}
+	select {
+	case s.previews.slots <- struct{}{}:
+	default:
+		s.logger.Warn("link preview skipped, too many in progress", "room", msg.Room, "message_id", msg.MessageID)
+		return
+	}
+
+	go func() {
+		defer func() { <-s.previews.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+		defer cancel()
+		preview, err := s.previews.fetch(ctx, link)
+		if err != nil {
+			s.logger.Info("no link preview", "url", link, "err", err)
+			return
+		}
+		s.addPreview(msg.Room, msg.MessageID, preview)
+	}()
+}
+
+// addPreview attaches preview to a stored message, unless it has since been
+// deleted, and sends it to the room as a preview event.
+func (s *Server) addPreview(room, id string, preview LinkPreview) {
+	s.messageLock.Lock()
+	defer s.messageLock.Unlock()
+
+	stored, err := s.messages.Get(room, id)
+	if err != nil || stored.Deleted {
+		return
+	}
+	stored.Preview = &preview
+	if err := s.messages.Update(stored); err != nil {
+		s.logger.Error("store link preview", "room", room, "message_id", id, "err", err)
+		return
+	}
+
+	event := Message{Type: "preview", Sender: stored.Sender, Room: room, MessageID: id, Preview: &preview}
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	s.appendHistory(event)
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	if r, exists := s.rooms[room]; exists {
+		s.fanoutLocked(r, event)
+	}
+}
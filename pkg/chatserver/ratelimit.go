@@ -0,0 +1,158 @@
+package chatserver
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit lets each user send Burst messages at once and Rate messages a
+// second after that. A zero Rate does not limit anything.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) unlimited() bool {
+	return l.Rate <= 0
+}
+
+// RateLimited is the Data of the error sent for a message over the limit.
+type RateLimited struct {
+	RetryAfterMS int64 `json:"retry_after_ms"`
+}
+
+// rateLimiter holds a token bucket for each user in each room, and one for
+// each user's direct messages under the empty room name.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[rateKey]*rate.Limiter
+}
+
+type rateKey struct {
+	user, room string
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[rateKey]*rate.Limiter)}
+}
+
+// allow takes a token from user's bucket for room, sized by limit. If none
+// is available it reports how long until one will be.
+func (l *rateLimiter) allow(user, room string, limit RateLimit, now time.Time) (time.Duration, bool) {
+	if limit.unlimited() {
+		return 0, true
+	}
+	burst := max(limit.Burst, 1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := rateKey{user, room}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = rate.NewLimiter(rate.Limit(limit.Rate), burst)
+		l.buckets[key] = bucket
+	} else if bucket.Limit() != rate.Limit(limit.Rate) || bucket.Burst() != burst {
+		bucket.SetLimitAt(now, rate.Limit(limit.Rate))
+		bucket.SetBurstAt(now, burst)
+	}
+
+	r := bucket.ReserveN(now, 1)
+	if wait := r.DelayFrom(now); wait > 0 {
+		r.CancelAt(now)
+		return wait, false
+	}
+	return 0, true
+}
+
+// prune forgets buckets that have refilled, as they are no different from
+// new ones.
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, bucket := range l.buckets {
+		if bucket.TokensAt(now) >= float64(bucket.Burst()) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitFor returns the limit on messages in room: its own if the owner
+// set one, or else the server's. The caller must hold roomLock.
+func (s *Server) rateLimitFor(room *Room) RateLimit {
+	if room.RateLimit != nil {
+		return *room.RateLimit
+	}
+	return s.rateLimit
+}
+
+// checkRate takes a token from the user's bucket for room, replying to c
+// with an error carrying a retry-after hint if the bucket is empty. Bots
+// are held to the bot rate limit instead of limit, if there is one.
+func (s *Server) checkRate(c *Client, user *User, room string, limit RateLimit) bool {
+	if s.botRateLimit != nil {
+		if _, ok := s.botOf(user.Username); ok {
+			limit = *s.botRateLimit
+		}
+	}
+	wait, ok := s.limits.allow(user.Username, room, limit, time.Now())
+	if ok {
+		return true
+	}
+	c.Reply(Message{
+		Type:    "error",
+		Code:    CodeRateLimited,
+		Content: fmt.Sprintf("You are sending messages too quickly; try again in %s", wait.Round(100*time.Millisecond)),
+		Room:    room,
+		Data:    RateLimited{RetryAfterMS: wait.Milliseconds()},
+	})
+	return false
+}
+
+// handleSetRateLimit lets a room's owner override the server's rate limit.
+// msg.Content is the number of messages a second each member may send,
+// with "0" for no limit and "default" to remove the override, and msg.Limit
+// the burst.
+func (s *Server) handleSetRateLimit(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	var limit *RateLimit
+	if msg.Content != "default" {
+		perSecond, err := strconv.ParseFloat(msg.Content, 64)
+		if err != nil || perSecond < 0 {
+			c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Rate must be a number of messages per second", Room: msg.Room})
+			return
+		}
+		if msg.Limit < 0 {
+			c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Burst cannot be negative", Room: msg.Room})
+			return
+		}
+		limit = &RateLimit{Rate: perSecond, Burst: msg.Limit}
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room, exists := s.rooms[msg.Room]
+	if !exists {
+		c.Reply(Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: msg.Room})
+		return
+	}
+	if room.Owner != user.Username {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "Only the room owner can change the rate limit", Room: room.Name})
+		return
+	}
+
+	room.RateLimit = limit
+	s.saveRoomLocked(room)
+	c.Reply(Message{Type: "info", Content: "Rate limit updated", Room: room.Name})
+}
@@ -0,0 +1,99 @@
+package chatserver
+
+import (
+	"sort"
+	"time"
+)
+
+func (s *Server) handleReactionAdd(c *Client, msg Message) {
+	s.react(c, msg, true)
+}
+
+func (s *Server) handleReactionRemove(c *Client, msg Message) {
+	s.react(c, msg, false)
+}
+
+// react adds or removes the sender's msg.Content reaction on a message and
+// fans out the message's updated reaction state.
+func (s *Server) react(c *Client, msg Message, add bool) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if msg.Content == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Reaction must name an emoji"})
+		return
+	}
+
+	s.messageLock.Lock()
+	stored, ok := s.lookupMessage(c, user, msg)
+	if !ok {
+		s.messageLock.Unlock()
+		return
+	}
+	if stored.Deleted {
+		s.messageLock.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeGone, Content: "Message was deleted", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+
+	users := append([]string(nil), stored.Reactions[msg.Content]...)
+	i := sort.SearchStrings(users, user.Username)
+	has := i < len(users) && users[i] == user.Username
+	switch {
+	case add && !has:
+		users = append(users, "")
+		copy(users[i+1:], users[i:])
+		users[i] = user.Username
+	case !add && has:
+		users = append(users[:i], users[i+1:]...)
+	default:
+		s.messageLock.Unlock()
+		return
+	}
+
+	reactions := make(map[string][]string, len(stored.Reactions)+1)
+	for emoji, who := range stored.Reactions {
+		reactions[emoji] = who
+	}
+	if len(users) == 0 {
+		delete(reactions, msg.Content)
+	} else {
+		reactions[msg.Content] = users
+	}
+	stored.Reactions = reactions
+
+	// Reacting to an open poll with a keycap votes for that option.
+	voted := false
+	if i, ok := keycapOption(msg.Content); ok && stored.Poll != nil && !stored.Poll.Closed && i < len(stored.Poll.Options) {
+		stored.Poll = stored.Poll.clone()
+		switch {
+		case add:
+			voted = stored.Poll.vote(user.Username, i)
+		case stored.Poll.votedFor(user.Username) == i:
+			voted = stored.Poll.vote(user.Username, -1)
+		}
+	}
+
+	err := s.messages.Update(stored)
+	s.messageLock.Unlock()
+	if err != nil {
+		c.reqLogger.Error("update reactions", "message_id", msg.MessageID, "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not update reactions", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+
+	if voted {
+		s.sendPoll(user, stored)
+	}
+
+	event := Message{Type: "reactions", Sender: user.Username, Room: stored.Room, MessageID: stored.MessageID, Reactions: stored.Reactions}
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	s.appendHistory(event)
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	if room, exists := s.rooms[stored.Room]; exists {
+		s.fanoutLocked(room, event)
+	}
+}
@@ -0,0 +1,131 @@
+package chatserver
+
+import (
+	"sync"
+)
+
+// ReadMarkerStore records, per user, the last message read in each
+// conversation. Room conversations are keyed by room name and direct
+// message conversations by "@" followed by the other user's name.
+type ReadMarkerStore interface {
+	SetReadMarker(username, conversation, messageID string) error
+	ReadMarkers(username string) (map[string]string, error)
+}
+
+// MemoryReadMarkerStore keeps read markers in memory.
+type MemoryReadMarkerStore struct {
+	mu      sync.RWMutex
+	markers map[string]map[string]string
+}
+
+func NewMemoryReadMarkerStore() *MemoryReadMarkerStore {
+	return &MemoryReadMarkerStore{markers: make(map[string]map[string]string)}
+}
+
+func (m *MemoryReadMarkerStore) SetReadMarker(username, conversation, messageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.markers[username] == nil {
+		m.markers[username] = make(map[string]string)
+	}
+	m.markers[username][conversation] = messageID
+	return nil
+}
+
+func (m *MemoryReadMarkerStore) ReadMarkers(username string) (map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	markers := make(map[string]string, len(m.markers[username]))
+	for conv, id := range m.markers[username] {
+		markers[conv] = id
+	}
+	return markers, nil
+}
+
+func dmConversation(peer string) string {
+	return "@" + peer
+}
+
+// handleRead records that the sender has read up to msg.MessageID, either in
+// msg.Room or in the DM conversation with msg.Target, and lets the other
+// participants know.
+func (s *Server) handleRead(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if msg.MessageID == "" || (msg.Room == "") == (msg.Target == "") {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Read receipt needs a message_id and either a room or a target"})
+		return
+	}
+
+	conversation := msg.Room
+	if msg.Target != "" {
+		conversation = dmConversation(msg.Target)
+	} else {
+		s.roomLock.Lock()
+		member := user.Rooms[msg.Room]
+		s.roomLock.Unlock()
+		if !member {
+			c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+			return
+		}
+	}
+
+	if err := s.readMarkers.SetReadMarker(user.Username, conversation, msg.MessageID); err != nil {
+		c.reqLogger.Error("save read marker", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not save read marker"})
+		return
+	}
+
+	receipt := Message{Type: "read", Sender: user.Username, Room: msg.Room, Target: msg.Target, MessageID: msg.MessageID}
+	if msg.Target != "" {
+		if peer := s.onlineUser(msg.Target); peer != nil {
+			peer.Send(receipt)
+		}
+		return
+	}
+
+	s.roomLock.Lock()
+	if room, exists := s.rooms[msg.Room]; exists {
+		for _, u := range room.Members {
+			if u != user {
+				u.Send(receipt)
+			}
+		}
+	}
+	s.roomLock.Unlock()
+}
+
+// handleGetReadMarkers returns the sender's read markers in Data, keyed by
+// conversation.
+func (s *Server) handleGetReadMarkers(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	markers, err := s.readMarkers.ReadMarkers(user.Username)
+	if err != nil {
+		c.reqLogger.Error("load read markers", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not load read markers"})
+		return
+	}
+	c.Send(Message{Type: "read_markers", Data: markers})
+}
+
+// sendReadMarker tells c where user stopped reading in room, if known.
+func (s *Server) sendReadMarker(c *Client, user *User, room string) {
+	markers, err := s.readMarkers.ReadMarkers(user.Username)
+	if err != nil {
+		c.reqLogger.Error("load read markers", "err", err)
+		return
+	}
+	if id, ok := markers[room]; ok {
+		c.Send(Message{Type: "read_marker", Room: room, MessageID: id})
+	}
+}
@@ -0,0 +1,64 @@
+package chatserver
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBroker is a Broker built on Redis pub/sub.
+type RedisBroker struct {
+	client  *redis.Client
+	channel string
+}
+
+// NewRedisBroker connects to the Redis server at url, such as
+// redis://localhost:6379/0, and exchanges events on channel.
+func NewRedisBroker(ctx context.Context, url, channel string) (*RedisBroker, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisBroker{client: client, channel: channel}, nil
+}
+
+func (b *RedisBroker) Publish(ctx context.Context, payload []byte) error {
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+func (b *RedisBroker) Subscribe(ctx context.Context, handle func(payload []byte)) error {
+	sub := b.client.Subscribe(ctx, b.channel)
+	defer sub.Close()
+
+	// Wait for the subscription to be confirmed, so errors surface here.
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m, ok := <-ch:
+			if !ok {
+				return errors.New("redis subscription closed")
+			}
+			handle([]byte(m.Payload))
+		}
+	}
+}
+
+func (b *RedisBroker) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+func (b *RedisBroker) Close() error {
+	return b.client.Close()
+}
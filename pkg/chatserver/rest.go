@@ -0,0 +1,217 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+)
+
+// The REST API serves integrations that would rather make a request than
+// hold a connection open. Its endpoints take the session token of a signed
+// in user as a bearer token and run the same handlers as the matching
+// WebSocket requests, answering with JSON. Failures are answered with the
+// error message as JSON and the nearest HTTP status.
+
+// httpStatuses maps error codes to HTTP statuses.
+var httpStatuses = map[string]int{
+	CodeInvalidRequest:   http.StatusBadRequest,
+	CodeUnknownType:      http.StatusNotFound,
+	CodeUnsupported:      http.StatusNotImplemented,
+	CodeUnauthenticated:  http.StatusUnauthorized,
+	CodeAccountDisabled:  http.StatusForbidden,
+	CodeForbidden:        http.StatusForbidden,
+	CodeBanned:           http.StatusForbidden,
+	CodeNotMember:        http.StatusForbidden,
+	CodePasswordRequired: http.StatusForbidden,
+	CodeWrongPassword:    http.StatusForbidden,
+	CodeRoomNotFound:     http.StatusNotFound,
+	CodeUserNotFound:     http.StatusNotFound,
+	CodeNotFound:         http.StatusNotFound,
+	CodeAlreadyExists:    http.StatusConflict,
+	CodeGone:             http.StatusGone,
+	CodeDisabled:         http.StatusForbidden,
+	CodeTooLarge:         http.StatusRequestEntityTooLarge,
+	CodeLimitExceeded:    http.StatusTooManyRequests,
+	CodeRateLimited:      http.StatusTooManyRequests,
+	CodeSpam:             http.StatusTooManyRequests,
+	CodeContentBlocked:   http.StatusUnprocessableEntity,
+	CodeInternal:         http.StatusInternalServerError,
+}
+
+// HistoryPage is the body of GET /rooms/{name}/messages. Before is the
+// cursor for the next older page, absent once the start of the room is
+// reached.
+type HistoryPage struct {
+	Messages []Message `json:"messages"`
+	Before   uint64    `json:"before,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeFailure answers with an error message.
+func writeFailure(w http.ResponseWriter, failure Message) {
+	status, ok := httpStatuses[failure.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, failure)
+}
+
+// callHTTP runs msg for the user r is authenticated as, answering r itself
+// if it cannot be run or fails.
+func (s *Server) callHTTP(w http.ResponseWriter, r *http.Request, msg Message) ([]Message, bool) {
+	ip := s.clientIP(r)
+	if s.ipBanned(ip) {
+		writeFailure(w, Message{Type: "error", Code: CodeBanned, Content: "Your address has been banned"})
+		return nil, false
+	}
+	username, ok := s.authenticateHTTP(w, r)
+	if !ok {
+		return nil, false
+	}
+	replies, failure := s.call(ip, "rest", username, msg)
+	if failure != nil {
+		writeFailure(w, *failure)
+		return nil, false
+	}
+	return replies, true
+}
+
+// handleRoomMessagesHTTP serves GET /rooms/{name}/messages, a page of the
+// room's history to a member. The before and limit parameters page back
+// through it as the history request's fields do.
+func (s *Server) handleRoomMessagesHTTP(w http.ResponseWriter, r *http.Request) {
+	msg := Message{Type: "history", Room: r.PathValue("name")}
+	params := r.URL.Query()
+	if v := params.Get("before"); v != "" {
+		before, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeFailure(w, Message{Type: "error", Code: CodeInvalidRequest, Content: "Invalid before " + strconv.Quote(v)})
+			return
+		}
+		msg.Before = before
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			writeFailure(w, Message{Type: "error", Code: CodeInvalidRequest, Content: "Invalid limit " + strconv.Quote(v)})
+			return
+		}
+		msg.Limit = limit
+	}
+
+	replies, ok := s.callHTTP(w, r, msg)
+	if !ok {
+		return
+	}
+	page := HistoryPage{Messages: []Message{}}
+	for _, reply := range replies {
+		if reply.Type == "history" {
+			if messages, ok := reply.Data.([]Message); ok {
+				page.Messages = messages
+			}
+			page.Before = reply.Before
+		}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handlePostMessageHTTP serves POST /rooms/{name}/messages, sending the
+// message in the body to the room as a broadcast request would. The body
+// is a message object; its content is required and its type and room are
+// taken from the request.
+func (s *Server) handlePostMessageHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.maxContent)*utf8.UTFMax+readLimitSlack))
+	if err != nil {
+		writeFailure(w, Message{Type: "error", Code: CodeTooLarge, Content: "Message is too large"})
+		return
+	}
+	msg, problems := decodeMessage(body)
+	if problems != nil {
+		writeFailure(w, invalidMessage(problems))
+		return
+	}
+	msg.Type, msg.Room = "broadcast", r.PathValue("name")
+
+	if _, ok := s.callHTTP(w, r, msg); !ok {
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleUserHTTP serves GET /users/{name}, what a whois request tells
+// about the user.
+func (s *Server) handleUserHTTP(w http.ResponseWriter, r *http.Request) {
+	replies, ok := s.callHTTP(w, r, Message{Type: "whois", Target: r.PathValue("name")})
+	if !ok {
+		return
+	}
+	for _, reply := range replies {
+		if reply.Type == "whois" {
+			writeJSON(w, http.StatusOK, reply.Data)
+			return
+		}
+	}
+	writeFailure(w, Message{Type: "error", Code: CodeInternal, Content: "No reply"})
+}
+
+// handleScheduleHTTP serves POST /rooms/{name}/scheduled, scheduling the
+// message in the body as a schedule request would, and answers with the
+// scheduled message. The body is a message object whose data is a
+// ScheduleRequest.
+func (s *Server) handleScheduleHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.maxContent)*utf8.UTFMax+readLimitSlack))
+	if err != nil {
+		writeFailure(w, Message{Type: "error", Code: CodeTooLarge, Content: "Message is too large"})
+		return
+	}
+	msg, problems := decodeMessage(body)
+	if problems != nil {
+		writeFailure(w, invalidMessage(problems))
+		return
+	}
+	msg.Type, msg.Room = "schedule", r.PathValue("name")
+
+	replies, ok := s.callHTTP(w, r, msg)
+	if !ok {
+		return
+	}
+	for _, reply := range replies {
+		if scheduled, ok := reply.Data.(ScheduledMessage); ok {
+			writeJSON(w, http.StatusCreated, scheduled)
+			return
+		}
+	}
+	writeFailure(w, Message{Type: "error", Code: CodeInternal, Content: "No reply"})
+}
+
+// handleListScheduledHTTP serves GET /scheduled, the user's scheduled
+// messages and reminders, soonest first.
+func (s *Server) handleListScheduledHTTP(w http.ResponseWriter, r *http.Request) {
+	replies, ok := s.callHTTP(w, r, Message{Type: "list_scheduled"})
+	if !ok {
+		return
+	}
+	for _, reply := range replies {
+		if reply.Type == "scheduled" {
+			writeJSON(w, http.StatusOK, reply.Data)
+			return
+		}
+	}
+	writeFailure(w, Message{Type: "error", Code: CodeInternal, Content: "No reply"})
+}
+
+// handleCancelScheduledHTTP serves DELETE /scheduled/{id}, cancelling one
+// of the user's scheduled messages or reminders.
+func (s *Server) handleCancelScheduledHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.callHTTP(w, r, Message{Type: "cancel_scheduled", Content: r.PathValue("id")}); !ok {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
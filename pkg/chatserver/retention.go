@@ -0,0 +1,140 @@
+package chatserver
+
+import (
+	"context"
+	"time"
+)
+
+// janitorInterval is how often room history is checked against retention
+// policies and empty rooms against the empty room policy.
+const janitorInterval = time.Minute
+
+// RetentionPolicy limits how much history a room keeps. Zero fields do not
+// limit anything.
+type RetentionPolicy struct {
+	MaxAge      time.Duration
+	MaxMessages int
+}
+
+func (p RetentionPolicy) unlimited() bool {
+	return p.MaxAge <= 0 && p.MaxMessages <= 0
+}
+
+// runJanitor prunes room history, refilled rate limit buckets, stale spam
+// tracking and long-empty rooms until ctx is done.
+func (s *Server) runJanitor(ctx context.Context) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.pruneHistory(now)
+			s.limits.prune(now)
+			s.spam.prune(s.spamPolicy, now)
+			s.expireRooms(now)
+			s.pruneTransfers(now)
+		}
+	}
+}
+
+// pruneHistory applies each room's retention policy: its own override if the
+// owner set one, or else the server's.
+func (s *Server) pruneHistory(now time.Time) {
+	s.roomLock.Lock()
+	policies := make(map[string]RetentionPolicy, len(s.rooms))
+	for name, room := range s.rooms {
+		policy := s.retention
+		if room.Retention != nil {
+			policy = *room.Retention
+		}
+		// In cluster mode each room is pruned by its owner.
+		if !policy.unlimited() && s.ownsRoom(name) {
+			policies[name] = policy
+		}
+	}
+	s.roomLock.Unlock()
+
+	for room, policy := range policies {
+		s.pruneRoom(room, policy, now)
+	}
+}
+
+func (s *Server) pruneRoom(room string, policy RetentionPolicy, now time.Time) {
+	var before time.Time
+	if policy.MaxAge > 0 {
+		before = now.Add(-policy.MaxAge)
+	}
+	s.pruneMessages(room, before, policy.MaxMessages)
+}
+
+// pruneMessages removes a room's messages sent before the given time, and
+// all but its newest keep, from the store, search index and history file.
+func (s *Server) pruneMessages(room string, before time.Time, keep int) {
+	s.messageLock.Lock()
+	defer s.messageLock.Unlock()
+
+	removed, err := s.messages.Prune(room, before, keep)
+	if err != nil {
+		s.logger.Error("prune history", "room", room, "err", err)
+		return
+	}
+	if len(removed) == 0 {
+		return
+	}
+	for _, id := range removed {
+		if err := s.search.Remove(room, id); err != nil {
+			s.logger.Error("remove from search index", "room", room, "message_id", id, "err", err)
+		}
+	}
+	s.compactHistory(room)
+	s.logger.Info("pruned history", "room", room, "messages", len(removed))
+}
+
+// handleSetRetention lets a room's owner override the server's retention
+// policy. msg.Content is the maximum age as a Go duration such as "720h",
+// or empty for none, and msg.Limit the maximum number of messages, or 0 for
+// none. A Content of "default" removes the override.
+func (s *Server) handleSetRetention(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	var policy *RetentionPolicy
+	if msg.Content != "default" {
+		policy = &RetentionPolicy{MaxMessages: msg.Limit}
+		if msg.Content != "" {
+			age, err := time.ParseDuration(msg.Content)
+			if err != nil || age <= 0 {
+				c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Retention age must be a positive duration such as 720h", Room: msg.Room})
+				return
+			}
+			policy.MaxAge = age
+		}
+		if policy.MaxMessages < 0 {
+			c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Retention limit cannot be negative", Room: msg.Room})
+			return
+		}
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room, exists := s.rooms[msg.Room]
+	if !exists {
+		c.Reply(Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: msg.Room})
+		return
+	}
+	if room.Owner != user.Username {
+		c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "Only the room owner can change retention", Room: room.Name})
+		return
+	}
+
+	room.Retention = policy
+	s.saveRoomLocked(room)
+	c.Reply(Message{Type: "info", Content: "Retention updated", Room: room.Name})
+}
@@ -0,0 +1,418 @@
+package chatserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrRoomNotFound = errors.New("room does not exist")
+
+// Room is a chat room. Its fields are guarded by the server's room lock.
+type Room struct {
+	Name  string
+	Owner string
+	Topic string
+	// Description says what the room is for, at more length than Topic.
+	Description string
+	// Tags help people find the room in the directory.
+	Tags []string
+	// Members holds the users who have joined the room and are connected
+	// to this instance.
+	Members []*User
+	// Moderators holds the usernames allowed to administer the room. The
+	// owner is always a moderator and is not listed here.
+	Moderators map[string]bool
+	// Bans maps banned usernames to the reason they were banned.
+	Bans map[string]string
+	// Private rooms are left out of room listings but can still be joined
+	// by name.
+	Private bool
+	// InviteOnly rooms can only be joined with one of Invites, keyed by
+	// code, except by their moderators.
+	InviteOnly bool
+	Invites    map[string]*Invite
+	// Pins lists the room's pinned messages in the order they were pinned.
+	Pins []Pin
+	// Retention overrides the server's retention policy for the room when
+	// set.
+	Retention *RetentionPolicy
+	// RateLimit overrides the server's rate limit for the room when set.
+	RateLimit *RateLimit
+	// SlowMode is how long members other than moderators must wait between
+	// messages; zero turns it off. lastPosted records when each member last
+	// sent one.
+	SlowMode   time.Duration
+	lastPosted map[string]time.Time
+	// FilterDisabled turns the server's content filter off for the room.
+	FilterDisabled bool
+	// FunDisabled turns off /roll, /flip and /8ball in the room.
+	FunDisabled bool
+	// AssistantEnabled lets the assistant answer in the room.
+	AssistantEnabled bool
+	// FilesEnabled lets members share files in the room.
+	FilesEnabled bool
+	// Permanent rooms are exempt from the empty room policy. Archived rooms
+	// were retired by it and cannot be joined.
+	Permanent bool
+	Archived  bool
+	CreatedAt time.Time
+	// LastActivity is when the room was created or last had a message
+	// posted.
+	LastActivity time.Time
+	passwordHash []byte
+	// watchers are the event streams following the room, with the users
+	// they follow it for.
+	watchers map[*Client]*User
+}
+
+// RoomTopic is the Data of the reply to joining a room.
+type RoomTopic struct {
+	Topic       string `json:"topic,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func (r *Room) topic() RoomTopic {
+	return RoomTopic{Topic: r.Topic, Description: r.Description}
+}
+
+// Protected reports whether joining the room requires a password.
+func (r *Room) Protected() bool {
+	return len(r.passwordHash) > 0
+}
+
+func (r *Room) checkPassword(password string) bool {
+	if !r.Protected() {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword(r.passwordHash, []byte(password)) == nil
+}
+
+// IsModerator reports whether username may administer the room.
+func (r *Room) IsModerator(username string) bool {
+	return username == r.Owner || r.Moderators[username]
+}
+
+// canModerate reports whether actor may take moderation action against
+// target: the owner can act on anyone else, moderators only on plain members.
+func (r *Room) canModerate(actor, target string) bool {
+	if actor == target || target == r.Owner {
+		return false
+	}
+	if actor == r.Owner {
+		return true
+	}
+	return r.IsModerator(actor) && !r.IsModerator(target)
+}
+
+func (r *Room) hasMember(user *User) bool {
+	for _, u := range r.Members {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// fanoutLocked sends msg to every connected member of room, on this
+// instance and, through the broker, on any others. The caller must hold
+// roomLock.
+func (s *Server) fanoutLocked(room *Room, msg Message) {
+	s.deliverLocked(room, msg)
+	s.publish(brokerEvent{Kind: eventRoom, Message: msg})
+}
+
+// deliverLocked sends msg to the members of room connected to this
+// instance and to its watchers. The caller must hold roomLock.
+func (s *Server) deliverLocked(room *Room, msg Message) {
+	for _, u := range room.Members {
+		u.Send(msg)
+	}
+	for c := range room.watchers {
+		c.Send(msg)
+	}
+}
+
+// roomNameProblem says what is wrong with name as the name of a new room,
+// or returns "". Names become part of the names of history files, so they
+// cannot hold path separators, ".." or control characters.
+func roomNameProblem(name string) string {
+	switch {
+	case name == "":
+		return "Room name is required"
+	case utf8.RuneCountInString(name) > maxNameLength:
+		return fmt.Sprintf("Room names must be at most %d characters", maxNameLength)
+	// "@name" identifies direct message conversations.
+	case strings.HasPrefix(name, "@"):
+		return "Room names cannot start with @"
+	case strings.ContainsAny(name, `/\`) || strings.Contains(name, ".."):
+		return `Room names cannot contain /, \ or ..`
+	case strings.ContainsFunc(name, unicode.IsControl):
+		return "Room names cannot contain control characters"
+	}
+	return ""
+}
+
+func (s *Server) handleCreateRoom(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if problem := roomNameProblem(msg.Content); problem != "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: problem})
+		return
+	}
+
+	room := &Room{
+		Name:       msg.Content,
+		Owner:      user.Username,
+		Moderators: make(map[string]bool),
+		Bans:       make(map[string]string),
+		Private:    msg.Private,
+	}
+	if msg.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(msg.Password), bcrypt.DefaultCost)
+		if err != nil {
+			c.reqLogger.Error("hash room password", "err", err)
+			c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Room creation failed"})
+			return
+		}
+		room.passwordHash = hash
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	if existing, exists := s.rooms[room.Name]; exists {
+		if !existing.Archived || existing.Owner != user.Username {
+			c.Reply(Message{Type: "error", Code: CodeAlreadyExists, Content: "Room already exists"})
+			return
+		}
+		// Its owner brings an archived room back as it was.
+		existing.Archived = false
+		existing.LastActivity = time.Now().UTC()
+		s.saveRoomLocked(existing)
+		c.Reply(Message{Type: "info", Content: "Room restored from the archive", Room: existing.Name})
+		return
+	}
+
+	// A room with this name may have existed before a restart.
+	s.loadHistory(room.Name)
+	room.CreatedAt = time.Now().UTC()
+	room.LastActivity = room.CreatedAt
+	s.rooms[room.Name] = room
+	s.saveRoomLocked(room)
+	s.emitEvent(EventRoomCreated, room.Name, room.Owner, nil)
+	s.publish(brokerEvent{
+		Kind:         eventRoomCreated,
+		Message:      Message{Type: "room_created", Sender: room.Owner, Room: room.Name, Private: room.Private},
+		PasswordHash: room.passwordHash,
+	})
+	c.Reply(Message{Type: "info", Content: "Room created successfully", Room: room.Name})
+}
+
+func (s *Server) handleJoinRoom(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if !s.pluginsAllowJoin(c, user, msg.Content) {
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room, exists := s.rooms[msg.Content]
+	if !exists {
+		c.Reply(Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist"})
+		return
+	}
+	if user.Rooms[room.Name] {
+		c.Reply(Message{Type: "error", Code: CodeAlreadyExists, Content: "You are already in that room", Room: room.Name})
+		return
+	}
+	if room.Archived {
+		c.Reply(Message{Type: "error", Code: CodeGone, Content: "That room has been archived", Room: room.Name})
+		return
+	}
+	if reason, banned := room.Bans[user.Username]; banned {
+		c.Reply(Message{Type: "error", Code: CodeBanned, Content: "You are banned from that room: " + reason, Room: room.Name})
+		return
+	}
+	invited := msg.Invite != "" && s.useInviteLocked(room, msg.Invite)
+	if room.InviteOnly && !invited && !room.IsModerator(user.Username) {
+		if msg.Invite == "" {
+			c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "That room is invite-only", Room: room.Name})
+		} else {
+			c.Reply(Message{Type: "error", Code: CodeForbidden, Content: "That invite is not valid", Room: room.Name})
+		}
+		return
+	}
+	// An invite stands in for the password.
+	if !invited && !room.checkPassword(msg.Password) {
+		if msg.Password == "" {
+			c.Reply(Message{Type: "error", Code: CodePasswordRequired, Content: "Room requires a password", Room: room.Name})
+		} else {
+			c.Reply(Message{Type: "error", Code: CodeWrongPassword, Content: "Wrong room password", Room: room.Name})
+		}
+		return
+	}
+
+	user.Rooms[room.Name] = true
+	room.Members = append(room.Members, user)
+	if err := s.roomStore.AddRoomMember(room.Name, user.Username); err != nil {
+		c.reqLogger.Error("save room member", "room", room.Name, "err", err)
+	}
+	s.emitEvent(EventUserJoined, room.Name, user.Username, nil)
+	s.federateMembership(room.Name, user.Username, true)
+	if len(s.scripts) > 0 {
+		go s.scriptsOnMembership("on_join", room.Name, user.Username)
+	}
+
+	s.sendHistoryPage(c, room.Name, 0, defaultHistoryPage)
+	s.sendReadMarker(c, user, room.Name)
+
+	c.Reply(Message{Type: "info", Content: "Joined room successfully", Room: room.Name, Data: room.topic()})
+}
+
+func (s *Server) handleLeaveRoom(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	name := msg.Content
+	if name == "" {
+		name = msg.Room
+	}
+	if !user.Rooms[name] {
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: name})
+		return
+	}
+
+	s.removeMemberLocked(name, user)
+	if len(s.scripts) > 0 {
+		go s.scriptsOnMembership("on_leave", name, user.Username)
+	}
+	c.Reply(Message{Type: "info", Content: "Left room successfully", Room: name})
+}
+
+// removeMemberLocked drops user from room, ending the streams they were
+// watching it with. The caller must hold roomLock.
+func (s *Server) removeMemberLocked(name string, user *User) {
+	if room, exists := s.rooms[name]; exists {
+		room.removeMember(user)
+		for c, u := range room.watchers {
+			if u == user {
+				delete(room.watchers, c)
+				c.Close()
+			}
+		}
+	}
+	delete(user.Rooms, name)
+	s.federateMembership(name, user.Username, false)
+	if err := s.roomStore.RemoveRoomMember(name, user.Username); err != nil {
+		s.logger.Error("remove room member", "room", name, "user", user.Username, "err", err)
+	}
+}
+
+// dropMemberships takes a user who has gone offline off the member lists of
+// their rooms. They keep the rooms themselves, which signin and resume
+// restore. A user who has already reconnected is left alone.
+func (s *Server) dropMemberships(user *User) {
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	if user.Online() {
+		return
+	}
+	for name := range user.Rooms {
+		if room, exists := s.rooms[name]; exists {
+			room.removeMember(user)
+		}
+	}
+}
+
+// removeMember takes user off the room's member list.
+func (r *Room) removeMember(user *User) {
+	for i, u := range r.Members {
+		if u == user {
+			r.Members = append(r.Members[:i], r.Members[i+1:]...)
+			return
+		}
+	}
+}
+
+// RoomMember describes a member of a room in a room_members reply.
+type RoomMember struct {
+	Username string `json:"username"`
+	// Role is owner, moderator or member.
+	Role   string `json:"role"`
+	Online bool   `json:"online"`
+	Status string `json:"status,omitempty"`
+	// Server is the server a member of a federated room is on, if not
+	// this one.
+	Server string `json:"server,omitempty"`
+}
+
+// handleRoomMembers replies with everyone who has joined msg.Room, online
+// or not, ordered by name. Only members may ask.
+func (s *Server) handleRoomMembers(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.userLock.Lock()
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	s.userLock.Unlock()
+
+	s.roomLock.Lock()
+	room, exists := s.rooms[msg.Room]
+	if !exists || !user.Rooms[msg.Room] {
+		s.roomLock.Unlock()
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return
+	}
+	var members []RoomMember
+	for _, u := range users {
+		if !u.Rooms[room.Name] {
+			continue
+		}
+		member := RoomMember{Username: u.Username, Role: "member", Online: u.Online(), Status: u.Status}
+		switch {
+		case u.Username == room.Owner:
+			member.Role = "owner"
+		case room.Moderators[u.Username]:
+			member.Role = "moderator"
+		}
+		members = append(members, member)
+	}
+	s.roomLock.Unlock()
+	members = append(members, s.remoteMembers(msg.Room)...)
+
+	for i, m := range members {
+		if !m.Online {
+			members[i].Online = s.onlineElsewhere(m.Username)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Username < members[j].Username })
+	c.Reply(Message{Type: "room_members", Room: msg.Room, Data: members})
+}
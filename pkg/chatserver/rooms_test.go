@@ -0,0 +1,41 @@
+package chatserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateRoomName(t *testing.T) {
+	tests := []struct {
+		name string
+		room string
+		ok   bool
+	}{
+		{"plain", "general", true},
+		{"spaces and accents", "café talk", true},
+		{"longest", strings.Repeat("r", maxNameLength), true},
+		{"empty", "", false},
+		{"too long", strings.Repeat("r", maxNameLength+1), false},
+		{"direct message", "@bob", false},
+		{"parent directory", "../../etc/cron.d/x", false},
+		{"dot dot", "..", false},
+		{"slash", "a/b", false},
+		{"backslash", `a\b`, false},
+		{"newline", "a\nb", false},
+		{"escape", "a\x1bb", false},
+		{"delete", "a\x7fb", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			c := signIn(t, s, "alice")
+			code := errorCode(do(s, c, Message{Type: "create_room", Content: tt.room}))
+			if tt.ok && code != "" {
+				t.Errorf("create_room %q answered %q", tt.room, code)
+			}
+			if !tt.ok && code != CodeInvalidRequest {
+				t.Errorf("create_room %q answered %q, want %q", tt.room, code, CodeInvalidRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package chatserver
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RoomRecord is what a RoomStore keeps of a room: its definition and
+// settings. Who has joined it is kept separately. The fields other than
+// Name, Owner and CreatedAt are stored together as the room's settings.
+type RoomRecord struct {
+	Name             string            `json:"-"`
+	Owner            string            `json:"-"`
+	CreatedAt        time.Time         `json:"-"`
+	Topic            string            `json:"topic,omitempty"`
+	Description      string            `json:"description,omitempty"`
+	Tags             []string          `json:"tags,omitempty"`
+	Private          bool              `json:"private,omitempty"`
+	InviteOnly       bool              `json:"invite_only,omitempty"`
+	Invites          []Invite          `json:"invites,omitempty"`
+	Pins             []Pin             `json:"pins,omitempty"`
+	PasswordHash     []byte            `json:"password_hash,omitempty"`
+	Moderators       []string          `json:"moderators,omitempty"`
+	Bans             map[string]string `json:"bans,omitempty"`
+	Retention        *RetentionPolicy  `json:"retention,omitempty"`
+	RateLimit        *RateLimit        `json:"rate_limit,omitempty"`
+	SlowMode         time.Duration     `json:"slow_mode,omitempty"`
+	FilterDisabled   bool              `json:"filter_disabled,omitempty"`
+	FunDisabled      bool              `json:"fun_disabled,omitempty"`
+	AssistantEnabled bool              `json:"assistant_enabled,omitempty"`
+	FilesEnabled     bool              `json:"files_enabled,omitempty"`
+	Permanent        bool              `json:"permanent,omitempty"`
+	Archived         bool              `json:"archived,omitempty"`
+}
+
+// RoomStore keeps rooms and their memberships across restarts.
+type RoomStore interface {
+	// SaveRoom stores room, replacing any existing room of the same name.
+	SaveRoom(room RoomRecord) error
+	// DeleteRoom removes a room and its memberships.
+	DeleteRoom(name string) error
+	Rooms() ([]RoomRecord, error)
+	AddRoomMember(room, username string) error
+	RemoveRoomMember(room, username string) error
+	// RoomMembers maps the name of each room with members to their
+	// usernames.
+	RoomMembers() (map[string][]string, error)
+}
+
+// MemoryRoomStore keeps rooms in memory.
+type MemoryRoomStore struct {
+	mu      sync.Mutex
+	rooms   map[string]RoomRecord
+	members map[string]map[string]bool
+}
+
+func NewMemoryRoomStore() *MemoryRoomStore {
+	return &MemoryRoomStore{
+		rooms:   make(map[string]RoomRecord),
+		members: make(map[string]map[string]bool),
+	}
+}
+
+func (m *MemoryRoomStore) SaveRoom(room RoomRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rooms[room.Name] = room
+	return nil
+}
+
+func (m *MemoryRoomStore) DeleteRoom(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.rooms, name)
+	delete(m.members, name)
+	return nil
+}
+
+func (m *MemoryRoomStore) Rooms() ([]RoomRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rooms := make([]RoomRecord, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+func (m *MemoryRoomStore) AddRoomMember(room, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.members[room] == nil {
+		m.members[room] = make(map[string]bool)
+	}
+	m.members[room][username] = true
+	return nil
+}
+
+func (m *MemoryRoomStore) RemoveRoomMember(room, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.members[room], username)
+	if len(m.members[room]) == 0 {
+		delete(m.members, room)
+	}
+	return nil
+}
+
+func (m *MemoryRoomStore) RoomMembers() (map[string][]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := make(map[string][]string, len(m.members))
+	for room, usernames := range m.members {
+		for username := range usernames {
+			members[room] = append(members[room], username)
+		}
+	}
+	return members, nil
+}
+
+// record returns what is stored of the room.
+func (r *Room) record() RoomRecord {
+	moderators := make([]string, 0, len(r.Moderators))
+	for name := range r.Moderators {
+		moderators = append(moderators, name)
+	}
+	slices.Sort(moderators)
+	var invites []Invite
+	for _, invite := range r.Invites {
+		invites = append(invites, *invite)
+	}
+	return RoomRecord{
+		Name:             r.Name,
+		Owner:            r.Owner,
+		CreatedAt:        r.CreatedAt,
+		Topic:            r.Topic,
+		Description:      r.Description,
+		Tags:             r.Tags,
+		Private:          r.Private,
+		InviteOnly:       r.InviteOnly,
+		Invites:          invites,
+		Pins:             slices.Clone(r.Pins),
+		PasswordHash:     r.passwordHash,
+		Moderators:       moderators,
+		Bans:             maps.Clone(r.Bans),
+		Retention:        r.Retention,
+		RateLimit:        r.RateLimit,
+		SlowMode:         r.SlowMode,
+		FilterDisabled:   r.FilterDisabled,
+		FunDisabled:      r.FunDisabled,
+		AssistantEnabled: r.AssistantEnabled,
+		FilesEnabled:     r.FilesEnabled,
+		Permanent:        r.Permanent,
+		Archived:         r.Archived,
+	}
+}
+
+// roomFromRecord rebuilds a room read back from the store.
+func roomFromRecord(rec RoomRecord) *Room {
+	room := &Room{
+		Name:             rec.Name,
+		Owner:            rec.Owner,
+		Topic:            rec.Topic,
+		Description:      rec.Description,
+		Tags:             rec.Tags,
+		Moderators:       make(map[string]bool, len(rec.Moderators)),
+		Bans:             rec.Bans,
+		Private:          rec.Private,
+		InviteOnly:       rec.InviteOnly,
+		Pins:             rec.Pins,
+		Retention:        rec.Retention,
+		RateLimit:        rec.RateLimit,
+		SlowMode:         rec.SlowMode,
+		FilterDisabled:   rec.FilterDisabled,
+		FunDisabled:      rec.FunDisabled,
+		AssistantEnabled: rec.AssistantEnabled,
+		FilesEnabled:     rec.FilesEnabled,
+		Permanent:        rec.Permanent,
+		Archived:         rec.Archived,
+		CreatedAt:        rec.CreatedAt,
+		LastActivity:     rec.CreatedAt,
+		passwordHash:     rec.PasswordHash,
+	}
+	for _, name := range rec.Moderators {
+		room.Moderators[name] = true
+	}
+	if len(rec.Invites) > 0 {
+		room.Invites = make(map[string]*Invite, len(rec.Invites))
+		for _, invite := range rec.Invites {
+			room.Invites[invite.Code] = &invite
+		}
+	}
+	if room.Bans == nil {
+		room.Bans = make(map[string]string)
+	}
+	return room
+}
+
+// saveRoomLocked writes room's definition and settings to the store after
+// a change. The caller must hold roomLock.
+func (s *Server) saveRoomLocked(room *Room) {
+	if err := s.roomStore.SaveRoom(room.record()); err != nil {
+		s.logger.Error("save room", "room", room.Name, "err", err)
+	}
+}
+
+// loadRooms restores the rooms and memberships kept in the store. Members
+// are taken back into their rooms when they next sign in.
+func (s *Server) loadRooms() {
+	records, err := s.roomStore.Rooms()
+	if err != nil {
+		s.logger.Error("load rooms", "err", err)
+		return
+	}
+	members, err := s.roomStore.RoomMembers()
+	if err != nil {
+		s.logger.Error("load room members", "err", err)
+		return
+	}
+
+	for _, rec := range records {
+		room := roomFromRecord(rec)
+		for _, username := range members[room.Name] {
+			s.loadUser(username).Rooms[room.Name] = true
+		}
+
+		s.roomLock.Lock()
+		s.loadHistory(room.Name)
+		if latest, err := s.messages.Page(room.Name, 0, 1); err == nil && len(latest) > 0 {
+			if sent, err := time.Parse(time.RFC3339Nano, latest[0].Timestamp); err == nil && sent.After(room.LastActivity) {
+				room.LastActivity = sent
+			}
+		}
+		s.rooms[room.Name] = room
+		s.roomLock.Unlock()
+		s.scheduleExpiries(room.Name)
+	}
+	if len(records) > 0 {
+		s.logger.Info("rooms restored", "rooms", len(records))
+	}
+}
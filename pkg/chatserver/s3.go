@@ -0,0 +1,119 @@
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config locates the bucket an S3AttachmentStore keeps files in. Endpoint
+// is a host and optional port, such as s3.amazonaws.com or an S3-compatible
+// service; Insecure talks to it over plain HTTP.
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Insecure  bool
+}
+
+// S3AttachmentStore keeps attachments as objects in an S3 bucket, with
+// their details as object metadata.
+type S3AttachmentStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// OpenS3AttachmentStore connects to the bucket described by cfg, checking
+// that it exists. Without keys, credentials are taken from the standard
+// AWS environment variables.
+func OpenS3AttachmentStore(cfg S3Config) (*S3AttachmentStore, error) {
+	creds := credentials.NewEnvAWS()
+	if cfg.AccessKey != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, "")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("bucket " + cfg.Bucket + " does not exist")
+	}
+	return &S3AttachmentStore{client: client, bucket: cfg.Bucket}, nil
+}
+
+func (s *S3AttachmentStore) Put(ctx context.Context, a *Attachment, r io.Reader) error {
+	info, err := s.client.PutObject(ctx, s.bucket, a.ID, &limitedReader{r: r, n: a.Size}, -1, minio.PutObjectOptions{
+		ContentType: a.Type,
+		UserMetadata: map[string]string{
+			// Metadata travels in headers, so the name is escaped.
+			"name":       url.PathEscape(a.Name),
+			"uploader":   a.Uploader,
+			"room":       url.PathEscape(a.Room),
+			"created-at": a.CreatedAt.Format(time.RFC3339Nano),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	a.Size = info.Size
+	return nil
+}
+
+func (s *S3AttachmentStore) Get(ctx context.Context, id string) (Attachment, io.ReadCloser, error) {
+	a, err := s.Stat(ctx, id)
+	if err != nil {
+		return a, nil, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, id, minio.GetObjectOptions{})
+	return a, obj, s3Error(err)
+}
+
+func (s *S3AttachmentStore) Stat(ctx context.Context, id string) (Attachment, error) {
+	if !validAttachmentID(id) {
+		return Attachment{}, ErrAttachmentNotFound
+	}
+	info, err := s.client.StatObject(ctx, s.bucket, id, minio.StatObjectOptions{})
+	if err != nil {
+		return Attachment{}, s3Error(err)
+	}
+	a := Attachment{
+		ID:       id,
+		Type:     info.ContentType,
+		Size:     info.Size,
+		Uploader: info.UserMetadata["Uploader"],
+	}
+	a.Name, _ = url.PathUnescape(info.UserMetadata["Name"])
+	a.Room, _ = url.PathUnescape(info.UserMetadata["Room"])
+	a.CreatedAt, _ = time.Parse(time.RFC3339Nano, info.UserMetadata["Created-At"])
+	if a.Name == "" {
+		a.Name = id
+	}
+	return a, nil
+}
+
+// s3Error maps a missing object to ErrAttachmentNotFound.
+func s3Error(err error) error {
+	if err != nil && minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+		return ErrAttachmentNotFound
+	}
+	return err
+}
@@ -0,0 +1,378 @@
+package chatserver
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Scheduled messages are posted to a room by the server on their sender's
+// behalf at a set time; reminders are sent back to their sender instead.
+// Both are kept in a ScheduleStore so that they survive restarts, and each
+// is removed from it as it is sent, so that one cancelled meanwhile, or
+// already sent by another instance sharing the store, is not sent again.
+
+var ErrScheduledNotFound = errors.New("scheduled message not found")
+
+const (
+	// maxScheduled caps how many messages one user can have waiting.
+	maxScheduled = 50
+	// maxScheduleAhead is how far ahead a message can be scheduled.
+	maxScheduleAhead = 366 * 24 * time.Hour
+)
+
+// ScheduledMessage is a message waiting to be sent.
+type ScheduledMessage struct {
+	ID     string `json:"id"`
+	Sender string `json:"sender"`
+	// Room is where the message is posted, or for a reminder, where it was
+	// set, if anywhere.
+	Room    string `json:"room,omitempty"`
+	Content string `json:"content"`
+	// Reminder marks a message sent to its sender rather than the room.
+	Reminder  bool      `json:"reminder,omitempty"`
+	At        time.Time `json:"at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ScheduleRequest is the Data of a schedule request. At is when to send the
+// message; In, a duration such as 10m, may be given instead.
+type ScheduleRequest struct {
+	At       time.Time `json:"at,omitempty"`
+	In       string    `json:"in,omitempty"`
+	Reminder bool      `json:"reminder,omitempty"`
+}
+
+// ScheduleStore keeps the messages waiting to be sent.
+type ScheduleStore interface {
+	AddScheduled(msg ScheduledMessage) error
+	// RemoveScheduled returns ErrScheduledNotFound if there is no message
+	// id, such as when it was already removed.
+	RemoveScheduled(id string) error
+	Scheduled() ([]ScheduledMessage, error)
+}
+
+// MemoryScheduleStore keeps scheduled messages in memory.
+type MemoryScheduleStore struct {
+	mu       sync.Mutex
+	messages map[string]ScheduledMessage
+}
+
+func NewMemoryScheduleStore() *MemoryScheduleStore {
+	return &MemoryScheduleStore{messages: make(map[string]ScheduledMessage)}
+}
+
+func (m *MemoryScheduleStore) AddScheduled(msg ScheduledMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages[msg.ID] = msg
+	return nil
+}
+
+func (m *MemoryScheduleStore) RemoveScheduled(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.messages[id]; !ok {
+		return ErrScheduledNotFound
+	}
+	delete(m.messages, id)
+	return nil
+}
+
+func (m *MemoryScheduleStore) Scheduled() ([]ScheduledMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	messages := make([]ScheduledMessage, 0, len(m.messages))
+	for _, msg := range m.messages {
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// loadScheduled sets timers for the messages in the store, sending at once
+// those whose time passed while the server was down.
+func (s *Server) loadScheduled() {
+	messages, err := s.scheduleStore.Scheduled()
+	if err != nil {
+		s.logger.Error("load scheduled messages", "err", err)
+		return
+	}
+	for _, msg := range messages {
+		s.setScheduleTimer(msg)
+	}
+	if len(messages) > 0 {
+		s.logger.Info("scheduled messages restored", "messages", len(messages))
+	}
+}
+
+// setScheduleTimer arranges for msg to be sent at its time.
+func (s *Server) setScheduleTimer(msg ScheduledMessage) {
+	s.scheduleLock.Lock()
+	defer s.scheduleLock.Unlock()
+	if s.scheduleTimers == nil {
+		s.scheduleTimers = make(map[string]*time.Timer)
+	}
+	if _, ok := s.scheduleTimers[msg.ID]; ok {
+		return
+	}
+	s.scheduleTimers[msg.ID] = time.AfterFunc(time.Until(msg.At), func() {
+		s.scheduleLock.Lock()
+		delete(s.scheduleTimers, msg.ID)
+		s.scheduleLock.Unlock()
+		s.sendScheduled(msg)
+	})
+}
+
+// stopScheduled stops the timers of scheduled messages; they are set again
+// when the server next starts.
+func (s *Server) stopScheduled() {
+	s.scheduleLock.Lock()
+	defer s.scheduleLock.Unlock()
+	for id, timer := range s.scheduleTimers {
+		timer.Stop()
+		delete(s.scheduleTimers, id)
+	}
+}
+
+// sendScheduled sends msg, whose time has come, unless it was cancelled or
+// sent already.
+func (s *Server) sendScheduled(msg ScheduledMessage) {
+	if err := s.scheduleStore.RemoveScheduled(msg.ID); err != nil {
+		if !errors.Is(err, ErrScheduledNotFound) {
+			s.logger.Error("remove scheduled message", "id", msg.ID, "err", err)
+		}
+		return
+	}
+
+	if msg.Reminder {
+		reminder := Message{Type: "reminder", Sender: "server", Target: msg.Sender, Room: msg.Room, Content: msg.Content}
+		stamp(&reminder)
+		if !s.sendTo(msg.Sender, reminder) {
+			s.dms.Push(msg.Sender, reminder)
+		}
+		return
+	}
+
+	user := s.loadUser(msg.Sender)
+	s.roomLock.Lock()
+	member := user.Rooms[msg.Room]
+	s.roomLock.Unlock()
+	if !member {
+		s.logger.Info("scheduled message dropped; sender left the room", "id", msg.ID, "room", msg.Room, "user", msg.Sender)
+		return
+	}
+	if _, err := s.relay(Message{Room: msg.Room, Sender: msg.Sender, Content: msg.Content}); err != nil {
+		s.logger.Warn("post scheduled message", "id", msg.ID, "room", msg.Room, "err", err)
+	}
+}
+
+// scheduledFor returns username's scheduled messages, soonest first.
+func (s *Server) scheduledFor(username string) ([]ScheduledMessage, error) {
+	all, err := s.scheduleStore.Scheduled()
+	if err != nil {
+		return nil, err
+	}
+	mine := slices.DeleteFunc(all, func(msg ScheduledMessage) bool { return msg.Sender != username })
+	slices.SortFunc(mine, func(a, b ScheduledMessage) int { return a.At.Compare(b.At) })
+	return mine, nil
+}
+
+// handleSchedule schedules msg.Content to be posted to msg.Room, or with
+// Reminder set in msg.Data, sent back to the sender, at the time msg.Data
+// gives.
+func (s *Server) handleSchedule(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	var req ScheduleRequest
+	if err := msg.DecodeData(&req); err != nil {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Data must say when to send the message", Room: msg.Room})
+		return
+	}
+	now := time.Now().UTC()
+	at := req.At.UTC()
+	if req.In != "" {
+		d, err := time.ParseDuration(req.In)
+		if err != nil {
+			c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "In must be a duration such as 10m or 2h30m", Room: msg.Room})
+			return
+		}
+		at = now.Add(d)
+	}
+	if !at.After(now) {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "The time to send the message must be in the future", Room: msg.Room})
+		return
+	}
+	if at.Sub(now) > maxScheduleAhead {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Messages can be scheduled at most a year ahead", Room: msg.Room})
+		return
+	}
+	if utf8.RuneCountInString(msg.Content) > s.maxContent {
+		c.Reply(Message{Type: "error", Code: CodeTooLarge, Content: "Message is too long", Room: msg.Room})
+		return
+	}
+	if msg.Room != "" || !req.Reminder {
+		s.roomLock.Lock()
+		member := user.Rooms[msg.Room]
+		s.roomLock.Unlock()
+		if !member {
+			c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+			return
+		}
+	}
+
+	pending, err := s.scheduledFor(user.Username)
+	if err != nil {
+		c.reqLogger.Error("load scheduled messages", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not schedule message", Room: msg.Room})
+		return
+	}
+	if len(pending) >= maxScheduled {
+		c.Reply(Message{Type: "error", Code: CodeLimitExceeded, Content: "You have too many scheduled messages; cancel some first", Room: msg.Room})
+		return
+	}
+
+	scheduled := ScheduledMessage{
+		ID:        newMessageID(now),
+		Sender:    user.Username,
+		Room:      msg.Room,
+		Content:   msg.Content,
+		Reminder:  req.Reminder,
+		At:        at,
+		CreatedAt: now,
+	}
+	if err := s.scheduleStore.AddScheduled(scheduled); err != nil {
+		c.reqLogger.Error("save scheduled message", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not schedule message", Room: msg.Room})
+		return
+	}
+	s.setScheduleTimer(scheduled)
+
+	what := "Message scheduled"
+	if scheduled.Reminder {
+		what = "Reminder set"
+	}
+	c.Reply(Message{Type: "info", Content: fmt.Sprintf("%s for %s (id %s)", what, at.Format(time.RFC1123), scheduled.ID), Room: msg.Room, Data: scheduled})
+}
+
+// handleListScheduled sends the sender their scheduled messages and
+// reminders, soonest first.
+func (s *Server) handleListScheduled(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	pending, err := s.scheduledFor(user.Username)
+	if err != nil {
+		c.reqLogger.Error("load scheduled messages", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not load scheduled messages"})
+		return
+	}
+	c.Reply(Message{Type: "scheduled", Room: msg.Room, Data: pending})
+}
+
+// handleCancelScheduled cancels the sender's scheduled message or reminder
+// whose ID is msg.Content.
+func (s *Server) handleCancelScheduled(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	pending, err := s.scheduledFor(user.Username)
+	if err != nil {
+		c.reqLogger.Error("load scheduled messages", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not cancel scheduled message"})
+		return
+	}
+	if !slices.ContainsFunc(pending, func(p ScheduledMessage) bool { return p.ID == msg.Content }) {
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "You have no such scheduled message", Room: msg.Room, Target: msg.Content})
+		return
+	}
+	if err := s.scheduleStore.RemoveScheduled(msg.Content); err != nil {
+		if errors.Is(err, ErrScheduledNotFound) {
+			c.Reply(Message{Type: "error", Code: CodeGone, Content: "The message was already sent", Room: msg.Room, Target: msg.Content})
+			return
+		}
+		c.reqLogger.Error("remove scheduled message", "id", msg.Content, "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not cancel scheduled message"})
+		return
+	}
+
+	s.scheduleLock.Lock()
+	if timer, ok := s.scheduleTimers[msg.Content]; ok {
+		timer.Stop()
+		delete(s.scheduleTimers, msg.Content)
+	}
+	s.scheduleLock.Unlock()
+	c.Reply(Message{Type: "info", Content: "Scheduled message cancelled", Room: msg.Room, Target: msg.Content})
+}
+
+// parseWhen reads the "in <duration>" or "at <time>" that starts args,
+// returning the schedule request and the rest of args.
+func parseWhen(args string) (ScheduleRequest, string, bool) {
+	fields := strings.SplitN(args, " ", 3)
+	if len(fields) < 3 {
+		return ScheduleRequest{}, "", false
+	}
+	rest := strings.TrimSpace(fields[2])
+	switch strings.ToLower(fields[0]) {
+	case "in":
+		if _, err := time.ParseDuration(fields[1]); err != nil {
+			return ScheduleRequest{}, "", false
+		}
+		return ScheduleRequest{In: fields[1]}, rest, rest != ""
+	case "at":
+		at, err := time.Parse(time.RFC3339, fields[1])
+		if err != nil {
+			return ScheduleRequest{}, "", false
+		}
+		return ScheduleRequest{At: at}, rest, rest != ""
+	}
+	return ScheduleRequest{}, "", false
+}
+
+// commandRemind sets a reminder with "me in <duration> <text>" or
+// "me at <time> <text>", lists them with "list" and cancels one with
+// "cancel <id>".
+func (s *Server) commandRemind(c *Client, user *User, msg Message, args string) {
+	sub, rest, _ := strings.Cut(args, " ")
+	switch strings.ToLower(sub) {
+	case "list":
+		s.handleListScheduled(c, Message{Type: "list_scheduled", Room: msg.Room})
+		return
+	case "cancel":
+		id := strings.TrimSpace(rest)
+		if id == "" {
+			c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Usage: /remind cancel <id>", Room: msg.Room})
+			return
+		}
+		s.handleCancelScheduled(c, Message{Type: "cancel_scheduled", Room: msg.Room, Content: id})
+		return
+	case "me":
+		if req, text, ok := parseWhen(strings.TrimSpace(rest)); ok {
+			req.Reminder = true
+			s.handleSchedule(c, Message{Type: "schedule", Room: msg.Room, Content: text, Data: req})
+			return
+		}
+	}
+	c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Usage: /remind me in <duration> <text>, /remind me at <time> <text>, /remind list or /remind cancel <id>", Room: msg.Room})
+}
+
+// commandSchedule schedules a message to the room with "in <duration>
+// <text>" or "at <time> <text>".
+func (s *Server) commandSchedule(c *Client, user *User, msg Message, args string) {
+	req, text, ok := parseWhen(args)
+	if !ok {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Usage: /schedule in <duration> <text> or /schedule at <time> <text>", Room: msg.Room})
+		return
+	}
+	s.handleSchedule(c, Message{Type: "schedule", Room: msg.Room, Content: text, Data: req})
+}
@@ -0,0 +1,252 @@
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Scripts let operators change how the server behaves with Lua files
+// dropped in a directory. A script may define any of these functions:
+//
+//	on_message(msg)  -- msg has room, sender, content and format
+//	on_join(event)   -- event has room and user
+//	on_leave(event)  -- event has room and user
+//
+// on_message is called before a user's room message is posted. It may
+// return a string to replace the message's content, or false and a reason
+// to reject it; returning nothing lets it through unchanged. on_join and
+// on_leave are called after the fact. Any of them may post to a room with
+// chat.send(room, text), as the script, and write to the server log with
+// chat.log(text); posts made from on_message follow the message.
+//
+// Scripts run in a sandbox without the io, os and package libraries or any
+// way to load code, and each call is cut short after the script timeout.
+// A script that fails is logged and otherwise ignored.
+
+// BridgeScript is the Bridge of messages scripts post to rooms.
+const BridgeScript = "script"
+
+// DefaultScriptTimeout bounds each call to a script unless the server is
+// given another timeout.
+const DefaultScriptTimeout = 200 * time.Millisecond
+
+// scriptCallStackSize limits how deep a script's calls may nest.
+const scriptCallStackSize = 200
+
+// sandboxRemoved are the base library functions scripts may not use.
+var sandboxRemoved = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage", "_printregs"}
+
+// Script is a loaded Lua script. Its calls are made one at a time.
+type Script struct {
+	// Name is the script's file name without .lua; it posts as this.
+	Name    string
+	timeout time.Duration
+
+	mu sync.Mutex
+	L  *lua.LState
+	// posts collects what the call being made posts with chat.send, and
+	// logs what it logs with chat.log.
+	posts []Message
+	logs  []string
+}
+
+// LoadScripts loads the .lua files in dir, in name order, giving each call
+// to them timeout to run.
+func LoadScripts(dir string, timeout time.Duration) ([]*Script, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.lua"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var scripts []*Script
+	for _, path := range paths {
+		script, err := LoadScript(path, timeout)
+		if err != nil {
+			for _, s := range scripts {
+				s.Close()
+			}
+			return nil, err
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts, nil
+}
+
+// LoadScript loads the Lua script at path, giving each call to it timeout to
+// run, including running the file itself.
+func LoadScript(path string, timeout time.Duration) (*Script, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Script{
+		Name:    strings.TrimSuffix(filepath.Base(path), ".lua"),
+		timeout: timeout,
+		L:       lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: scriptCallStackSize}),
+	}
+	s.openSandbox()
+
+	fn, err := s.L.LoadString(string(src))
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("load script %s: %w", path, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s.L.SetContext(ctx)
+	err = s.L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true})
+	s.L.RemoveContext()
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("run script %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// openSandbox opens the libraries scripts may use and adds the chat table.
+func (s *Script) openSandbox() {
+	L := s.L
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range sandboxRemoved {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	chat := L.NewTable()
+	L.SetField(chat, "send", L.NewFunction(func(L *lua.LState) int {
+		s.posts = append(s.posts, Message{Room: L.CheckString(1), Sender: s.Name, Bridge: BridgeScript, Content: L.CheckString(2)})
+		return 0
+	}))
+	L.SetField(chat, "log", L.NewFunction(func(L *lua.LState) int {
+		s.logs = append(s.logs, L.CheckString(1))
+		return 0
+	}))
+	L.SetGlobal("chat", chat)
+	L.SetGlobal("print", L.GetField(chat, "log"))
+}
+
+// Close frees the script's interpreter.
+func (s *Script) Close() {
+	s.L.Close()
+}
+
+// call calls the script's function name with a table of fields, if it
+// defines one, returning its results and what it posted and logged. ok is
+// false if it does not define the function.
+func (s *Script) call(name string, fields map[string]string) (results []lua.LValue, posts []Message, logs []string, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn, isFn := s.L.GetGlobal(name).(*lua.LFunction)
+	if !isFn {
+		return nil, nil, nil, false, nil
+	}
+	arg := s.L.NewTable()
+	for k, v := range fields {
+		arg.RawSetString(k, lua.LString(v))
+	}
+
+	s.posts, s.logs = nil, nil
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	s.L.SetContext(ctx)
+	top := s.L.GetTop()
+	err = s.L.CallByParam(lua.P{Fn: fn, NRet: lua.MultRet, Protect: true}, arg)
+	s.L.RemoveContext()
+	posts, logs = s.posts, s.logs
+	s.posts, s.logs = nil, nil
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%s timed out after %s", name, s.timeout)
+		}
+		s.L.SetTop(top)
+		return nil, posts, logs, true, err
+	}
+	for i := top + 1; i <= s.L.GetTop(); i++ {
+		results = append(results, s.L.Get(i))
+	}
+	s.L.SetTop(top)
+	return results, posts, logs, true, nil
+}
+
+// runScript calls name in script, logging what it logged and any failure.
+func (s *Server) runScript(script *Script, name string, fields map[string]string) ([]lua.LValue, []Message, bool) {
+	results, posts, logs, ok, err := script.call(name, fields)
+	for _, line := range logs {
+		s.logger.Info(line, "script", script.Name)
+	}
+	if err != nil {
+		s.logger.Warn("script failed", "script", script.Name, "function", name, "err", err)
+		return nil, posts, false
+	}
+	return results, posts, ok
+}
+
+// scriptsAllowMessage runs the scripts' on_message on msg, from user,
+// applying the changes they make to its content. If one rejects it, it
+// replies to c and returns false. It returns what the scripts posted, to be
+// relayed once msg is.
+func (s *Server) scriptsAllowMessage(c *Client, user *User, msg *Message) ([]Message, bool) {
+	var posts []Message
+	for _, script := range s.scripts {
+		fields := map[string]string{"room": msg.Room, "sender": user.Username, "content": msg.Content, "format": msg.Format}
+		results, sent, ok := s.runScript(script, "on_message", fields)
+		posts = append(posts, sent...)
+		if !ok || len(results) == 0 {
+			continue
+		}
+		switch v := results[0].(type) {
+		case lua.LString:
+			msg.Content = string(v)
+		case lua.LBool:
+			if !v {
+				reason := ""
+				if len(results) > 1 {
+					reason = lua.LVAsString(results[1])
+				}
+				c.Reply(Message{Type: "error", Code: CodeContentBlocked, Content: rejection("Message rejected", reason), Room: msg.Room})
+				return nil, false
+			}
+		}
+	}
+	return posts, true
+}
+
+// scriptsOnMembership runs the scripts' on_join or on_leave for user and
+// room, relaying what they post. It takes roomLock, so a handler holding it
+// runs it in its own goroutine, which then posts once the handler is done.
+func (s *Server) scriptsOnMembership(name, room, user string) {
+	for _, script := range s.scripts {
+		_, posts, _ := s.runScript(script, name, map[string]string{"room": room, "user": user})
+		s.relayScriptPosts(posts)
+	}
+}
+
+// relayScriptPosts posts what scripts sent with chat.send.
+func (s *Server) relayScriptPosts(posts []Message) {
+	for _, post := range posts {
+		if _, err := s.relay(post); err != nil {
+			s.logger.Warn("post script message", "script", post.Sender, "room", post.Room, "err", err)
+		}
+	}
+}
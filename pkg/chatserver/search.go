@@ -0,0 +1,157 @@
+package chatserver
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSearchResults bounds how many messages a search returns.
+const maxSearchResults = 100
+
+// SearchQuery describes a message search within one room. Zero fields other
+// than Room do not filter.
+type SearchQuery struct {
+	Room string
+	// Text holds keywords that must all appear in a message.
+	Text   string
+	Sender string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// SearchIndex indexes room messages for keyword search.
+type SearchIndex interface {
+	// Index adds msg to the index, replacing an earlier version of it.
+	Index(msg Message) error
+	Remove(room, id string) error
+	// Search returns matching messages, newest first.
+	Search(q SearchQuery) ([]Message, error)
+}
+
+// MemorySearchIndex is a SearchIndex that scans messages kept in memory.
+type MemorySearchIndex struct {
+	mu    sync.RWMutex
+	rooms map[string]map[string]Message
+}
+
+func NewMemorySearchIndex() *MemorySearchIndex {
+	return &MemorySearchIndex{rooms: make(map[string]map[string]Message)}
+}
+
+func (m *MemorySearchIndex) Index(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.rooms[msg.Room] == nil {
+		m.rooms[msg.Room] = make(map[string]Message)
+	}
+	m.rooms[msg.Room][msg.MessageID] = msg
+	return nil
+}
+
+func (m *MemorySearchIndex) Remove(room, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.rooms[room], id)
+	return nil
+}
+
+func (m *MemorySearchIndex) Search(q SearchQuery) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	words := strings.Fields(strings.ToLower(q.Text))
+	var results []Message
+	for _, msg := range m.rooms[q.Room] {
+		if q.Sender != "" && msg.Sender != q.Sender {
+			continue
+		}
+		if !q.Since.IsZero() || !q.Until.IsZero() {
+			sent, err := time.Parse(time.RFC3339Nano, msg.Timestamp)
+			if err != nil || (!q.Since.IsZero() && sent.Before(q.Since)) || (!q.Until.IsZero() && sent.After(q.Until)) {
+				continue
+			}
+		}
+		if !containsAll(strings.ToLower(msg.Content), words) {
+			continue
+		}
+		results = append(results, msg)
+	}
+
+	// Message IDs are ULIDs, so they sort by time.
+	sort.Slice(results, func(i, j int) bool { return results[i].MessageID > results[j].MessageID })
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, nil
+}
+
+func containsAll(s string, words []string) bool {
+	for _, w := range words {
+		if !strings.Contains(s, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleSearch looks for messages in msg.Room containing the keywords in
+// msg.Content, optionally sent by msg.Target between msg.Since and
+// msg.Until.
+func (s *Server) handleSearch(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	if strings.TrimSpace(msg.Content) == "" && msg.Target == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Search needs keywords or a sender", Room: msg.Room})
+		return
+	}
+
+	s.roomLock.Lock()
+	member := user.Rooms[msg.Room]
+	s.roomLock.Unlock()
+	if !member {
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return
+	}
+
+	q := SearchQuery{Room: msg.Room, Text: msg.Content, Sender: msg.Target, Limit: msg.Limit}
+	if q.Limit <= 0 || q.Limit > maxSearchResults {
+		q.Limit = maxSearchResults
+	}
+	for _, bound := range []struct {
+		value string
+		dst   *time.Time
+	}{{msg.Since, &q.Since}, {msg.Until, &q.Until}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Dates must be in RFC 3339 format", Room: msg.Room})
+			return
+		}
+		*bound.dst = t
+	}
+
+	results, err := s.search.Search(q)
+	if err != nil {
+		c.reqLogger.Error("search", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Search failed", Room: msg.Room})
+		return
+	}
+	c.Send(Message{Type: "search_results", Room: msg.Room, Content: msg.Content, Target: msg.Target, Data: results})
+}
+
+// indexMessage adds msg to the search index, logging any failure.
+func (s *Server) indexMessage(msg Message) {
+	if err := s.search.Index(msg); err != nil {
+		s.logger.Error("index message", "room", msg.Room, "message_id", msg.MessageID, "err", err)
+	}
+}
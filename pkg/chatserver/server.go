@@ -0,0 +1,1045 @@
+// Package chatserver implements the chat WebSocket server so it can be
+// embedded in other binaries.
+package chatserver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+type User struct {
+	Username string
+	// conns is the set of connections the user is signed in on; they may
+	// sign in from several at once. It is guarded by connsLock, which may
+	// be taken while holding any of the server's locks.
+	conns     map[*Client]bool
+	connsLock sync.Mutex
+	// Rooms is the set of rooms the user has joined. It is guarded by the
+	// server's room lock.
+	Rooms map[string]bool
+
+	lastTyping map[string]time.Time
+	// mutedUntil is when an automatic mute for spam ends. It is guarded by
+	// the room lock.
+	mutedUntil time.Time
+	// Status is the user's availability, StatusAvailable if empty, and
+	// StatusText optionally describes it. Both are guarded by the room lock.
+	Status     string
+	StatusText string
+	// TranslateTo is the language the user has room messages translated
+	// to, if any. It is guarded by the room lock.
+	TranslateTo string
+}
+
+func newUser(username string) *User {
+	return &User{
+		Username:   username,
+		conns:      make(map[*Client]bool),
+		Rooms:      make(map[string]bool),
+		lastTyping: make(map[string]time.Time),
+	}
+}
+
+// Send delivers msg to every connection the user is signed in on,
+// reporting whether any of them took it.
+func (u *User) Send(msg Message) bool {
+	sent := false
+	for _, c := range u.connections() {
+		if c.Send(msg) {
+			sent = true
+		}
+	}
+	return sent
+}
+
+// Online reports whether the user is signed in on any connection.
+func (u *User) Online() bool {
+	u.connsLock.Lock()
+	defer u.connsLock.Unlock()
+	return len(u.conns) > 0
+}
+
+// connections returns the connections the user is signed in on.
+func (u *User) connections() []*Client {
+	u.connsLock.Lock()
+	defer u.connsLock.Unlock()
+	conns := make([]*Client, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// addConn records that the user is signed in on c.
+func (u *User) addConn(c *Client) {
+	u.connsLock.Lock()
+	defer u.connsLock.Unlock()
+	u.conns[c] = true
+}
+
+// removeConn forgets c and reports whether it was the user's last
+// connection.
+func (u *User) removeConn(c *Client) bool {
+	u.connsLock.Lock()
+	defer u.connsLock.Unlock()
+	if !u.conns[c] {
+		return false
+	}
+	delete(u.conns, c)
+	return len(u.conns) == 0
+}
+
+type Message struct {
+	Type string `json:"type"`
+	// ID is an optional client-chosen correlation ID. The server echoes it
+	// in the ack or error that answers the request.
+	ID string `json:"id,omitempty"`
+	// Code is set on errors to one of the Code constants; the details of
+	// the error, if any, are in Data.
+	Code    string `json:"code,omitempty"`
+	Sender  string `json:"sender"`
+	Target  string `json:"target,omitempty"`
+	Content string `json:"content"`
+	// Format is how Content is written: plain, the default, or markdown.
+	Format   string `json:"format,omitempty"`
+	Room     string `json:"room,omitempty"`
+	Password string `json:"password,omitempty"`
+	Private  bool   `json:"private,omitempty"`
+	// Invite is an invite code, in requests to join an invite-only room.
+	Invite string `json:"invite,omitempty"`
+	// Status is a user's availability in set_status requests and status
+	// events: available, away or dnd.
+	Status string `json:"status,omitempty"`
+	// MessageID identifies a chat message, or in requests such as read
+	// receipts and edits, the earlier message they refer to.
+	MessageID string `json:"message_id,omitempty"`
+	// Timestamp is when the server handled the message, in RFC 3339 format.
+	Timestamp string `json:"timestamp,omitempty"`
+	Edited    bool   `json:"edited,omitempty"`
+	// Seq orders messages within a room. SinceSeq is the last sequence a
+	// client has seen, in sync requests.
+	Seq      uint64 `json:"seq,omitempty"`
+	SinceSeq uint64 `json:"since_seq,omitempty"`
+	// Before and Limit page through history: Before is the sequence number
+	// to page back from and Limit the page size. Limit also bounds a sync,
+	// and More is set on a sync_complete that stopped short of the latest
+	// message.
+	Before uint64 `json:"before,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	More   bool   `json:"more,omitempty"`
+	// Cursor continues a listing from the page that returned it.
+	Cursor string `json:"cursor,omitempty"`
+	// Since and Until bound searches by date, in RFC 3339 format.
+	Since string `json:"since,omitempty"`
+	Until string `json:"until,omitempty"`
+	// ExpiresIn asks for a chat message to self-destruct that many seconds
+	// after it is sent. ExpiresAt is set by the server to when it will, in
+	// RFC 3339 format.
+	ExpiresIn int    `json:"expires_in,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// Deleted marks a tombstone left in place of a deleted message.
+	Deleted bool `json:"deleted,omitempty"`
+	// ReplyTo is the message this one answers. ThreadID is set by the
+	// server to the root message of the thread it belongs to.
+	ReplyTo  string `json:"reply_to,omitempty"`
+	ThreadID string `json:"thread_id,omitempty"`
+	// Bridge names the bridge, such as matrix, that relayed a chat message
+	// from another network. Its Sender is then the sender's ID there. It is
+	// hook for messages posted by integrations, sent as the hook's name,
+	// federation for those posted on a linked server, sent as user@server,
+	// and server for the results of fun commands such as /roll.
+	Bridge string `json:"bridge,omitempty"`
+	// Action marks a chat message sent with /me, to be shown as something
+	// its sender did.
+	Action bool `json:"action,omitempty"`
+	// Poll is set on a chat message that opens a poll, and on poll events,
+	// with the votes so far.
+	Poll *Poll `json:"poll,omitempty"`
+	// Forwarded credits the original of a message forwarded from another
+	// room.
+	Forwarded *Forward `json:"forwarded,omitempty"`
+	// Preview summarises the first link in a chat message. The server adds
+	// it after the message is sent, announcing it with a preview event.
+	Preview *LinkPreview `json:"preview,omitempty"`
+	// Translations holds a chat message's content translated into other
+	// languages, by language code, as members have asked for it.
+	Translations map[string]string `json:"translations,omitempty"`
+	// Encrypted carries the payload of an encrypted_dm in place of Content.
+	Encrypted *Ciphertext `json:"encrypted,omitempty"`
+	// Attachments lists files uploaded to /upload that a chat message
+	// shares. Clients need only give their IDs.
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// File describes the file a file_offer, file_chunk or file_complete
+	// message is about.
+	File *FileInfo `json:"file,omitempty"`
+	// Mentions lists the room members a chat message @mentions.
+	Mentions []string `json:"mentions,omitempty"`
+	// Reactions maps each emoji on a message to the users who reacted.
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	// Data carries structured payloads such as listings.
+	Data any `json:"data,omitempty"`
+}
+
+// DecodeData unmarshals the structured payload of a received message into v.
+func (m Message) DecodeData(v any) error {
+	raw, err := json.Marshal(m.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// HandlerFunc handles one inbound message of a registered type.
+type HandlerFunc func(c *Client, msg Message)
+
+type Server struct {
+	addr         string
+	accounts     UserRepository
+	readMarkers  ReadMarkerStore
+	roomStore    RoomStore
+	stars        StarStore
+	keys         KeyStore
+	messages     MessageStore
+	search       SearchIndex
+	historyFiles bool
+	historyDir   string
+	retention    RetentionPolicy
+	emptyRooms   EmptyRoomPolicy
+	rateLimit    RateLimit
+	filter       ContentFilter
+	spamPolicy   SpamPolicy
+	spam         *spamDetector
+	auditLog     auditLog
+	resetTokens  resetTokens
+	limits       *rateLimiter
+
+	// broker links this instance to others sharing its rooms; it is nil for
+	// a single instance. remoteOnline maps users signed in elsewhere to the
+	// instance they are on and is guarded by presenceLock.
+	broker       Broker
+	instanceID   string
+	outbox       chan []byte
+	remoteOnline map[string]string
+	presenceLock sync.Mutex
+	admins       map[string]bool
+	credentials  CredentialStore
+	tlsCert      string
+	tlsKey       string
+	tlsConfig    *tls.Config
+	redirectAddr string
+	bots         *botListener
+	grpcAddr     string
+	lineAddr     string
+	sessionKey   []byte
+	sessionTTL   time.Duration
+	sessions     *sessionManager
+
+	clients        map[*Client]*User
+	users          map[string]*User
+	rooms          map[string]*Room
+	dms            *dmQueue
+	handlers       map[string]HandlerFunc
+	public         map[string]bool
+	middleware     [stageCount][]Middleware
+	broadcast      chan Message
+	upgrader       websocket.Upgrader
+	mux            *http.ServeMux
+	started        time.Time
+	logger         *slog.Logger
+	nextConnID     atomic.Uint64
+	metrics        *metrics
+	metricsEnabled bool
+	maxContent     int
+	maxFileSize    int64
+	// attachments keeps files uploaded over HTTP; uploads are refused when
+	// it is nil.
+	attachments AttachmentStore
+	// expandEmoji replaces :shortcode: emoji in messages when set.
+	expandEmoji bool
+	// previews fetches link previews; they are off when it is nil.
+	previews          *linkPreviewer
+	maxAttachmentSize int64
+	debugEnabled      bool
+	// translator translates messages; /translate and auto-translation are
+	// off when it is nil. translateSlots limits translations in progress.
+	translator     Translator
+	translateSlots chan struct{}
+	// conns holds every open connection, signed in or not, and ipConns
+	// counts them by client address; both are guarded by connLock. connWG
+	// tracks their handlers.
+	conns   map[*Client]bool
+	ipConns map[netip.Addr]int
+	connWG  sync.WaitGroup
+	// polls holds the long-polling connections by ID and is guarded by
+	// pollLock.
+	polls         map[string]*pollConn
+	pollLock      sync.Mutex
+	shutdownGrace time.Duration
+	keepalive     Keepalive
+	maxConnsPerIP int
+	// trustedProxies may set X-Forwarded-For.
+	trustedProxies []netip.Prefix
+	// allowedOrigins are the patterns of the other sites whose pages may
+	// connect; anyOrigin lets every site's do.
+	allowedOrigins []string
+	anyOrigin      bool
+	// compressMin is the smallest message compressed for clients that
+	// negotiate compression; see WithCompression.
+	compressMin int
+	// ipBans mirrors ipBanStore for checks on every upgrade and is guarded
+	// by ipBanLock.
+	ipBanStore IPBanStore
+	ipBans     []IPBan
+	ipBanLock  sync.RWMutex
+	// matrix mirrors rooms to a Matrix homeserver; it is nil when the
+	// bridge is off.
+	matrix *matrixBridge
+	// webhookBridges joins rooms to Slack and Discord channels; it is nil
+	// when there are none.
+	webhookBridges *webhookBridges
+	// telegram relays rooms to Telegram groups; it is nil when none are.
+	telegram *telegramBridges
+	// federation shares rooms with other servers; it is nil when it is
+	// off.
+	federation *federation
+	// cluster shards rooms between the instances sharing the broker; it is
+	// nil unless cluster mode is on.
+	cluster *cluster
+	// assistant answers the messages that mention it; it is nil when there
+	// is none.
+	assistant *assistantBot
+	// webhooks mirrors webhookStore and is guarded by webhookLock.
+	webhookStore WebhookStore
+	webhooks     []Webhook
+	webhookLock  sync.RWMutex
+	webhookQueue chan webhookDelivery
+	// hooks mirrors hookStore, keyed by token hash, and is guarded by
+	// hookLock.
+	hookStore HookStore
+	hooks     map[string]Hook
+	hookLock  sync.RWMutex
+	// botAccounts mirrors botStore, keyed by bot name, and is guarded by
+	// botLock. botRateLimit, if set, replaces the rate limits for bots.
+	botStore     BotStore
+	botAccounts  map[string]Bot
+	botLock      sync.RWMutex
+	botRateLimit *RateLimit
+	// plugins are asked about messages, joins and commands, in order.
+	plugins []namedPlugin
+	// scripts are run on messages, joins and leaves, in order.
+	scripts []*Script
+	// commands are the slash commands, by name.
+	commands    map[string]Command
+	commandLock sync.RWMutex
+
+	connLock    sync.Mutex
+	clientLock  sync.Mutex
+	userLock    sync.Mutex
+	roomLock    sync.Mutex
+	handlerLock sync.RWMutex
+	files       *fileTransfers
+	// messageLock serialises read-modify-write changes to stored messages.
+	messageLock sync.Mutex
+
+	// expiryTimers holds the pending deletions of self-destructing
+	// messages, keyed by room and message ID.
+	expiryTimers map[string]*time.Timer
+	expiryLock   sync.Mutex
+	// scheduleTimers holds the timers of messages in scheduleStore waiting
+	// to be sent, keyed by ID.
+	scheduleStore  ScheduleStore
+	scheduleTimers map[string]*time.Timer
+	scheduleLock   sync.Mutex
+}
+
+func New(opts ...Option) *Server {
+	s := &Server{
+		addr:      ":8000",
+		clients:   make(map[*Client]*User),
+		users:     make(map[string]*User),
+		rooms:     make(map[string]*Room),
+		dms:       newDMQueue(),
+		limits:    newRateLimiter(),
+		spam:      newSpamDetector(),
+		files:     newFileTransfers(),
+		admins:    make(map[string]bool),
+		handlers:  make(map[string]HandlerFunc),
+		public:    maps.Clone(publicTypes),
+		broadcast: make(chan Message),
+		upgrader: websocket.Upgrader{
+			// Origins are checked by serveConn, which can say why.
+			CheckOrigin:  func(r *http.Request) bool { return true },
+			Subprotocols: encodings,
+		},
+		mux:               http.NewServeMux(),
+		started:           time.Now(),
+		sessionTTL:        24 * time.Hour,
+		historyFiles:      true,
+		historyDir:        ".",
+		conns:             make(map[*Client]bool),
+		ipConns:           make(map[netip.Addr]int),
+		polls:             make(map[string]*pollConn),
+		shutdownGrace:     5 * time.Second,
+		keepalive:         DefaultKeepalive,
+		instanceID:        newInstanceID(),
+		outbox:            make(chan []byte, outboxSize),
+		webhookQueue:      make(chan webhookDelivery, webhookQueueSize),
+		hooks:             make(map[string]Hook),
+		botAccounts:       make(map[string]Bot),
+		commands:          make(map[string]Command),
+		remoteOnline:      make(map[string]string),
+		logger:            slog.Default(),
+		metricsEnabled:    true,
+		maxContent:        defaultMaxContent,
+		maxFileSize:       defaultMaxFileSize,
+		maxAttachmentSize: defaultMaxAttachmentSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.accounts == nil {
+		s.accounts = NewMemoryUserRepository()
+	}
+	if s.messages == nil {
+		s.messages = NewMemoryMessageStore()
+	}
+	if s.search == nil {
+		s.search = NewMemorySearchIndex()
+	}
+	if s.readMarkers == nil {
+		s.readMarkers = NewMemoryReadMarkerStore()
+	}
+	if s.stars == nil {
+		s.stars = NewMemoryStarStore()
+	}
+	if s.keys == nil {
+		s.keys = NewMemoryKeyStore()
+	}
+	if s.ipBanStore == nil {
+		s.ipBanStore = NewMemoryIPBanStore()
+	}
+	if s.roomStore == nil {
+		s.roomStore = NewMemoryRoomStore()
+	}
+	if s.webhookStore == nil {
+		s.webhookStore = NewMemoryWebhookStore()
+	}
+	if s.hookStore == nil {
+		s.hookStore = NewMemoryHookStore()
+	}
+	if s.botStore == nil {
+		s.botStore = NewMemoryBotStore()
+	}
+	if s.scheduleStore == nil {
+		s.scheduleStore = NewMemoryScheduleStore()
+	}
+	if s.credentials == nil {
+		s.credentials = NewBcryptStore(s.accounts)
+	}
+	s.sessions = newSessionManager(s.sessionKey, s.sessionTTL)
+	s.metrics = newMetrics(s)
+	s.loadIPBans()
+	s.loadPasswordChanges()
+	s.loadWebhooks()
+	s.loadHooks()
+	s.loadBots()
+	s.loadRooms()
+	s.loadScheduled()
+
+	s.Handle("signup", s.handleSignup)
+	s.Handle("signin", s.handleSignin)
+	s.Handle("resume", s.handleResume)
+	s.Handle("signout", func(c *Client, msg Message) { s.handleSignout(c) })
+	s.Handle("change_password", s.handleChangePassword)
+	s.Handle("reset_password", s.handleResetPassword)
+	s.Handle("create_room", s.handleCreateRoom)
+	s.Handle("join_room", s.handleJoinRoom)
+	s.Handle("leave_room", s.handleLeaveRoom)
+	s.Handle("presence_query", s.handlePresenceQuery)
+	s.Handle("room_members", s.handleRoomMembers)
+	s.Handle("list_rooms", s.handleListRooms)
+	s.Handle("set_invite_only", s.handleSetInviteOnly)
+	s.Handle("create_invite", s.handleCreateInvite)
+	s.Handle("revoke_invite", s.handleRevokeInvite)
+	s.Handle("list_invites", s.handleListInvites)
+	s.Handle("pin", s.handlePin)
+	s.Handle("unpin", s.handleUnpin)
+	s.Handle("get_pins", s.handleGetPins)
+	s.Handle("whois", s.handleWhois)
+	s.Handle("set_status", s.handleSetStatus)
+	s.Handle("set_last_seen", s.handleSetLastSeen)
+	s.Handle("set_translate", s.handleSetTranslate)
+	s.Handle("grant_moderator", s.handleGrantModerator)
+	s.Handle("revoke_moderator", s.handleRevokeModerator)
+	s.Handle("kick", s.handleKick)
+	s.Handle("ban", s.handleBan)
+	s.Handle("unban", s.handleUnban)
+	s.Handle("set_topic", s.handleSetTopic)
+	s.Handle("set_description", s.handleSetDescription)
+	s.Handle("set_tags", s.handleSetTags)
+	s.Handle("set_slow_mode", s.handleSetSlowMode)
+	s.Handle("set_filter", s.handleSetFilter)
+	s.Handle("set_fun", s.handleSetFun)
+	s.Handle("set_assistant", s.handleSetAssistant)
+	s.Handle("admin_list_users", s.handleAdminListUsers)
+	s.Handle("admin_disable_user", s.handleAdminDisableUser)
+	s.Handle("admin_enable_user", s.handleAdminEnableUser)
+	s.Handle("admin_signout_user", s.handleAdminSignoutUser)
+	s.Handle("admin_delete_user", s.handleAdminDeleteUser)
+	s.Handle("admin_reset_password", s.handleAdminResetPassword)
+	s.Handle("admin_ban_ip", s.handleAdminBanIP)
+	s.Handle("admin_unban_ip", s.handleAdminUnbanIP)
+	s.Handle("admin_list_ip_bans", s.handleAdminListIPBans)
+	s.Handle("admin_set_permanent", s.handleAdminSetPermanent)
+	s.Handle("admin_add_webhook", s.handleAdminAddWebhook)
+	s.Handle("admin_remove_webhook", s.handleAdminRemoveWebhook)
+	s.Handle("admin_list_webhooks", s.handleAdminListWebhooks)
+	s.Handle("admin_add_hook", s.handleAdminAddHook)
+	s.Handle("admin_remove_hook", s.handleAdminRemoveHook)
+	s.Handle("admin_list_hooks", s.handleAdminListHooks)
+	s.Handle("admin_create_bot", s.handleAdminCreateBot)
+	s.Handle("admin_rotate_bot_key", s.handleAdminRotateBotKey)
+	s.Handle("admin_list_bots", s.handleAdminListBots)
+	s.Handle("typing", s.handleTyping)
+	s.Handle("read", s.handleRead)
+	s.Handle("get_read_markers", s.handleGetReadMarkers)
+	s.Handle("forward", s.handleForward)
+	s.Handle("set_files", s.handleSetFiles)
+	s.Handle("file_offer", s.handleFileOffer)
+	s.Handle("file_chunk", s.handleFileChunk)
+	s.Handle("file_complete", s.handleFileComplete)
+	s.Handle("star", s.handleStar)
+	s.Handle("unstar", s.handleUnstar)
+	s.Handle("list_starred", s.handleListStarred)
+	s.Handle("schedule", s.handleSchedule)
+	s.Handle("list_scheduled", s.handleListScheduled)
+	s.Handle("cancel_scheduled", s.handleCancelScheduled)
+	s.Handle("edit", s.handleEdit)
+	s.Handle("delete", s.handleDelete)
+	s.Handle("reaction_add", s.handleReactionAdd)
+	s.Handle("reaction_remove", s.handleReactionRemove)
+	s.Handle("get_thread", s.handleGetThread)
+	s.Handle("sync", s.handleSync)
+	s.Handle("history", s.handleHistory)
+	s.Handle("search", s.handleSearch)
+	s.Handle("set_retention", s.handleSetRetention)
+	s.Handle("set_rate_limit", s.handleSetRateLimit)
+	s.Handle("broadcast", s.handleChat)
+	s.Handle("capabilities", s.handleCapabilities)
+	s.Handle("hello", s.handleHello)
+	s.Handle("dm", s.handleDirectMessage)
+	s.Handle("publish_key", s.handlePublishKey)
+	s.Handle("get_key", s.handleGetKey)
+	s.Handle("encrypted_dm", s.handleEncryptedDM)
+	s.Handle("register_command", s.handleRegisterCommand)
+	s.Handle("unregister_command", s.handleUnregisterCommand)
+	s.Handle("vote", s.handleVote)
+	s.Handle("close_poll", s.handleClosePoll)
+	s.registerCommands()
+
+	s.mux.HandleFunc("/ws", s.handleConnections)
+	s.mux.HandleFunc("/admin/export", s.handleExport)
+	s.mux.HandleFunc("/rooms", s.handleRoomsHTTP)
+	s.mux.HandleFunc("GET /rooms/{name}/messages", s.handleRoomMessagesHTTP)
+	s.mux.HandleFunc("POST /rooms/{name}/messages", s.handlePostMessageHTTP)
+	s.mux.HandleFunc("GET /rooms/{name}/stream", s.handleRoomStreamHTTP)
+	s.mux.HandleFunc("GET /users/{name}", s.handleUserHTTP)
+	s.mux.HandleFunc("POST /rooms/{name}/scheduled", s.handleScheduleHTTP)
+	s.mux.HandleFunc("GET /scheduled", s.handleListScheduledHTTP)
+	s.mux.HandleFunc("DELETE /scheduled/{id}", s.handleCancelScheduledHTTP)
+	s.mux.HandleFunc("POST /poll", s.handlePollOpen)
+	s.mux.HandleFunc("POST /poll/{id}", s.handlePollSend)
+	s.mux.HandleFunc("GET /poll/{id}", s.handlePollFetch)
+	s.mux.HandleFunc("DELETE /poll/{id}", s.handlePollClose)
+	if s.matrix != nil {
+		s.mux.HandleFunc("PUT /_matrix/app/v1/transactions/{txnId}", s.handleMatrixTransaction)
+		s.mux.HandleFunc("POST /_matrix/app/v1/ping", s.handleMatrixPing)
+	}
+	if s.webhookBridges != nil {
+		s.mux.HandleFunc("POST /bridges/{token}", s.handleWebhookBridge)
+	}
+	if s.federation != nil {
+		s.mux.HandleFunc("GET /federation", s.handleFederation)
+	}
+	s.mux.HandleFunc("POST /hooks/{token}", s.handleHook)
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/readyz", s.handleReadyz)
+	if s.attachments != nil {
+		s.mux.HandleFunc("/upload", s.handleUpload)
+		s.mux.HandleFunc("/files/", s.handleFile)
+	}
+	if s.metricsEnabled {
+		s.mux.Handle("/metrics", s.metrics.handler())
+	}
+	if s.debugEnabled {
+		s.registerDebug()
+	}
+	return s
+}
+
+// Handle registers h for messages of the given type, replacing any existing
+// handler, including the built-in ones. Unless the type is one of the
+// built-in ones that need no sign in, or was registered with HandlePublic,
+// its requests can only be made once signed in.
+func (s *Server) Handle(msgType string, h HandlerFunc) {
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+	s.handlers[msgType] = h
+}
+
+func (s *Server) handler(msgType string) (HandlerFunc, bool) {
+	s.handlerLock.RLock()
+	defer s.handlerLock.RUnlock()
+	h, ok := s.handlers[msgType]
+	return h, ok
+}
+
+// ServeHTTP serves the server's endpoints, so it can be mounted on an
+// existing mux instead of calling Run.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Broadcast queues msg for delivery to the members of msg.Room.
+func (s *Server) Broadcast(msg Message) {
+	s.broadcast <- msg
+}
+
+// Run listens on the configured address and serves until ctx is cancelled.
+func (s *Server) Run(ctx context.Context) error {
+	var botTLS *tls.Config
+	if s.bots != nil && s.tlsEnabled() {
+		var err error
+		if botTLS, err = s.botTLSConfig(); err != nil {
+			return err
+		}
+	}
+	var grpcLis net.Listener
+	var grpcSrv *grpc.Server
+	if s.grpcAddr != "" {
+		var opts []grpc.ServerOption
+		if s.tlsEnabled() {
+			cfg, err := s.grpcTLSConfig()
+			if err != nil {
+				return err
+			}
+			opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+		}
+		var err error
+		if grpcLis, err = net.Listen("tcp", s.grpcAddr); err != nil {
+			return err
+		}
+		grpcSrv = s.newGRPCServer(opts...)
+	}
+	var lineLis net.Listener
+	if s.lineAddr != "" {
+		var err error
+		if lineLis, err = net.Listen("tcp", s.lineAddr); err != nil {
+			return err
+		}
+	}
+
+	// Background work outlives ctx so that clients can still be served
+	// while the server drains.
+	workCtx, stopWork := context.WithCancel(context.Background())
+	defer stopWork()
+
+	go s.handleMessages(workCtx)
+	go s.runJanitor(workCtx)
+	s.runWebhooks(workCtx)
+	if s.matrix != nil {
+		go s.runMatrix(workCtx)
+	}
+	if s.webhookBridges != nil {
+		go s.runWebhookBridges(workCtx)
+	}
+	if s.telegram != nil {
+		go s.runTelegram(workCtx)
+	}
+	if s.federation != nil {
+		go s.runFederation(workCtx)
+	}
+	if s.assistant != nil {
+		go s.runAssistant(workCtx)
+	}
+	if s.broker != nil {
+		go s.runPublisher(workCtx)
+		go s.runBroker(workCtx)
+		if s.cluster != nil {
+			// Heartbeats stop with ctx, when the instance starts to leave.
+			go s.runCluster(ctx)
+		}
+	}
+
+	servers := []*http.Server{{Addr: s.addr, Handler: s, TLSConfig: s.tlsConfig}}
+	errc := make(chan error, 5)
+	if lineLis != nil {
+		go func() {
+			s.logger.Info("line protocol listener started", "addr", s.lineAddr)
+			errc <- s.serveLines(lineLis)
+		}()
+	}
+	if grpcSrv != nil {
+		go func() {
+			s.logger.Info("grpc server started", "addr", s.grpcAddr)
+			errc <- grpcSrv.Serve(grpcLis)
+		}()
+	}
+	if s.tlsEnabled() {
+		go func() {
+			s.logger.Info("https server started", "addr", s.addr)
+			errc <- servers[0].ListenAndServeTLS(s.tlsCert, s.tlsKey)
+		}()
+
+		if s.redirectAddr != "" {
+			redirect := &http.Server{Addr: s.redirectAddr, Handler: redirectHandler(s.addr)}
+			servers = append(servers, redirect)
+			go func() {
+				s.logger.Info("http redirect server started", "addr", s.redirectAddr)
+				errc <- redirect.ListenAndServe()
+			}()
+		}
+
+		if botTLS != nil {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/ws", s.handleBotConnections)
+			bots := &http.Server{Addr: s.bots.addr, Handler: mux, TLSConfig: botTLS}
+			servers = append(servers, bots)
+			go func() {
+				s.logger.Info("bot listener started", "addr", s.bots.addr)
+				errc <- bots.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+			}()
+		}
+	} else {
+		go func() {
+			s.logger.Info("http server started", "addr", s.addr)
+			errc <- servers[0].ListenAndServe()
+		}()
+	}
+
+	var runErr error
+	select {
+	case runErr = <-errc:
+	case <-ctx.Done():
+	}
+	s.leaveCluster()
+
+	// Shutdown stops the listeners and waits for the requests in progress,
+	// among them event streams and long polls, which drain ends along with
+	// the hijacked WebSocket connections.
+	shutdownCtx, stop := context.WithTimeout(context.Background(), s.shutdownGrace+5*time.Second)
+	defer stop()
+	if lineLis != nil {
+		lineLis.Close()
+	}
+	shutdownErrs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() { shutdownErrs <- srv.Shutdown(shutdownCtx) }()
+	}
+	s.drain("Server is shutting down")
+	for range servers {
+		if err := <-shutdownErrs; err != nil && runErr == nil {
+			runErr = err
+		}
+	}
+	if grpcSrv != nil {
+		grpcSrv.GracefulStop()
+	}
+	s.stopExpiries()
+	s.stopScheduled()
+
+	if errors.Is(runErr, http.ErrServerClosed) {
+		return nil
+	}
+	return runErr
+}
+
+func (s *Server) tlsEnabled() bool {
+	return s.tlsCert != "" || s.tlsConfig != nil
+}
+
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bot "); ok {
+		account := s.authenticateBot(key)
+		if account == "" {
+			s.logger.Warn("refused bot key", "ip", s.clientIP(r))
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		s.serveConn(w, r, account)
+		return
+	}
+	s.serveConn(w, r, "")
+}
+
+// serveConn upgrades r to a WebSocket connection and serves it until it
+// closes. If account is set, the connection has already proved it belongs to
+// that account and is signed in to it straight away.
+func (s *Server) serveConn(w http.ResponseWriter, r *http.Request, account string) {
+	ip := s.clientIP(r)
+	if s.ipBanned(ip) {
+		s.logger.Info("refused banned address", "ip", ip)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !s.originAllowed(r) {
+		s.logger.Warn("refused origin", "ip", ip, "origin", r.Header.Get("Origin"))
+		s.metrics.websocketError("origin")
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if !s.acquireIP(ip) {
+		s.logger.Warn("too many connections", "ip", ip)
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer s.releaseIP(ip)
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Warn("websocket upgrade", "ip", ip, "err", err)
+		s.metrics.websocketError("upgrade")
+		return
+	}
+
+	c := newClient(ws, s.logger.With("conn", s.nextConnID.Add(1), "ip", ip), s.metrics, s.keepalive)
+	c.ip = ip
+	c.compressMin = s.compressMin
+	go c.writePump()
+	c.logger.Debug("connected")
+
+	s.connWG.Add(1)
+	defer s.connWG.Done()
+	defer s.disconnect(c)
+
+	s.connLock.Lock()
+	s.conns[c] = true
+	s.connLock.Unlock()
+
+	ws.SetReadLimit(int64(s.maxContent)*utf8.UTFMax + readLimitSlack)
+	c.extendReadDeadline()
+	ws.SetPongHandler(func(string) error { return c.extendReadDeadline() })
+	if account != "" {
+		s.signIn(c, account)
+	}
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if isTimeout(err) {
+				c.logger.Info("connection timed out")
+				s.metrics.websocketError("timeout")
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.logger.Warn("read failed", "err", err)
+				s.metrics.websocketError("read")
+			} else {
+				c.logger.Debug("disconnected", "err", err)
+			}
+			break
+		}
+		c.extendReadDeadline()
+		c.lastMessage.Store(time.Now().UnixNano())
+
+		msg, problems := decodeFrame(ws.Subprotocol(), data)
+		s.dispatch(c, msg, problems)
+	}
+}
+
+// dispatch passes a request from c through the pipeline to its handler.
+// problems are any found decoding it.
+func (s *Server) dispatch(c *Client, msg Message, problems []FieldError) {
+	// Handlers answer through Reply, so the ID is taken off the message to
+	// keep it out of anything they relay to others.
+	c.request, c.failed = msg.ID, false
+	msg.ID = ""
+	c.reqLogger = c.logger.With("type", msg.Type)
+	if user := s.userOf(c); user != nil {
+		c.reqLogger = c.reqLogger.With("user", user.Username)
+	}
+	if msg.Room != "" {
+		c.reqLogger = c.reqLogger.With("room", msg.Room)
+	}
+	c.reqLogger.Debug("request")
+
+	h, ok := s.handler(msg.Type)
+	s.metrics.countMessage(msg.Type, ok)
+	if problems != nil {
+		c.Reply(invalidMessage(problems))
+		return
+	}
+	if !ok {
+		c.Reply(Message{Type: "error", Code: CodeUnknownType, Content: "Unknown message type", Data: []FieldError{{Field: "type", Problem: "is not a known message type"}}})
+		return
+	}
+	s.pipeline(h)(c, msg)
+	if c.request != "" && !c.failed {
+		c.Send(Message{Type: "ack", ID: c.request, Content: msg.Type})
+	}
+}
+
+// newCallClient makes a Client with no connection, for a request from ip
+// that arrived over another API than the WebSocket one.
+func (s *Server) newCallClient(ip netip.Addr, via string) *Client {
+	c := newClient(nil, s.logger.With("conn", s.nextConnID.Add(1), "ip", ip, "via", via), s.metrics, s.keepalive)
+	c.ip = ip
+	return c
+}
+
+// call handles msg as a request made by username, or by nobody if it is
+// empty, over another API than the WebSocket one, and returns the replies.
+// If the request failed, failure is its error reply. The user is not
+// connected by it, so events still go wherever they are connected.
+func (s *Server) call(ip netip.Addr, via, username string, msg Message) (replies []Message, failure *Message) {
+	c := s.newCallClient(ip, via)
+	defer c.Close()
+	if username != "" {
+		user := s.loadUser(username)
+		s.clientLock.Lock()
+		s.clients[c] = user
+		s.clientLock.Unlock()
+		defer func() {
+			s.clientLock.Lock()
+			delete(s.clients, c)
+			s.clientLock.Unlock()
+		}()
+	}
+
+	s.dispatch(c, msg, nil)
+	for {
+		select {
+		case reply := <-c.send:
+			if reply.Type == "error" {
+				return nil, &reply
+			}
+			replies = append(replies, reply)
+		default:
+			return replies, nil
+		}
+	}
+}
+
+func (s *Server) handleMessages(ctx context.Context) {
+	for {
+		var msg Message
+		select {
+		case <-ctx.Done():
+			return
+		case msg = <-s.broadcast:
+		}
+
+		s.roomLock.Lock()
+		room, exists := s.rooms[msg.Room]
+		if exists {
+			s.postToRoomLocked(room, msg)
+		}
+		s.roomLock.Unlock()
+	}
+}
+
+// userOf returns the user signed in on c, or nil.
+func (s *Server) userOf(c *Client) *User {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+	return s.clients[c]
+}
+
+// onlineUser returns username if they are signed in on a connection to
+// this instance, or nil.
+func (s *Server) onlineUser(username string) *User {
+	s.userLock.Lock()
+	user := s.users[username]
+	s.userLock.Unlock()
+	if user == nil || !user.Online() {
+		return nil
+	}
+	return user
+}
+
+func (s *Server) disconnect(c *Client) {
+	s.connLock.Lock()
+	delete(s.conns, c)
+	s.connLock.Unlock()
+
+	s.clientLock.Lock()
+	user, ok := s.clients[c]
+	detached := ok && user.removeConn(c)
+	delete(s.clients, c)
+	s.clientLock.Unlock()
+
+	if detached {
+		s.announcePresence(user, false)
+		s.recordLastSeen(user.Username)
+		s.dropMemberships(user)
+	}
+	s.cancelTransfers(func(t *fileTransfer) bool { return t.client == c })
+
+	c.Close()
+}
+
+// ShutdownNotice is the Data of a server_shutdown message.
+type ShutdownNotice struct {
+	Reason       string `json:"reason"`
+	GraceSeconds int    `json:"grace_seconds"`
+}
+
+// drain tells every connected client that the server is going away, gives
+// them the shutdown grace period, then closes their connections with a
+// going-away frame. It returns once their handlers have finished and any
+// history write in progress is complete.
+func (s *Server) drain(reason string) {
+	notice := Message{
+		Type:    "server_shutdown",
+		Content: reason,
+		Data:    ShutdownNotice{Reason: reason, GraceSeconds: int(s.shutdownGrace.Seconds())},
+	}
+	s.connLock.Lock()
+	conns := make([]*Client, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.connLock.Unlock()
+	if len(conns) == 0 {
+		return
+	}
+	s.logger.Info("draining connections", "count", len(conns))
+	for _, c := range conns {
+		c.Send(notice)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(s.shutdownGrace):
+		for _, c := range conns {
+			c.CloseWith(websocket.CloseGoingAway, reason)
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			s.logger.Warn("connections still open after shutdown")
+		}
+	}
+
+	historyLock.Lock()
+	historyLock.Unlock()
+}
@@ -0,0 +1,97 @@
+package chatserver
+
+import (
+	"io"
+	"log/slog"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestServer returns a server that keeps everything in memory, logs
+// nothing and hashes passwords cheaply. Its handlers are driven with do,
+// without a network.
+func newTestServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	base := []Option{
+		WithHistoryFiles(false),
+		WithMetrics(false),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}
+	s := New(append(base, opts...)...)
+	if store, ok := s.credentials.(*BcryptStore); ok {
+		store.cost = bcrypt.MinCost
+	}
+	return s
+}
+
+// newTestClient returns a client with no connection; what it is sent stays
+// in its queue for drain.
+func newTestClient(s *Server) *Client {
+	return s.newCallClient(netip.MustParseAddr("192.0.2.1"), "test")
+}
+
+// drain returns the messages queued for c.
+func drain(c *Client) []Message {
+	var msgs []Message
+	for {
+		select {
+		case msg := <-c.send:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+// do handles msg as a request from c and returns what c was sent.
+func do(s *Server, c *Client, msg Message) []Message {
+	drain(c)
+	s.dispatch(c, msg, nil)
+	return drain(c)
+}
+
+// errorCode returns the code of the first error in msgs, or "".
+func errorCode(msgs []Message) string {
+	for _, msg := range msgs {
+		if msg.Type == "error" {
+			return msg.Code
+		}
+	}
+	return ""
+}
+
+// find returns the first message of msgType in msgs.
+func find(msgs []Message, msgType string) (Message, bool) {
+	for _, msg := range msgs {
+		if msg.Type == msgType {
+			return msg, true
+		}
+	}
+	return Message{}, false
+}
+
+// signIn signs username up, unless they exist already, and in on a new
+// client.
+func signIn(t *testing.T, s *Server, username string) *Client {
+	t.Helper()
+	c := newTestClient(s)
+	if code := errorCode(do(s, c, Message{Type: "signup", Sender: username, Content: username + "-password"})); code != "" && code != CodeAlreadyExists {
+		t.Fatalf("signup %s: %s", username, code)
+	}
+	if code := errorCode(do(s, c, Message{Type: "signin", Sender: username, Content: username + "-password"})); code != "" {
+		t.Fatalf("signin %s: %s", username, code)
+	}
+	return c
+}
+
+// mustDo is do for requests that must succeed.
+func mustDo(t *testing.T, s *Server, c *Client, msg Message) []Message {
+	t.Helper()
+	msgs := do(s, c, msg)
+	if code := errorCode(msgs); code != "" {
+		t.Fatalf("%s: %s", msg.Type, code)
+	}
+	return msgs
+}
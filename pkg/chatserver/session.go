@@ -0,0 +1,146 @@
+package chatserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidSession = errors.New("invalid or expired session token")
+
+type sessionClaims struct {
+	ID       string `json:"id"`
+	Username string `json:"u"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+// sessionManager issues HMAC-signed session tokens. Tokens are stateless;
+// the manager only remembers revoked ones until they would have expired,
+// plus a per-user cutoff before which all of a user's tokens are invalid.
+type sessionManager struct {
+	key []byte
+	ttl time.Duration
+
+	mu      sync.Mutex
+	revoked map[string]time.Time
+	cutoff  map[string]int64
+}
+
+func newSessionManager(key []byte, ttl time.Duration) *sessionManager {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	return &sessionManager{key: key, ttl: ttl, revoked: make(map[string]time.Time), cutoff: make(map[string]int64)}
+}
+
+func (m *sessionManager) Issue(username string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := sessionClaims{
+		ID:       hex.EncodeToString(id),
+		Username: username,
+		IssuedAt: now.UnixNano(),
+		Expires:  now.Add(m.ttl).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString(payload)
+	return enc + "." + m.sign(enc), nil
+}
+
+// Verify returns the username a token was issued to.
+func (m *sessionManager) Verify(token string) (string, error) {
+	claims, err := m.parse(token)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	_, revoked := m.revoked[claims.ID]
+	if cutoff, ok := m.cutoff[claims.Username]; ok && claims.IssuedAt < cutoff {
+		revoked = true
+	}
+	m.mu.Unlock()
+
+	if revoked || time.Now().Unix() >= claims.Expires {
+		return "", ErrInvalidSession
+	}
+	return claims.Username, nil
+}
+
+func (m *sessionManager) Revoke(token string) {
+	claims, err := m.parse(token)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.pruneLocked()
+	m.revoked[claims.ID] = time.Unix(claims.Expires, 0)
+	m.mu.Unlock()
+}
+
+// RevokeUser invalidates every token issued to username so far.
+func (m *sessionManager) RevokeUser(username string) {
+	m.RevokeUserBefore(username, time.Now())
+}
+
+// RevokeUserBefore invalidates the tokens issued to username before t,
+// unless a later cutoff is set already.
+func (m *sessionManager) RevokeUserBefore(username string, t time.Time) {
+	m.mu.Lock()
+	if cutoff := t.UnixNano(); cutoff > m.cutoff[username] {
+		m.cutoff[username] = cutoff
+	}
+	m.mu.Unlock()
+}
+
+func (m *sessionManager) parse(token string) (*sessionClaims, error) {
+	enc, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(m.sign(enc))) {
+		return nil, ErrInvalidSession
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, ErrInvalidSession
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidSession
+	}
+	return &claims, nil
+}
+
+func (m *sessionManager) sign(payload string) string {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (m *sessionManager) pruneLocked() {
+	now := time.Now()
+	for id, expires := range m.revoked {
+		if now.After(expires) {
+			delete(m.revoked, id)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package chatserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionManagerVerify(t *testing.T) {
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		token func(m *sessionManager, token string) string
+		valid bool
+	}{
+		{"issued", time.Hour, nil, true},
+		{"revoked", time.Hour, func(m *sessionManager, token string) string {
+			m.Revoke(token)
+			return token
+		}, false},
+		{"other token revoked", time.Hour, func(m *sessionManager, token string) string {
+			other, _ := m.Issue("alice")
+			m.Revoke(other)
+			return token
+		}, true},
+		{"user revoked", time.Hour, func(m *sessionManager, token string) string {
+			m.RevokeUser("alice")
+			return token
+		}, false},
+		{"other user revoked", time.Hour, func(m *sessionManager, token string) string {
+			m.RevokeUser("bob")
+			return token
+		}, true},
+		{"issued after user revoked", time.Hour, func(m *sessionManager, token string) string {
+			m.RevokeUser("alice")
+			token, _ = m.Issue("alice")
+			return token
+		}, true},
+		{"cutoff before issue", time.Hour, func(m *sessionManager, token string) string {
+			m.RevokeUserBefore("alice", time.Now().Add(-time.Minute))
+			return token
+		}, true},
+		{"cutoff after issue", time.Hour, func(m *sessionManager, token string) string {
+			m.RevokeUserBefore("alice", time.Now().Add(time.Minute))
+			return token
+		}, false},
+		{"earlier cutoff ignored", time.Hour, func(m *sessionManager, token string) string {
+			m.RevokeUserBefore("alice", time.Now().Add(time.Minute))
+			m.RevokeUserBefore("alice", time.Now().Add(-time.Minute))
+			return token
+		}, false},
+		{"expired", -time.Second, nil, false},
+		{"tampered", time.Hour, func(m *sessionManager, token string) string {
+			enc, sig, _ := strings.Cut(token, ".")
+			return enc + "x." + sig
+		}, false},
+		{"signed with another key", time.Hour, func(m *sessionManager, token string) string {
+			token, _ = newSessionManager(nil, time.Hour).Issue("alice")
+			return token
+		}, false},
+		{"malformed", time.Hour, func(m *sessionManager, token string) string { return "not-a-token" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newSessionManager(nil, tt.ttl)
+			token, err := m.Issue("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != nil {
+				token = tt.token(m, token)
+			}
+			username, err := m.Verify(token)
+			if valid := err == nil; valid != tt.valid {
+				t.Fatalf("Verify error %v, want valid %v", err, tt.valid)
+			}
+			if tt.valid && username != "alice" {
+				t.Errorf("Verify = %q, want alice", username)
+			}
+		})
+	}
+}
+
+func TestSessionManagerSharedKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	token, err := newSessionManager(key, time.Hour).Issue("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A restart with the same key still accepts the token.
+	if username, err := newSessionManager(key, time.Hour).Verify(token); err != nil || username != "alice" {
+		t.Errorf("Verify = %q, %v, want alice", username, err)
+	}
+}
@@ -0,0 +1,161 @@
+package chatserver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpamPolicy sets when a user's room messages count as spam. Sending spam
+// mutes the user in every room for MuteFor. Zero fields turn their check
+// off.
+type SpamPolicy struct {
+	// RepeatLimit is how many identical messages in a row, each within
+	// RepeatWindow of the last, count as spam.
+	RepeatLimit  int
+	RepeatWindow time.Duration
+	// MaxMentions is the most @mentions one message may hold.
+	MaxMentions int
+	// MaxLinks is the most links a user may post within LinkWindow.
+	MaxLinks   int
+	LinkWindow time.Duration
+	MuteFor    time.Duration
+}
+
+func (p SpamPolicy) enabled() bool {
+	return p.MuteFor > 0 && (p.RepeatLimit > 0 || p.MaxMentions > 0 || p.MaxLinks > 0)
+}
+
+// spamDetector tracks each user's recent messages.
+type spamDetector struct {
+	mu    sync.Mutex
+	users map[string]*spamState
+}
+
+type spamState struct {
+	last    string
+	lastAt  time.Time
+	repeats int
+	links   []time.Time
+}
+
+func newSpamDetector() *spamDetector {
+	return &spamDetector{users: make(map[string]*spamState)}
+}
+
+// check records that username sent content at now and returns why it is
+// spam under policy, or "" if it is not.
+func (d *spamDetector) check(username, content string, policy SpamPolicy, now time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st := d.users[username]
+	if st == nil {
+		st = &spamState{}
+		d.users[username] = st
+	}
+
+	normalized := strings.ToLower(strings.TrimSpace(content))
+	if normalized == st.last && now.Sub(st.lastAt) <= policy.RepeatWindow {
+		st.repeats++
+	} else {
+		st.repeats = 1
+	}
+	st.last, st.lastAt = normalized, now
+	if policy.RepeatLimit > 0 && st.repeats >= policy.RepeatLimit {
+		st.repeats = 0
+		return fmt.Sprintf("repeated the same message %d times", policy.RepeatLimit)
+	}
+
+	if mentions := countMentions(content); policy.MaxMentions > 0 && mentions > policy.MaxMentions {
+		return fmt.Sprintf("mentioned %d users in one message", mentions)
+	}
+
+	if policy.MaxLinks > 0 {
+		recent := st.links[:0]
+		for _, t := range st.links {
+			if now.Sub(t) <= policy.LinkWindow {
+				recent = append(recent, t)
+			}
+		}
+		for range countLinks(content) {
+			recent = append(recent, now)
+		}
+		st.links = recent
+		if len(recent) > policy.MaxLinks {
+			st.links = nil
+			return fmt.Sprintf("posted more than %d links in %s", policy.MaxLinks, policy.LinkWindow)
+		}
+	}
+	return ""
+}
+
+// prune forgets users whose last message is older than every window.
+func (d *spamDetector) prune(policy SpamPolicy, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keep := max(policy.RepeatWindow, policy.LinkWindow)
+	for name, st := range d.users {
+		if now.Sub(st.lastAt) > keep {
+			delete(d.users, name)
+		}
+	}
+}
+
+func countMentions(content string) int {
+	n := 0
+	for _, word := range strings.Fields(content) {
+		if len(word) > 1 && word[0] == '@' {
+			n++
+		}
+	}
+	return n
+}
+
+func countLinks(content string) int {
+	n := 0
+	for _, word := range strings.Fields(strings.ToLower(content)) {
+		if strings.HasPrefix(word, "http://") || strings.HasPrefix(word, "https://") || strings.HasPrefix(word, "www.") {
+			n++
+		}
+	}
+	return n
+}
+
+// checkSpamLocked refuses messages from muted users and mutes users whose
+// message is spam, recording an audit entry. The caller must hold
+// roomLock.
+func (s *Server) checkSpamLocked(c *Client, user *User, room *Room, content string) bool {
+	now := time.Now()
+	if wait := user.mutedUntil.Sub(now); wait > 0 {
+		c.Reply(Message{
+			Type:    "error",
+			Code:    CodeRateLimited,
+			Content: fmt.Sprintf("You are muted for another %s", wait.Round(time.Second)),
+			Room:    room.Name,
+			Data:    RateLimited{RetryAfterMS: wait.Milliseconds()},
+		})
+		return false
+	}
+	if !s.spamPolicy.enabled() {
+		return true
+	}
+
+	reason := s.spam.check(user.Username, content, s.spamPolicy, now)
+	if reason == "" {
+		return true
+	}
+	user.mutedUntil = now.Add(s.spamPolicy.MuteFor)
+	s.audit(AuditEntry{Actor: "server", Action: "mute", Target: user.Username, Room: room.Name,
+		Detail: fmt.Sprintf("spam: %s; muted for %s", reason, s.spamPolicy.MuteFor)})
+	c.Reply(Message{
+		Type:    "error",
+		Code:    CodeSpam,
+		Content: fmt.Sprintf("Message blocked as spam: you %s. You are muted for %s", reason, s.spamPolicy.MuteFor),
+		Room:    room.Name,
+		Data:    RateLimited{RetryAfterMS: s.spamPolicy.MuteFor.Milliseconds()},
+	})
+	return false
+}
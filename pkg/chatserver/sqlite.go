@@ -0,0 +1,825 @@
+package chatserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	username            TEXT PRIMARY KEY,
+	password_hash       BLOB NOT NULL,
+	admin               INTEGER NOT NULL DEFAULT 0,
+	disabled            INTEGER NOT NULL DEFAULT 0,
+	last_seen_at        TIMESTAMP,
+	hide_last_seen      INTEGER NOT NULL DEFAULT 0,
+	translate_to        TEXT NOT NULL DEFAULT '',
+	password_changed_at TIMESTAMP,
+	created_at          TIMESTAMP NOT NULL,
+	updated_at          TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS read_markers (
+	username     TEXT NOT NULL,
+	conversation TEXT NOT NULL,
+	message_id   TEXT NOT NULL,
+	updated_at   TIMESTAMP NOT NULL,
+	PRIMARY KEY (username, conversation)
+);
+
+CREATE TABLE IF NOT EXISTS stars (
+	username   TEXT NOT NULL,
+	room       TEXT NOT NULL,
+	message_id TEXT NOT NULL,
+	starred_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (username, room, message_id)
+);
+
+CREATE TABLE IF NOT EXISTS public_keys (
+	username   TEXT PRIMARY KEY,
+	algorithm  TEXT NOT NULL,
+	key        TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ip_bans (
+	prefix     TEXT PRIMARY KEY,
+	reason     TEXT NOT NULL,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id         TEXT PRIMARY KEY,
+	url        TEXT NOT NULL,
+	events     TEXT NOT NULL,
+	rooms      TEXT NOT NULL,
+	secret     TEXT NOT NULL,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS hooks (
+	id         TEXT PRIMARY KEY,
+	name       TEXT NOT NULL,
+	room       TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS bots (
+	name       TEXT PRIMARY KEY,
+	scopes     TEXT NOT NULL,
+	rooms      TEXT NOT NULL,
+	key_hash   TEXT NOT NULL UNIQUE,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rooms (
+	name       TEXT PRIMARY KEY,
+	owner      TEXT NOT NULL,
+	settings   TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS room_members (
+	room      TEXT NOT NULL,
+	username  TEXT NOT NULL,
+	joined_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (room, username)
+);
+
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+	id         TEXT PRIMARY KEY,
+	sender     TEXT NOT NULL,
+	room       TEXT NOT NULL,
+	content    TEXT NOT NULL,
+	reminder   INTEGER NOT NULL DEFAULT 0,
+	send_at    TIMESTAMP NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+	content,
+	room UNINDEXED,
+	message_id UNINDEXED,
+	sender UNINDEXED,
+	sent_at UNINDEXED,
+	body UNINDEXED
+);`
+
+// sqliteColumns lists columns added after a table was first created, so
+// older databases can be upgraded in place.
+var sqliteColumns = []struct{ table, column, decl string }{
+	{"users", "admin", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "last_seen_at", "TIMESTAMP"},
+	{"users", "hide_last_seen", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "translate_to", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "password_changed_at", "TIMESTAMP"},
+}
+
+// SQLiteStore persists accounts, per-user state and a full-text message
+// index in a SQLite database file.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serialise access through one connection.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	for _, col := range sqliteColumns {
+		var count int
+		err := db.QueryRow(
+			`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, col.table, col.column,
+		).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE " + col.table + " ADD COLUMN " + col.column + " " + col.decl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SQLiteStore) Close() error {
+	return r.db.Close()
+}
+
+func (r *SQLiteStore) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+func (r *SQLiteStore) Create(account *Account) error {
+	now := time.Now().UTC()
+	_, err := r.db.Exec(
+		`INSERT INTO users (username, password_hash, admin, disabled, hide_last_seen, translate_to, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		account.Username, account.PasswordHash, account.Admin, account.Disabled, account.HideLastSeen, account.TranslateTo, now, now,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrUserExists
+		}
+		return err
+	}
+
+	account.CreatedAt = now
+	account.UpdatedAt = now
+	return nil
+}
+
+func (r *SQLiteStore) Find(username string) (*Account, error) {
+	account, err := scanAccount(r.db.QueryRow(
+		`SELECT `+accountColumns+` FROM users WHERE username = ?`, username,
+	))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return account, nil
+}
+
+func (r *SQLiteStore) List() ([]*Account, error) {
+	rows, err := r.db.Query(`SELECT ` + accountColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []*Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (r *SQLiteStore) Delete(username string) error {
+	res, err := r.db.Exec(`DELETE FROM users WHERE username = ?`, username)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+const accountColumns = `username, password_hash, admin, disabled, last_seen_at, hide_last_seen, translate_to, password_changed_at, created_at, updated_at`
+
+func scanAccount(row interface{ Scan(...any) error }) (*Account, error) {
+	var account Account
+	var lastSeen, passwordChanged sql.NullTime
+	err := row.Scan(
+		&account.Username, &account.PasswordHash, &account.Admin, &account.Disabled,
+		&lastSeen, &account.HideLastSeen, &account.TranslateTo, &passwordChanged, &account.CreatedAt, &account.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	account.LastSeen = lastSeen.Time
+	account.PasswordChangedAt = passwordChanged.Time
+	return &account, nil
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteStore) Update(account *Account) error {
+	now := time.Now().UTC()
+	res, err := r.db.Exec(
+		`UPDATE users SET password_hash = ?, admin = ?, disabled = ?, hide_last_seen = ?, translate_to = ?, password_changed_at = ?, updated_at = ? WHERE username = ?`,
+		account.PasswordHash, account.Admin, account.Disabled, account.HideLastSeen, account.TranslateTo, nullTime(account.PasswordChangedAt), now, account.Username,
+	)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+
+	account.UpdatedAt = now
+	return nil
+}
+
+func (r *SQLiteStore) SetLastSeen(username string, at time.Time) error {
+	res, err := r.db.Exec(`UPDATE users SET last_seen_at = ? WHERE username = ?`, at.UTC(), username)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+func (r *SQLiteStore) SetReadMarker(username, conversation, messageID string) error {
+	_, err := r.db.Exec(
+		`INSERT INTO read_markers (username, conversation, message_id, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (username, conversation) DO UPDATE SET message_id = excluded.message_id, updated_at = excluded.updated_at`,
+		username, conversation, messageID, time.Now().UTC(),
+	)
+	return err
+}
+
+func (r *SQLiteStore) ReadMarkers(username string) (map[string]string, error) {
+	rows, err := r.db.Query(`SELECT conversation, message_id FROM read_markers WHERE username = ?`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	markers := make(map[string]string)
+	for rows.Next() {
+		var conversation, id string
+		if err := rows.Scan(&conversation, &id); err != nil {
+			return nil, err
+		}
+		markers[conversation] = id
+	}
+	return markers, rows.Err()
+}
+
+func (r *SQLiteStore) AddStar(username string, star Star) error {
+	_, err := r.db.Exec(
+		`INSERT INTO stars (username, room, message_id, starred_at) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		username, star.Room, star.MessageID, star.StarredAt,
+	)
+	return err
+}
+
+func (r *SQLiteStore) RemoveStar(username, room, messageID string) error {
+	res, err := r.db.Exec(`DELETE FROM stars WHERE username = ? AND room = ? AND message_id = ?`, username, room, messageID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrStarNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteStore) Stars(username string) ([]Star, error) {
+	return scanStars(r.db.Query(`SELECT room, message_id, starred_at FROM stars WHERE username = ?`, username))
+}
+
+func (r *SQLiteStore) SetKey(key PublicKey) error {
+	_, err := r.db.Exec(
+		`INSERT INTO public_keys (username, algorithm, key, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET algorithm = excluded.algorithm, key = excluded.key, updated_at = excluded.updated_at`,
+		key.Username, key.Algorithm, key.Key, key.UpdatedAt,
+	)
+	return err
+}
+
+func (r *SQLiteStore) Key(username string) (PublicKey, error) {
+	key := PublicKey{Username: username}
+	err := r.db.QueryRow(`SELECT algorithm, key, updated_at FROM public_keys WHERE username = ?`, username).
+		Scan(&key.Algorithm, &key.Key, &key.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, ErrKeyNotFound
+	}
+	return key, err
+}
+
+func (r *SQLiteStore) DeleteKey(username string) error {
+	_, err := r.db.Exec(`DELETE FROM public_keys WHERE username = ?`, username)
+	return err
+}
+
+// scanStars reads the rows of a stars query.
+func scanStars(rows *sql.Rows, err error) ([]Star, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stars []Star
+	for rows.Next() {
+		var star Star
+		if err := rows.Scan(&star.Room, &star.MessageID, &star.StarredAt); err != nil {
+			return nil, err
+		}
+		stars = append(stars, star)
+	}
+	return stars, rows.Err()
+}
+
+func (r *SQLiteStore) AddIPBan(ban IPBan) error {
+	_, err := r.db.Exec(
+		`INSERT INTO ip_bans (prefix, reason, created_by, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (prefix) DO UPDATE SET reason = excluded.reason, created_by = excluded.created_by, created_at = excluded.created_at`,
+		ban.Prefix.String(), ban.Reason, ban.CreatedBy, ban.CreatedAt,
+	)
+	return err
+}
+
+func (r *SQLiteStore) RemoveIPBan(prefix netip.Prefix) error {
+	res, err := r.db.Exec(`DELETE FROM ip_bans WHERE prefix = ?`, prefix.String())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrIPBanNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteStore) IPBans() ([]IPBan, error) {
+	return scanIPBans(r.db.Query(`SELECT prefix, reason, created_by, created_at FROM ip_bans`))
+}
+
+// scanIPBans reads the rows of an ip_bans query.
+func scanIPBans(rows *sql.Rows, err error) ([]IPBan, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []IPBan
+	for rows.Next() {
+		var ban IPBan
+		var prefix string
+		if err := rows.Scan(&prefix, &ban.Reason, &ban.CreatedBy, &ban.CreatedAt); err != nil {
+			return nil, err
+		}
+		if ban.Prefix, err = netip.ParsePrefix(prefix); err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+func (r *SQLiteStore) AddWebhook(hook Webhook) error {
+	events, rooms, err := encodeWebhookLists(hook)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(
+		`INSERT INTO webhooks (id, url, events, rooms, secret, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		hook.ID, hook.URL, string(events), string(rooms), hook.Secret, hook.CreatedBy, hook.CreatedAt,
+	)
+	return err
+}
+
+func (r *SQLiteStore) RemoveWebhook(id string) error {
+	res, err := r.db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteStore) Webhooks() ([]Webhook, error) {
+	return scanWebhooks(r.db.Query(`SELECT id, url, events, rooms, secret, created_by, created_at FROM webhooks`))
+}
+
+// encodeWebhookLists encodes a webhook's events and rooms for storage.
+func encodeWebhookLists(hook Webhook) (events, rooms []byte, err error) {
+	if events, err = json.Marshal(hook.Events); err != nil {
+		return nil, nil, err
+	}
+	if rooms, err = json.Marshal(hook.Rooms); err != nil {
+		return nil, nil, err
+	}
+	return events, rooms, nil
+}
+
+// scanWebhooks reads the rows of a webhooks query.
+func scanWebhooks(rows *sql.Rows, err error) ([]Webhook, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var hook Webhook
+		var events, rooms []byte
+		if err := rows.Scan(&hook.ID, &hook.URL, &events, &rooms, &hook.Secret, &hook.CreatedBy, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(events, &hook.Events); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(rooms, &hook.Rooms); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (r *SQLiteStore) AddHook(hook Hook) error {
+	_, err := r.db.Exec(
+		`INSERT INTO hooks (id, name, room, token_hash, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		hook.ID, hook.Name, hook.Room, hook.TokenHash, hook.CreatedBy, hook.CreatedAt,
+	)
+	return err
+}
+
+func (r *SQLiteStore) RemoveHook(id string) error {
+	res, err := r.db.Exec(`DELETE FROM hooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrHookNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteStore) Hooks() ([]Hook, error) {
+	return scanHooks(r.db.Query(`SELECT id, name, room, token_hash, created_by, created_at FROM hooks`))
+}
+
+// scanHooks reads the rows of a hooks query.
+func scanHooks(rows *sql.Rows, err error) ([]Hook, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Hook
+	for rows.Next() {
+		var hook Hook
+		if err := rows.Scan(&hook.ID, &hook.Name, &hook.Room, &hook.TokenHash, &hook.CreatedBy, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (r *SQLiteStore) SaveBot(bot Bot) error {
+	scopes, rooms, err := encodeBotLists(bot)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(
+		`INSERT INTO bots (name, scopes, rooms, key_hash, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET scopes = excluded.scopes, rooms = excluded.rooms, key_hash = excluded.key_hash`,
+		bot.Name, string(scopes), string(rooms), bot.KeyHash, bot.CreatedBy, bot.CreatedAt,
+	)
+	return err
+}
+
+func (r *SQLiteStore) DeleteBot(name string) error {
+	res, err := r.db.Exec(`DELETE FROM bots WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBotNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteStore) Bots() ([]Bot, error) {
+	return scanBots(r.db.Query(`SELECT name, scopes, rooms, key_hash, created_by, created_at FROM bots`))
+}
+
+// encodeBotLists encodes a bot's scopes and rooms for storage.
+func encodeBotLists(bot Bot) (scopes, rooms []byte, err error) {
+	if scopes, err = json.Marshal(bot.Scopes); err != nil {
+		return nil, nil, err
+	}
+	if rooms, err = json.Marshal(bot.Rooms); err != nil {
+		return nil, nil, err
+	}
+	return scopes, rooms, nil
+}
+
+// scanBots reads the rows of a bots query.
+func scanBots(rows *sql.Rows, err error) ([]Bot, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bots []Bot
+	for rows.Next() {
+		var bot Bot
+		var scopes, rooms []byte
+		if err := rows.Scan(&bot.Name, &scopes, &rooms, &bot.KeyHash, &bot.CreatedBy, &bot.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(scopes, &bot.Scopes); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(rooms, &bot.Rooms); err != nil {
+			return nil, err
+		}
+		bots = append(bots, bot)
+	}
+	return bots, rows.Err()
+}
+
+func (r *SQLiteStore) SaveRoom(room RoomRecord) error {
+	settings, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(
+		`INSERT INTO rooms (name, owner, settings, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET owner = excluded.owner, settings = excluded.settings`,
+		room.Name, room.Owner, string(settings), room.CreatedAt,
+	)
+	return err
+}
+
+func (r *SQLiteStore) DeleteRoom(name string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM room_members WHERE room = ?`, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM rooms WHERE name = ?`, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLiteStore) Rooms() ([]RoomRecord, error) {
+	return scanRooms(r.db.Query(`SELECT name, owner, settings, created_at FROM rooms`))
+}
+
+func (r *SQLiteStore) AddRoomMember(room, username string) error {
+	_, err := r.db.Exec(
+		`INSERT INTO room_members (room, username, joined_at) VALUES (?, ?, ?) ON CONFLICT (room, username) DO NOTHING`,
+		room, username, time.Now().UTC(),
+	)
+	return err
+}
+
+func (r *SQLiteStore) RemoveRoomMember(room, username string) error {
+	_, err := r.db.Exec(`DELETE FROM room_members WHERE room = ? AND username = ?`, room, username)
+	return err
+}
+
+func (r *SQLiteStore) RoomMembers() (map[string][]string, error) {
+	return scanRoomMembers(r.db.Query(`SELECT room, username FROM room_members`))
+}
+
+func (r *SQLiteStore) AddScheduled(msg ScheduledMessage) error {
+	_, err := r.db.Exec(
+		`INSERT INTO scheduled_messages (id, sender, room, content, reminder, send_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		msg.ID, msg.Sender, msg.Room, msg.Content, msg.Reminder, msg.At, msg.CreatedAt,
+	)
+	return err
+}
+
+func (r *SQLiteStore) RemoveScheduled(id string) error {
+	res, err := r.db.Exec(`DELETE FROM scheduled_messages WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrScheduledNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteStore) Scheduled() ([]ScheduledMessage, error) {
+	return scanScheduled(r.db.Query(`SELECT id, sender, room, content, reminder, send_at, created_at FROM scheduled_messages`))
+}
+
+// scanScheduled reads the rows of a scheduled_messages query.
+func scanScheduled(rows *sql.Rows, err error) ([]ScheduledMessage, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []ScheduledMessage
+	for rows.Next() {
+		var msg ScheduledMessage
+		if err := rows.Scan(&msg.ID, &msg.Sender, &msg.Room, &msg.Content, &msg.Reminder, &msg.At, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func (r *SQLiteStore) Index(msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var sentAt int64
+	if t, err := time.Parse(time.RFC3339Nano, msg.Timestamp); err == nil {
+		sentAt = t.UnixNano()
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM messages_fts WHERE room = ? AND message_id = ?`, msg.Room, msg.MessageID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO messages_fts (content, room, message_id, sender, sent_at, body) VALUES (?, ?, ?, ?, ?, ?)`,
+		msg.Content, msg.Room, msg.MessageID, msg.Sender, sentAt, string(body),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLiteStore) Remove(room, id string) error {
+	_, err := r.db.Exec(`DELETE FROM messages_fts WHERE room = ? AND message_id = ?`, room, id)
+	return err
+}
+
+func (r *SQLiteStore) Search(q SearchQuery) ([]Message, error) {
+	query := `SELECT body FROM messages_fts WHERE room = ?`
+	args := []any{q.Room}
+	if match := ftsQuery(q.Text); match != "" {
+		query += ` AND messages_fts MATCH ?`
+		args = append(args, match)
+	}
+	if q.Sender != "" {
+		query += ` AND sender = ?`
+		args = append(args, q.Sender)
+	}
+	if !q.Since.IsZero() {
+		query += ` AND sent_at >= ?`
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		query += ` AND sent_at <= ?`
+		args = append(args, q.Until.UnixNano())
+	}
+	query += ` ORDER BY message_id DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []Message
+	for rows.Next() {
+		var body string
+		if err := rows.Scan(&body); err != nil {
+			return nil, err
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(body), &msg); err != nil {
+			return nil, err
+		}
+		results = append(results, msg)
+	}
+	return results, rows.Err()
+}
+
+// ftsQuery turns keywords into an FTS5 query matching all of them, quoting
+// each so user input cannot use query syntax.
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// scanRooms reads the rows of a rooms query.
+func scanRooms(rows *sql.Rows, err error) ([]RoomRecord, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []RoomRecord
+	for rows.Next() {
+		var settings []byte
+		var name, owner string
+		var createdAt time.Time
+		if err := rows.Scan(&name, &owner, &settings, &createdAt); err != nil {
+			return nil, err
+		}
+		var room RoomRecord
+		if err := json.Unmarshal(settings, &room); err != nil {
+			return nil, err
+		}
+		room.Name, room.Owner, room.CreatedAt = name, owner, createdAt
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// scanRoomMembers reads the rows of a room_members query.
+func scanRoomMembers(rows *sql.Rows, err error) (map[string][]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[string][]string)
+	for rows.Next() {
+		var room, username string
+		if err := rows.Scan(&room, &username); err != nil {
+			return nil, err
+		}
+		members[room] = append(members[room], username)
+	}
+	return members, rows.Err()
+}
@@ -0,0 +1,131 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// handleRoomStreamHTTP serves GET /rooms/{name}/stream, the messages sent
+// to a room as Server-Sent Events, for clients that cannot use WebSockets.
+// The stream is read-only; messages are posted to /rooms/{name}/messages.
+// Browsers' EventSource cannot set headers, so the session token may be
+// given as the token parameter instead of a bearer token. The stream ends
+// when the user leaves the room.
+func (s *Server) handleRoomStreamHTTP(w http.ResponseWriter, r *http.Request) {
+	ip := s.clientIP(r)
+	if s.ipBanned(ip) {
+		writeFailure(w, Message{Type: "error", Code: CodeBanned, Content: "Your address has been banned"})
+		return
+	}
+	var username string
+	var ok bool
+	if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+		username, ok = s.authenticateToken(w, token)
+	} else {
+		username, ok = s.authenticateHTTP(w, r)
+	}
+	if !ok {
+		return
+	}
+
+	name := r.PathValue("name")
+	user := s.loadUser(username)
+	c := s.newCallClient(ip, "sse")
+	defer c.Close()
+
+	s.roomLock.Lock()
+	room, exists := s.rooms[name]
+	if !exists || !user.Rooms[name] {
+		s.roomLock.Unlock()
+		writeFailure(w, Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: name})
+		return
+	}
+	if room.watchers == nil {
+		room.watchers = make(map[*Client]*User)
+	}
+	room.watchers[c] = user
+	s.roomLock.Unlock()
+	defer func() {
+		s.roomLock.Lock()
+		delete(room.watchers, c)
+		s.roomLock.Unlock()
+	}()
+
+	// Streams are drained with the connections on shutdown.
+	s.connWG.Add(1)
+	defer s.connWG.Done()
+	s.connLock.Lock()
+	s.conns[c] = true
+	s.connLock.Unlock()
+	defer func() {
+		s.connLock.Lock()
+		delete(s.conns, c)
+		s.connLock.Unlock()
+	}()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep proxies such as nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		c.logger.Error("stream not flushable", "err", err)
+		return
+	}
+	c.logger.Info("room stream opened", "user", username, "room", name)
+	defer c.logger.Info("room stream closed", "user", username, "room", name)
+
+	// Comments keep idle streams from being timed out by proxies.
+	ping := time.NewTicker(s.keepalive.PingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case msg := <-c.send:
+			if err := writeEvent(w, msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-c.flush:
+			for {
+				select {
+				case msg := <-c.send:
+					if err := writeEvent(w, msg); err != nil {
+						return
+					}
+				default:
+					rc.Flush()
+					return
+				}
+			}
+		case <-c.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes msg as an event named for its type, with its sequence
+// number, if it has one, as the event ID.
+func writeEvent(w http.ResponseWriter, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if msg.Seq != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", msg.Seq); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type, data)
+	return err
+}
@@ -0,0 +1,185 @@
+package chatserver
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxStars caps how many messages one user can star.
+const maxStars = 500
+
+var ErrStarNotFound = errors.New("star not found")
+
+// Star records that a user saved a message.
+type Star struct {
+	Room      string    `json:"room"`
+	MessageID string    `json:"message_id"`
+	StarredAt time.Time `json:"starred_at"`
+}
+
+// StarredMessage is one entry of the Data of a starred reply.
+type StarredMessage struct {
+	Star
+	Message Message `json:"message"`
+}
+
+// StarStore keeps the messages each user has starred.
+type StarStore interface {
+	// AddStar stars a message for username; starring it again does
+	// nothing.
+	AddStar(username string, star Star) error
+	RemoveStar(username, room, messageID string) error
+	Stars(username string) ([]Star, error)
+}
+
+type starKey struct{ room, messageID string }
+
+// MemoryStarStore keeps stars in memory.
+type MemoryStarStore struct {
+	mu    sync.Mutex
+	stars map[string]map[starKey]Star
+}
+
+func NewMemoryStarStore() *MemoryStarStore {
+	return &MemoryStarStore{stars: make(map[string]map[starKey]Star)}
+}
+
+func (m *MemoryStarStore) AddStar(username string, star Star) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stars[username] == nil {
+		m.stars[username] = make(map[starKey]Star)
+	}
+	key := starKey{star.Room, star.MessageID}
+	if _, ok := m.stars[username][key]; !ok {
+		m.stars[username][key] = star
+	}
+	return nil
+}
+
+func (m *MemoryStarStore) RemoveStar(username, room, messageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := starKey{room, messageID}
+	if _, ok := m.stars[username][key]; !ok {
+		return ErrStarNotFound
+	}
+	delete(m.stars[username], key)
+	return nil
+}
+
+func (m *MemoryStarStore) Stars(username string) ([]Star, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stars := make([]Star, 0, len(m.stars[username]))
+	for _, star := range m.stars[username] {
+		stars = append(stars, star)
+	}
+	return stars, nil
+}
+
+// handleStar saves msg.MessageID in msg.Room to the sender's starred
+// messages.
+func (s *Server) handleStar(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	s.roomLock.Lock()
+	member := user.Rooms[msg.Room]
+	s.roomLock.Unlock()
+	if !member {
+		c.Reply(Message{Type: "error", Code: CodeNotMember, Content: "You are not in that room", Room: msg.Room})
+		return
+	}
+	stored, err := s.messages.Get(msg.Room, msg.MessageID)
+	if err != nil || stored.Deleted {
+		if err != nil && !errors.Is(err, ErrMessageNotFound) {
+			c.reqLogger.Error("load message", "message_id", msg.MessageID, "err", err)
+		}
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Message not found", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+
+	stars, err := s.stars.Stars(user.Username)
+	if err != nil {
+		c.reqLogger.Error("load stars", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not star message", Room: msg.Room})
+		return
+	}
+	if len(stars) >= maxStars {
+		c.Reply(Message{Type: "error", Code: CodeLimitExceeded, Content: "You have starred too many messages; unstar some first", Room: msg.Room})
+		return
+	}
+
+	star := Star{Room: msg.Room, MessageID: msg.MessageID, StarredAt: time.Now().UTC()}
+	if err := s.stars.AddStar(user.Username, star); err != nil {
+		c.reqLogger.Error("save star", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not star message", Room: msg.Room})
+		return
+	}
+	c.Reply(Message{Type: "info", Content: "Message starred", Room: msg.Room, MessageID: msg.MessageID})
+}
+
+// handleUnstar removes msg.MessageID in msg.Room from the sender's starred
+// messages.
+func (s *Server) handleUnstar(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	if err := s.stars.RemoveStar(user.Username, msg.Room, msg.MessageID); err != nil {
+		if !errors.Is(err, ErrStarNotFound) {
+			c.reqLogger.Error("remove star", "err", err)
+			c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not unstar message", Room: msg.Room})
+			return
+		}
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Message is not starred", Room: msg.Room, MessageID: msg.MessageID})
+		return
+	}
+	c.Reply(Message{Type: "info", Content: "Message unstarred", Room: msg.Room, MessageID: msg.MessageID})
+}
+
+// handleListStarred sends the sender their starred messages from every
+// room, most recently starred first. Messages since deleted or pruned are
+// left out.
+func (s *Server) handleListStarred(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	stars, err := s.stars.Stars(user.Username)
+	if err != nil {
+		c.reqLogger.Error("load stars", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not load starred messages"})
+		return
+	}
+	sort.Slice(stars, func(i, j int) bool { return stars[i].StarredAt.After(stars[j].StarredAt) })
+
+	starred := make([]StarredMessage, 0, len(stars))
+	for _, star := range stars {
+		stored, err := s.messages.Get(star.Room, star.MessageID)
+		if err != nil {
+			if !errors.Is(err, ErrMessageNotFound) {
+				c.reqLogger.Error("load message", "room", star.Room, "message_id", star.MessageID, "err", err)
+			}
+			continue
+		}
+		if stored.Deleted {
+			continue
+		}
+		starred = append(starred, StarredMessage{Star: star, Message: stored})
+	}
+	c.Reply(Message{Type: "starred", Data: starred})
+}
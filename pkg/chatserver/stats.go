@@ -0,0 +1,128 @@
+package chatserver
+
+import (
+	"sort"
+	"time"
+)
+
+// RoomInfo summarises a room for listings. Members counts everyone who has
+// joined, Online those connected to this instance.
+type RoomInfo struct {
+	Name        string   `json:"name"`
+	Owner       string   `json:"owner"`
+	Topic       string   `json:"topic,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Members     int      `json:"members"`
+	Online      int      `json:"online"`
+	Private     bool     `json:"private,omitempty"`
+	Protected   bool     `json:"protected,omitempty"`
+	InviteOnly  bool     `json:"invite_only,omitempty"`
+	Files       bool     `json:"files,omitempty"`
+	// SlowMode is the slow mode interval in seconds, or 0 if it is off.
+	SlowMode     int       `json:"slow_mode,omitempty"`
+	LastActivity time.Time `json:"last_activity"`
+	Permanent    bool      `json:"permanent,omitempty"`
+	Archived     bool      `json:"archived,omitempty"`
+}
+
+// Stats is a point-in-time snapshot of server activity.
+type Stats struct {
+	Connections int           `json:"connections"`
+	SignedIn    int           `json:"signed_in"`
+	Rooms       int           `json:"rooms"`
+	Uptime      time.Duration `json:"uptime"`
+}
+
+// info summarises the room, which members users have joined.
+func (r *Room) info(members int) RoomInfo {
+	return RoomInfo{
+		Name:         r.Name,
+		Owner:        r.Owner,
+		Topic:        r.Topic,
+		Description:  r.Description,
+		Tags:         r.Tags,
+		Members:      members,
+		Online:       len(r.Members),
+		Private:      r.Private,
+		Protected:    r.Protected(),
+		InviteOnly:   r.InviteOnly,
+		Files:        r.FilesEnabled,
+		SlowMode:     int(r.SlowMode.Seconds()),
+		LastActivity: r.LastActivity,
+		Permanent:    r.Permanent,
+		Archived:     r.Archived,
+	}
+}
+
+// Rooms returns every room, including private and archived ones, ordered by
+// name.
+func (s *Server) Rooms() []RoomInfo {
+	return s.roomInfos(true)
+}
+
+func (s *Server) roomInfos(private bool) []RoomInfo {
+	s.userLock.Lock()
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	s.userLock.Unlock()
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	members := make(map[string]int, len(s.rooms))
+	for _, u := range users {
+		for name := range u.Rooms {
+			members[name]++
+		}
+	}
+	infos := make([]RoomInfo, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		if (room.Private || room.Archived) && !private {
+			continue
+		}
+		infos = append(infos, room.info(members[room.Name]))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// OnlineUsers returns the usernames currently signed in, ordered by name.
+func (s *Server) OnlineUsers() []string {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+
+	seen := make(map[string]bool, len(s.clients))
+	names := make([]string, 0, len(s.clients))
+	for _, user := range s.clients {
+		if !seen[user.Username] {
+			seen[user.Username] = true
+			names = append(names, user.Username)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) Stats() Stats {
+	s.connLock.Lock()
+	conns := len(s.conns)
+	s.connLock.Unlock()
+
+	s.clientLock.Lock()
+	signedIn := len(s.clients)
+	s.clientLock.Unlock()
+
+	s.roomLock.Lock()
+	rooms := len(s.rooms)
+	s.roomLock.Unlock()
+
+	return Stats{
+		Connections: conns,
+		SignedIn:    signedIn,
+		Rooms:       rooms,
+		Uptime:      time.Since(s.started),
+	}
+}
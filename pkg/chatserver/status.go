@@ -0,0 +1,76 @@
+package chatserver
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+// User statuses, set with set_status.
+const (
+	StatusAvailable    = "available"
+	StatusAway         = "away"
+	StatusDoNotDisturb = "dnd"
+)
+
+// maxStatusText limits the text that may accompany a status.
+const maxStatusText = 140
+
+// handleSetStatus sets the sender's status to msg.Status, with msg.Content
+// as optional text, and tells the members of their rooms. Direct messages
+// to users in do-not-disturb are held until they change status.
+func (s *Server) handleSetStatus(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	switch msg.Status {
+	case StatusAvailable, StatusAway, StatusDoNotDisturb:
+	default:
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Status must be available, away or dnd"})
+		return
+	}
+	if utf8.RuneCountInString(msg.Content) > maxStatusText {
+		c.Reply(Message{Type: "error", Code: CodeTooLarge, Content: "Status text is too long"})
+		return
+	}
+
+	event := Message{
+		Type:      "status",
+		Sender:    user.Username,
+		Status:    msg.Status,
+		Content:   msg.Content,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	s.roomLock.Lock()
+	wasDND := user.Status == StatusDoNotDisturb
+	user.Status, user.StatusText = msg.Status, msg.Content
+	rooms := make([]string, 0, len(user.Rooms))
+	for name := range user.Rooms {
+		rooms = append(rooms, name)
+	}
+	s.deliverToRoommatesLocked(rooms, event)
+	s.roomLock.Unlock()
+	s.publish(brokerEvent{Kind: eventStatus, Message: event, Rooms: rooms})
+
+	c.Reply(Message{Type: "info", Content: "Status set to " + msg.Status, Status: msg.Status})
+	if wasDND && msg.Status != StatusDoNotDisturb {
+		s.deliverQueuedDMs(c, user)
+	}
+}
+
+// doNotDisturb reports whether username, as known to this instance, is in
+// do-not-disturb, so notifications for them should be held back.
+func (s *Server) doNotDisturb(username string) bool {
+	s.userLock.Lock()
+	user := s.users[username]
+	s.userLock.Unlock()
+	if user == nil {
+		return false
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+	return user.Status == StatusDoNotDisturb
+}
@@ -0,0 +1,288 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The Telegram bridge relays rooms to Telegram groups through bots. Room
+// messages are sent to the group by the bot, prefixed with their sender's
+// name, and the group's messages are fetched by long polling and posted to
+// the room with the Telegram user's name as the sender. Replies are carried
+// across both ways. The bot must be a member of the group, with privacy
+// mode turned off in @BotFather so that it sees every message.
+
+// TelegramBridge relays Room to the Telegram group ChatID through the bot
+// whose token is Token. APIURL is the Bot API server, by default
+// https://api.telegram.org.
+type TelegramBridge struct {
+	Room   string
+	Token  string
+	ChatID int64
+	APIURL string
+}
+
+const defaultTelegramAPI = "https://api.telegram.org"
+
+const (
+	// telegramPollWait is how long a getUpdates call waits for updates.
+	telegramPollWait = 25 * time.Second
+	// telegramTimeout bounds each Bot API call, including the wait.
+	telegramTimeout = telegramPollWait + 15*time.Second
+	// telegramRetry is how long polling pauses after a failure.
+	telegramRetry = 5 * time.Second
+	// maxTelegramText is the longest message Telegram accepts, in
+	// characters.
+	maxTelegramText = 4096
+)
+
+// telegramBot is a bot the bridge uses, polled once however many groups it
+// relays.
+type telegramBot struct {
+	api   string
+	token string
+}
+
+// telegramBridges is the state of the Telegram bridges. The maps are not
+// changed after they are set up.
+type telegramBridges struct {
+	byRoom map[string][]TelegramBridge
+	// rooms maps each bot's groups back to their rooms.
+	rooms  map[telegramBot]map[int64]string
+	client *http.Client
+	queue  chan Message
+	// ids pairs "chat/message ID" with "chat/Telegram message ID".
+	ids *bridgeIDs
+}
+
+func newTelegramBridges(bridges []TelegramBridge) *telegramBridges {
+	b := &telegramBridges{
+		byRoom: make(map[string][]TelegramBridge),
+		rooms:  make(map[telegramBot]map[int64]string),
+		client: &http.Client{Timeout: telegramTimeout},
+		queue:  make(chan Message, bridgeQueueSize),
+		ids:    newBridgeIDs(),
+	}
+	for _, bridge := range bridges {
+		if bridge.APIURL == "" {
+			bridge.APIURL = defaultTelegramAPI
+		}
+		b.byRoom[bridge.Room] = append(b.byRoom[bridge.Room], bridge)
+		bot := telegramBot{api: strings.TrimSuffix(bridge.APIURL, "/"), token: bridge.Token}
+		if b.rooms[bot] == nil {
+			b.rooms[bot] = make(map[int64]string)
+		}
+		b.rooms[bot][bridge.ChatID] = bridge.Room
+	}
+	return b
+}
+
+// telegramUser, telegramChat and telegramMessage hold the fields of the
+// Bot API's objects the bridge uses.
+type telegramUser struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+}
+
+type telegramChat struct {
+	ID int64 `json:"id"`
+}
+
+type telegramMessage struct {
+	MessageID      int64            `json:"message_id"`
+	From           *telegramUser    `json:"from"`
+	Chat           telegramChat     `json:"chat"`
+	Text           string           `json:"text"`
+	Caption        string           `json:"caption"`
+	ReplyToMessage *telegramMessage `json:"reply_to_message"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+// telegramKey identifies a message in a Telegram group, or the copy of a
+// local message sent there.
+func telegramKey(chatID int64, id string) string {
+	return strconv.FormatInt(chatID, 10) + "/" + id
+}
+
+// enqueue queues msg to be sent to its room's groups if it has any and it
+// did not come from Telegram. It reports false if the queue is full.
+func (b *telegramBridges) enqueue(msg Message) bool {
+	if msg.Bridge == "telegram" || len(b.byRoom[msg.Room]) == 0 {
+		return true
+	}
+	select {
+	case b.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// call calls the Bot API method with params as bot, decoding the result
+// into out.
+func (b *telegramBridges) call(ctx context.Context, bot telegramBot, method string, params, out any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, bot.api+"/bot"+bot.token+"/"+method, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// The error includes the URL, and with it the token.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("telegram %s: %s", method, resp.Status)
+	}
+	if !reply.OK {
+		return fmt.Errorf("telegram %s: %s", method, reply.Description)
+	}
+	return json.Unmarshal(reply.Result, out)
+}
+
+// send sends msg to the group of bridge, as a reply if the message it
+// answers is known there.
+func (b *telegramBridges) send(ctx context.Context, bridge TelegramBridge, msg Message) error {
+	text := msg.Sender + ": " + msg.Content
+	if utf8.RuneCountInString(text) > maxTelegramText {
+		text = string([]rune(text)[:maxTelegramText-1]) + "…"
+	}
+	params := map[string]any{"chat_id": bridge.ChatID, "text": text}
+	if msg.ReplyTo != "" {
+		if key := b.ids.remote(telegramKey(bridge.ChatID, msg.ReplyTo)); key != "" {
+			_, id, _ := strings.Cut(key, "/")
+			replyID, _ := strconv.ParseInt(id, 10, 64)
+			params["reply_parameters"] = map[string]any{"message_id": replyID, "allow_sending_without_reply": true}
+		}
+	}
+	bot := telegramBot{api: strings.TrimSuffix(bridge.APIURL, "/"), token: bridge.Token}
+	var sent telegramMessage
+	if err := b.call(ctx, bot, "sendMessage", params, &sent); err != nil {
+		return err
+	}
+	b.ids.add(telegramKey(bridge.ChatID, msg.MessageID), telegramKey(bridge.ChatID, strconv.FormatInt(sent.MessageID, 10)))
+	return nil
+}
+
+// runTelegram polls each bot and sends the messages queued for the
+// Telegram bridges until ctx is done.
+func (s *Server) runTelegram(ctx context.Context) {
+	b := s.telegram
+	for bot := range b.rooms {
+		go s.pollTelegram(ctx, bot)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-b.queue:
+			if msg.Sender == "" || msg.Content == "" || msg.Deleted {
+				continue
+			}
+			for _, bridge := range b.byRoom[msg.Room] {
+				if err := b.send(ctx, bridge, msg); err != nil {
+					s.logger.Warn("send to telegram", "room", msg.Room, "chat_id", bridge.ChatID, "message_id", msg.MessageID, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// pollTelegram fetches the messages sent to bot's groups until ctx is done,
+// posting them to their rooms.
+func (s *Server) pollTelegram(ctx context.Context, bot telegramBot) {
+	b := s.telegram
+	var offset int64
+	for {
+		var updates []telegramUpdate
+		params := map[string]any{
+			"offset":          offset,
+			"timeout":         int(telegramPollWait.Seconds()),
+			"allowed_updates": []string{"message"},
+		}
+		if err := b.call(ctx, bot, "getUpdates", params, &updates); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger.Warn("poll telegram", "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(telegramRetry):
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil {
+				s.relayTelegramMessage(bot, *u.Message)
+			}
+		}
+	}
+}
+
+// relayTelegramMessage posts m to the room its group is relayed to.
+func (s *Server) relayTelegramMessage(bot telegramBot, m telegramMessage) {
+	b := s.telegram
+	room, ok := b.rooms[bot][m.Chat.ID]
+	if !ok || m.From == nil {
+		return
+	}
+	text := m.Text
+	if text == "" {
+		text = m.Caption
+	}
+	if text == "" {
+		return
+	}
+	msg := Message{Room: room, Sender: telegramName(m.From), Bridge: "telegram", Content: text}
+	if r := m.ReplyToMessage; r != nil {
+		if local := b.ids.local(telegramKey(m.Chat.ID, strconv.FormatInt(r.MessageID, 10))); local != "" {
+			_, msg.ReplyTo, _ = strings.Cut(local, "/")
+		}
+	}
+
+	sent, err := s.relay(msg)
+	if err != nil {
+		s.logger.Warn("relay telegram message", "room", room, "chat_id", m.Chat.ID, "err", err)
+		return
+	}
+	b.ids.add(telegramKey(m.Chat.ID, sent.MessageID), telegramKey(m.Chat.ID, strconv.FormatInt(m.MessageID, 10)))
+}
+
+// telegramName is how a Telegram user is shown: their username, or else
+// their full name.
+func telegramName(u *telegramUser) string {
+	if u.Username != "" {
+		return u.Username
+	}
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
@@ -0,0 +1,347 @@
+package chatserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The line protocol lets people chat with nothing more than netcat or
+// telnet. Each line sent is a command, such as /login or /join, or text
+// for the current room; each line received describes one message. It is
+// plain TCP, so passwords cross the network unencrypted.
+
+const lineGreeting = "Welcome. Sign in with /login <name> <password>, or sign up with /signup <name> <password>. /help lists the commands.\r\n"
+
+const lineHelp = `commands:
+  /signup <name> <password>  create an account
+  /login <name> <password>   sign in
+  /join <room> [password]    join a room and make it current
+  /room <room>               switch to a room already joined
+  /leave [room]              leave the current room, or another
+  /rooms [search]            list public rooms
+  /who                       list who is online in the current room
+  /msg <user> <text>         send a direct message
+  /whois <user>              show whether a user is online
+  /quit                      disconnect
+anything else is sent to the current room`
+
+// lineFeatures are the optional events line clients are sent.
+var lineFeatures = map[string]bool{FeaturePresence: true}
+
+// lineSession is a line protocol connection. room is the current room and
+// belongs to the read loop.
+type lineSession struct {
+	c    *Client
+	room string
+}
+
+// serveLines accepts line protocol connections on lis until it is closed.
+func (s *Server) serveLines(lis net.Listener) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveLineConn(conn)
+	}
+}
+
+func (s *Server) serveLineConn(conn net.Conn) {
+	defer conn.Close()
+	var ip netip.Addr
+	if addr, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+		ip = addr.Addr().Unmap()
+	}
+	if s.ipBanned(ip) {
+		s.logger.Info("refused banned address", "ip", ip)
+		fmt.Fprint(conn, "! Your address has been banned\r\n")
+		return
+	}
+	if !s.acquireIP(ip) {
+		s.logger.Warn("too many connections", "ip", ip)
+		fmt.Fprint(conn, "! Too many connections\r\n")
+		return
+	}
+	defer s.releaseIP(ip)
+
+	c := s.newCallClient(ip, "line")
+	c.features.Store(&lineFeatures)
+	go s.writeLines(c, conn)
+	c.logger.Debug("connected")
+
+	s.connWG.Add(1)
+	defer s.connWG.Done()
+	defer s.disconnect(c)
+	defer c.Close()
+	s.connLock.Lock()
+	s.conns[c] = true
+	s.connLock.Unlock()
+
+	c.Send(Message{Type: "line", Content: lineGreeting})
+	ls := &lineSession{c: c}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, s.maxContent*utf8.UTFMax+readLimitSlack)
+	for scanner.Scan() {
+		c.lastMessage.Store(time.Now().UnixNano())
+		if quit := s.handleLine(ls, strings.TrimRight(scanner.Text(), "\r")); quit {
+			c.CloseAfterFlush()
+			<-c.done
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.logger.Info("read failed", "err", err)
+	}
+}
+
+// writeLines writes the client's messages to conn until it closes.
+func (s *Server) writeLines(c *Client, conn net.Conn) {
+	defer conn.Close()
+	check := time.NewTicker(c.keepalive.PingInterval)
+	defer check.Stop()
+
+	write := func(msg Message) error {
+		text := lineText(msg)
+		if text == "" {
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(c.keepalive.WriteTimeout))
+		_, err := fmt.Fprint(conn, text)
+		return err
+	}
+	for {
+		select {
+		case msg := <-c.send:
+			if err := write(msg); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.flush:
+			for {
+				select {
+				case msg := <-c.send:
+					if write(msg) != nil {
+						c.Close()
+						return
+					}
+				default:
+					c.Close()
+					return
+				}
+			}
+		case <-c.done:
+			return
+		case now := <-check.C:
+			if c.idle(now) {
+				c.logger.Info("connection idle, closing")
+				c.CloseAfterFlush()
+			}
+		}
+	}
+}
+
+// handleLine runs one line from the client, reporting whether it asked to
+// quit.
+func (s *Server) handleLine(ls *lineSession, line string) (quit bool) {
+	c := ls.c
+	if strings.TrimSpace(line) == "" {
+		return false
+	}
+	if !strings.HasPrefix(line, "/") {
+		if ls.room == "" {
+			c.Send(lineNote("join a room first (/join <room>)"))
+			return false
+		}
+		s.dispatch(c, Message{Type: "broadcast", Room: ls.room, Content: line}, nil)
+		return false
+	}
+
+	cmd, rest, _ := strings.Cut(line[1:], " ")
+	rest = strings.TrimSpace(rest)
+	args := strings.Fields(rest)
+	var msg Message
+	switch cmd {
+	case "signup", "login":
+		if len(args) != 2 {
+			c.Send(lineNote("usage: /" + cmd + " <name> <password>"))
+			return false
+		}
+		msg = Message{Type: "signin", Sender: args[0], Content: args[1]}
+		if cmd == "signup" {
+			msg.Type = "signup"
+		}
+	case "join":
+		if len(args) < 1 || len(args) > 2 {
+			c.Send(lineNote("usage: /join <room> [password]"))
+			return false
+		}
+		msg = Message{Type: "join_room", Content: args[0]}
+		if len(args) == 2 {
+			msg.Password = args[1]
+		}
+		// The room becomes current only once it has been joined.
+		s.dispatch(c, msg, nil)
+		if !c.failed {
+			ls.room = args[0]
+		}
+		return false
+	case "room":
+		if len(args) != 1 {
+			c.Send(lineNote("usage: /room <room>"))
+			return false
+		}
+		ls.room = args[0]
+		return false
+	case "leave":
+		room := ls.room
+		if len(args) == 1 {
+			room = args[0]
+		}
+		if room == "" {
+			c.Send(lineNote("usage: /leave [room]"))
+			return false
+		}
+		if room == ls.room {
+			ls.room = ""
+		}
+		msg = Message{Type: "leave_room", Content: room}
+	case "rooms":
+		msg = Message{Type: "list_rooms", Content: rest}
+	case "who":
+		if ls.room == "" {
+			c.Send(lineNote("join a room first (/join <room>)"))
+			return false
+		}
+		msg = Message{Type: "presence_query", Room: ls.room}
+	case "msg":
+		target, text, _ := strings.Cut(rest, " ")
+		if target == "" || strings.TrimSpace(text) == "" {
+			c.Send(lineNote("usage: /msg <user> <text>"))
+			return false
+		}
+		msg = Message{Type: "dm", Target: target, Content: strings.TrimSpace(text)}
+	case "whois":
+		if len(args) != 1 {
+			c.Send(lineNote("usage: /whois <user>"))
+			return false
+		}
+		msg = Message{Type: "whois", Target: args[0]}
+	case "quit":
+		return true
+	case "help":
+		c.Send(Message{Type: "line", Content: strings.ReplaceAll(lineHelp, "\n", "\r\n") + "\r\n"})
+		return false
+	default:
+		c.Send(lineNote("unknown command /" + cmd + "; /help lists the commands"))
+		return false
+	}
+	s.dispatch(c, msg, nil)
+	return false
+}
+
+// lineNote is a complaint about a line, shown like an error.
+func lineNote(text string) Message {
+	return Message{Type: "error", Content: text}
+}
+
+// lineSafe makes text from other users safe to write to a terminal: line
+// breaks and tabs become spaces and other control characters, which could
+// move the cursor or send escape sequences, are dropped.
+func lineSafe(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// lineText renders msg for a line client, or returns "" for messages they
+// are not shown.
+func lineText(msg Message) string {
+	if msg.Type == "line" {
+		return msg.Content
+	}
+	stamp := time.Now().Format("15:04:05")
+	if at, err := time.Parse(time.RFC3339Nano, msg.Timestamp); err == nil {
+		stamp = at.Local().Format("15:04:05")
+	}
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		for i, arg := range args {
+			if text, ok := arg.(string); ok {
+				args[i] = lineSafe(text)
+			}
+		}
+		fmt.Fprintf(&b, stamp+" "+format+"\r\n", args...)
+	}
+	inRoom := func(text string) string {
+		if msg.Room == "" {
+			return text
+		}
+		return "[" + msg.Room + "] " + text
+	}
+
+	switch msg.Type {
+	case "error":
+		line("! %s", inRoom(msg.Content))
+	case "info":
+		line("* %s", inRoom(msg.Content))
+	case "broadcast":
+		content := msg.Content
+		switch {
+		case msg.Deleted:
+			content = "(deleted)"
+		case msg.Edited:
+			content += " (edited)"
+		}
+		line("[%s] %s: %s", msg.Room, msg.Sender, content)
+	case "dm":
+		line("[dm] %s -> %s: %s", msg.Sender, msg.Target, msg.Content)
+	case "history":
+		var page []Message
+		msg.DecodeData(&page)
+		for _, m := range page {
+			b.WriteString(lineText(m))
+		}
+	case "presence":
+		line("* %s is %s", msg.Sender, msg.Content)
+	case "presence_list":
+		var online []string
+		msg.DecodeData(&online)
+		line("* [%s] online: %s", msg.Room, strings.Join(online, ", "))
+	case "rooms":
+		var page RoomPage
+		msg.DecodeData(&page)
+		line("* %d public rooms", len(page.Rooms))
+		for _, r := range page.Rooms {
+			fmt.Fprintf(&b, "    %s (%d members, %d online) %s\r\n", lineSafe(r.Name), r.Members, r.Online, lineSafe(r.Topic))
+		}
+	case "whois":
+		var info WhoisInfo
+		msg.DecodeData(&info)
+		switch {
+		case info.Online:
+			line("* %s is online", info.Username)
+		case info.LastSeen != nil:
+			line("* %s was last seen %s", info.Username, info.LastSeen.Local().Format(time.DateTime))
+		default:
+			line("* %s is offline", info.Username)
+		}
+	case "topic":
+		line("* [%s] %s set the topic: %s", msg.Room, msg.Sender, msg.Content)
+	case "server_shutdown", "room_archived", "room_deleted":
+		line("* %s", msg.Content)
+	}
+	return b.String()
+}
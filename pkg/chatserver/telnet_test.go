@@ -0,0 +1,59 @@
+package chatserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineTextEscapesControlCharacters(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+	}{
+		{"escape sequence in content", Message{Type: "broadcast", Room: "general", Sender: "alice", Content: "hi\x1b[2J\x1b]0;pwned\x07"}, "[general] alice: hi[2J]0;pwned"},
+		{"line break in content", Message{Type: "broadcast", Room: "general", Sender: "alice", Content: "one\r\ntwo"}, "[general] alice: one  two"},
+		{"control characters in sender", Message{Type: "dm", Sender: "al\x7fice\x08", Target: "bob", Content: "x"}, "[dm] alice -> bob: x"},
+		{"control characters in room", Message{Type: "info", Room: "gen\x1beral", Content: "Joined"}, "* [general] Joined"},
+		{"C1 control", Message{Type: "presence", Sender: "bob\u009b31m", Content: "online"}, "* bob31m is online"},
+		{"plain text untouched", Message{Type: "broadcast", Room: "café", Sender: "zoë", Content: "déjà vu 👋"}, "[café] zoë: déjà vu 👋"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lineText(tt.msg)
+			text, ok := strings.CutSuffix(got, "\r\n")
+			if !ok {
+				t.Fatalf("lineText = %q, want a line ending in CRLF", got)
+			}
+			// The line starts with the time it is shown.
+			if _, text, _ = strings.Cut(text, " "); text != tt.want {
+				t.Errorf("lineText = %q, want %q", text, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineJoinSetsRoomOnlyOnSuccess(t *testing.T) {
+	s := newTestServer(t)
+	owner := signIn(t, s, "bob")
+	mustDo(t, s, owner, Message{Type: "create_room", Content: "general"})
+	mustDo(t, s, owner, Message{Type: "create_room", Content: "secret", Password: "hunter2"})
+
+	ls := &lineSession{c: signIn(t, s, "alice")}
+	steps := []struct {
+		line string
+		want string
+	}{
+		{"/join general", "general"},
+		{"/join nowhere", "general"},
+		{"/join secret wrong", "general"},
+		{"/join secret hunter2", "secret"},
+	}
+	for _, step := range steps {
+		s.handleLine(ls, step.line)
+		drain(ls.c)
+		if ls.room != step.want {
+			t.Errorf("after %q current room is %q, want %q", step.line, ls.room, step.want)
+		}
+	}
+}
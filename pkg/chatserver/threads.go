@@ -0,0 +1,67 @@
+package chatserver
+
+import (
+	"errors"
+)
+
+// resolveThread fills in msg.ThreadID from the message it replies to, so
+// every reply in a thread carries the ID of the thread's root message. It
+// reports errors to c.
+func (s *Server) resolveThread(c *Client, msg *Message) bool {
+	msg.ThreadID = ""
+	if msg.ReplyTo == "" {
+		return true
+	}
+
+	parent, err := s.messages.Get(msg.Room, msg.ReplyTo)
+	if err != nil {
+		if !errors.Is(err, ErrMessageNotFound) {
+			c.reqLogger.Error("resolve thread", "err", err)
+		}
+		c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "Reply target not found", Room: msg.Room, MessageID: msg.ReplyTo})
+		return false
+	}
+
+	msg.ThreadID = parent.ThreadID
+	if msg.ThreadID == "" {
+		msg.ThreadID = parent.MessageID
+	}
+	return true
+}
+
+// handleGetThread returns the root message of a thread and all of its
+// replies, oldest first, in Data.
+func (s *Server) handleGetThread(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+
+	threadID := msg.ThreadID
+	if threadID == "" {
+		threadID = msg.MessageID
+	}
+	root, ok := s.lookupMessage(c, user, Message{Room: msg.Room, MessageID: threadID})
+	if !ok {
+		return
+	}
+	if root.ThreadID != "" {
+		threadID = root.ThreadID
+	}
+
+	messages, err := s.messages.Messages(msg.Room)
+	if err != nil {
+		c.reqLogger.Error("load thread", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not load thread", Room: msg.Room})
+		return
+	}
+
+	var thread []Message
+	for _, m := range messages {
+		if m.MessageID == threadID || m.ThreadID == threadID {
+			thread = append(thread, m)
+		}
+	}
+	c.Send(Message{Type: "thread", Room: msg.Room, ThreadID: threadID, Data: thread})
+}
@@ -0,0 +1,353 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Messages are translated by a Translator, such as DeepL or LibreTranslate,
+// when the server has one. A member asks for one message in their language
+// with /translate; members who turned on auto-translation with
+// set_translate are sent every room message in theirs as it is posted.
+// Translations are kept on the stored message, by language, so that each
+// is made once and history carries them alongside the original.
+
+const (
+	// translateTimeout bounds one call to the translation provider.
+	translateTimeout = 10 * time.Second
+	// maxTranslations caps the messages being auto-translated at once;
+	// messages posted while it is reached go untranslated.
+	maxTranslations = 8
+)
+
+// languageCode matches the language codes translations are asked for in,
+// such as de or pt-br.
+var languageCode = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]{2,4})?$`)
+
+// Translator translates text into the language target, a lowercase code
+// such as de or pt-br, detecting the language it is written in.
+type Translator interface {
+	Translate(ctx context.Context, text, target string) (Translation, error)
+}
+
+// Translation is text translated into Lang from Source, which is empty if
+// the provider did not say.
+type Translation struct {
+	Lang   string `json:"lang"`
+	Source string `json:"source,omitempty"`
+	Text   string `json:"text"`
+}
+
+// sameLanguage reports whether a translation into target from source
+// would change nothing, such as en into en-gb.
+func sameLanguage(source, target string) bool {
+	source, target = strings.ToLower(source), strings.ToLower(target)
+	if source == "" {
+		return false
+	}
+	base, _, _ := strings.Cut(target, "-")
+	return source == target || source == base
+}
+
+var translateClient = &http.Client{Timeout: translateTimeout}
+
+// postJSON posts body to url with header set, decoding the answer into out.
+// An answer other than 200 OK is an error, described by errMessage if it
+// finds a description in the answer's body.
+func postJSON(ctx context.Context, url string, header http.Header, body, out any, errMessage func([]byte) string) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := translateClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var raw bytes.Buffer
+	if _, err := raw.ReadFrom(resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if msg := errMessage(raw.Bytes()); msg != "" {
+			return errors.New(msg)
+		}
+		return errors.New(resp.Status)
+	}
+	return json.Unmarshal(raw.Bytes(), out)
+}
+
+// DeepLTranslator translates with the DeepL API. APIURL defaults to the
+// free API for keys ending in :fx and the paid one for others.
+type DeepLTranslator struct {
+	APIURL string
+	APIKey string
+}
+
+func (d DeepLTranslator) Translate(ctx context.Context, text, target string) (Translation, error) {
+	api := d.APIURL
+	switch {
+	case api != "":
+	case strings.HasSuffix(d.APIKey, ":fx"):
+		api = "https://api-free.deepl.com"
+	default:
+		api = "https://api.deepl.com"
+	}
+	header := http.Header{"Authorization": {"DeepL-Auth-Key " + d.APIKey}}
+	body := map[string]any{"text": []string{text}, "target_lang": strings.ToUpper(target)}
+	var reply struct {
+		Translations []struct {
+			DetectedSourceLanguage string `json:"detected_source_language"`
+			Text                   string `json:"text"`
+		} `json:"translations"`
+	}
+	err := postJSON(ctx, strings.TrimSuffix(api, "/")+"/v2/translate", header, body, &reply, func(raw []byte) string {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(raw, &e)
+		return e.Message
+	})
+	if err != nil {
+		return Translation{}, fmt.Errorf("deepl: %w", err)
+	}
+	if len(reply.Translations) == 0 {
+		return Translation{}, errors.New("deepl: no translation")
+	}
+	t := reply.Translations[0]
+	return Translation{Lang: target, Source: strings.ToLower(t.DetectedSourceLanguage), Text: t.Text}, nil
+}
+
+// LibreTranslator translates with a LibreTranslate server at APIURL. APIKey
+// is only needed by servers that ask for one.
+type LibreTranslator struct {
+	APIURL string
+	APIKey string
+}
+
+func (l LibreTranslator) Translate(ctx context.Context, text, target string) (Translation, error) {
+	body := map[string]any{"q": text, "source": "auto", "target": target, "format": "text"}
+	if l.APIKey != "" {
+		body["api_key"] = l.APIKey
+	}
+	var reply struct {
+		TranslatedText   string `json:"translatedText"`
+		DetectedLanguage struct {
+			Language string `json:"language"`
+		} `json:"detectedLanguage"`
+	}
+	err := postJSON(ctx, strings.TrimSuffix(l.APIURL, "/")+"/translate", http.Header{}, body, &reply, func(raw []byte) string {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(raw, &e)
+		return e.Error
+	})
+	if err != nil {
+		return Translation{}, fmt.Errorf("libretranslate: %w", err)
+	}
+	return Translation{Lang: target, Source: reply.DetectedLanguage.Language, Text: reply.TranslatedText}, nil
+}
+
+// translateMessage returns the translation of the stored message msg into
+// lang, making it and keeping it on the message if it has none yet.
+func (s *Server) translateMessage(ctx context.Context, msg Message, lang string) (Translation, error) {
+	if text, ok := msg.Translations[lang]; ok {
+		t := Translation{Lang: lang, Text: text}
+		// A message already in lang is kept as it is.
+		if text == msg.Content {
+			t.Source = lang
+		}
+		return t, nil
+	}
+	t, err := s.translator.Translate(ctx, msg.Content, lang)
+	if err != nil {
+		return t, err
+	}
+	if sameLanguage(t.Source, lang) {
+		t.Text = msg.Content
+	}
+
+	s.messageLock.Lock()
+	defer s.messageLock.Unlock()
+	stored, err := s.messages.Get(msg.Room, msg.MessageID)
+	if err != nil || stored.Deleted || stored.Content != msg.Content {
+		return t, nil
+	}
+	stored.Translations = maps.Clone(stored.Translations)
+	if stored.Translations == nil {
+		stored.Translations = make(map[string]string)
+	}
+	stored.Translations[lang] = t.Text
+	if err := s.messages.Update(stored); err != nil {
+		s.logger.Error("store translation", "room", msg.Room, "message_id", msg.MessageID, "err", err)
+	}
+	return t, nil
+}
+
+// scheduleTranslationsLocked sends msg, just posted, translated to each
+// member of its room connected here who asked for messages in another
+// language. The caller must hold roomLock.
+func (s *Server) scheduleTranslationsLocked(msg Message) {
+	if s.translator == nil || msg.Deleted || msg.Content == "" || msg.Encrypted != nil {
+		return
+	}
+	room, ok := s.rooms[msg.Room]
+	if !ok {
+		return
+	}
+	wanted := make(map[string][]string)
+	for _, u := range room.Members {
+		if u.TranslateTo != "" && u.Username != msg.Sender && u.Online() {
+			wanted[u.TranslateTo] = append(wanted[u.TranslateTo], u.Username)
+		}
+	}
+	if len(wanted) == 0 {
+		return
+	}
+	select {
+	case s.translateSlots <- struct{}{}:
+	default:
+		s.logger.Warn("translation skipped, too many in progress", "room", msg.Room, "message_id", msg.MessageID)
+		return
+	}
+
+	go func() {
+		defer func() { <-s.translateSlots }()
+		for lang, usernames := range wanted {
+			ctx, cancel := context.WithTimeout(context.Background(), translateTimeout)
+			t, err := s.translateMessage(ctx, msg, lang)
+			cancel()
+			if err != nil {
+				s.logger.Warn("translate message", "room", msg.Room, "message_id", msg.MessageID, "lang", lang, "err", err)
+				continue
+			}
+			if sameLanguage(t.Source, lang) {
+				continue
+			}
+			for _, username := range usernames {
+				s.sendTo(username, translationEvent(msg, t))
+			}
+		}
+	}()
+}
+
+// translationEvent tells a member the translation t of msg.
+func translationEvent(msg Message, t Translation) Message {
+	event := Message{Type: "translation", Sender: msg.Sender, Room: msg.Room, MessageID: msg.MessageID, Content: t.Text, Data: t}
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	return event
+}
+
+// commandTranslate translates a message of the room, "<lang> <message-id>",
+// or some text, "<lang> <text>", for the user alone.
+func (s *Server) commandTranslate(c *Client, user *User, msg Message, args string) {
+	if s.translator == nil {
+		c.Reply(Message{Type: "error", Code: CodeDisabled, Content: "The server cannot translate messages", Room: msg.Room})
+		return
+	}
+	lang, rest, _ := strings.Cut(args, " ")
+	lang, rest = strings.ToLower(lang), strings.TrimSpace(rest)
+	if !languageCode.MatchString(lang) || rest == "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Usage: /translate <language> <message-id or text>, such as /translate de hello", Room: msg.Room})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), translateTimeout)
+	defer cancel()
+	target := Message{Room: msg.Room, Sender: user.Username, Content: rest}
+	stored, err := s.messages.Get(msg.Room, rest)
+	switch {
+	case err == nil && stored.Deleted:
+		c.Reply(Message{Type: "error", Code: CodeGone, Content: "Message was deleted", Room: msg.Room, MessageID: rest})
+		return
+	case err == nil && stored.Encrypted != nil:
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Encrypted messages cannot be translated", Room: msg.Room, MessageID: rest})
+		return
+	case err == nil:
+		target = stored
+	case !errors.Is(err, ErrMessageNotFound):
+		c.reqLogger.Error("load message", "message_id", rest, "err", err)
+	}
+
+	var t Translation
+	if target.MessageID != "" {
+		t, err = s.translateMessage(ctx, target, lang)
+	} else {
+		t, err = s.translator.Translate(ctx, target.Content, lang)
+	}
+	if err != nil {
+		c.reqLogger.Warn("translate", "lang", lang, "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not translate", Room: msg.Room})
+		return
+	}
+	c.Reply(translationEvent(target, t))
+}
+
+// handleSetTranslate turns on automatic translation of room messages into
+// the language msg.Content, or turns it off with "off".
+func (s *Server) handleSetTranslate(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		c.Reply(Message{Type: "error", Code: CodeUnauthenticated, Content: "You must sign in first"})
+		return
+	}
+	lang := strings.ToLower(msg.Content)
+	if lang == "off" {
+		lang = ""
+	} else if !languageCode.MatchString(lang) {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Translate must be a language code, such as de or pt-br, or off"})
+		return
+	}
+	if lang != "" && s.translator == nil {
+		c.Reply(Message{Type: "error", Code: CodeDisabled, Content: "The server cannot translate messages"})
+		return
+	}
+
+	account, err := s.accounts.Find(user.Username)
+	if err == nil {
+		account.TranslateTo = lang
+		err = s.accounts.Update(account)
+	}
+	if err != nil {
+		s.sendAccountError(c, err)
+		return
+	}
+	s.roomLock.Lock()
+	user.TranslateTo = lang
+	s.roomLock.Unlock()
+	if lang == "" {
+		c.Reply(Message{Type: "info", Content: "Automatic translation turned off"})
+	} else {
+		c.Reply(Message{Type: "info", Content: "Room messages will be translated to " + lang})
+	}
+}
+
+// loadTranslateTo caches the language user has room messages translated to.
+func (s *Server) loadTranslateTo(user *User) {
+	if s.translator == nil {
+		return
+	}
+	account, err := s.accounts.Find(user.Username)
+	if err != nil {
+		return
+	}
+	s.roomLock.Lock()
+	user.TranslateTo = account.TranslateTo
+	s.roomLock.Unlock()
+}
@@ -0,0 +1,37 @@
+package chatserver
+
+import "time"
+
+// typingInterval is the minimum gap between typing notifications fanned out
+// for the same user and room; clients typically resend while keys are held.
+const typingInterval = 2 * time.Second
+
+// handleTyping tells the other members of a room that the sender is typing.
+// Typing events are rate-limited and never persisted.
+func (s *Server) handleTyping(c *Client, msg Message) {
+	user := s.userOf(c)
+	if user == nil {
+		return
+	}
+
+	s.roomLock.Lock()
+	defer s.roomLock.Unlock()
+
+	room, exists := s.rooms[msg.Room]
+	if !exists || !user.Rooms[room.Name] {
+		return
+	}
+
+	now := time.Now()
+	if last, ok := user.lastTyping[room.Name]; ok && now.Sub(last) < typingInterval {
+		return
+	}
+	user.lastTyping[room.Name] = now
+
+	event := Message{Type: "typing", Sender: user.Username, Room: room.Name}
+	for _, u := range room.Members {
+		if u != user {
+			u.Send(event)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package chatserver
+
+import (
+	"errors"
+	"slices"
+	"sort"
+)
+
+// RoomUnread counts the messages in a room that a user has not read: those
+// from others after their read marker, or all of them if they have none.
+type RoomUnread struct {
+	Room     string `json:"room"`
+	Unread   int    `json:"unread"`
+	Mentions int    `json:"mentions,omitempty"`
+	// LastSeq is the sequence number of the room's latest message.
+	LastSeq uint64 `json:"last_seq,omitempty"`
+}
+
+// SyncState is the Data of the sync message sent at signin and resume, so
+// clients can show what is waiting without replaying history.
+type SyncState struct {
+	Unread []RoomUnread `json:"unread"`
+}
+
+// unreadIn counts the messages in room that user has not read, given the
+// ID of the last one they read, if any.
+func (s *Server) unreadIn(username, room, readID string) (RoomUnread, error) {
+	counts := RoomUnread{Room: room}
+
+	var since uint64
+	if readID != "" {
+		read, err := s.messages.Get(room, readID)
+		switch {
+		case err == nil:
+			since = read.Seq
+		case !errors.Is(err, ErrMessageNotFound):
+			return counts, err
+		}
+		// A marker on a message since pruned leaves everything kept unread.
+	}
+
+	messages, err := s.messages.Since(room, since, 0)
+	if err != nil {
+		return counts, err
+	}
+	for _, m := range messages {
+		counts.LastSeq = m.Seq
+		if m.Deleted || m.Sender == username {
+			continue
+		}
+		counts.Unread++
+		if slices.Contains(m.Mentions, username) {
+			counts.Mentions++
+		}
+	}
+	return counts, nil
+}
+
+// sendSyncState tells c how many unread messages user has in each of rooms.
+func (s *Server) sendSyncState(c *Client, user *User, rooms []string) {
+	markers, err := s.readMarkers.ReadMarkers(user.Username)
+	if err != nil {
+		c.reqLogger.Error("load read markers", "err", err)
+		return
+	}
+
+	state := SyncState{Unread: make([]RoomUnread, 0, len(rooms))}
+	for _, room := range rooms {
+		counts, err := s.unreadIn(user.Username, room, markers[room])
+		if err != nil {
+			c.reqLogger.Error("count unread", "room", room, "err", err)
+			continue
+		}
+		state.Unread = append(state.Unread, counts)
+	}
+	sort.Slice(state.Unread, func(i, j int) bool { return state.Unread[i].Room < state.Unread[j].Room })
+	c.Send(Message{Type: "sync", Data: state})
+}
@@ -0,0 +1,132 @@
+package chatserver
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+// Account is the persisted form of a user.
+type Account struct {
+	Username     string
+	PasswordHash []byte
+	Admin        bool
+	Disabled     bool
+	// LastSeen is when the user last signed in or went offline; it is zero
+	// if they never have. HideLastSeen keeps it from other users.
+	// TranslateTo is the language they have room messages translated to,
+	// if any. PasswordChangedAt is when they last changed their password,
+	// zero if they never have.
+	LastSeen          time.Time
+	HideLastSeen      bool
+	TranslateTo       string
+	PasswordChangedAt time.Time
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+// UserRepository stores accounts. Create returns ErrUserExists for duplicate
+// usernames; Find, Update and Delete return ErrUserNotFound for unknown ones.
+type UserRepository interface {
+	Create(account *Account) error
+	Find(username string) (*Account, error)
+	Update(account *Account) error
+	Delete(username string) error
+	// List returns all accounts ordered by username.
+	List() ([]*Account, error)
+	// SetLastSeen records when username was last online. Update does not
+	// change it.
+	SetLastSeen(username string, at time.Time) error
+}
+
+// MemoryUserRepository keeps accounts in memory. It is used in tests and
+// when no database is configured.
+type MemoryUserRepository struct {
+	mu       sync.RWMutex
+	accounts map[string]Account
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{accounts: make(map[string]Account)}
+}
+
+func (r *MemoryUserRepository) Create(account *Account) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.accounts[account.Username]; exists {
+		return ErrUserExists
+	}
+
+	now := time.Now().UTC()
+	account.CreatedAt = now
+	account.UpdatedAt = now
+	r.accounts[account.Username] = *account
+	return nil
+}
+
+func (r *MemoryUserRepository) Find(username string) (*Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	account, exists := r.accounts[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	return &account, nil
+}
+
+func (r *MemoryUserRepository) Update(account *Account) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, exists := r.accounts[account.Username]
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	account.LastSeen = stored.LastSeen
+	account.UpdatedAt = time.Now().UTC()
+	r.accounts[account.Username] = *account
+	return nil
+}
+
+func (r *MemoryUserRepository) SetLastSeen(username string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	account, exists := r.accounts[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	account.LastSeen = at.UTC()
+	r.accounts[username] = account
+	return nil
+}
+
+func (r *MemoryUserRepository) Delete(username string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.accounts[username]; !exists {
+		return ErrUserNotFound
+	}
+	delete(r.accounts, username)
+	return nil
+}
+
+func (r *MemoryUserRepository) List() ([]*Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	accounts := make([]*Account, 0, len(r.accounts))
+	for _, account := range r.accounts {
+		account := account
+		accounts = append(accounts, &account)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Username < accounts[j].Username })
+	return accounts, nil
+}
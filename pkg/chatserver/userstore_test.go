@@ -0,0 +1,108 @@
+package chatserver
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMemoryUserRepository(t *testing.T) {
+	tests := []struct {
+		name    string
+		run     func(r *MemoryUserRepository) error
+		wantErr error
+	}{
+		{"create new", func(r *MemoryUserRepository) error {
+			return r.Create(&Account{Username: "bob"})
+		}, nil},
+		{"create duplicate", func(r *MemoryUserRepository) error {
+			return r.Create(&Account{Username: "alice"})
+		}, ErrUserExists},
+		{"find unknown", func(r *MemoryUserRepository) error {
+			_, err := r.Find("bob")
+			return err
+		}, ErrUserNotFound},
+		{"update unknown", func(r *MemoryUserRepository) error {
+			return r.Update(&Account{Username: "bob"})
+		}, ErrUserNotFound},
+		{"delete unknown", func(r *MemoryUserRepository) error {
+			return r.Delete("bob")
+		}, ErrUserNotFound},
+		{"set last seen unknown", func(r *MemoryUserRepository) error {
+			return r.SetLastSeen("bob", time.Now())
+		}, ErrUserNotFound},
+		{"delete", func(r *MemoryUserRepository) error {
+			if err := r.Delete("alice"); err != nil {
+				return err
+			}
+			_, err := r.Find("alice")
+			return err
+		}, ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewMemoryUserRepository()
+			if err := r.Create(&Account{Username: "alice"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.run(r); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryUserRepositoryUpdate(t *testing.T) {
+	r := NewMemoryUserRepository()
+	account := &Account{Username: "alice"}
+	if err := r.Create(account); err != nil {
+		t.Fatal(err)
+	}
+	if account.CreatedAt.IsZero() || !account.UpdatedAt.Equal(account.CreatedAt) {
+		t.Errorf("Create set CreatedAt %v, UpdatedAt %v", account.CreatedAt, account.UpdatedAt)
+	}
+	seen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := r.SetLastSeen("alice", seen); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find hands out copies; changes only stick through Update, which
+	// leaves LastSeen alone.
+	found, _ := r.Find("alice")
+	found.Admin = true
+	found.LastSeen = time.Time{}
+	if again, _ := r.Find("alice"); again.Admin {
+		t.Error("change to a found account stored without Update")
+	}
+	if err := r.Update(found); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := r.Find("alice")
+	if !got.Admin {
+		t.Error("Update did not store Admin")
+	}
+	if !got.LastSeen.Equal(seen) {
+		t.Errorf("LastSeen = %v after Update, want %v", got.LastSeen, seen)
+	}
+}
+
+func TestMemoryUserRepositoryList(t *testing.T) {
+	r := NewMemoryUserRepository()
+	for _, name := range []string{"carol", "alice", "bob"} {
+		if err := r.Create(&Account{Username: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accounts, err := r.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, account := range accounts {
+		names = append(names, account.Username)
+	}
+	if want := []string{"alice", "bob", "carol"}; !slices.Equal(names, want) {
+		t.Errorf("List = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,245 @@
+package chatserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// defaultMaxContent is the default limit on the length of Content, in
+	// characters.
+	defaultMaxContent = 4000
+	// maxNameLength limits usernames, room names and other identifiers.
+	maxNameLength = 64
+	// maxTopicLength and maxDescriptionLength limit room topics and
+	// descriptions, in characters.
+	maxTopicLength       = 200
+	maxDescriptionLength = 1000
+	// maxPasswordBytes is the most bcrypt will hash.
+	maxPasswordBytes = 72
+	// readLimitSlack is how many bytes a client frame may hold beyond the
+	// longest allowed Content.
+	readLimitSlack = 16 << 10
+)
+
+// FieldError describes one problem with a field of a client message. A
+// list of them is the Data of the error sent for an invalid message.
+type FieldError struct {
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+// requiredFields lists, by message type, the fields that must not be
+// empty. Types registered with Handle that are not listed only have their
+// sizes checked.
+var requiredFields = map[string][]string{
+	"signup":               {"sender", "content"},
+	"signin":               {"sender", "content"},
+	"resume":               {"content"},
+	"change_password":      {"password", "content"},
+	"reset_password":       {"password", "content"},
+	"create_room":          {"content"},
+	"join_room":            {"content"},
+	"grant_moderator":      {"room", "target"},
+	"revoke_moderator":     {"room", "target"},
+	"kick":                 {"room", "target"},
+	"ban":                  {"room", "target"},
+	"unban":                {"room", "target"},
+	"set_topic":            {"room"},
+	"set_description":      {"room"},
+	"set_tags":             {"room"},
+	"set_slow_mode":        {"room", "content"},
+	"set_filter":           {"room", "content"},
+	"set_fun":              {"room", "content"},
+	"set_assistant":        {"room", "content"},
+	"set_invite_only":      {"room", "content"},
+	"create_invite":        {"room"},
+	"revoke_invite":        {"room", "content"},
+	"list_invites":         {"room"},
+	"pin":                  {"room", "message_id"},
+	"unpin":                {"room", "message_id"},
+	"get_pins":             {"room"},
+	"admin_disable_user":   {"target"},
+	"admin_enable_user":    {"target"},
+	"admin_signout_user":   {"target"},
+	"admin_delete_user":    {"target"},
+	"admin_reset_password": {"target"},
+	"admin_ban_ip":         {"target"},
+	"admin_unban_ip":       {"target"},
+	"admin_set_permanent":  {"room", "content"},
+	"admin_remove_webhook": {"target"},
+	"admin_remove_hook":    {"target"},
+	"admin_rotate_bot_key": {"target"},
+	"unregister_command":   {"content"},
+	"vote":                 {"room", "message_id", "content"},
+	"close_poll":           {"room", "message_id"},
+	"typing":               {"room"},
+	"presence_query":       {"room"},
+	"room_members":         {"room"},
+	"whois":                {"target"},
+	"set_last_seen":        {"content"},
+	"set_translate":        {"content"},
+	"set_status":           {"status"},
+	"read":                 {"message_id"},
+	"forward":              {"room", "message_id", "target"},
+	"set_files":            {"room", "content"},
+	"file_offer":           {"room"},
+	"file_chunk":           {"room", "content"},
+	"file_complete":        {"room"},
+	"star":                 {"room", "message_id"},
+	"unstar":               {"room", "message_id"},
+	"schedule":             {"content"},
+	"cancel_scheduled":     {"content"},
+	"edit":                 {"room", "message_id", "content"},
+	"delete":               {"room", "message_id"},
+	"reaction_add":         {"room", "message_id", "content"},
+	"reaction_remove":      {"room", "message_id", "content"},
+	"get_thread":           {"room"},
+	"sync":                 {"room"},
+	"history":              {"room"},
+	"search":               {"room"},
+	"set_retention":        {"room"},
+	"set_rate_limit":       {"room", "content"},
+	"broadcast":            {"room", "content"},
+	"dm":                   {"target", "content"},
+	"publish_key":          {"content"},
+	"get_key":              {"target"},
+	"encrypted_dm":         {"target"},
+}
+
+// validate checks msg against the limits on field sizes and the fields its
+// type requires.
+func (s *Server) validate(msg Message) []FieldError {
+	var problems []FieldError
+	fail := func(field, format string, args ...any) {
+		problems = append(problems, FieldError{Field: field, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	for _, field := range requiredFields[msg.Type] {
+		if strings.TrimSpace(fieldValue(msg, field)) == "" {
+			fail(field, "is required")
+		}
+	}
+
+	content := msg.Content
+	if msg.Type == "signup" || msg.Type == "signin" || msg.Type == "change_password" || msg.Type == "reset_password" {
+		// The password travels in Content for these.
+		if len(content) > maxPasswordBytes {
+			fail("content", "is longer than %d bytes", maxPasswordBytes)
+		}
+	} else if n := utf8.RuneCountInString(content); n > s.maxContent {
+		fail("content", "is longer than %d characters", s.maxContent)
+	}
+	for _, field := range []string{"sender", "target", "room", "status", "message_id", "reply_to", "thread_id", "cursor", "invite"} {
+		if utf8.RuneCountInString(fieldValue(msg, field)) > maxNameLength {
+			fail(field, "is longer than %d characters", maxNameLength)
+		}
+	}
+	if len(msg.Password) > maxPasswordBytes {
+		fail("password", "is longer than %d bytes", maxPasswordBytes)
+	}
+	if msg.Limit < 0 {
+		fail("limit", "must not be negative")
+	}
+	if msg.Format != "" && msg.Format != FormatPlain && msg.Format != FormatMarkdown {
+		fail("format", "must be %s or %s", FormatPlain, FormatMarkdown)
+	}
+	return problems
+}
+
+// decodeMessage parses a client frame, rejecting fields Message does not
+// have. On failure msg holds whatever was decoded before the problem.
+func decodeMessage(data []byte) (msg Message, problems []FieldError) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&msg)
+	if err == nil && dec.More() {
+		err = errors.New("trailing data")
+	}
+	if err == nil {
+		return msg, nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr):
+		return msg, []FieldError{{Field: typeErr.Field, Problem: "must be a " + typeErr.Type.String()}}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return msg, []FieldError{{Field: field, Problem: "is not a known field"}}
+	default:
+		return msg, []FieldError{{Problem: "message is not a valid JSON object"}}
+	}
+}
+
+func fieldValue(msg Message, field string) string {
+	switch field {
+	case "sender":
+		return msg.Sender
+	case "target":
+		return msg.Target
+	case "content":
+		return msg.Content
+	case "room":
+		return msg.Room
+	case "status":
+		return msg.Status
+	case "message_id":
+		return msg.MessageID
+	case "reply_to":
+		return msg.ReplyTo
+	case "thread_id":
+		return msg.ThreadID
+	case "cursor":
+		return msg.Cursor
+	case "invite":
+		return msg.Invite
+	case "password":
+		return msg.Password
+	}
+	return ""
+}
+
+// reservedUsernames are names the server posts under, which no account may
+// take.
+var reservedUsernames = map[string]bool{
+	"server": true,
+	"system": true,
+}
+
+// usernameProblem says what is wrong with name as the name of a new
+// account, or returns "". Names are written as @name to mention someone,
+// so they are limited to letters, digits, _, - and ".".
+func usernameProblem(name string) string {
+	switch {
+	case name == "":
+		return "Username is required"
+	case utf8.RuneCountInString(name) > maxNameLength:
+		return fmt.Sprintf("Usernames must be at most %d characters", maxNameLength)
+	case strings.Contains(name, "@"):
+		return "Usernames cannot contain @"
+	case strings.ContainsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_-.", r)
+	}):
+		return "Usernames can only contain letters, digits, _, - and ."
+	case reservedUsernames[strings.ToLower(name)]:
+		return fmt.Sprintf("The username %q is reserved", name)
+	}
+	return ""
+}
+
+// invalidMessage is the error sent in reply to a message that failed
+// validation.
+func invalidMessage(problems []FieldError) Message {
+	parts := make([]string, len(problems))
+	for i, p := range problems {
+		parts[i] = p.Field + " " + p.Problem
+	}
+	return Message{Type: "error", Code: CodeInvalidRequest, Content: "Invalid message: " + strings.Join(parts, "; "), Data: problems}
+}
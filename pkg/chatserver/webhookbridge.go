@@ -0,0 +1,224 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Webhook bridges join a room to a Slack or Discord channel through the
+// platforms' webhooks. Messages sent to the room are posted to the
+// channel's incoming webhook URL, and the channel's outgoing webhook, or
+// anything else speaking the same payloads, posts messages to the room at
+// /bridges/{token}. A message relayed from a channel is not sent back to
+// channels of the same platform.
+
+// WebhookBridge joins Room to a channel. Format is the platform whose
+// payloads are used, slack or discord. URL is where room messages are
+// posted, if set. Token, if set, is the secret part of the path the
+// channel's messages are posted to.
+type WebhookBridge struct {
+	Room   string
+	Format string
+	URL    string
+	Token  string
+}
+
+const (
+	BridgeSlack   = "slack"
+	BridgeDiscord = "discord"
+)
+
+const (
+	// webhookTimeout bounds each post to a channel.
+	webhookTimeout = 10 * time.Second
+	// maxDiscordContent is the longest message Discord accepts, in
+	// characters.
+	maxDiscordContent = 2000
+)
+
+// webhookBridges is the state of the webhook bridges. byRoom and byToken
+// index the bridges and are not changed after they are set up.
+type webhookBridges struct {
+	byRoom  map[string][]WebhookBridge
+	byToken map[string]WebhookBridge
+	client  *http.Client
+	queue   chan Message
+}
+
+func newWebhookBridges(bridges []WebhookBridge) *webhookBridges {
+	b := &webhookBridges{
+		byRoom:  make(map[string][]WebhookBridge),
+		byToken: make(map[string]WebhookBridge),
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan Message, bridgeQueueSize),
+	}
+	for _, bridge := range bridges {
+		if bridge.URL != "" {
+			b.byRoom[bridge.Room] = append(b.byRoom[bridge.Room], bridge)
+		}
+		if bridge.Token != "" {
+			b.byToken[bridge.Token] = bridge
+		}
+	}
+	return b
+}
+
+// enqueue queues msg to be posted to its room's channels, if it has any.
+// It reports false if the queue is full.
+func (b *webhookBridges) enqueue(msg Message) bool {
+	if len(b.byRoom[msg.Room]) == 0 {
+		return true
+	}
+	select {
+	case b.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// post sends msg to the channel behind bridge's URL.
+func (b *webhookBridges) post(ctx context.Context, bridge WebhookBridge, msg Message) error {
+	var payload any
+	switch bridge.Format {
+	case BridgeDiscord:
+		content := msg.Content
+		if utf8.RuneCountInString(content) > maxDiscordContent {
+			content = string([]rune(content)[:maxDiscordContent-1]) + "…"
+		}
+		payload = map[string]any{
+			"content":  content,
+			"username": msg.Sender,
+			// Relayed text must not ping @everyone or anyone else.
+			"allowed_mentions": map[string]any{"parse": []string{}},
+		}
+	default:
+		payload = map[string]string{"text": slackEscaper.Replace(msg.Content), "username": msg.Sender}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, bridge.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// slackEscaper escapes the characters Slack treats as markup in message
+// text.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// runWebhookBridges posts the messages queued for the webhook bridges until
+// ctx is done, one at a time so that they arrive in order.
+func (s *Server) runWebhookBridges(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-s.webhookBridges.queue:
+			if msg.Sender == "" || msg.Content == "" || msg.Deleted {
+				continue
+			}
+			for _, bridge := range s.webhookBridges.byRoom[msg.Room] {
+				if msg.Bridge == bridge.Format {
+					continue
+				}
+				if err := s.webhookBridges.post(ctx, bridge, msg); err != nil {
+					s.logger.Warn("post to webhook bridge", "room", msg.Room, "format", bridge.Format, "message_id", msg.MessageID, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// webhookPayload holds the fields of Slack and Discord webhook payloads
+// the bridge uses. Slack's outgoing webhooks post them as a form.
+type webhookPayload struct {
+	Text     string `json:"text"`
+	Content  string `json:"content"`
+	Username string `json:"username"`
+	UserName string `json:"user_name"`
+	BotID    string `json:"bot_id"`
+}
+
+// handleWebhookBridge serves POST /bridges/{token}, posting the message in
+// a Slack or Discord webhook payload to the room the token belongs to.
+func (s *Server) handleWebhookBridge(w http.ResponseWriter, r *http.Request) {
+	bridge, ok := s.webhookBridges.byToken[r.PathValue("token")]
+	if !ok {
+		writeFailure(w, Message{Type: "error", Code: CodeNotFound, Content: "No such bridge"})
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, int64(s.maxContent)*utf8.UTFMax+readLimitSlack)
+	var p webhookPayload
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		r.Body = body
+		if err := r.ParseForm(); err != nil {
+			writeFailure(w, Message{Type: "error", Code: CodeInvalidRequest, Content: "Invalid form"})
+			return
+		}
+		p = webhookPayload{Text: r.PostForm.Get("text"), UserName: r.PostForm.Get("user_name"), BotID: r.PostForm.Get("bot_id")}
+	} else if err := json.NewDecoder(body).Decode(&p); err != nil {
+		writeFailure(w, Message{Type: "error", Code: CodeInvalidRequest, Content: "Invalid payload"})
+		return
+	}
+
+	// Messages posted by bots, among them this bridge's own, are not
+	// relayed back.
+	if p.BotID != "" {
+		writeJSON(w, http.StatusOK, struct{}{})
+		return
+	}
+	msg := Message{Room: bridge.Room, Bridge: bridge.Format, Content: p.Text, Sender: p.Username}
+	if msg.Content == "" {
+		msg.Content = p.Content
+	}
+	if msg.Sender == "" {
+		msg.Sender = p.UserName
+	}
+	if msg.Sender == "" {
+		msg.Sender = bridge.Format
+	}
+	if strings.TrimSpace(msg.Content) == "" {
+		writeFailure(w, Message{Type: "error", Code: CodeInvalidRequest, Content: "Payload has no text"})
+		return
+	}
+
+	if _, err := s.relay(msg); err != nil {
+		switch {
+		case errors.Is(err, ErrRoomNotFound):
+			writeFailure(w, Message{Type: "error", Code: CodeRoomNotFound, Content: "Room does not exist", Room: bridge.Room})
+		case errors.Is(err, ErrRelayTooLong):
+			writeFailure(w, Message{Type: "error", Code: CodeTooLarge, Content: "Message is too large"})
+		case errors.Is(err, ErrContentRejected):
+			writeFailure(w, Message{Type: "error", Code: CodeContentBlocked, Content: "Message contains blocked words"})
+		default:
+			s.logger.Error("relay webhook message", "room", bridge.Room, "err", err)
+			writeFailure(w, Message{Type: "error", Code: CodeInternal, Content: "Could not post message"})
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,374 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhooks tell external systems about chat activity. Admins register a URL
+// with the events it wants, optionally limited to some rooms, and each such
+// event is posted to it as a WebhookEvent. Deliveries are signed with the
+// webhook's secret: the X-Chat-Signature header is "sha256=" and the hex
+// HMAC-SHA256 of the body. Failed deliveries are retried with backoff.
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// The events webhooks can subscribe to.
+const (
+	EventMessagePosted = "message.posted"
+	EventUserJoined    = "user.joined"
+	EventRoomCreated   = "room.created"
+)
+
+var webhookEvents = []string{EventMessagePosted, EventUserJoined, EventRoomCreated}
+
+const (
+	// webhookDeliveryTimeout bounds each attempt at a delivery.
+	webhookDeliveryTimeout = 10 * time.Second
+	// webhookAttempts is how many times a delivery is tried, waiting
+	// webhookBackoff after the first failure and twice as long after each
+	// one after that.
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+	// webhookWorkers is how many deliveries are made at once.
+	webhookWorkers = 4
+	// webhookQueueSize is how many deliveries may wait before more are
+	// dropped.
+	webhookQueueSize = 1024
+)
+
+// Webhook posts the events it subscribes to, in Rooms or in every room if
+// Rooms is empty, to URL. Secret signs the deliveries; it is only shown
+// when the webhook is added.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Rooms     []string  `json:"rooms,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookRequest is the Data of an admin_add_webhook request.
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Rooms  []string `json:"rooms,omitempty"`
+}
+
+// WebhookEvent is the body of a delivery. Message is set for
+// message.posted, User for user.joined and room.created.
+type WebhookEvent struct {
+	ID      string    `json:"id"`
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room"`
+	User    string    `json:"user,omitempty"`
+	Message *Message  `json:"message,omitempty"`
+}
+
+// WebhookStore keeps the registered webhooks.
+type WebhookStore interface {
+	AddWebhook(hook Webhook) error
+	RemoveWebhook(id string) error
+	Webhooks() ([]Webhook, error)
+}
+
+// MemoryWebhookStore keeps webhooks in memory.
+type MemoryWebhookStore struct {
+	mu    sync.Mutex
+	hooks map[string]Webhook
+}
+
+func NewMemoryWebhookStore() *MemoryWebhookStore {
+	return &MemoryWebhookStore{hooks: make(map[string]Webhook)}
+}
+
+func (m *MemoryWebhookStore) AddWebhook(hook Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks[hook.ID] = hook
+	return nil
+}
+
+func (m *MemoryWebhookStore) RemoveWebhook(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.hooks[id]; !ok {
+		return ErrWebhookNotFound
+	}
+	delete(m.hooks, id)
+	return nil
+}
+
+func (m *MemoryWebhookStore) Webhooks() ([]Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hooks := make([]Webhook, 0, len(m.hooks))
+	for _, hook := range m.hooks {
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// wants reports whether the webhook subscribes to event in room.
+func (h Webhook) wants(event, room string) bool {
+	return slices.Contains(h.Events, event) && (len(h.Rooms) == 0 || slices.Contains(h.Rooms, room))
+}
+
+// webhookDelivery is one event on its way to one webhook.
+type webhookDelivery struct {
+	hook  Webhook
+	id    string
+	event string
+	body  []byte
+}
+
+// loadWebhooks fills the in-memory list of webhooks from the store.
+func (s *Server) loadWebhooks() {
+	hooks, err := s.webhookStore.Webhooks()
+	if err != nil {
+		s.logger.Error("load webhooks", "err", err)
+		return
+	}
+	s.webhookLock.Lock()
+	s.webhooks = hooks
+	s.webhookLock.Unlock()
+}
+
+// emitEvent queues deliveries of event in room to the webhooks that want
+// it. It never blocks, so it may be called holding roomLock.
+func (s *Server) emitEvent(event, room, user string, msg *Message) {
+	s.webhookLock.RLock()
+	var hooks []Webhook
+	for _, hook := range s.webhooks {
+		if hook.wants(event, room) {
+			hooks = append(hooks, hook)
+		}
+	}
+	s.webhookLock.RUnlock()
+	if len(hooks) == 0 {
+		return
+	}
+
+	id := newMessageID(time.Now())
+	body, err := json.Marshal(WebhookEvent{ID: id, Event: event, Time: time.Now().UTC(), Room: room, User: user, Message: msg})
+	if err != nil {
+		s.logger.Error("encode webhook event", "event", event, "err", err)
+		return
+	}
+	for _, hook := range hooks {
+		select {
+		case s.webhookQueue <- webhookDelivery{hook: hook, id: id, event: event, body: body}:
+		default:
+			s.logger.Warn("webhook queue full, dropping delivery", "webhook", hook.ID, "event", event)
+		}
+	}
+}
+
+// runWebhooks makes the queued deliveries until ctx is done.
+func (s *Server) runWebhooks(ctx context.Context) {
+	client := &http.Client{Timeout: webhookDeliveryTimeout}
+	for range webhookWorkers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-s.webhookQueue:
+					s.deliverWebhook(ctx, client, d)
+				}
+			}
+		}()
+	}
+}
+
+// deliverWebhook posts d, retrying failures that may be temporary.
+func (s *Server) deliverWebhook(ctx context.Context, client *http.Client, d webhookDelivery) {
+	mac := hmac.New(sha256.New, []byte(d.hook.Secret))
+	mac.Write(d.body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	wait := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := postWebhook(ctx, client, d, signature)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == webhookAttempts {
+			s.logger.Warn("webhook delivery failed", "webhook", d.hook.ID, "event", d.event, "attempts", attempt, "err", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// postWebhook makes one attempt at d, reporting whether a failure is worth
+// retrying.
+func postWebhook(ctx context.Context, client *http.Client, d webhookDelivery, signature string) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chat-Event", d.event)
+	req.Header.Set("X-Chat-Delivery", d.id)
+	req.Header.Set("X-Chat-Signature", signature)
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout:
+		return true, errors.New(resp.Status)
+	default:
+		return false, errors.New(resp.Status)
+	}
+}
+
+// Webhooks returns the registered webhooks, oldest first, without their
+// secrets.
+func (s *Server) Webhooks() []Webhook {
+	s.webhookLock.RLock()
+	hooks := slices.Clone(s.webhooks)
+	s.webhookLock.RUnlock()
+
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	slices.SortFunc(hooks, func(a, b Webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return hooks
+}
+
+// AddWebhook registers a webhook for req, returning it with its secret. by
+// names who added it.
+func (s *Server) AddWebhook(req WebhookRequest, by string) (Webhook, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Webhook{}, err
+	}
+	hook := Webhook{
+		ID:        newMessageID(time.Now()),
+		URL:       req.URL,
+		Events:    req.Events,
+		Rooms:     req.Rooms,
+		Secret:    hex.EncodeToString(secret),
+		CreatedBy: by,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.webhookStore.AddWebhook(hook); err != nil {
+		return Webhook{}, err
+	}
+
+	s.webhookLock.Lock()
+	s.webhooks = append(s.webhooks, hook)
+	s.webhookLock.Unlock()
+	s.audit(AuditEntry{Actor: by, Action: "add_webhook", Target: hook.ID,
+		Detail: fmt.Sprintf("%s for %s", hook.URL, strings.Join(hook.Events, ","))})
+	return hook, nil
+}
+
+// RemoveWebhook unregisters the webhook id. by names who removed it.
+func (s *Server) RemoveWebhook(id, by string) error {
+	if err := s.webhookStore.RemoveWebhook(id); err != nil {
+		return err
+	}
+
+	s.webhookLock.Lock()
+	s.webhooks = slices.DeleteFunc(s.webhooks, func(h Webhook) bool { return h.ID == id })
+	s.webhookLock.Unlock()
+	s.audit(AuditEntry{Actor: by, Action: "remove_webhook", Target: id})
+	return nil
+}
+
+// checkWebhookRequest returns what is wrong with req, or "".
+func checkWebhookRequest(req WebhookRequest) string {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "Webhook URL must be an http or https URL"
+	}
+	if len(req.Events) == 0 {
+		return "Webhook needs at least one event"
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return "Unknown event " + strconv.Quote(event) + "; events are " + strings.Join(webhookEvents, ", ")
+		}
+	}
+	return ""
+}
+
+// handleAdminAddWebhook registers the webhook described by the
+// WebhookRequest in msg.Data, answering with it and its secret.
+func (s *Server) handleAdminAddWebhook(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	var req WebhookRequest
+	if err := msg.DecodeData(&req); err != nil {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: "Request needs a url and events in data"})
+		return
+	}
+	if problem := checkWebhookRequest(req); problem != "" {
+		c.Reply(Message{Type: "error", Code: CodeInvalidRequest, Content: problem})
+		return
+	}
+	hook, err := s.AddWebhook(req, admin.Username)
+	if err != nil {
+		c.reqLogger.Error("add webhook", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not add webhook"})
+		return
+	}
+	c.Reply(Message{Type: "webhook", Target: hook.ID, Data: hook})
+}
+
+// handleAdminRemoveWebhook unregisters the webhook whose ID is msg.Target.
+func (s *Server) handleAdminRemoveWebhook(c *Client, msg Message) {
+	admin := s.requireAdmin(c)
+	if admin == nil {
+		return
+	}
+	if err := s.RemoveWebhook(msg.Target, admin.Username); err != nil {
+		if errors.Is(err, ErrWebhookNotFound) {
+			c.Reply(Message{Type: "error", Code: CodeNotFound, Content: "No such webhook", Target: msg.Target})
+			return
+		}
+		c.reqLogger.Error("remove webhook", "err", err)
+		c.Reply(Message{Type: "error", Code: CodeInternal, Content: "Could not remove webhook", Target: msg.Target})
+		return
+	}
+	c.Reply(Message{Type: "info", Content: "Webhook removed", Target: msg.Target})
+}
+
+func (s *Server) handleAdminListWebhooks(c *Client, msg Message) {
+	if s.requireAdmin(c) == nil {
+		return
+	}
+	c.Reply(Message{Type: "webhooks", Data: s.Webhooks()})
+}
@@ -0,0 +1,5 @@
+// Package pluginpb holds the gRPC service definition that chat server
+// plugins serve and the code generated from it.
+package pluginpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative plugin.proto
@@ -0,0 +1,244 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: plugin.proto
+
+package pluginpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Plugin_OnMessage_FullMethodName = "/chat.plugin.v1.Plugin/OnMessage"
+	Plugin_OnJoin_FullMethodName    = "/chat.plugin.v1.Plugin/OnJoin"
+	Plugin_OnCommand_FullMethodName = "/chat.plugin.v1.Plugin/OnCommand"
+	Plugin_Commands_FullMethodName  = "/chat.plugin.v1.Plugin/Commands"
+)
+
+// PluginClient is the client API for Plugin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Plugin is served by plugin binaries and called by the chat server, which
+// starts them. See package chatplugin for what each call means.
+type PluginClient interface {
+	// OnMessage is called before a room message is posted, and may reject
+	// it or change its content.
+	OnMessage(ctx context.Context, in *MessageEvent, opts ...grpc.CallOption) (*Verdict, error)
+	// OnJoin is called before a user joins a room, and may refuse the join.
+	OnJoin(ctx context.Context, in *JoinEvent, opts ...grpc.CallOption) (*Verdict, error)
+	// OnCommand is called for a room message starting with a slash, and may
+	// answer it in place of it being posted.
+	OnCommand(ctx context.Context, in *CommandEvent, opts ...grpc.CallOption) (*CommandReply, error)
+	// Commands lists the commands the plugin answers, for the server's
+	// command list and /help.
+	Commands(ctx context.Context, in *CommandsRequest, opts ...grpc.CallOption) (*CommandList, error)
+}
+
+type pluginClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPluginClient(cc grpc.ClientConnInterface) PluginClient {
+	return &pluginClient{cc}
+}
+
+func (c *pluginClient) OnMessage(ctx context.Context, in *MessageEvent, opts ...grpc.CallOption) (*Verdict, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Verdict)
+	err := c.cc.Invoke(ctx, Plugin_OnMessage_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pluginClient) OnJoin(ctx context.Context, in *JoinEvent, opts ...grpc.CallOption) (*Verdict, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Verdict)
+	err := c.cc.Invoke(ctx, Plugin_OnJoin_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pluginClient) OnCommand(ctx context.Context, in *CommandEvent, opts ...grpc.CallOption) (*CommandReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CommandReply)
+	err := c.cc.Invoke(ctx, Plugin_OnCommand_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pluginClient) Commands(ctx context.Context, in *CommandsRequest, opts ...grpc.CallOption) (*CommandList, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CommandList)
+	err := c.cc.Invoke(ctx, Plugin_Commands_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PluginServer is the server API for Plugin service.
+// All implementations must embed UnimplementedPluginServer
+// for forward compatibility
+//
+// Plugin is served by plugin binaries and called by the chat server, which
+// starts them. See package chatplugin for what each call means.
+type PluginServer interface {
+	// OnMessage is called before a room message is posted, and may reject
+	// it or change its content.
+	OnMessage(context.Context, *MessageEvent) (*Verdict, error)
+	// OnJoin is called before a user joins a room, and may refuse the join.
+	OnJoin(context.Context, *JoinEvent) (*Verdict, error)
+	// OnCommand is called for a room message starting with a slash, and may
+	// answer it in place of it being posted.
+	OnCommand(context.Context, *CommandEvent) (*CommandReply, error)
+	// Commands lists the commands the plugin answers, for the server's
+	// command list and /help.
+	Commands(context.Context, *CommandsRequest) (*CommandList, error)
+	mustEmbedUnimplementedPluginServer()
+}
+
+// UnimplementedPluginServer must be embedded to have forward compatible implementations.
+type UnimplementedPluginServer struct {
+}
+
+func (UnimplementedPluginServer) OnMessage(context.Context, *MessageEvent) (*Verdict, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method OnMessage not implemented")
+}
+func (UnimplementedPluginServer) OnJoin(context.Context, *JoinEvent) (*Verdict, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method OnJoin not implemented")
+}
+func (UnimplementedPluginServer) OnCommand(context.Context, *CommandEvent) (*CommandReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method OnCommand not implemented")
+}
+func (UnimplementedPluginServer) Commands(context.Context, *CommandsRequest) (*CommandList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Commands not implemented")
+}
+func (UnimplementedPluginServer) mustEmbedUnimplementedPluginServer() {}
+
+// UnsafePluginServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PluginServer will
+// result in compilation errors.
+type UnsafePluginServer interface {
+	mustEmbedUnimplementedPluginServer()
+}
+
+func RegisterPluginServer(s grpc.ServiceRegistrar, srv PluginServer) {
+	s.RegisterService(&Plugin_ServiceDesc, srv)
+}
+
+func _Plugin_OnMessage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MessageEvent)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PluginServer).OnMessage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Plugin_OnMessage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PluginServer).OnMessage(ctx, req.(*MessageEvent))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Plugin_OnJoin_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JoinEvent)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PluginServer).OnJoin(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Plugin_OnJoin_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PluginServer).OnJoin(ctx, req.(*JoinEvent))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Plugin_OnCommand_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommandEvent)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PluginServer).OnCommand(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Plugin_OnCommand_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PluginServer).OnCommand(ctx, req.(*CommandEvent))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Plugin_Commands_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommandsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PluginServer).Commands(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Plugin_Commands_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PluginServer).Commands(ctx, req.(*CommandsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Plugin_ServiceDesc is the grpc.ServiceDesc for Plugin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Plugin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "chat.plugin.v1.Plugin",
+	HandlerType: (*PluginServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "OnMessage",
+			Handler:    _Plugin_OnMessage_Handler,
+		},
+		{
+			MethodName: "OnJoin",
+			Handler:    _Plugin_OnJoin_Handler,
+		},
+		{
+			MethodName: "OnCommand",
+			Handler:    _Plugin_OnCommand_Handler,
+		},
+		{
+			MethodName: "Commands",
+			Handler:    _Plugin_Commands_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "plugin.proto",
+}